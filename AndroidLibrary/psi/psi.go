@@ -56,6 +56,7 @@ func Start(
 		return fmt.Errorf("error loading configuration file: %s", err)
 	}
 	config.NetworkConnectivityChecker = provider
+	config.EmbeddedServerEntryList = embeddedServerEntryList
 
 	if useDeviceBinder {
 		config.DeviceBinder = provider
@@ -74,15 +75,6 @@ func Start(
 		return fmt.Errorf("error initializing datastore: %s", err)
 	}
 
-	serverEntries, err := psiphon.DecodeAndValidateServerEntryList(embeddedServerEntryList)
-	if err != nil {
-		return fmt.Errorf("error decoding embedded server entry list: %s", err)
-	}
-	err = psiphon.StoreServerEntries(serverEntries, false)
-	if err != nil {
-		return fmt.Errorf("error storing embedded server entry list: %s", err)
-	}
-
 	controller, err = psiphon.NewController(config)
 	if err != nil {
 		return fmt.Errorf("error initializing controller: %s", err)
@@ -30,6 +30,15 @@ import (
 
 const (
 	DATA_STORE_FILENAME                            = "psiphon.db"
+	DATA_STORE_ARCHIVE_FILENAME                    = "psiphon.archive.db"
+	DATA_STORE_DEFAULT_PROPAGATION_CHANNEL_ID      = "default"
+	DATA_STORE_COMPACTION_CHECK_PERIOD             = 1 * time.Hour
+	DATA_STORE_COMPACTION_FREE_SIZE_THRESHOLD      = 32 * 1024 * 1024
+	DATA_STORE_COMPACTION_FRAGMENTATION_THRESHOLD  = 0.5
+	DATA_STORE_OPEN_RETRY_INITIAL_DELAY            = 500 * time.Millisecond
+	DATA_STORE_OPEN_RETRY_MAX_DELAY                = 8 * time.Second
+	SERVER_ENTRY_DISABLE_BASE_PERIOD               = 1 * time.Minute
+	SERVER_ENTRY_DISABLE_MAX_PERIOD                = 24 * time.Hour
 	CONNECTION_WORKER_POOL_SIZE                    = 10
 	TUNNEL_POOL_SIZE                               = 1
 	TUNNEL_CONNECT_TIMEOUT                         = 20 * time.Second
@@ -51,10 +60,17 @@ const (
 	FETCH_REMOTE_SERVER_LIST_RETRY_PERIOD          = 5 * time.Second
 	FETCH_REMOTE_SERVER_LIST_STALE_PERIOD          = 6 * time.Hour
 	PSIPHON_API_CLIENT_SESSION_ID_LENGTH           = 16
+	PSIPHON_API_HANDSHAKE_IDENTITY_NONCE_LENGTH    = 16
+	PSIPHON_API_HANDSHAKE_SERVER_ENTRY_BATCH_SIZE  = 100
 	PSIPHON_API_SERVER_TIMEOUT                     = 20 * time.Second
 	PSIPHON_API_STATUS_REQUEST_PERIOD_MIN          = 5 * time.Minute
 	PSIPHON_API_STATUS_REQUEST_PERIOD_MAX          = 10 * time.Minute
 	PSIPHON_API_STATUS_REQUEST_PADDING_MAX_BYTES   = 256
+	PSIPHON_API_KNOWN_SERVER_PADDING_MAX_COUNT     = 32
+	PSIPHON_API_MAX_RESPONSE_BODY_BYTES            = 16 * 1024 * 1024
+	PSIPHON_API_TOO_MANY_REQUESTS_MAX_RETRIES      = 3
+	PSIPHON_API_RETRY_AFTER_MAX_PERIOD             = 10 * time.Second
+	PSIPHON_API_MAX_DISCARDED_RESPONSE_BYTES       = 64 * 1024
 	PSIPHON_API_CONNECTED_REQUEST_PERIOD           = 24 * time.Hour
 	PSIPHON_API_CONNECTED_REQUEST_RETRY_PERIOD     = 5 * time.Second
 	FETCH_ROUTES_TIMEOUT                           = 1 * time.Minute
@@ -86,6 +102,25 @@ type Config struct {
 	// This parameter is deprecated and may be removed.
 	DataStoreTempDirectory string
 
+	// DataStoreOpenRetryCount is the number of times opening the datastore is
+	// retried, with exponential backoff, when the datastore file is locked by
+	// another process; for example, when two client instances briefly overlap
+	// during a restart. For the default, 0, opening the datastore isn't
+	// retried. Only the BoltDB datastore locks its file.
+	DataStoreOpenRetryCount int
+
+	// EmbeddedServerEntryList is an optional list of encoded server entries,
+	// typically embedded in the client binary, which InitDataStore imports.
+	// The list is imported only once, on the first InitDataStore with the
+	// list, and not on each run.
+	EmbeddedServerEntryList string
+
+	// KeyValueEncryptionKey is a base64-encoded, 32 byte secret key used by
+	// SetEncryptedKeyValue and GetEncryptedKeyValue to encrypt selected
+	// datastore key/value pairs. When blank, encrypted key/values can't be
+	// stored or retrieved.
+	KeyValueEncryptionKey string
+
 	// PropagationChannelId is a string identifier which indicates how the
 	// Psiphon client was distributed. This parameter is required.
 	// This value is supplied by and depends on the Psiphon Network, and is
@@ -112,6 +147,14 @@ type Config struct {
 	// typically embedded in the client binary.
 	RemoteServerListSignaturePublicKey string
 
+	// MinimumServerListEntries is the minimum number of valid server entries
+	// which a downloaded server list must contain to be stored. A list with
+	// fewer valid server entries, which may be truncated or compromised, is
+	// rejected in its entirety, with an alert. This applies to remote server
+	// lists and to lists fetched with FetchAndStoreServerList. When 0, there
+	// is no minimum.
+	MinimumServerListEntries int
+
 	// ClientVersion is the client version number that the client reports
 	// to the server. The version number refers to the host client application,
 	// not the core tunnel library. One purpose of this value is to enable
@@ -134,9 +177,20 @@ type Config struct {
 	// in any country is selected.
 	EgressRegion string
 
+	// EgressRegionGroups maps region group names, such as "EU", to lists of
+	// member regions. When EgressRegion is a group name, servers in any of
+	// the member regions are selected.
+	EgressRegionGroups map[string][]string
+
+	// RequireEgressRegion specifies that an EgressRegion must be configured.
+	// When set and EgressRegion is blank, NewServerEntryIterator fails
+	// instead of selecting servers in any region.
+	RequireEgressRegion bool
+
 	// TunnelProtocol indicates which protocol to use. Valid values include:
-	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "FRONTED-MEEK-OSSH". For the default,
-	// "", the best performing protocol is used.
+	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "FRONTED-MEEK-OSSH",
+	// "FRONTED-MEEK-HTTP-OSSH". For the default, "", the best performing protocol
+	// is used.
 	TunnelProtocol string
 
 	// EstablishTunnelTimeoutSeconds specifies a time limit after which to halt
@@ -197,6 +251,11 @@ type Config struct {
 	// is used exclusively and all other known servers are ignored.
 	TargetServerEntry string
 
+	// TargetServerEntryPreferred modifies the TargetServerEntry behavior. When set,
+	// the target server entry is the first candidate, but is not used exclusively:
+	// all other known servers follow as candidates in the usual order.
+	TargetServerEntryPreferred bool
+
 	// DisableApi disables Psiphon server API calls including handshake, connected,
 	// status, etc. This is used for special case temporary tunnels (Windows VPN mode).
 	DisableApi bool
@@ -252,10 +311,243 @@ type Config struct {
 	// that require typical (system CA) server authentication.
 	TrustedCACertificatesFilename string
 
+	// AcceptableWebServerCertificateIssuers is a list of hex-encoded SHA-256
+	// fingerprints of CA certificates. When set, Psiphon API web servers are
+	// authenticated with standard CA verification, using the roots in
+	// TrustedCACertificatesFilename or the system roots, and the server
+	// certificate must be issued by one of the listed CAs. The server entry
+	// web server certificate is not used. When not set, the server entry
+	// web server certificate is pinned.
+	AcceptableWebServerCertificateIssuers []string
+
 	// DisablePeriodicSshKeepAlive indicates whether to send an SSH keepalive every
 	// 1-2 minutes, when the tunnel is idle. If the SSH keepalive times out, the tunnel
 	// is considered to have failed.
 	DisablePeriodicSshKeepAlive bool
+
+	// PadHandshakeKnownServers adds a random number of decoy entries to the list
+	// of known servers submitted in the handshake request, so that the submitted
+	// count isn't a reliable indicator of how many servers the client knows.
+	// Decoy entries are addresses in the reserved 240.0.0.0/4 range, which are
+	// never Psiphon server addresses; the server is expected to ignore known
+	// servers that don't match a server in its own list, so discovery stats
+	// are unaffected.
+	PadHandshakeKnownServers bool
+
+	// MaxApiResponseBodyBytes specifies the maximum size of a Psiphon API
+	// response body. Reading a larger response body, such as a handshake
+	// response with an enormous server list, fails. When 0,
+	// PSIPHON_API_MAX_RESPONSE_BODY_BYTES is used.
+	MaxApiResponseBodyBytes int
+
+	// MaxHandshakeKnownServers is the maximum number of known servers submitted
+	// in the handshake request. When the client knows more servers, the most
+	// recently seen servers, by server entry lastSeen time, are submitted, which
+	// keeps discovery stats focused on active servers. When 0, there is no limit.
+	MaxHandshakeKnownServers int
+
+	// PsiphonApiServerTimeoutSeconds specifies the default time limit for each
+	// Psiphon API request, including reading the response. Individual requests
+	// may override this limit. When 0, PSIPHON_API_SERVER_TIMEOUT is used.
+	PsiphonApiServerTimeoutSeconds int
+
+	// PsiphonApiServerTimeoutJitterPercent specifies a random adjustment,
+	// applied to each Psiphon API request timeout, of up to this percentage
+	// of the timeout, either shorter or longer. This spreads out timeouts so
+	// that, under a network disruption, requests don't all fail at the same
+	// moment. When 0, there is no jitter. The maximum is 100.
+	PsiphonApiServerTimeoutJitterPercent int
+
+	// PsiphonApiIdleConnTimeoutSeconds specifies how long an idle keep-alive
+	// connection, used by the tunneled Psiphon API client, remains open before
+	// it's closed. Closing idle connections before an intermediary drops them
+	// avoids failed requests on stale connections. When 0, there is no limit.
+	PsiphonApiIdleConnTimeoutSeconds int
+
+	// PsiphonApiMaxIdleConns specifies the maximum number of idle keep-alive
+	// connections retained by the tunneled Psiphon API client. When 0, there
+	// is no limit beyond the default per-host limit.
+	PsiphonApiMaxIdleConns int
+
+	// RejectPrivateServerEntryIpAddresses specifies that server entries with
+	// an IP address in a private or reserved range, including loopback
+	// addresses, are rejected as invalid. By default, these server entries
+	// are accepted, as they are used in tests. See
+	// SetRejectPrivateServerEntryIpAddresses.
+	RejectPrivateServerEntryIpAddresses bool
+
+	// ImportServerEntriesByPriority specifies that server entries received in
+	// handshake responses and remote server lists are ranked in descending
+	// ServerPriority order instead of being shuffled. See StoreServerEntriesByPriority.
+	ImportServerEntriesByPriority bool
+
+	// StoreHandshakeServerEntriesAsynchronously specifies that server entries
+	// received in the handshake response are stored in the background, after
+	// the handshake completes, so that storing a large server list doesn't
+	// delay tunnel readiness. The handshake still writes the server entries
+	// to a datastore staging area, which is faster than storing them.
+	// Completion is reported in the HandshakeServerEntriesStored notice.
+	StoreHandshakeServerEntriesAsynchronously bool
+
+	// MaxHandshakeServerEntries is the maximum number of server entries,
+	// received in a handshake response, which are stored. When the response
+	// contains more server entries, only the first MaxHandshakeServerEntries
+	// valid server entries are stored. This limits the number of server
+	// entries a compromised server can add to the datastore. When 0, there
+	// is no limit.
+	MaxHandshakeServerEntries int
+
+	// ValidateHandshakeEchoedIds specifies that, when the handshake response
+	// echoes the propagation channel ID or sponsor ID, the echoed value must
+	// match PropagationChannelId or SponsorId, or the handshake fails. Not all
+	// servers echo these values; values which are not echoed aren't checked.
+	ValidateHandshakeEchoedIds bool
+
+	// VerifyHandshakeServerIdentity specifies that the handshake request
+	// includes a random nonce which the server must echo in the handshake
+	// response, along with its own IP address, which must match the server
+	// entry of the tunnel. This ties the web API response to the tunnel's
+	// server and detects a handshake answered by some other server, such as
+	// a man-in-the-middle within the tunnel. When set, handshakes with
+	// servers which don't echo the nonce fail.
+	VerifyHandshakeServerIdentity bool
+
+	// ServerEntryFailureThreshold is the number of consecutive failed tunnel
+	// establishment attempts after which a server is temporarily disabled
+	// and skipped by server entry iterators. The disable period starts at
+	// SERVER_ENTRY_DISABLE_BASE_PERIOD and doubles with each additional
+	// consecutive failure, up to SERVER_ENTRY_DISABLE_MAX_PERIOD. A
+	// successful connection re-enables the server. When 0, servers are
+	// never disabled.
+	ServerEntryFailureThreshold int
+
+	// ServerEntryFailureHalfLifeSeconds specifies the period over which the
+	// recorded failure counts for a server, including the count of
+	// consecutive failures, are halved. Decay is based on the time elapsed
+	// since the last failure, so servers which failed during a past outage
+	// recover eligibility. When 0, failure counts don't decay.
+	ServerEntryFailureHalfLifeSeconds int
+
+	// AllowedRegions is a list of ISO 3166-1 alpha-2 country codes. When
+	// specified, server entries in other regions are skipped, and not stored,
+	// when imported. By default, server entries in all regions are stored.
+	AllowedRegions []string
+
+	// RetryApiRequestsAfterTooManyRequests specifies that Psiphon API requests
+	// which receive a 429 Too Many Requests response with a Retry-After header
+	// are retried after waiting for the indicated period. Retry-After periods
+	// longer than PSIPHON_API_RETRY_AFTER_MAX_PERIOD are not honored, and the
+	// request fails as usual.
+	RetryApiRequestsAfterTooManyRequests bool
+
+	// ExpectedWebCertFingerprints is a list of hex encoded SHA-256 fingerprints
+	// of the web server certificates expected for this propagation channel. When
+	// specified, imported server entries whose WebServerCertificate doesn't match
+	// one of the fingerprints are rejected and not stored.
+	ExpectedWebCertFingerprints []string
+
+	// UseServerEntryPreferredProtocol specifies that, when TunnelProtocol is not
+	// set, the protocol which last successfully established a tunnel to a server
+	// is selected for that server, instead of a random supported protocol.
+	UseServerEntryPreferredProtocol bool
+
+	// LatencyWeightedServerEntries specifies that the server entries which
+	// ServerEntryIterator returns after the first TunnelPoolSize ranked server
+	// entries are ordered by ascending latency, as recorded by
+	// SetServerEntryLatency, instead of being shuffled. Server entries without
+	// a recorded latency are returned after those with a recorded latency.
+	LatencyWeightedServerEntries bool
+
+	// ReshuffleOnReset specifies whether ServerEntryIterator.Reset computes a
+	// new candidate order. When false, the order is computed once, by the first
+	// Reset, and each subsequent Reset reproduces the same order until the
+	// iterator is explicitly reshuffled with ServerEntryIterator.Reshuffle.
+	// Server entries stored after the order is computed are not candidates
+	// until the next reshuffle. When omitted, defaults to true.
+	ReshuffleOnReset *bool
+
+	// PartitionServerEntriesByPropagationChannel specifies that stored server
+	// entries are partitioned by PropagationChannelId. Server entries stored
+	// while this is set are recorded under the current propagation channel,
+	// and the server entry iterator only selects server entries recorded under
+	// the current propagation channel. When PropagationChannelId is blank,
+	// DATA_STORE_DEFAULT_PROPAGATION_CHANNEL_ID is used. When this is not set,
+	// all stored server entries are selected, as before.
+	PartitionServerEntriesByPropagationChannel bool
+
+	// OnCandidate is an optional callback which is invoked by the server entry
+	// iterator for each server entry it yields and for each stored server entry
+	// it skips, with a SERVER_ENTRY_SKIP_REASON value. This may be used to
+	// measure candidate selection. This value must be set at runtime.
+	OnCandidate func(serverEntry *ServerEntry, yielded bool, skipReason string)
+
+	// OnAvailableEgressRegionsChanged is an optional callback which is invoked
+	// with the sorted list of available egress regions when that list changes.
+	// Unlike the AvailableEgressRegions notice, which is emitted each time
+	// server entries are stored, this is invoked only when regions are added
+	// or removed, and once for the first report. This value must be set at
+	// runtime.
+	OnAvailableEgressRegionsChanged func(regions []string)
+
+	// FrontingAddressStrategy specifies how the front address is selected for
+	// each fronted meek connection attempt. Valid values include: "random",
+	// "round-robin", and "sticky", which selects the same front address for a
+	// server for the duration of the session. For the default, "", a random
+	// front address is selected.
+	FrontingAddressStrategy string
+
+	// CompactDataStoreAutomatically specifies that the datastore is periodically
+	// checked and compacted when its free space, or the fraction of it which is
+	// free space, exceeds a threshold. See CompactDataStore.
+	//
+	// On platforms using the BoltDB datastore, compaction requires exclusive
+	// access to the database file, so exceeding a threshold only schedules
+	// compaction; the file is rebuilt at the next OpenDataStore, typically
+	// when the client is restarted. No further checks are made while
+	// compaction is scheduled.
+	CompactDataStoreAutomatically bool
+
+	// ServerEntryInsertPosition specifies the rank assigned to newly stored
+	// server entries. Valid values include: "next-to-top", which keeps the
+	// last selected server as the top ranked server; "top"; and "tail", the
+	// lowest rank. For the default, "", "next-to-top" is used.
+	ServerEntryInsertPosition string
+
+	// ServerEntryStoreOrder specifies how StoreServerEntries orders a list of
+	// server entries relative to each other and to the existing ranked server
+	// entries. Valid values include: "shuffle", the default, which shuffles
+	// the list before storing each entry at ServerEntryInsertPosition;
+	// "input-order", which stores the list so that it's ranked in the input
+	// order, at ServerEntryInsertPosition; and "interleave", which shuffles
+	// the list and ranks its entries alternately with the existing ranked
+	// server entries, starting below the top ranked entry.
+	ServerEntryStoreOrder string
+
+	// ServerEntryCodec specifies the format of server entry records stored
+	// in the datastore. Valid values include: "json", the default, and
+	// "gob", which is more compact. The codec is recorded when the datastore
+	// is created, and a datastore may not be opened with a different codec.
+	// Stored server entries aren't migrated: switching codecs requires
+	// deleting the existing datastore files.
+	ServerEntryCodec string
+
+	// MaxProtocolSuccessCount bounds the protocol success counts recorded by
+	// RecordSuccessfulProtocol. When any count exceeds this limit, all counts
+	// are halved, so that the distribution favors recent establishments.
+	// When 0, there is no limit.
+	MaxProtocolSuccessCount int
+
+	// RedactNoticeServerAddresses specifies that notices redact server IP
+	// addresses, emitting a keyed hash of each address in its place. This
+	// is intended for privacy-sensitive deployments which retain notice
+	// logs. See SetNoticeServerAddressRedaction.
+	RedactNoticeServerAddresses bool
+
+	// DataStoreOperationLogSize is a debugging option which enables an
+	// in-memory log of the most recent datastore mutations, such as stores
+	// and promotions, with up to this number of entries. The log isn't
+	// persisted. See GetDataStoreOperationLog. When 0, no log is kept.
+	DataStoreOperationLogSize int
 }
 
 // LoadConfig parses and validates a JSON format Psiphon config JSON
@@ -295,6 +587,39 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		}
 	}
 
+	if config.FrontingAddressStrategy != "" {
+		if !Contains(SupportedFrontingAddressStrategies, config.FrontingAddressStrategy) {
+			return nil, ContextError(
+				errors.New("invalid fronting address strategy"))
+		}
+	}
+
+	if config.ServerEntryInsertPosition != "" {
+		if !Contains(SupportedServerEntryInsertPositions, config.ServerEntryInsertPosition) {
+			return nil, ContextError(
+				errors.New("invalid server entry insert position"))
+		}
+	}
+
+	if config.ServerEntryStoreOrder != "" {
+		if !Contains(SupportedServerEntryStoreOrders, config.ServerEntryStoreOrder) {
+			return nil, ContextError(
+				errors.New("invalid server entry store order"))
+		}
+	}
+
+	if config.ServerEntryCodec != "" {
+		if !Contains(SupportedServerEntryCodecs, config.ServerEntryCodec) {
+			return nil, ContextError(
+				errors.New("invalid server entry codec"))
+		}
+	}
+
+	if config.ReshuffleOnReset == nil {
+		defaultReshuffleOnReset := true
+		config.ReshuffleOnReset = &defaultReshuffleOnReset
+	}
+
 	if config.EstablishTunnelTimeoutSeconds == nil {
 		defaultEstablishTunnelTimeoutSeconds := ESTABLISH_TUNNEL_TIMEOUT_SECONDS
 		config.EstablishTunnelTimeoutSeconds = &defaultEstablishTunnelTimeoutSeconds
@@ -320,5 +645,13 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		return nil, ContextError(errors.New("DnsServerGetter interface must be set at runtime"))
 	}
 
+	if config.OnCandidate != nil {
+		return nil, ContextError(errors.New("OnCandidate callback must be set at runtime"))
+	}
+
+	if config.OnAvailableEgressRegionsChanged != nil {
+		return nil, ContextError(errors.New("OnAvailableEgressRegionsChanged callback must be set at runtime"))
+	}
+
 	return &config, nil
 }
@@ -37,6 +37,7 @@ import (
 type Controller struct {
 	config                         *Config
 	sessionId                      string
+	frontingAddressSelector        *FrontingAddressSelector
 	componentFailureSignal         chan struct{}
 	shutdownBroadcast              chan struct{}
 	runWaitGroup                   *sync.WaitGroup
@@ -67,6 +68,9 @@ func NewController(config *Config) (controller *Controller, err error) {
 	// Needed by regen, at least
 	rand.Seed(int64(time.Now().Nanosecond()))
 
+	SetRejectPrivateServerEntryIpAddresses(config.RejectPrivateServerEntryIpAddresses)
+	SetNoticeServerAddressRedaction(config.RedactNoticeServerAddresses)
+
 	// Generate a session ID for the Psiphon server API. This session ID is
 	// used across all tunnels established by the controller.
 	sessionId, err := MakeSessionId()
@@ -88,8 +92,9 @@ func NewController(config *Config) (controller *Controller, err error) {
 	}
 
 	controller = &Controller{
-		config:    config,
-		sessionId: sessionId,
+		config:                  config,
+		sessionId:               sessionId,
+		frontingAddressSelector: NewFrontingAddressSelector(config.FrontingAddressStrategy),
 		// componentFailureSignal receives a signal from a component (including socks and
 		// http local proxies) if they unexpectedly fail. Senders should not block.
 		// A buffer allows at least one stop signal to be sent before there is a receiver.
@@ -291,11 +296,12 @@ func (controller *Controller) connectedReporter() {
 loop:
 	for {
 
-		// Pick any active tunnel and make the next connected request. No error
-		// is logged if there's no active tunnel, as that's not an unexpected condition.
+		// Pick any active tunnel with a session and make the next connected
+		// request. No error is logged if there's no such tunnel, as that's not
+		// an unexpected condition.
 		reported := false
-		tunnel := controller.getNextActiveTunnel()
-		if tunnel != nil {
+		tunnel := controller.getNextActiveTunnel(true)
+		if tunnel != nil && tunnel.session != nil {
 			err := tunnel.session.DoConnectedRequest()
 			if err == nil {
 				reported = true
@@ -359,7 +365,7 @@ loop:
 	for {
 		// Pick any active tunnel and make the next download attempt. No error
 		// is logged if there's no active tunnel, as that's not an unexpected condition.
-		tunnel := controller.getNextActiveTunnel()
+		tunnel := controller.getNextActiveTunnel(false)
 		if tunnel != nil {
 			err := DownloadUpgrade(controller.config, clientUpgradeVersion, tunnel)
 			if err == nil {
@@ -381,8 +387,9 @@ loop:
 }
 
 func (controller *Controller) startClientUpgradeDownloader(session *Session) {
-	// session is nil when DisableApi is set
-	if controller.config.DisableApi {
+	// session is nil when DisableApi is set, or when the tunnel server's web
+	// server certificate is invalid
+	if controller.config.DisableApi || session == nil {
 		return
 	}
 
@@ -430,7 +437,7 @@ loop:
 	for {
 		select {
 		case failedTunnel := <-controller.failedTunnels:
-			NoticeAlert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
+			NoticeAlert("tunnel failed: %s", redactServerAddress(failedTunnel.serverEntry.IpAddress))
 			controller.terminateTunnel(failedTunnel)
 
 			// Note: we make this extra check to ensure the shutdown signal takes priority
@@ -480,10 +487,11 @@ loop:
 					// multi-tunnels, the session is connected as long as at least one
 					// tunnel is established.
 					controller.startOrSignalConnectedReporter()
-
-					controller.startClientUpgradeDownloader(establishedTunnel.session)
 				}
 
+				// The upgrade downloader is started by the first tunnel with a
+				// session, which may not be the first tunnel established.
+				controller.startClientUpgradeDownloader(establishedTunnel.session)
 			} else {
 				controller.discardTunnel(establishedTunnel)
 			}
@@ -576,7 +584,7 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
-	NoticeInfo("discard tunnel: %s", tunnel.serverEntry.IpAddress)
+	NoticeInfo("discard tunnel: %s", redactServerAddress(tunnel.serverEntry.IpAddress))
 	// TODO: not calling PromoteServerEntry, since that would rank the
 	// discarded tunnel before fully active tunnels. Can a discarded tunnel
 	// be promoted (since it connects), but with lower rank than all active
@@ -597,7 +605,7 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) (int, bool) {
 	// a duplicate connection.
 	for _, activeTunnel := range controller.tunnels {
 		if activeTunnel.serverEntry.IpAddress == tunnel.serverEntry.IpAddress {
-			NoticeAlert("duplicate tunnel: %s", tunnel.serverEntry.IpAddress)
+			NoticeAlert("duplicate tunnel: %s", redactServerAddress(tunnel.serverEntry.IpAddress))
 			return len(controller.tunnels), false
 		}
 	}
@@ -672,13 +680,18 @@ func (controller *Controller) terminateAllTunnels() {
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
 // tunnels. Currently, tunnel selection order is simple round-robin.
-func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
+// When requireSession is set, tunnels without a Psiphon API session, as
+// when the server's web server certificate is invalid, are skipped.
+func (controller *Controller) getNextActiveTunnel(requireSession bool) (tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	for i := len(controller.tunnels); i > 0; i-- {
 		tunnel = controller.tunnels[controller.nextTunnel]
 		controller.nextTunnel =
 			(controller.nextTunnel + 1) % len(controller.tunnels)
+		if requireSession && tunnel.session == nil {
+			continue
+		}
 		return tunnel
 	}
 	return nil
@@ -703,7 +716,7 @@ func (controller *Controller) isActiveTunnelServerEntry(serverEntry *ServerEntry
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
-	tunnel := controller.getNextActiveTunnel()
+	tunnel := controller.getNextActiveTunnel(false)
 	if tunnel == nil {
 		return nil, ContextError(errors.New("no active tunnels"))
 	}
@@ -918,6 +931,7 @@ loop:
 			controller.sessionId,
 			controller.establishPendingConns,
 			serverEntry,
+			controller.frontingAddressSelector,
 			controller) // TunnelOwner
 		if err != nil {
 			// Before emitting error, check if establish interrupted, in which
@@ -925,10 +939,13 @@ loop:
 			if controller.isStopEstablishingBroadcast() {
 				break loop
 			}
-			NoticeInfo("failed to connect to %s: %s", serverEntry.IpAddress, err)
+			NoticeInfo("failed to connect to %s: %s", redactServerAddress(serverEntry.IpAddress), err)
+			controller.recordServerEntryOutcome(serverEntry, false)
 			continue
 		}
 
+		controller.recordServerEntryOutcome(serverEntry, true)
+
 		// Deliver established tunnel.
 		// Don't block. Assumes the receiver has a buffer large enough for
 		// the number of desired tunnels. If there's no room, the tunnel must
@@ -942,6 +959,22 @@ loop:
 	NoticeInfo("stopped establish worker")
 }
 
+// recordServerEntryOutcome records a completed, uninterrupted establishment
+// attempt in the server entry attempt and failure counters.
+func (controller *Controller) recordServerEntryOutcome(serverEntry *ServerEntry, success bool) {
+	err := RecordServerEntryAttempt(serverEntry.IpAddress)
+	if err == nil {
+		if success {
+			err = RecordServerEntrySuccess(serverEntry.IpAddress)
+		} else {
+			err = RecordServerEntryFailure(serverEntry.IpAddress)
+		}
+	}
+	if err != nil {
+		NoticeAlert("failed to record server entry outcome: %s", err)
+	}
+}
+
 func (controller *Controller) isStopEstablishingBroadcast() bool {
 	select {
 	case <-controller.stopEstablishingBroadcast:
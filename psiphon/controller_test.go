@@ -46,6 +46,53 @@ func TestControllerRunFrontedMeek(t *testing.T) {
 	controllerRun(t, TUNNEL_PROTOCOL_FRONTED_MEEK)
 }
 
+func TestControllerTunnelWithoutSession(t *testing.T) {
+
+	// A tunnel to a server with an invalid web server certificate is
+	// established without a session.
+	sessionlessTunnel := &Tunnel{serverEntry: makeTestServerEntry("10.0.70.1", "ZD")}
+	sessionTunnel := &Tunnel{
+		serverEntry: makeTestServerEntry("10.0.70.2", "ZD"),
+		session:     &Session{},
+	}
+
+	controller := &Controller{
+		config: &Config{
+			UpgradeDownloadUrl:      "http://127.0.0.1/upgrade",
+			UpgradeDownloadFilename: "upgrade",
+		},
+		shutdownBroadcast:     make(chan struct{}),
+		runWaitGroup:          new(sync.WaitGroup),
+		tunnels:               []*Tunnel{sessionlessTunnel},
+		signalReportConnected: make(chan struct{}),
+	}
+
+	if controller.getNextActiveTunnel(false) != sessionlessTunnel {
+		t.Errorf("tunnel without session not selected")
+	}
+	if controller.getNextActiveTunnel(true) != nil {
+		t.Errorf("tunnel without session unexpectedly selected")
+	}
+
+	// The connected reporter makes its first request attempt before
+	// checking for shutdown, and must not use the missing session.
+	controller.startOrSignalConnectedReporter()
+	close(controller.shutdownBroadcast)
+	controller.runWaitGroup.Wait()
+
+	controller.startClientUpgradeDownloader(sessionlessTunnel.session)
+	if controller.startedUpgradeDownloader {
+		t.Errorf("upgrade downloader started without a session")
+	}
+
+	controller.tunnels = append(controller.tunnels, sessionTunnel)
+	for i := 0; i < 2; i++ {
+		if controller.getNextActiveTunnel(true) != sessionTunnel {
+			t.Errorf("tunnel with session not selected")
+		}
+	}
+}
+
 func controllerRun(t *testing.T, protocol string) {
 
 	configFileContents, err := ioutil.ReadFile("controller_test.config")
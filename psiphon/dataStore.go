@@ -27,7 +27,9 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -35,47 +37,78 @@ import (
 	sqlite3 "github.com/Psiphon-Inc/go-sqlite3"
 )
 
-type dataStore struct {
-	init sync.Once
-	db   *sql.DB
-}
-
-var singleton dataStore
-
-// InitDataStore initializes the singleton instance of dataStore. This
-// function uses a sync.Once and is safe for use by concurrent goroutines.
-// The underlying sql.DB connection pool is also safe.
-//
-// Note: the sync.Once was more useful when initDataStore was private and
-// called on-demand by the public functions below. Now we require an explicit
-// InitDataStore() call with the filename passed in. The on-demand calls
-// have been replaced by checkInitDataStore() to assert that Init was called.
-func InitDataStore(config *Config) (err error) {
-	singleton.init.Do(func() {
-		filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
-		var db *sql.DB
-		db, err = sql.Open(
-			"sqlite3",
-			fmt.Sprintf("file:%s?cache=private&mode=rwc", filename))
-		if err != nil {
-			// Note: intending to set the err return value for InitDataStore
-			err = fmt.Errorf("initDataStore failed to open database: %s", err)
-			return
-		}
-		initialization := "pragma journal_mode=WAL;\n"
-		if config.DataStoreTempDirectory != "" {
-			// On some platforms (e.g., Android), the standard temporary directories expected
-			// by sqlite (see unixGetTempname in aggregate sqlite3.c) may not be present.
-			// In that case, sqlite tries to use the current working directory; but this may
-			// be "/" (again, on Android) which is not writable.
-			// Instead of setting the process current working directory from this library,
-			// use the deprecated temp_store_directory pragma to force use of a specified
-			// temporary directory: https://www.sqlite.org/pragma.html#pragma_temp_store_directory.
-			// TODO: is there another way to restrict writing of temporary files? E.g. temp_store=3?
-			initialization += fmt.Sprintf(
-				"pragma temp_store_directory=\"%s\";\n", config.DataStoreTempDirectory)
-		}
-		initialization += `
+// DataStore is a handle to an open datastore. A process may open several
+// independent datastores, each in its own config.DataStoreDirectory, and
+// operate on them concurrently. The package-level datastore functions
+// operate on the default DataStore opened by InitDataStore.
+type DataStore struct {
+	config              *Config
+	filename            string
+	db                  *sql.DB
+	archiveDB           *sql.DB
+	compactionScheduler *dataStoreCompactionScheduler
+	codec               serverEntryCodec
+	operationLog        *dataStoreOperationLog
+	regionsMutex        sync.Mutex
+	availableRegions    []string
+}
+
+// requiredTables are the tables which OpenDataStore creates in the
+// live database.
+var requiredTables = []string{
+	"serverEntry",
+	"serverEntryProtocol",
+	"splitTunnelRoutes",
+	"urlETags",
+	"urlETagTimestamps",
+	"keyValue",
+	"internalKeyValue",
+	"serverEntryPropagationChannel",
+	"regionTransferStats",
+	"serverEntryPreferredProtocol",
+	"serverEntryPinned",
+	"serverEntryStats",
+	"serverEntryDisable",
+	"serverEntryLatency",
+	"serverEntryLastFailure",
+	"serverEntrySeen",
+	"protocolSuccessStats",
+	"appMetadata",
+	"serverEntryQuarantine",
+	"stagedServerEntry",
+	"resolvedHost",
+}
+
+// OpenDataStore opens the datastore in config.DataStoreDirectory, creating
+// it if necessary, and returns a handle to it. The handle is safe for use
+// by concurrent goroutines. The caller must call Close when done with the
+// datastore.
+func OpenDataStore(config *Config) (*DataStore, error) {
+	filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
+	resolvedFilename, absErr := filepath.Abs(filename)
+	if absErr != nil {
+		resolvedFilename = filepath.Clean(filename)
+	}
+	db, err := sql.Open(
+		"sqlite3",
+		fmt.Sprintf("file:%s?cache=private&mode=rwc", filename))
+	if err != nil {
+		return nil, fmt.Errorf("openDataStore failed to open database: %s", err)
+	}
+	initialization := "pragma journal_mode=WAL;\n"
+	if config.DataStoreTempDirectory != "" {
+		// On some platforms (e.g., Android), the standard temporary directories expected
+		// by sqlite (see unixGetTempname in aggregate sqlite3.c) may not be present.
+		// In that case, sqlite tries to use the current working directory; but this may
+		// be "/" (again, on Android) which is not writable.
+		// Instead of setting the process current working directory from this library,
+		// use the deprecated temp_store_directory pragma to force use of a specified
+		// temporary directory: https://www.sqlite.org/pragma.html#pragma_temp_store_directory.
+		// TODO: is there another way to restrict writing of temporary files? E.g. temp_store=3?
+		initialization += fmt.Sprintf(
+			"pragma temp_store_directory=\"%s\";\n", config.DataStoreTempDirectory)
+	}
+	initialization += `
         create table if not exists serverEntry
             (id text not null primary key,
              rank integer not null unique,
@@ -93,24 +126,312 @@ func InitDataStore(config *Config) (err error) {
         create table if not exists urlETags
             (url text not null primary key,
              etag text not null);
+        create table if not exists urlETagTimestamps
+            (url text not null primary key,
+             stored integer not null);
         create table if not exists keyValue
             (key text not null primary key,
              value text not null);
+        create table if not exists internalKeyValue
+            (key text not null primary key,
+             value text not null);
+        create table if not exists serverEntryPropagationChannel
+            (serverEntryId text not null,
+             propagationChannelId text not null,
+             primary key (serverEntryId, propagationChannelId));
+        create table if not exists regionTransferStats
+            (region text not null primary key,
+             bytes integer not null);
+        create table if not exists serverEntryPreferredProtocol
+            (serverEntryId text not null primary key,
+             protocol text not null);
+        create table if not exists serverEntryPinned
+            (serverEntryId text not null primary key);
+        create table if not exists serverEntryStats
+            (serverEntryId text not null primary key,
+             attempts integer not null default 0,
+             failures integer not null default 0);
+        create table if not exists serverEntryDisable
+            (serverEntryId text not null primary key,
+             consecutiveFailures integer not null default 0,
+             disabledUntil integer not null default 0);
+        create table if not exists serverEntryLatency
+            (serverEntryId text not null primary key,
+             latency integer not null);
+        create table if not exists serverEntryLastFailure
+            (serverEntryId text not null primary key,
+             lastFailure integer not null);
+        create table if not exists serverEntrySeen
+            (serverEntryId text not null primary key,
+             firstSeen integer not null,
+             lastSeen integer not null);
+        create table if not exists protocolSuccessStats
+            (protocol text not null primary key,
+             count integer not null);
+        create table if not exists appMetadata
+            (key text not null primary key,
+             value blob not null);
+        create table if not exists serverEntryQuarantine
+            (id text not null primary key,
+             data blob not null);
+        create table if not exists stagedServerEntry
+            (stagingId text not null,
+             sequence integer not null,
+             data blob not null,
+             primary key (stagingId, sequence));
+        create table if not exists resolvedHost
+            (host text not null primary key,
+             expiry integer not null,
+             data blob not null);
         `
-		_, err = db.Exec(initialization)
+	_, err = db.Exec(initialization)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openDataStore failed to initialize: %s", err)
+	}
+
+	// Server entries staged by a handshake which didn't complete, as when
+	// the process exited mid-handshake, are discarded.
+	_, err = db.Exec("delete from stagedServerEntry;")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openDataStore failed to discard staged server entries: %s", err)
+	}
+
+	// Archived server entries are kept in a separate file, so that cold
+	// server entries don't add to the size of the live database.
+	archiveFilename := filepath.Join(config.DataStoreDirectory, DATA_STORE_ARCHIVE_FILENAME)
+	archiveDB, err := sql.Open(
+		"sqlite3",
+		fmt.Sprintf("file:%s?cache=private&mode=rwc", archiveFilename))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openDataStore failed to open archive database: %s", err)
+	}
+	_, err = archiveDB.Exec(`
+        pragma journal_mode=WAL;
+        create table if not exists serverEntry
+            (id text not null primary key,
+             data blob not null);
+        `)
+	if err != nil {
+		db.Close()
+		archiveDB.Close()
+		return nil, fmt.Errorf("openDataStore failed to initialize archive: %s", err)
+	}
+
+	dataStore := &DataStore{
+		config:    config,
+		filename:  resolvedFilename,
+		db:        db,
+		archiveDB: archiveDB,
+	}
+	if config.DataStoreOperationLogSize > 0 {
+		dataStore.operationLog = newDataStoreOperationLog(config.DataStoreOperationLogSize)
+	}
+
+	err = dataStore.initServerEntryCodec()
+	if err != nil {
+		db.Close()
+		archiveDB.Close()
+		return nil, fmt.Errorf("openDataStore failed to initialize server entry codec: %s", err)
+	}
+
+	if config.CompactDataStoreAutomatically {
+		dataStore.compactionScheduler = newDataStoreCompactionScheduler(
+			dataStore.getSize, nil, dataStore.Compact)
+		dataStore.compactionScheduler.start()
+	}
+
+	return dataStore, nil
+}
+
+func (dataStore *DataStore) checkInit() {
+	if dataStore.db == nil {
+		panic("checkInit: datastore not initialized")
+	}
+}
+
+// Close stops the datastore compaction scheduler, if running, and closes
+// the datastore. Close must not be called concurrently with any other
+// DataStore method.
+func (dataStore *DataStore) Close() {
+	if dataStore.compactionScheduler != nil {
+		dataStore.compactionScheduler.stop()
+	}
+	if dataStore.db != nil {
+		dataStore.db.Close()
+	}
+	if dataStore.archiveDB != nil {
+		dataStore.archiveDB.Close()
+	}
+	dataStore.compactionScheduler = nil
+	dataStore.db = nil
+	dataStore.archiveDB = nil
+}
+
+// Sync forces pending data store writes to be flushed to disk.
+// This may be called before the process is backgrounded or killed, as
+// is common on mobile platforms. The WAL is checkpointed into the main
+// database files.
+func (dataStore *DataStore) Sync() error {
+	dataStore.checkInit()
+	for _, db := range []*sql.DB{dataStore.db, dataStore.archiveDB} {
+		_, err := db.Exec("pragma wal_checkpoint(FULL);")
 		if err != nil {
-			err = fmt.Errorf("initDataStore failed to initialize: %s", err)
-			return
+			return ContextError(err)
 		}
-		singleton.db = db
-	})
-	return err
+	}
+	return nil
+}
+
+// Compact rebuilds the datastore file, reclaiming free space.
+func (dataStore *DataStore) Compact() error {
+	dataStore.checkInit()
+	_, err := dataStore.db.Exec("vacuum;")
+	if err != nil {
+		return ContextError(err)
+	}
+	NoticeInfo("compacted datastore")
+	return nil
+}
+
+// Snapshot writes a consistent copy of the datastore to the specified file,
+// which may be opened as a datastore for offline analysis. The copy is
+// read within a single transaction which, in WAL journal mode, doesn't block
+// writers. Archived server entries are not included in the snapshot.
+func (dataStore *DataStore) Snapshot(path string) error {
+	dataStore.checkInit()
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return ContextError(err)
+	}
+	snapshotDB, err := sql.Open(
+		"sqlite3",
+		fmt.Sprintf("file:%s?cache=private&mode=rwc", path))
+	if err != nil {
+		return ContextError(err)
+	}
+	defer snapshotDB.Close()
+
+	transaction, err := dataStore.db.Begin()
+	if err != nil {
+		return ContextError(err)
+	}
+	defer transaction.Rollback()
+
+	// Tables are ordered before indexes, so that the indexes are created
+	// after the tables they reference.
+	rows, err := transaction.Query(`
+        select type, name, sql from sqlite_master
+        where sql is not null and name not like 'sqlite_%'
+        order by type desc;
+        `)
+	if err != nil {
+		return ContextError(err)
+	}
+	var tables, statements []string
+	for rows.Next() {
+		var schemaType, name, statement string
+		err = rows.Scan(&schemaType, &name, &statement)
+		if err != nil {
+			rows.Close()
+			return ContextError(err)
+		}
+		if schemaType == "table" {
+			tables = append(tables, name)
+		}
+		statements = append(statements, statement)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return ContextError(err)
+	}
+
+	snapshotTransaction, err := snapshotDB.Begin()
+	if err != nil {
+		return ContextError(err)
+	}
+	defer snapshotTransaction.Rollback()
+
+	for _, statement := range statements {
+		_, err = snapshotTransaction.Exec(statement)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+	for _, table := range tables {
+		err = copyTable(transaction, snapshotTransaction, table)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	err = snapshotTransaction.Commit()
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// copyTable inserts all the rows of the named table, read in the source
+// transaction, into the same table in the target transaction.
+func copyTable(source, target *sql.Tx, table string) error {
+	rows, err := source.Query(fmt.Sprintf("select * from %s;", table))
+	if err != nil {
+		return ContextError(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return ContextError(err)
+	}
+	insert := fmt.Sprintf(
+		"insert into %s values (%s);",
+		table,
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+	values := make([]interface{}, len(columns))
+	valuePointers := make([]interface{}, len(columns))
+	for i := range values {
+		valuePointers[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(valuePointers...)
+		if err != nil {
+			return ContextError(err)
+		}
+		_, err = target.Exec(insert, values...)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return ContextError(err)
+	}
+	return nil
 }
 
-func checkInitDataStore() {
-	if singleton.db == nil {
-		panic("checkInitDataStore: datastore not initialized")
+// getSize returns the size of the datastore and the size of its
+// free pages, in bytes.
+func (dataStore *DataStore) getSize() (size, freeSize int64, err error) {
+	dataStore.checkInit()
+	var pageSize, pageCount, freelistCount int64
+	for _, pragma := range []struct {
+		name  string
+		value *int64
+	}{
+		{"page_size", &pageSize},
+		{"page_count", &pageCount},
+		{"freelist_count", &freelistCount},
+	} {
+		err = dataStore.db.QueryRow("pragma " + pragma.name + ";").Scan(pragma.value)
+		if err != nil {
+			return 0, 0, ContextError(err)
+		}
 	}
+	return pageCount * pageSize, freelistCount * pageSize, nil
 }
 
 func canRetry(err error) bool {
@@ -122,15 +443,21 @@ func canRetry(err error) bool {
 }
 
 // transactionWithRetry will retry a write transaction if sqlite3
-// reports a table is locked by another writer.
-func transactionWithRetry(updater func(*sql.Tx) error) error {
-	checkInitDataStore()
+// reports a table is locked by another writer. A failed transaction
+// is reported in a DataStoreError notice.
+func (dataStore *DataStore) transactionWithRetry(updater func(*sql.Tx) error) (err error) {
+	dataStore.checkInit()
+	defer func() {
+		if err != nil {
+			NoticeDataStoreError("write", err)
+		}
+	}()
 	for i := 0; i < 10; i++ {
 		if i > 0 {
 			// Delay on retry
 			time.Sleep(100)
 		}
-		transaction, err := singleton.db.Begin()
+		transaction, err := dataStore.db.Begin()
 		if err != nil {
 			return ContextError(err)
 		}
@@ -157,10 +484,10 @@ func transactionWithRetry(updater func(*sql.Tx) error) error {
 
 // serverEntryExists returns true if a serverEntry with the
 // given ipAddress id already exists.
-func serverEntryExists(transaction *sql.Tx, ipAddress string) (bool, error) {
+func (dataStore *DataStore) serverEntryExists(transaction *sql.Tx, ipAddress string) (bool, error) {
 	query := "select count(*) from serverEntry where id  = ?;"
 	var count int
-	err := singleton.db.QueryRow(query, ipAddress).Scan(&count)
+	err := dataStore.db.QueryRow(query, ipAddress).Scan(&count)
 	if err != nil {
 		return false, ContextError(err)
 	}
@@ -173,11 +500,18 @@ func serverEntryExists(transaction *sql.Tx, ipAddress string) (bool, error) {
 // purpose of inserting at next-to-top is to keep the last selected server
 // as the top ranked server. Note, server candidates are iterated in decending
 // rank order, so the largest rank is top rank.
+// config.ServerEntryInsertPosition may instead specify the top or the
+// tail rank.
 // When replaceIfExists is true, an existing server entry record is
 // overwritten; otherwise, the existing record is unchanged.
 // If the server entry data is malformed, an alert notice is issued and
 // the entry is skipped; no error is returned.
-func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
+// Server entries outside of config.AllowedRegions, or with a web server
+// certificate not matching config.ExpectedWebCertFingerprints, are also
+// skipped with a notice and no error.
+func (dataStore *DataStore) StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("StoreServerEntry", serverEntry.IpAddress)
 
 	// Server entries should already be validated before this point,
 	// so instead of skipping we fail with an error.
@@ -186,8 +520,43 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 		return ContextError(errors.New("invalid server entry"))
 	}
 
-	return transactionWithRetry(func(transaction *sql.Tx) error {
-		serverEntryExists, err := serverEntryExists(transaction, serverEntry.IpAddress)
+	if !dataStore.acceptServerEntry(serverEntry) {
+		return nil
+	}
+
+	partition := getServerEntryPartition(dataStore.config)
+	insertPosition := dataStore.config.ServerEntryInsertPosition
+	seen := serverEntrySeenClock().UnixNano()
+
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		// The last seen timestamp is updated even when an existing server
+		// entry isn't replaced, as the server entry was re-delivered.
+		_, err := transaction.Exec(`
+            insert or ignore into serverEntrySeen (serverEntryId, firstSeen, lastSeen)
+            values (?, ?, ?);
+            `, serverEntry.IpAddress, seen, seen)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		_, err = transaction.Exec(`
+            update serverEntrySeen set lastSeen = ?
+            where serverEntryId = ?;
+            `, seen, serverEntry.IpAddress)
+		if err != nil {
+			return err
+		}
+		if partition != "" {
+			_, err = transaction.Exec(`
+                insert or ignore into serverEntryPropagationChannel (serverEntryId, propagationChannelId)
+                values (?, ?);
+                `, serverEntry.IpAddress, partition)
+			if err != nil {
+				// Note: ContextError() would break canRetry()
+				return err
+			}
+		}
+		serverEntryExists, err := dataStore.serverEntryExists(transaction, serverEntry.IpAddress)
 		if err != nil {
 			return ContextError(err)
 		}
@@ -198,21 +567,29 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 			// NoticeInfo("ignored update for server %s", serverEntry.IpAddress)
 			return nil
 		}
-		_, err = transaction.Exec(`
-            update serverEntry set rank = rank + 1
-                where id = (select id from serverEntry order by rank desc limit 1);
-            `)
-		if err != nil {
-			// Note: ContextError() would break canRetry()
-			return err
+		rank := "(select coalesce(max(rank)-1, 0) from serverEntry)"
+		switch insertPosition {
+		case SERVER_ENTRY_INSERT_POSITION_TOP:
+			rank = "(select coalesce(max(rank)+1, 0) from serverEntry)"
+		case SERVER_ENTRY_INSERT_POSITION_TAIL:
+			rank = "(select coalesce(min(rank)-1, 0) from serverEntry)"
+		default:
+			_, err = transaction.Exec(`
+                update serverEntry set rank = rank + 1
+                    where id = (select id from serverEntry order by rank desc limit 1);
+                `)
+			if err != nil {
+				// Note: ContextError() would break canRetry()
+				return err
+			}
 		}
-		data, err := json.Marshal(serverEntry)
+		data, err := dataStore.codec.Marshal(serverEntry)
 		if err != nil {
 			return ContextError(err)
 		}
 		_, err = transaction.Exec(`
             insert or replace into serverEntry (id, rank, region, data)
-            values (?, (select coalesce(max(rank)-1, 0) from serverEntry), ?, ?);
+            values (?, `+rank+`, ?, ?);
             `, serverEntry.IpAddress, serverEntry.Region, data)
 		if err != nil {
 			return err
@@ -224,10 +601,7 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 			return err
 		}
 		for _, protocol := range SupportedTunnelProtocols {
-			// Note: for meek, the capabilities are FRONTED-MEEK and UNFRONTED-MEEK
-			// and the additonal OSSH service is assumed to be available internally.
-			requiredCapability := strings.TrimSuffix(protocol, "-OSSH")
-			if Contains(serverEntry.Capabilities, requiredCapability) {
+			if serverEntry.SupportsProtocol(protocol) {
 				_, err = transaction.Exec(`
                     insert into serverEntryProtocol (serverEntryId, protocol)
                     values (?, ?);
@@ -239,25 +613,80 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 		}
 		// TODO: post notice after commit
 		if !serverEntryExists {
-			NoticeInfo("updated server %s", serverEntry.IpAddress)
+			NoticeInfo("updated server %s", redactServerAddress(serverEntry.IpAddress))
 		}
 		return nil
 	})
 }
 
+// GetServerEntrySeen returns the times when the specified server entry was
+// first stored and last stored or re-delivered. Zero times are returned
+// when there is no record for the server entry.
+func (dataStore *DataStore) GetServerEntrySeen(ipAddress string) (firstSeen, lastSeen time.Time, err error) {
+	dataStore.checkInit()
+	var firstSeenNano, lastSeenNano int64
+	err = dataStore.db.QueryRow(
+		"select firstSeen, lastSeen from serverEntrySeen where serverEntryId = ?;",
+		ipAddress).Scan(&firstSeenNano, &lastSeenNano)
+	if err == sql.ErrNoRows {
+		return time.Time{}, time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, time.Time{}, ContextError(err)
+	}
+	return time.Unix(0, firstSeenNano), time.Unix(0, lastSeenNano), nil
+}
+
 // StoreServerEntries shuffles and stores a list of server entries.
 // Shuffling is performed on imported server entrues as part of client-side
-// load balancing.
+// load balancing. config.ServerEntryStoreOrder may instead specify that the
+// list is ranked in input order, or interleaved with the existing ranked
+// server entries.
+// There is an independent transaction for each entry insert/update.
+func (dataStore *DataStore) StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
+
+	orderServerEntriesForStore(dataStore.config, serverEntries)
+
+	err := dataStore.storeServerEntries(serverEntries, replaceIfExists)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if dataStore.config.ServerEntryStoreOrder == SERVER_ENTRY_STORE_ORDER_INTERLEAVE {
+		err = dataStore.interleaveRankedServerEntries(makeServerEntryBatch(serverEntries))
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	return nil
+}
+
+// StoreServerEntriesByPriority stores a list of server entries, seeding the
+// rank order with the server entries in descending ServerPriority order
+// instead of shuffling. Entries with equal priority are shuffled.
 // There is an independent transaction for each entry insert/update.
-func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
+func (dataStore *DataStore) StoreServerEntriesByPriority(serverEntries []*ServerEntry, replaceIfExists bool) error {
 
+	// Each stored entry is assigned the next-to-top rank, so the entries
+	// are stored in ascending priority order: the highest priority entry
+	// is stored last and ends up ranked just below the top ranked entry.
+	shuffleServerEntries(serverEntries)
+	sort.Stable(serverEntriesByPriority(serverEntries))
+
+	return dataStore.storeServerEntries(serverEntries, replaceIfExists)
+}
+
+func shuffleServerEntries(serverEntries []*ServerEntry) {
 	for index := len(serverEntries) - 1; index > 0; index-- {
 		swapIndex := rand.Intn(index + 1)
 		serverEntries[index], serverEntries[swapIndex] = serverEntries[swapIndex], serverEntries[index]
 	}
+}
 
+func (dataStore *DataStore) storeServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
 	for _, serverEntry := range serverEntries {
-		err := StoreServerEntry(serverEntry, replaceIfExists)
+		err := dataStore.StoreServerEntry(serverEntry, replaceIfExists)
 		if err != nil {
 			return ContextError(err)
 		}
@@ -265,7 +694,7 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 
 	// Since there has possibly been a significant change in the server entries,
 	// take this opportunity to update the available egress regions.
-	ReportAvailableRegions()
+	dataStore.ReportAvailableRegions()
 
 	return nil
 }
@@ -273,14 +702,36 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 // PromoteServerEntry assigns the top rank (one more than current
 // max rank) to the specified server entry. Server candidates are
 // iterated in decending rank order, so this server entry will be
-// the first candidate in a subsequent tunnel establishment.
-func PromoteServerEntry(ipAddress string) error {
-	return transactionWithRetry(func(transaction *sql.Tx) error {
+// the first candidate in a subsequent tunnel establishment. The promotion
+// is recorded in the promotion history; see GetPromotionHistory.
+func (dataStore *DataStore) PromoteServerEntry(ipAddress string) error {
+	dataStore.recordOperation("PromoteServerEntry", ipAddress)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
 		_, err := transaction.Exec(`
             update serverEntry
             set rank = (select MAX(rank)+1 from serverEntry)
             where id = ?;
             `, ipAddress)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		var encodedHistory string
+		err = transaction.QueryRow(
+			"select value from keyValue where key = ?;",
+			DATA_STORE_PROMOTION_HISTORY_KEY).Scan(&encodedHistory)
+		if err != nil && err != sql.ErrNoRows {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		updatedHistory, err := appendPromotionEvent([]byte(encodedHistory), ipAddress)
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(`
+            insert or replace into keyValue (key, value)
+            values (?, ?);
+            `, DATA_STORE_PROMOTION_HISTORY_KEY, string(updatedHistory))
 		if err != nil {
 			// Note: ContextError() would break canRetry()
 			return err
@@ -289,307 +740,2035 @@ func PromoteServerEntry(ipAddress string) error {
 	})
 }
 
-// ServerEntryIterator is used to iterate over
-// stored server entries in rank order.
-type ServerEntryIterator struct {
-	region                      string
-	protocol                    string
-	shuffleHeadLength           int
-	transaction                 *sql.Tx
-	cursor                      *sql.Rows
-	isTargetServerEntryIterator bool
-	hasNextTargetServerEntry    bool
-	targetServerEntry           *ServerEntry
+// RebuildRankedServerEntries discards the existing server entry ranking
+// and re-ranks all stored server entries in random order. This recovers
+// from a ranking which has been externally manipulated or corrupted.
+func (dataStore *DataStore) RebuildRankedServerEntries() error {
+	dataStore.recordOperation("RebuildRankedServerEntries", "")
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		rows, err := transaction.Query("select id from serverEntry;")
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		var serverEntryIds []string
+		for rows.Next() {
+			var serverEntryId string
+			err = rows.Scan(&serverEntryId)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			serverEntryIds = append(serverEntryIds, serverEntryId)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for index := len(serverEntryIds) - 1; index > 0; index-- {
+			swapIndex := rand.Intn(index + 1)
+			serverEntryIds[index], serverEntryIds[swapIndex] = serverEntryIds[swapIndex], serverEntryIds[index]
+		}
+
+		// New ranks are assigned above the current maximum rank, so that
+		// the rank uniqueness constraint holds while ranks are updated.
+		var maxRank int64
+		err = transaction.QueryRow(
+			"select coalesce(max(rank), 0) from serverEntry;").Scan(&maxRank)
+		if err != nil {
+			return err
+		}
+		for index, serverEntryId := range serverEntryIds {
+			_, err = transaction.Exec(`
+                update serverEntry set rank = ?
+                where id = ?;
+                `, maxRank+int64(len(serverEntryIds)-index), serverEntryId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// NewServerEntryIterator creates a new NewServerEntryIterator
-func NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+// interleaveRankedServerEntries re-ranks the server entries in batch
+// alternately with the other server entries. See interleaveServerEntryIds.
+func (dataStore *DataStore) interleaveRankedServerEntries(batch map[string]bool) error {
+	dataStore.recordOperation("InterleaveRankedServerEntries", "")
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		rows, err := transaction.Query("select id from serverEntry order by rank desc;")
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		var serverEntryIds []string
+		for rows.Next() {
+			var serverEntryId string
+			err = rows.Scan(&serverEntryId)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			serverEntryIds = append(serverEntryIds, serverEntryId)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
 
-	// When configured, this target server entry is the only candidate
-	if config.TargetServerEntry != "" {
-		return newTargetServerEntryIterator(config)
-	}
+		serverEntryIds = interleaveServerEntryIds(serverEntryIds, batch)
 
-	checkInitDataStore()
-	iterator = &ServerEntryIterator{
-		region:                      config.EgressRegion,
-		protocol:                    config.TunnelProtocol,
-		shuffleHeadLength:           config.TunnelPoolSize,
-		isTargetServerEntryIterator: false,
+		// As in RebuildRankedServerEntries, new ranks are assigned above the
+		// current maximum rank, so that the rank uniqueness constraint holds
+		// while ranks are updated.
+		var maxRank int64
+		err = transaction.QueryRow(
+			"select coalesce(max(rank), 0) from serverEntry;").Scan(&maxRank)
+		if err != nil {
+			return err
+		}
+		for index, serverEntryId := range serverEntryIds {
+			_, err = transaction.Exec(`
+                update serverEntry set rank = ?
+                where id = ?;
+                `, maxRank+int64(len(serverEntryIds)-index), serverEntryId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ArchiveServerEntry moves the specified server entry from the live
+// database to the archive database. Archived server entries are not
+// candidates for tunnel establishment.
+// The record is written to the archive before it's deleted from the
+// live database, so a failure may leave a duplicate, but never loses
+// the record.
+func (dataStore *DataStore) ArchiveServerEntry(ipAddress string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("ArchiveServerEntry", ipAddress)
+	var data []byte
+	err := dataStore.db.QueryRow(
+		"select data from serverEntry where id = ?;", ipAddress).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ContextError(fmt.Errorf("server entry not found: %s", ipAddress))
 	}
-	err = iterator.Reset()
 	if err != nil {
-		return nil, err
+		return ContextError(err)
 	}
-	return iterator, nil
+	_, err = dataStore.archiveDB.Exec(`
+        insert or replace into serverEntry (id, data)
+        values (?, ?);
+        `, ipAddress, data)
+	if err != nil {
+		return ContextError(err)
+	}
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		return deleteServerEntry(transaction, ipAddress)
+	})
 }
 
-// newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
-func newTargetServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
-	serverEntry, err := DecodeServerEntry(config.TargetServerEntry)
+// moveServerEntryToQuarantine stores the raw server entry record in the
+// quarantine table and removes the server entry from the store.
+func (dataStore *DataStore) moveServerEntryToQuarantine(serverEntryId string, data []byte) error {
+	dataStore.recordOperation("QuarantineServerEntry", serverEntryId)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or replace into serverEntryQuarantine (id, data)
+            values (?, ?);
+            `, serverEntryId, data)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		return deleteServerEntry(transaction, serverEntryId)
+	})
+}
+
+// GetQuarantinedServerEntryIds returns the IDs of all server entries which
+// have been quarantined.
+func (dataStore *DataStore) GetQuarantinedServerEntryIds() ([]string, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query("select id from serverEntryQuarantine order by id;")
 	if err != nil {
-		return nil, err
-	}
-	if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
-		return nil, errors.New("TargetServerEntry does not support EgressRegion")
+		return nil, ContextError(err)
 	}
-	if config.TunnelProtocol != "" {
-		// Note: same capability/protocol mapping as in StoreServerEntry
-		requiredCapability := strings.TrimSuffix(config.TunnelProtocol, "-OSSH")
-		if !Contains(serverEntry.Capabilities, requiredCapability) {
-			return nil, errors.New("TargetServerEntry does not support TunnelProtocol")
+	defer rows.Close()
+	serverEntryIds := make([]string, 0)
+	for rows.Next() {
+		var serverEntryId string
+		err = rows.Scan(&serverEntryId)
+		if err != nil {
+			return nil, ContextError(err)
 		}
+		serverEntryIds = append(serverEntryIds, serverEntryId)
 	}
-	iterator = &ServerEntryIterator{
-		isTargetServerEntryIterator: true,
-		hasNextTargetServerEntry:    true,
-		targetServerEntry:           serverEntry,
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
 	}
-	NoticeInfo("using TargetServerEntry: %s", serverEntry.IpAddress)
-	return iterator, nil
+	return serverEntryIds, nil
 }
 
-// Reset a NewServerEntryIterator to the start of its cycle. The next
-// call to Next will return the first server entry.
-func (iterator *ServerEntryIterator) Reset() error {
-	iterator.Close()
-
-	if iterator.isTargetServerEntryIterator {
-		iterator.hasNextTargetServerEntry = true
+// StageServerEntries appends server entries to the staging area identified
+// by stagingId. Staged server entries aren't candidates and aren't seen by
+// any other DataStore function; they're read back, in the order staged,
+// with ScanStagedServerEntries. This allows a large server list to be
+// written in bounded batches before it's known whether the list will be
+// kept.
+func (dataStore *DataStore) StageServerEntries(stagingId string, serverEntries []*ServerEntry) error {
+	dataStore.recordOperation("StageServerEntries", stagingId)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		var sequence int64
+		err := transaction.QueryRow(
+			"select coalesce(max(sequence), 0) from stagedServerEntry where stagingId = ?;",
+			stagingId).Scan(&sequence)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		for _, serverEntry := range serverEntries {
+			data, err := json.Marshal(serverEntry)
+			if err != nil {
+				return err
+			}
+			sequence += 1
+			_, err = transaction.Exec(`
+                insert into stagedServerEntry (stagingId, sequence, data)
+                values (?, ?, ?);
+                `, stagingId, sequence, data)
+			if err != nil {
+				// Note: ContextError() would break canRetry()
+				return err
+			}
+		}
 		return nil
-	}
+	})
+}
 
-	count := CountServerEntries(iterator.region, iterator.protocol)
-	NoticeCandidateServers(iterator.region, iterator.protocol, count)
+// ScanStagedServerEntries reads the server entries in the staging area
+// identified by stagingId, in the order they were staged, and calls scanner
+// with each batch of at most batchSize server entries. Each batch is read by
+// its own query, which is closed before scanner is called, so scanner may
+// store the server entries.
+func (dataStore *DataStore) ScanStagedServerEntries(
+	stagingId string, batchSize int, scanner func([]*ServerEntry) error) error {
+
+	dataStore.checkInit()
+	var lastSequence int64
+	for {
+		rows, err := dataStore.db.Query(`
+            select sequence, data from stagedServerEntry
+            where stagingId = ? and sequence > ?
+            order by sequence limit ?;
+            `, stagingId, lastSequence, batchSize)
+		if err != nil {
+			return ContextError(err)
+		}
+		var serverEntries []*ServerEntry
+		for rows.Next() {
+			var data []byte
+			err = rows.Scan(&lastSequence, &data)
+			if err != nil {
+				rows.Close()
+				return ContextError(err)
+			}
+			serverEntry := new(ServerEntry)
+			err = json.Unmarshal(data, serverEntry)
+			if err != nil {
+				rows.Close()
+				return ContextError(err)
+			}
+			serverEntries = append(serverEntries, serverEntry)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return ContextError(err)
+		}
+		if len(serverEntries) == 0 {
+			return nil
+		}
+		err = scanner(serverEntries)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+}
 
-	transaction, err := singleton.db.Begin()
+// getStagedServerEntryKeys returns the key of each server entry in the
+// staging area identified by stagingId, in the order staged.
+func (dataStore *DataStore) getStagedServerEntryKeys(stagingId string) (stagedServerEntryKeys, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query(`
+        select sequence, data from stagedServerEntry
+        where stagingId = ? order by sequence;
+        `, stagingId)
 	if err != nil {
-		return ContextError(err)
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	var keys stagedServerEntryKeys
+	for rows.Next() {
+		var sequence int64
+		var data []byte
+		err = rows.Scan(&sequence, &data)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		var priority struct {
+			ServerPriority int `json:"serverPriority"`
+		}
+		err = json.Unmarshal(data, &priority)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		keys = append(keys, stagedServerEntryKey{
+			sequence: sequence, priority: priority.ServerPriority})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
 	}
-	var cursor *sql.Rows
+	return keys, nil
+}
 
-	// This query implements the Psiphon server candidate selection
-	// algorithm: the first TunnelPoolSize server candidates are in rank
-	// (priority) order, to favor previously successful servers; then the
-	// remaining long tail is shuffled to raise up less recent candidates.
+// getStagedServerEntries returns the server entries with the specified
+// staging sequences, in the order specified.
+func (dataStore *DataStore) getStagedServerEntries(
+	stagingId string, sequences []int64) ([]*ServerEntry, error) {
 
-	whereClause, whereParams := makeServerEntryWhereClause(
-		iterator.region, iterator.protocol, nil)
-	headLength := iterator.shuffleHeadLength
-	queryFormat := `
-		select data from serverEntry %s
-		order by case
-		when rank > coalesce((select rank from serverEntry %s order by rank desc limit ?, 1), -1) then rank
-		else abs(random())%%((select rank from serverEntry %s order by rank desc limit ?, 1))
-		end desc;`
-	query := fmt.Sprintf(queryFormat, whereClause, whereClause, whereClause)
-	params := make([]interface{}, 0)
-	params = append(params, whereParams...)
-	params = append(params, whereParams...)
-	params = append(params, headLength)
-	params = append(params, whereParams...)
-	params = append(params, headLength)
-
-	cursor, err = transaction.Query(query, params...)
-	if err != nil {
-		transaction.Rollback()
-		return ContextError(err)
+	dataStore.checkInit()
+	serverEntries := make([]*ServerEntry, 0, len(sequences))
+	for _, sequence := range sequences {
+		var data []byte
+		err := dataStore.db.QueryRow(`
+            select data from stagedServerEntry
+            where stagingId = ? and sequence = ?;
+            `, stagingId, sequence).Scan(&data)
+		if err == sql.ErrNoRows {
+			return nil, ContextError(fmt.Errorf("staged server entry %d not found", sequence))
+		}
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		serverEntry := new(ServerEntry)
+		err = json.Unmarshal(data, serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		serverEntries = append(serverEntries, serverEntry)
 	}
-	iterator.transaction = transaction
-	iterator.cursor = cursor
-	return nil
+	return serverEntries, nil
 }
 
-// Close cleans up resources associated with a ServerEntryIterator.
-func (iterator *ServerEntryIterator) Close() {
-	if iterator.cursor != nil {
-		iterator.cursor.Close()
+// DeleteStagedServerEntries discards the staging area identified by
+// stagingId. Staging areas which aren't discarded are discarded when the
+// datastore is next opened.
+func (dataStore *DataStore) DeleteStagedServerEntries(stagingId string) error {
+	dataStore.recordOperation("DeleteStagedServerEntries", stagingId)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(
+			"delete from stagedServerEntry where stagingId = ?;", stagingId)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		return nil
+	})
+}
+
+// deleteServerEntry removes a server entry, along with its protocol and
+// propagation channel records.
+func deleteServerEntry(transaction *sql.Tx, ipAddress string) error {
+	_, err := transaction.Exec(`
+        delete from serverEntry where id = ?;
+        `, ipAddress)
+	if err != nil {
+		// Note: ContextError() would break canRetry()
+		return err
 	}
-	iterator.cursor = nil
-	if iterator.transaction != nil {
-		iterator.transaction.Rollback()
+	_, err = transaction.Exec(`
+        delete from serverEntryProtocol where serverEntryId = ?;
+        `, ipAddress)
+	if err != nil {
+		return err
 	}
-	iterator.transaction = nil
+	_, err = transaction.Exec(`
+        delete from serverEntryPropagationChannel where serverEntryId = ?;
+        `, ipAddress)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-// Next returns the next server entry, by rank, for a ServerEntryIterator.
-// Returns nil with no error when there is no next item.
-func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error) {
-	defer func() {
+// RevalidateServerEntries runs ValidateServerEntry on all stored server
+// entries and deletes those which are no longer valid, such as server
+// entries stored before a validation rule was added. Server entries which
+// can't be decoded are also deleted. The number of deleted server entries
+// is returned.
+func (dataStore *DataStore) RevalidateServerEntries() (removed int, err error) {
+	dataStore.checkInit()
+	dataStore.recordOperation("RevalidateServerEntries", "")
+	rows, err := dataStore.db.Query("select id, data from serverEntry;")
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	var invalidIds []string
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
 		if err != nil {
-			iterator.Close()
+			rows.Close()
+			return 0, ContextError(err)
 		}
-	}()
-
-	if iterator.isTargetServerEntryIterator {
-		if iterator.hasNextTargetServerEntry {
-			iterator.hasNextTargetServerEntry = false
-			return MakeCompatibleServerEntry(iterator.targetServerEntry), nil
+		serverEntry, err := decodeStoredServerEntry(dataStore.codec, data)
+		if err == nil {
+			err = ValidateServerEntry(serverEntry)
 		}
-		return nil, nil
-	}
-
-	if !iterator.cursor.Next() {
-		err = iterator.cursor.Err()
 		if err != nil {
-			return nil, ContextError(err)
+			NoticeAlert("invalid stored server %s: %s", redactServerAddress(id), err)
+			invalidIds = append(invalidIds, id)
 		}
-		// There is no next item
-		return nil, nil
 	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, ContextError(err)
+	}
+	if len(invalidIds) == 0 {
+		return 0, nil
+	}
+	err = dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		for _, id := range invalidIds {
+			err := deleteServerEntry(transaction, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(invalidIds), nil
+}
 
+// RestoreServerEntry moves the specified server entry from the archive
+// database back to the live database. The restored server entry is
+// stored as with StoreServerEntry. A server entry which the datastore
+// doesn't accept, such as one outside of config.AllowedRegions, isn't
+// restored; an error is returned and the server entry remains archived.
+func (dataStore *DataStore) RestoreServerEntry(ipAddress string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("RestoreServerEntry", ipAddress)
 	var data []byte
-	err = iterator.cursor.Scan(&data)
+	err := dataStore.archiveDB.QueryRow(
+		"select data from serverEntry where id = ?;", ipAddress).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ContextError(fmt.Errorf("archived server entry not found: %s", ipAddress))
+	}
 	if err != nil {
-		return nil, ContextError(err)
+		return ContextError(err)
 	}
-	serverEntry = new(ServerEntry)
-	err = json.Unmarshal(data, serverEntry)
+	serverEntry := new(ServerEntry)
+	err = dataStore.codec.Unmarshal(data, serverEntry)
 	if err != nil {
-		return nil, ContextError(err)
+		return ContextError(err)
+	}
+	// StoreServerEntry skips, without an error, server entries which aren't
+	// accepted, so acceptance is checked before the archived record is
+	// deleted.
+	if !dataStore.acceptServerEntry(serverEntry) {
+		return ContextError(fmt.Errorf("archived server entry not accepted: %s", ipAddress))
+	}
+	err = dataStore.StoreServerEntry(serverEntry, true)
+	if err != nil {
+		return ContextError(err)
+	}
+	_, err = dataStore.archiveDB.Exec(
+		"delete from serverEntry where id = ?;", ipAddress)
+	if err != nil {
+		return ContextError(err)
 	}
+	return nil
+}
 
-	return MakeCompatibleServerEntry(serverEntry), nil
+// GetServerEntry returns the stored server entry with the specified
+// IP address. If not found, it returns a nil value.
+func (dataStore *DataStore) GetServerEntry(ipAddress string) (*ServerEntry, error) {
+	serverEntries, err := dataStore.GetServerEntries([]string{ipAddress})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if len(serverEntries) == 0 {
+		return nil, nil
+	}
+	return serverEntries[0], nil
 }
 
-// MakeCompatibleServerEntry provides backwards compatibility with old server entries
-// which have a single meekFrontingDomain and not a meekFrontingAddresses array.
-// By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
-// uses that single value as legacy clients do.
-func MakeCompatibleServerEntry(serverEntry *ServerEntry) *ServerEntry {
-	if len(serverEntry.MeekFrontingAddresses) == 0 && serverEntry.MeekFrontingDomain != "" {
-		serverEntry.MeekFrontingAddresses =
-			append(serverEntry.MeekFrontingAddresses, serverEntry.MeekFrontingDomain)
+// GetServerEntries returns the stored server entries with the specified
+// IP addresses, in the same order. IP addresses with no stored server entry
+// are skipped. All server entries are read in a single transaction.
+func (dataStore *DataStore) GetServerEntries(ipAddresses []string) ([]*ServerEntry, error) {
+	dataStore.checkInit()
+	transaction, err := dataStore.db.Begin()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer transaction.Rollback()
+	statement, err := transaction.Prepare("select data from serverEntry where id = ?;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer statement.Close()
+	serverEntries := make([]*ServerEntry, 0, len(ipAddresses))
+	undecodable := make(undecodableServerEntries)
+	for _, ipAddress := range ipAddresses {
+		var data []byte
+		err = statement.QueryRow(ipAddress).Scan(&data)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		serverEntry := undecodable.decode(dataStore.codec, ipAddress, data)
+		if serverEntry == nil {
+			continue
+		}
+		serverEntries = append(serverEntries, MakeCompatibleServerEntry(serverEntry))
 	}
+	statement.Close()
+	transaction.Rollback()
 
-	return serverEntry
+	// Undecodable server entries are quarantined once the read transaction
+	// is complete.
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return serverEntries, nil
 }
 
-func makeServerEntryWhereClause(
-	region, protocol string, excludeIds []string) (whereClause string, whereParams []interface{}) {
-	whereClause = ""
-	whereParams = make([]interface{}, 0)
-	if region != "" {
-		whereClause += " where region = ?"
-		whereParams = append(whereParams, region)
+// SetServerEntryPreferredProtocol records the protocol which successfully
+// established a tunnel to the specified server. The protocol must be a
+// supported tunnel protocol and the server entry must have the required
+// capability.
+func (dataStore *DataStore) SetServerEntryPreferredProtocol(ipAddress, protocol string) error {
+	dataStore.recordOperation("SetServerEntryPreferredProtocol", ipAddress)
+	err := validateServerEntryPreferredProtocol(dataStore, ipAddress, protocol)
+	if err != nil {
+		return ContextError(err)
 	}
-	if protocol != "" {
-		if len(whereClause) > 0 {
-			whereClause += " and"
-		} else {
-			whereClause += " where"
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or replace into serverEntryPreferredProtocol (serverEntryId, protocol)
+            values (?, ?);
+            `, ipAddress, protocol)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
 		}
-		whereClause +=
-			" exists (select 1 from serverEntryProtocol where protocol = ? and serverEntryId = serverEntry.id)"
-		whereParams = append(whereParams, protocol)
+		return nil
+	})
+}
+
+// GetServerEntryPreferredProtocol retrieves the recorded preferred protocol
+// for the specified server. If not found, it returns an empty string value.
+func (dataStore *DataStore) GetServerEntryPreferredProtocol(ipAddress string) (protocol string, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow(
+		"select protocol from serverEntryPreferredProtocol where serverEntryId = ?;", ipAddress)
+	err = rows.Scan(&protocol)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	if len(excludeIds) > 0 {
-		if len(whereClause) > 0 {
-			whereClause += " and"
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return protocol, nil
+}
+
+// SetServerEntryPinned marks or unmarks the specified server entry as
+// pinned. Pinned server entries are never evicted from the datastore.
+// The pinned mark is retained when the server entry is archived.
+func (dataStore *DataStore) SetServerEntryPinned(ipAddress string, pinned bool) error {
+	dataStore.recordOperation("SetServerEntryPinned", ipAddress)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		var err error
+		if pinned {
+			_, err = transaction.Exec(`
+                insert or replace into serverEntryPinned (serverEntryId)
+                values (?);
+                `, ipAddress)
 		} else {
-			whereClause += " where"
+			_, err = transaction.Exec(
+				"delete from serverEntryPinned where serverEntryId = ?;", ipAddress)
 		}
-		whereClause += " id in ("
-		for index, id := range excludeIds {
-			if index > 0 {
-				whereClause += ", "
-			}
-			whereClause += "?"
-			whereParams = append(whereParams, id)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
 		}
-		whereClause += ")"
-	}
-	return whereClause, whereParams
+		return nil
+	})
 }
 
-// CountServerEntries returns a count of stored servers for the
-// specified region and protocol.
-func CountServerEntries(region, protocol string) int {
-	checkInitDataStore()
-	var count int
-	whereClause, whereParams := makeServerEntryWhereClause(region, protocol, nil)
-	query := "select count(*) from serverEntry" + whereClause
-	err := singleton.db.QueryRow(query, whereParams...).Scan(&count)
+// SetServerEntryLatency records the latency measured for the specified
+// server. See config.LatencyWeightedServerEntries.
+func (dataStore *DataStore) SetServerEntryLatency(ipAddress string, latency time.Duration) error {
+	dataStore.recordOperation("SetServerEntryLatency", ipAddress)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or replace into serverEntryLatency (serverEntryId, latency)
+            values (?, ?);
+            `, ipAddress, int64(latency))
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		return nil
+	})
+}
 
+// IsServerEntryPinned returns true when the specified server entry is
+// pinned.
+func (dataStore *DataStore) IsServerEntryPinned(ipAddress string) (bool, error) {
+	dataStore.checkInit()
+	var count int
+	err := dataStore.db.QueryRow(
+		"select count(*) from serverEntryPinned where serverEntryId = ?;", ipAddress).Scan(&count)
 	if err != nil {
-		NoticeAlert("CountServerEntries failed: %s", err)
-		return 0
+		return false, ContextError(err)
 	}
+	return count > 0, nil
+}
 
-	if region == "" {
-		region = "(any)"
-	}
-	if protocol == "" {
-		protocol = "(any)"
-	}
-	NoticeInfo("servers for region %s and protocol %s: %d",
+// ServerEntryIterator is used to iterate over
+// stored server entries in rank order.
+type ServerEntryIterator struct {
+	dataStore                   *DataStore
+	region                      string
+	regions                     []string
+	protocol                    string
+	shuffleHeadLength           int
+	usePreferredProtocol        bool
+	latencyWeighted             bool
+	reshuffleOnReset            bool
+	chronological               bool
+	partition                   string
+	clientVersion               string
+	onCandidate                 func(*ServerEntry, bool, string)
+	transaction                 *sql.Tx
+	cursor                      *sql.Rows
+	shuffledServerEntryIds      []string
+	serverEntryIndex            int
+	knownServerEntryIds         map[string]bool
+	refreshedServerEntryIds     []string
+	isTargetServerEntryIterator bool
+	hasNextTargetServerEntry    bool
+	targetServerEntry           *ServerEntry
+}
+
+// NewServerEntryIterator creates a new NewServerEntryIterator
+func (dataStore *DataStore) NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+
+	if config.RequireEgressRegion && config.EgressRegion == "" {
+		return nil, ContextError(errors.New("egress region required"))
+	}
+
+	// When configured, this target server entry is the only candidate
+	if config.TargetServerEntry != "" && !config.TargetServerEntryPreferred {
+		return newTargetServerEntryIterator(config)
+	}
+
+	dataStore.checkInit()
+	iterator = &ServerEntryIterator{
+		dataStore:                   dataStore,
+		region:                      config.EgressRegion,
+		regions:                     getRegionGroupMembers(config.EgressRegionGroups, config.EgressRegion),
+		protocol:                    config.TunnelProtocol,
+		shuffleHeadLength:           config.TunnelPoolSize,
+		usePreferredProtocol:        config.UseServerEntryPreferredProtocol,
+		latencyWeighted:             config.LatencyWeightedServerEntries,
+		reshuffleOnReset:            config.ReshuffleOnReset == nil || *config.ReshuffleOnReset,
+		partition:                   getServerEntryPartition(config),
+		clientVersion:               config.ClientVersion,
+		onCandidate:                 config.OnCandidate,
+		isTargetServerEntryIterator: false,
+	}
+
+	// When configured as preferred, the target server entry is the first
+	// candidate, followed by the stored server entries
+	if config.TargetServerEntry != "" {
+		iterator.targetServerEntry, err = decodeTargetServerEntry(config)
+		if err != nil {
+			return nil, err
+		}
+		NoticeInfo("using preferred TargetServerEntry: %s",
+			redactServerAddress(iterator.targetServerEntry.IpAddress))
+	}
+
+	err = iterator.Reset()
+	if err != nil {
+		return nil, err
+	}
+	return iterator, nil
+}
+
+// NewChronologicalServerEntryIterator creates a new ServerEntryIterator which
+// returns server entries in ascending firstSeen order, instead of in rank
+// order; see GetServerEntrySeen. Server entries with no firstSeen record are
+// returned last. The config region, protocol, and propagation channel filters
+// apply as for NewServerEntryIterator; TargetServerEntry is not used.
+func (dataStore *DataStore) NewChronologicalServerEntryIterator(config *Config) (*ServerEntryIterator, error) {
+
+	if config.RequireEgressRegion && config.EgressRegion == "" {
+		return nil, ContextError(errors.New("egress region required"))
+	}
+
+	dataStore.checkInit()
+	iterator := &ServerEntryIterator{
+		dataStore:            dataStore,
+		region:               config.EgressRegion,
+		regions:              getRegionGroupMembers(config.EgressRegionGroups, config.EgressRegion),
+		protocol:             config.TunnelProtocol,
+		usePreferredProtocol: config.UseServerEntryPreferredProtocol,
+		reshuffleOnReset:     true,
+		chronological:        true,
+		partition:            getServerEntryPartition(config),
+		clientVersion:        config.ClientVersion,
+		onCandidate:          config.OnCandidate,
+	}
+
+	err := iterator.Reset()
+	if err != nil {
+		return nil, err
+	}
+	return iterator, nil
+}
+
+// newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
+func newTargetServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+	serverEntry, err := decodeTargetServerEntry(config)
+	if err != nil {
+		return nil, err
+	}
+	iterator = &ServerEntryIterator{
+		isTargetServerEntryIterator: true,
+		hasNextTargetServerEntry:    true,
+		targetServerEntry:           serverEntry,
+	}
+	NoticeInfo("using TargetServerEntry: %s", redactServerAddress(serverEntry.IpAddress))
+	return iterator, nil
+}
+
+// decodeTargetServerEntry decodes config.TargetServerEntry and checks that
+// it's compatible with the configured EgressRegion and TunnelProtocol.
+func decodeTargetServerEntry(config *Config) (*ServerEntry, error) {
+	serverEntry, err := DecodeServerEntry(config.TargetServerEntry)
+	if err != nil {
+		return nil, err
+	}
+	if !regionMatches(
+		getRegionGroupMembers(config.EgressRegionGroups, config.EgressRegion), serverEntry.Region) {
+
+		return nil, errors.New("TargetServerEntry does not support EgressRegion")
+	}
+	if config.TunnelProtocol != "" {
+		if !serverEntry.SupportsProtocol(config.TunnelProtocol) {
+			return nil, errors.New("TargetServerEntry does not support TunnelProtocol")
+		}
+	}
+	return serverEntry, nil
+}
+
+// Reset a NewServerEntryIterator to the start of its cycle. The next
+// call to Next will return the first server entry.
+func (iterator *ServerEntryIterator) Reset() error {
+	iterator.Close()
+
+	iterator.hasNextTargetServerEntry = (iterator.targetServerEntry != nil)
+
+	if iterator.isTargetServerEntryIterator {
+		return nil
+	}
+
+	// When no protocol is specified, the iterator accepts all supported
+	// protocols, so the count is also broken down by protocol. The region
+	// and protocol count doesn't reflect the other filters applied by Next,
+	// so NoCandidateServers is determined by the candidate count, which is
+	// made in the same scan.
+	count, protocolCounts, candidateCount, err := iterator.countCandidates()
+	if err != nil {
+		return ContextError(err)
+	}
+	NoticeCandidateServers(iterator.region, iterator.protocol, count, protocolCounts)
+	if candidateCount == 0 {
+		NoticeNoCandidateServers(iterator.region, iterator.protocol)
+	}
+
+	if iterator.onCandidate != nil {
+		err := iterator.reportFilteredServerEntries()
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	// When ReshuffleOnReset is disabled, the candidate order computed by
+	// the first Reset is reused.
+	if !iterator.reshuffleOnReset && iterator.shuffledServerEntryIds != nil {
+		iterator.serverEntryIndex = 0
+		iterator.knownServerEntryIds = makeServerEntryIdSet(iterator.shuffledServerEntryIds)
+		return nil
+	}
+
+	whereClause, whereParams := makeServerEntryWhereClause(
+		iterator.regions, iterator.protocol, iterator.partition, nil)
+
+	if iterator.chronological {
+
+		// In chronological mode, all server entries are ordered by ascending
+		// firstSeen time. Server entries without a firstSeen time are last.
+
+		transaction, err := iterator.dataStore.db.Begin()
+		if err != nil {
+			return ContextError(err)
+		}
+		cursor, err := transaction.Query(`
+		select id, data from serverEntry
+		left join serverEntrySeen on serverEntrySeen.serverEntryId = serverEntry.id`+whereClause+`
+		order by firstSeen is null, firstSeen, serverEntry.id;`, whereParams...)
+		if err != nil {
+			transaction.Rollback()
+			return ContextError(err)
+		}
+		iterator.transaction = transaction
+		iterator.cursor = cursor
+		return nil
+	}
+
+	// The candidates are selected in rank order and then ordered by the
+	// Psiphon server candidate selection algorithm, in
+	// shuffleCandidateServerEntryIds. The tail is shuffled with math/rand,
+	// as in the BoltDB implementation, rather than in the query, so that the
+	// candidate order is the same in both implementations for a fixed seed.
+	// The recorded latencies are selected for latency weighted mode.
+
+	rows, err := iterator.dataStore.db.Query(`
+		select id, latency from serverEntry
+		left join serverEntryLatency on serverEntryLatency.serverEntryId = serverEntry.id`+whereClause+`
+		order by rank desc;`, whereParams...)
+	if err != nil {
+		return ContextError(err)
+	}
+	defer rows.Close()
+
+	serverEntryIds := make([]string, 0)
+	var latencies map[string]time.Duration
+	if iterator.latencyWeighted {
+		latencies = make(map[string]time.Duration)
+	}
+	for rows.Next() {
+		var id string
+		var latency sql.NullInt64
+		err = rows.Scan(&id, &latency)
+		if err != nil {
+			return ContextError(err)
+		}
+		serverEntryIds = append(serverEntryIds, id)
+		if latencies != nil && latency.Valid && latency.Int64 > 0 {
+			latencies[id] = time.Duration(latency.Int64)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return ContextError(err)
+	}
+
+	shuffleCandidateServerEntryIds(serverEntryIds, iterator.shuffleHeadLength, latencies)
+
+	// The candidate order is retained for Next and, when ReshuffleOnReset is
+	// disabled, for subsequent Resets. The IDs of the candidates are
+	// recorded for RefreshRanked.
+	iterator.shuffledServerEntryIds = serverEntryIds
+	iterator.serverEntryIndex = 0
+	iterator.knownServerEntryIds = makeServerEntryIdSet(serverEntryIds)
+	return nil
+}
+
+// Reshuffle discards any candidate order retained when ReshuffleOnReset
+// is disabled and resets the iterator with a newly computed order.
+func (iterator *ServerEntryIterator) Reshuffle() error {
+	iterator.shuffledServerEntryIds = nil
+	return iterator.Reset()
+}
+
+// RefreshRanked merges server entries stored since the iterator was reset,
+// such as server entries received in a handshake, into the remaining
+// candidates. The new server entries, in rank order, are the next
+// candidates; the order of the remaining candidates is unchanged and
+// iteration isn't restarted. RefreshRanked has no effect for target server
+// entry iterators or in chronological mode.
+func (iterator *ServerEntryIterator) RefreshRanked() error {
+	if iterator.isTargetServerEntryIterator ||
+		iterator.chronological ||
+		iterator.knownServerEntryIds == nil {
+		return nil
+	}
+
+	whereClause, whereParams := makeServerEntryWhereClause(
+		iterator.regions, iterator.protocol, iterator.partition, nil)
+	rows, err := iterator.dataStore.db.Query(
+		"select id from serverEntry"+whereClause+" order by rank desc;", whereParams...)
+	if err != nil {
+		return ContextError(err)
+	}
+	defer rows.Close()
+	var newServerEntryIds []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return ContextError(err)
+		}
+		if !iterator.knownServerEntryIds[id] {
+			newServerEntryIds = append(newServerEntryIds, id)
+			iterator.knownServerEntryIds[id] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return ContextError(err)
+	}
+
+	iterator.refreshedServerEntryIds = append(
+		newServerEntryIds, iterator.refreshedServerEntryIds...)
+	return nil
+}
+
+// nextServerEntryData returns the ID and data of the next server entry in
+// the iterator cycle: first any server entries merged by RefreshRanked;
+// then either from the candidate order computed by Reset or, in
+// chronological mode, from the query cursor. Returns nil data with no error when
+// there is no next item.
+func (iterator *ServerEntryIterator) nextServerEntryData() (string, []byte, error) {
+	for len(iterator.refreshedServerEntryIds) > 0 {
+		id := iterator.refreshedServerEntryIds[0]
+		iterator.refreshedServerEntryIds = iterator.refreshedServerEntryIds[1:]
+		data, err := iterator.getServerEntryData(id)
+		if err != nil {
+			return "", nil, err
+		}
+		if data != nil {
+			return id, data, nil
+		}
+	}
+
+	if iterator.shuffledServerEntryIds != nil {
+		for iterator.serverEntryIndex < len(iterator.shuffledServerEntryIds) {
+			id := iterator.shuffledServerEntryIds[iterator.serverEntryIndex]
+			iterator.serverEntryIndex += 1
+			data, err := iterator.getServerEntryData(id)
+			if err != nil {
+				return "", nil, err
+			}
+			if data != nil {
+				return id, data, nil
+			}
+		}
+		return "", nil, nil
+	}
+
+	if !iterator.cursor.Next() {
+		return "", nil, iterator.cursor.Err()
+	}
+	var id string
+	var data []byte
+	err := iterator.cursor.Scan(&id, &data)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, data, nil
+}
+
+// getServerEntryData returns the data of the specified server entry, or
+// nil when the server entry was deleted after the candidates were selected.
+func (iterator *ServerEntryIterator) getServerEntryData(id string) ([]byte, error) {
+	var data []byte
+	err := iterator.dataStore.db.QueryRow(
+		"select data from serverEntry where id = ?;", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// reportFilteredServerEntries reports, to the OnCandidate callback, all the
+// stored server entries which the iterator query excludes. As the query
+// performs the filtering, these server entries are reported on Reset rather
+// than as Next progresses.
+func (iterator *ServerEntryIterator) reportFilteredServerEntries() error {
+
+	whereClause, whereParams := makeServerEntryWhereClause(
+		iterator.regions, iterator.protocol, iterator.partition, nil)
+	rows, err := iterator.dataStore.db.Query("select id from serverEntry"+whereClause, whereParams...)
+	if err != nil {
+		return ContextError(err)
+	}
+	candidateIds := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return ContextError(err)
+		}
+		candidateIds[id] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return ContextError(err)
+	}
+
+	filteredServerEntries := make([]*ServerEntry, 0)
+	rows, err = iterator.dataStore.db.Query("select id, data from serverEntry;")
+	if err != nil {
+		return ContextError(err)
+	}
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			rows.Close()
+			return ContextError(err)
+		}
+		if candidateIds[id] {
+			continue
+		}
+		serverEntry := new(ServerEntry)
+		err = iterator.dataStore.codec.Unmarshal(data, serverEntry)
+		if err != nil {
+			rows.Close()
+			return ContextError(err)
+		}
+		filteredServerEntries = append(filteredServerEntries, serverEntry)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return ContextError(err)
+	}
+
+	for _, serverEntry := range filteredServerEntries {
+		skipReason := SERVER_ENTRY_SKIP_REASON_PROPAGATION_CHANNEL
+		if !regionMatches(iterator.regions, serverEntry.Region) {
+			skipReason = SERVER_ENTRY_SKIP_REASON_REGION
+		} else if iterator.protocol != "" && !serverEntry.SupportsProtocol(iterator.protocol) {
+			skipReason = SERVER_ENTRY_SKIP_REASON_PROTOCOL
+		}
+		iterator.reportCandidate(serverEntry, false, skipReason)
+	}
+
+	return nil
+}
+
+// Close cleans up resources associated with a ServerEntryIterator.
+func (iterator *ServerEntryIterator) Close() {
+	if iterator.cursor != nil {
+		iterator.cursor.Close()
+	}
+	iterator.cursor = nil
+	if iterator.transaction != nil {
+		iterator.transaction.Rollback()
+	}
+	iterator.transaction = nil
+	iterator.knownServerEntryIds = nil
+	iterator.refreshedServerEntryIds = nil
+}
+
+// Next returns the next server entry, by rank, for a ServerEntryIterator.
+// Returns nil with no error when there is no next item.
+func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error) {
+	defer func() {
+		if err != nil {
+			iterator.Close()
+		}
+	}()
+
+	if iterator.hasNextTargetServerEntry {
+		iterator.hasNextTargetServerEntry = false
+		iterator.reportCandidate(iterator.targetServerEntry, true, "")
+		return MakeCompatibleServerEntry(iterator.targetServerEntry), nil
+	}
+
+	if iterator.isTargetServerEntryIterator {
+		return nil, nil
+	}
+
+	// Loop until we have the next server entry that's not a repeat
+	// of the preferred target server entry, if any, that's not
+	// currently disabled, and that accepts the client version.
+	for {
+		var id string
+		var data []byte
+		id, data, err = iterator.nextServerEntryData()
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if data == nil {
+			// There is no next item
+			return nil, nil
+		}
+
+		var decodeErr error
+		serverEntry, decodeErr = decodeStoredServerEntry(iterator.dataStore.codec, data)
+		if decodeErr != nil {
+			iterator.dataStore.quarantineServerEntry(id, data, decodeErr)
+			continue
+		}
+
+		var skipReason string
+		skipReason, err = iterator.getSkipReason(serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if skipReason != "" {
+			iterator.reportCandidate(serverEntry, false, skipReason)
+			continue
+		}
+
+		break
+	}
+
+	if iterator.usePreferredProtocol {
+		serverEntry.PreferredProtocol, err = iterator.dataStore.GetServerEntryPreferredProtocol(serverEntry.IpAddress)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	iterator.reportCandidate(serverEntry, true, "")
+
+	return MakeCompatibleServerEntry(serverEntry), nil
+}
+
+// getSkipReason returns the reason Next skips the server entry, or "" when
+// the server entry is a candidate. The region, protocol and partition
+// filters are applied in the server entry query and aren't checked here.
+func (iterator *ServerEntryIterator) getSkipReason(serverEntry *ServerEntry) (string, error) {
+
+	// Skip the preferred target server entry, if any, as it's already
+	// been returned as the first candidate.
+	if iterator.targetServerEntry != nil &&
+		serverEntry.IpAddress == iterator.targetServerEntry.IpAddress {
+		return SERVER_ENTRY_SKIP_REASON_TARGET, nil
+	}
+	disabledUntil, err := iterator.dataStore.GetServerEntryDisabledUntil(serverEntry.IpAddress)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	if time.Now().Before(disabledUntil) {
+		return SERVER_ENTRY_SKIP_REASON_DISABLED, nil
+	}
+	if !serverEntry.supportsClientVersion(iterator.clientVersion) {
+		return SERVER_ENTRY_SKIP_REASON_CLIENT_VERSION, nil
+	}
+	return "", nil
+}
+
+// countCandidates returns counts of the stored server entries in the
+// iterator region: count and protocolCounts, for NoticeCandidateServers, are
+// the server entries which support the iterator protocol and, when no
+// protocol is specified, each supported protocol; candidateCount is the
+// server entries which Next would return, applying the same filters as
+// Next. All counts are made in a single scan. Server entries which can't be
+// decoded aren't counted; they're quarantined by Next.
+func (iterator *ServerEntryIterator) countCandidates() (
+	count int, protocolCounts map[string]int, candidateCount int, err error) {
+
+	if iterator.protocol == "" {
+		protocolCounts = make(map[string]int)
+		for _, supportedProtocol := range SupportedTunnelProtocols {
+			protocolCounts[supportedProtocol] = 0
+		}
+	}
+	countProtocols := func(serverEntry *ServerEntry) {
+		if iterator.protocol == "" || serverEntry.SupportsProtocol(iterator.protocol) {
+			count += 1
+		}
+		for supportedProtocol := range protocolCounts {
+			if serverEntry.SupportsProtocol(supportedProtocol) {
+				protocolCounts[supportedProtocol] += 1
+			}
+		}
+	}
+
+	// The query selects the server entries in the iterator region, so that
+	// the protocol counts aren't limited to the iterator protocol, along with
+	// whether each server entry supports the iterator protocol and is in the
+	// iterator partition.
+	query := "select data"
+	queryParams := make([]interface{}, 0)
+	if iterator.protocol != "" {
+		query += ", exists (select 1 from serverEntryProtocol" +
+			" where protocol = ? and serverEntryId = serverEntry.id)"
+		queryParams = append(queryParams, iterator.protocol)
+	} else {
+		query += ", 1"
+	}
+	if iterator.partition != "" {
+		query += ", exists (select 1 from serverEntryPropagationChannel" +
+			" where propagationChannelId = ? and serverEntryId = serverEntry.id)"
+		queryParams = append(queryParams, iterator.partition)
+	} else {
+		query += ", 1"
+	}
+	whereClause, whereParams := makeServerEntryWhereClause(iterator.regions, "", "", nil)
+	query += " from serverEntry" + whereClause
+	queryParams = append(queryParams, whereParams...)
+
+	rows, err := iterator.dataStore.db.Query(query, queryParams...)
+	if err != nil {
+		return 0, nil, 0, ContextError(err)
+	}
+	candidates := make([]*ServerEntry, 0)
+	for rows.Next() {
+		var data []byte
+		var supportsProtocol, inPartition bool
+		err = rows.Scan(&data, &supportsProtocol, &inPartition)
+		if err != nil {
+			rows.Close()
+			return 0, nil, 0, ContextError(err)
+		}
+		serverEntry, err := decodeStoredServerEntry(iterator.dataStore.codec, data)
+		if err != nil {
+			continue
+		}
+		countProtocols(serverEntry)
+		if supportsProtocol && inPartition {
+			candidates = append(candidates, serverEntry)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, 0, ContextError(err)
+	}
+
+	for _, serverEntry := range candidates {
+		skipReason, err := iterator.getSkipReason(serverEntry)
+		if err != nil {
+			return 0, nil, 0, ContextError(err)
+		}
+		if skipReason == "" {
+			candidateCount += 1
+		}
+	}
+	return count, protocolCounts, candidateCount, nil
+}
+
+// reportCandidate invokes the OnCandidate callback, when configured.
+func (iterator *ServerEntryIterator) reportCandidate(
+	serverEntry *ServerEntry, yielded bool, skipReason string) {
+
+	if iterator.onCandidate != nil {
+		iterator.onCandidate(serverEntry, yielded, skipReason)
+	}
+}
+
+// MakeCompatibleServerEntry provides backwards compatibility with old server entries
+// which have a single meekFrontingDomain and not a meekFrontingAddresses array.
+// By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
+// uses that single value as legacy clients do.
+func MakeCompatibleServerEntry(serverEntry *ServerEntry) *ServerEntry {
+	if len(serverEntry.MeekFrontingAddresses) == 0 && serverEntry.MeekFrontingDomain != "" {
+		serverEntry.MeekFrontingAddresses =
+			append(serverEntry.MeekFrontingAddresses, serverEntry.MeekFrontingDomain)
+	}
+
+	return serverEntry
+}
+
+func makeServerEntryWhereClause(
+	regions []string, protocol, partition string, excludeIds []string) (whereClause string, whereParams []interface{}) {
+	whereClause = ""
+	whereParams = make([]interface{}, 0)
+	if len(regions) > 0 {
+		whereClause += " where region in ("
+		for index, region := range regions {
+			if index > 0 {
+				whereClause += ", "
+			}
+			whereClause += "?"
+			whereParams = append(whereParams, region)
+		}
+		whereClause += ")"
+	}
+	if protocol != "" {
+		if len(whereClause) > 0 {
+			whereClause += " and"
+		} else {
+			whereClause += " where"
+		}
+		whereClause +=
+			" exists (select 1 from serverEntryProtocol where protocol = ? and serverEntryId = serverEntry.id)"
+		whereParams = append(whereParams, protocol)
+	}
+	if partition != "" {
+		if len(whereClause) > 0 {
+			whereClause += " and"
+		} else {
+			whereClause += " where"
+		}
+		whereClause +=
+			" exists (select 1 from serverEntryPropagationChannel where propagationChannelId = ? and serverEntryId = serverEntry.id)"
+		whereParams = append(whereParams, partition)
+	}
+	if len(excludeIds) > 0 {
+		if len(whereClause) > 0 {
+			whereClause += " and"
+		} else {
+			whereClause += " where"
+		}
+		whereClause += " id in ("
+		for index, id := range excludeIds {
+			if index > 0 {
+				whereClause += ", "
+			}
+			whereClause += "?"
+			whereParams = append(whereParams, id)
+		}
+		whereClause += ")"
+	}
+	return whereClause, whereParams
+}
+
+// CountServerEntries returns a count of stored servers for the
+// specified region and protocol. The region may be a group name in
+// config.EgressRegionGroups.
+func (dataStore *DataStore) CountServerEntries(region, protocol string) int {
+	dataStore.checkInit()
+	var count int
+	regions := getRegionGroupMembers(dataStore.config.EgressRegionGroups, region)
+	whereClause, whereParams := makeServerEntryWhereClause(regions, protocol, "", nil)
+	query := "select count(*) from serverEntry" + whereClause
+	err := dataStore.db.QueryRow(query, whereParams...).Scan(&count)
+
+	if err != nil {
+		NoticeAlert("CountServerEntries failed: %s", err)
+		return 0
+	}
+
+	if region == "" {
+		region = "(any)"
+	}
+	if protocol == "" {
+		protocol = "(any)"
+	}
+	NoticeInfo("servers for region %s and protocol %s: %d",
 		region, protocol, count)
 
-	return count
+	return count
+}
+
+// CountServerEntriesMatching returns a count of stored servers for
+// which predicate returns true. All server entries are scanned once.
+func (dataStore *DataStore) CountServerEntriesMatching(predicate func(*ServerEntry) bool) (int, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query("select id, data from serverEntry;")
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	count := 0
+	undecodable := make(undecodableServerEntries)
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			rows.Close()
+			return 0, ContextError(err)
+		}
+		serverEntry := undecodable.decode(dataStore.codec, id, data)
+		if serverEntry == nil {
+			continue
+		}
+		if predicate(serverEntry) {
+			count += 1
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	// Undecodable server entries are quarantined once the scan is complete.
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return count, nil
+}
+
+// GetRandomServerEntry returns a stored server entry selected uniformly at
+// random, using math/rand, from the server entries matching the specified
+// region and protocol. The region may be a group name in
+// config.EgressRegionGroups. The selection is made in a single scan, using
+// reservoir sampling. nil is returned when no server entry matches.
+func (dataStore *DataStore) GetRandomServerEntry(region, protocol string) (*ServerEntry, error) {
+	dataStore.checkInit()
+	regions := getRegionGroupMembers(dataStore.config.EgressRegionGroups, region)
+	whereClause, whereParams := makeServerEntryWhereClause(regions, protocol, "", nil)
+	rows, err := dataStore.db.Query("select data from serverEntry"+whereClause, whereParams...)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	var selectedData []byte
+	count := 0
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		count += 1
+		if rand.Intn(count) == 0 {
+			selectedData = data
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
+	}
+	if selectedData == nil {
+		return nil, nil
+	}
+	serverEntry := new(ServerEntry)
+	err = dataStore.codec.Unmarshal(selectedData, serverEntry)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return MakeCompatibleServerEntry(serverEntry), nil
+}
+
+// GetReachableProtocols returns the tunnel protocols, in
+// SupportedTunnelProtocols order, for which at least one server entry in
+// the specified region is not disabled, accepts the client version, and is
+// valid. The region may be a group name in config.EgressRegionGroups. All
+// server entries in the region are scanned once.
+func (dataStore *DataStore) GetReachableProtocols(region string) ([]string, error) {
+	dataStore.checkInit()
+	regions := getRegionGroupMembers(dataStore.config.EgressRegionGroups, region)
+	whereClause, whereParams := makeServerEntryWhereClause(regions, "", "", nil)
+	rows, err := dataStore.db.Query(`
+        select id, data, coalesce(serverEntryDisable.disabledUntil, 0) from serverEntry
+        left join serverEntryDisable on serverEntryDisable.serverEntryId = serverEntry.id`+
+		whereClause, whereParams...)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	reachableProtocols := make(map[string]bool)
+	undecodable := make(undecodableServerEntries)
+	for rows.Next() {
+		var id string
+		var data []byte
+		var disabledUntilNano int64
+		err = rows.Scan(&id, &data, &disabledUntilNano)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		serverEntry := undecodable.decode(dataStore.codec, id, data)
+		if serverEntry == nil {
+			continue
+		}
+		var disabledUntil time.Time
+		if disabledUntilNano != 0 {
+			disabledUntil = time.Unix(0, disabledUntilNano)
+		}
+		if !isServerEntryReachable(dataStore.config, serverEntry, disabledUntil) {
+			continue
+		}
+		for _, protocol := range serverEntry.GetSupportedProtocols() {
+			reachableProtocols[protocol] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
+	}
+	rows.Close()
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+	return makeReachableProtocolList(reachableProtocols), nil
+}
+
+// readDataStoreFile opens the datastore file at path, read-only, and reads
+// its server entries and key-values. Server entries which can't be decoded
+// are skipped and counted in undecodable.
+func readDataStoreFile(path string) (
+	serverEntries []*ServerEntry, keyValues map[string]string, undecodable int, err error) {
+
+	db, err := sql.Open(
+		"sqlite3",
+		fmt.Sprintf("file:%s?cache=private&mode=ro", path))
+	if err != nil {
+		return nil, nil, 0, ContextError(err)
+	}
+	defer db.Close()
+
+	keyValues = make(map[string]string)
+	rows, err := db.Query("select key, value from keyValue;")
+	if err != nil {
+		return nil, nil, 0, ContextError(err)
+	}
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			rows.Close()
+			return nil, nil, 0, ContextError(err)
+		}
+		keyValues[key] = value
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, 0, ContextError(err)
+	}
+
+	var codecName string
+	err = db.QueryRow(
+		"select value from internalKeyValue where key = ?;",
+		DATA_STORE_SERVER_ENTRY_CODEC_KEY).Scan(&codecName)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, 0, ContextError(err)
+	}
+	codec, err := newServerEntryCodec(codecName)
+	if err != nil {
+		return nil, nil, 0, ContextError(err)
+	}
+
+	serverEntries = make([]*ServerEntry, 0)
+	rows, err = db.Query("select data from serverEntry;")
+	if err != nil {
+		return nil, nil, 0, ContextError(err)
+	}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			rows.Close()
+			return nil, nil, 0, ContextError(err)
+		}
+		serverEntry := new(ServerEntry)
+		err = codec.Unmarshal(data, serverEntry)
+		if err != nil {
+			undecodable += 1
+			continue
+		}
+		serverEntries = append(serverEntries, serverEntry)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, 0, ContextError(err)
+	}
+
+	return serverEntries, keyValues, undecodable, nil
+}
+
+// VerifyDataStoreIntegrity checks that every required table exists in the
+// live database. The returned report lists the number of rows in each
+// table, and flags each missing required table and each unexpected table.
+// The report is intended for diagnostics.
+func (dataStore *DataStore) VerifyDataStoreIntegrity() ([]string, error) {
+	dataStore.checkInit()
+
+	rows, err := dataStore.db.Query(`
+        select name from sqlite_master
+        where type = 'table' and name not like 'sqlite_%'
+        order by name;
+        `)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return nil, ContextError(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
+	}
+
+	report := make([]string, 0)
+	for _, table := range requiredTables {
+		if !Contains(tables, table) {
+			report = append(report, fmt.Sprintf("missing table: %s", table))
+		}
+	}
+	for _, table := range tables {
+		if !Contains(requiredTables, table) {
+			report = append(report, fmt.Sprintf("unexpected table: %s", table))
+		}
+		var count int
+		err = dataStore.db.QueryRow(
+			fmt.Sprintf("select count(*) from %s;", table)).Scan(&count)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		report = append(report, fmt.Sprintf("table %s: %d rows", table, count))
+	}
+	return report, nil
+}
+
+// ReportAvailableRegions prints a notice with the available egress regions
+// and, when the regions have changed, invokes OnAvailableEgressRegionsChanged.
+func (dataStore *DataStore) ReportAvailableRegions() {
+	dataStore.checkInit()
+
+	// TODO: For consistency, regions-per-protocol should be used
+
+	rows, err := dataStore.db.Query("select distinct(region) from serverEntry;")
+	if err != nil {
+		NoticeAlert("failed to query data store for available regions: %s", ContextError(err))
+		return
+	}
+	defer rows.Close()
+
+	var regions []string
+
+	for rows.Next() {
+		var region string
+		err = rows.Scan(&region)
+		if err != nil {
+			NoticeAlert("failed to retrieve available regions from data store: %s", ContextError(err))
+			return
+		}
+
+		// Some server entries do not have a region, but it makes no sense to return
+		// an empty string as an "available region".
+		if region != "" {
+			regions = append(regions, region)
+		}
+	}
+
+	dataStore.reportAvailableRegions(regions)
+}
+
+// SuggestEgressRegion returns the region with the most stored server
+// entries, which may be used as a default egress region. Server entries
+// without a region are ignored. A blank region is returned when there are
+// no server entries with a region.
+func (dataStore *DataStore) SuggestEgressRegion() (string, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query(
+		"select region, count(*) from serverEntry where region != '' group by region;")
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer rows.Close()
+	regionCounts := make(map[string]int)
+	for rows.Next() {
+		var region string
+		var count int
+		err = rows.Scan(&region, &count)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		regionCounts[region] = count
+	}
+	if err = rows.Err(); err != nil {
+		return "", ContextError(err)
+	}
+	return selectEgressRegion(regionCounts), nil
+}
+
+// GetServerEntryIpAddresses returns an array containing
+// all stored server IP addresses.
+func (dataStore *DataStore) GetServerEntryIpAddresses() (ipAddresses []string, err error) {
+	dataStore.checkInit()
+	ipAddresses = make([]string, 0)
+	rows, err := dataStore.db.Query("select id from serverEntry;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ipAddress string
+		err = rows.Scan(&ipAddress)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		ipAddresses = append(ipAddresses, ipAddress)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
+	}
+	return ipAddresses, nil
+}
+
+// getRankedServerEntryIpAddresses returns the IP addresses of the stored
+// server entries, with the top ranked server entry first.
+func (dataStore *DataStore) getRankedServerEntryIpAddresses() (ipAddresses []string, err error) {
+	dataStore.checkInit()
+	ipAddresses = make([]string, 0)
+	rows, err := dataStore.db.Query("select id from serverEntry order by rank desc;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ipAddress string
+		err = rows.Scan(&ipAddress)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		ipAddresses = append(ipAddresses, ipAddress)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ContextError(err)
+	}
+	return ipAddresses, nil
+}
+
+// RecordServerEntryAttempt increments the count of tunnel establishment
+// attempts made to the specified server.
+func (dataStore *DataStore) RecordServerEntryAttempt(ipAddress string) error {
+	dataStore.recordOperation("RecordServerEntryAttempt", ipAddress)
+	return dataStore.incrementServerEntryStat(ipAddress, "attempts")
+}
+
+// RecordServerEntryFailure increments the count of failed tunnel
+// establishment attempts made to the specified server. When
+// config.ServerEntryFailureThreshold is set and the count of consecutive
+// failures reaches it, the server is disabled for a period that doubles
+// with each additional failure. When config.ServerEntryFailureHalfLifeSeconds
+// is set, the existing failure counts are decayed before being incremented.
+func (dataStore *DataStore) RecordServerEntryFailure(ipAddress string) error {
+	dataStore.recordOperation("RecordServerEntryFailure", ipAddress)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or ignore into serverEntryStats (serverEntryId)
+            values (?);
+            `, ipAddress)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		_, err = transaction.Exec(`
+            insert or ignore into serverEntryDisable (serverEntryId)
+            values (?);
+            `, ipAddress)
+		if err != nil {
+			return err
+		}
+		var failures, consecutiveFailures int
+		var lastFailureNano int64
+		err = transaction.QueryRow(`
+            select serverEntryStats.failures,
+                   serverEntryDisable.consecutiveFailures,
+                   coalesce(serverEntryLastFailure.lastFailure, 0)
+            from serverEntryStats
+            join serverEntryDisable
+                on serverEntryDisable.serverEntryId = serverEntryStats.serverEntryId
+            left join serverEntryLastFailure
+                on serverEntryLastFailure.serverEntryId = serverEntryStats.serverEntryId
+            where serverEntryStats.serverEntryId = ?;
+            `, ipAddress).Scan(&failures, &consecutiveFailures, &lastFailureNano)
+		if err != nil {
+			return err
+		}
+		var lastFailure time.Time
+		if lastFailureNano != 0 {
+			lastFailure = time.Unix(0, lastFailureNano)
+		}
+		failures = decayServerEntryFailures(dataStore.config, failures, lastFailure) + 1
+		consecutiveFailures = decayServerEntryFailures(
+			dataStore.config, consecutiveFailures, lastFailure) + 1
+		_, err = transaction.Exec(`
+            update serverEntryStats set failures = ?
+            where serverEntryId = ?;
+            `, failures, ipAddress)
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(`
+            update serverEntryDisable set consecutiveFailures = ?
+            where serverEntryId = ?;
+            `, consecutiveFailures, ipAddress)
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(`
+            insert or replace into serverEntryLastFailure (serverEntryId, lastFailure)
+            values (?, ?);
+            `, ipAddress, serverEntryFailureClock().UnixNano())
+		if err != nil {
+			return err
+		}
+		disablePeriod := getServerEntryDisablePeriod(
+			consecutiveFailures, dataStore.config.ServerEntryFailureThreshold)
+		if disablePeriod == 0 {
+			return nil
+		}
+		_, err = transaction.Exec(`
+            update serverEntryDisable set disabledUntil = ?
+            where serverEntryId = ?;
+            `, time.Now().Add(disablePeriod).UnixNano(), ipAddress)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// RecordServerEntrySuccess resets the count of consecutive failed tunnel
+// establishment attempts made to the specified server and re-enables the
+// server if it was disabled.
+func (dataStore *DataStore) RecordServerEntrySuccess(ipAddress string) error {
+	dataStore.recordOperation("RecordServerEntrySuccess", ipAddress)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            delete from serverEntryDisable where serverEntryId = ?;
+            `, ipAddress)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		return nil
+	})
+}
+
+// SetServerEntryDisabledUntil disables the specified server until the
+// given time. ServerEntryIterator skips disabled servers. A zero time
+// re-enables the server.
+func (dataStore *DataStore) SetServerEntryDisabledUntil(ipAddress string, disabledUntil time.Time) error {
+	dataStore.recordOperation("SetServerEntryDisabledUntil", ipAddress)
+	var disabledUntilNano int64
+	if !disabledUntil.IsZero() {
+		disabledUntilNano = disabledUntil.UnixNano()
+	}
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or ignore into serverEntryDisable (serverEntryId)
+            values (?);
+            `, ipAddress)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		_, err = transaction.Exec(`
+            update serverEntryDisable set disabledUntil = ?
+            where serverEntryId = ?;
+            `, disabledUntilNano, ipAddress)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// DisableRegion disables all stored servers in the specified region until
+// the given time. The servers are updated in a single transaction.
+// ServerEntryIterator skips disabled servers.
+func (dataStore *DataStore) DisableRegion(region string, disabledUntil time.Time) error {
+	dataStore.recordOperation("DisableRegion", region)
+	return dataStore.setRegionDisabledUntil(region, disabledUntil.UnixNano())
+}
+
+// ClearRegionDisable re-enables all stored servers in the specified region,
+// including servers disabled individually.
+func (dataStore *DataStore) ClearRegionDisable(region string) error {
+	dataStore.recordOperation("ClearRegionDisable", region)
+	return dataStore.setRegionDisabledUntil(region, 0)
+}
+
+func (dataStore *DataStore) setRegionDisabledUntil(region string, disabledUntilNano int64) error {
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		// The region subqueries use idx_serverEntry_region.
+		_, err := transaction.Exec(`
+            insert or ignore into serverEntryDisable (serverEntryId)
+            select id from serverEntry where region = ?;
+            `, region)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		_, err = transaction.Exec(`
+            update serverEntryDisable set disabledUntil = ?
+            where serverEntryId in (select id from serverEntry where region = ?);
+            `, disabledUntilNano, region)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
-// ReportAvailableRegions prints a notice with the available egress regions.
-func ReportAvailableRegions() {
-	checkInitDataStore()
-
-	// TODO: For consistency, regions-per-protocol should be used
-
-	rows, err := singleton.db.Query("select distinct(region) from serverEntry;")
+// GetServerEntryDisabledUntil returns the time until which the specified
+// server is disabled. A zero time is returned when the server has not
+// been disabled.
+func (dataStore *DataStore) GetServerEntryDisabledUntil(ipAddress string) (time.Time, error) {
+	dataStore.checkInit()
+	var disabledUntilNano int64
+	err := dataStore.db.QueryRow(
+		"select disabledUntil from serverEntryDisable where serverEntryId = ?;",
+		ipAddress).Scan(&disabledUntilNano)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
 	if err != nil {
-		NoticeAlert("failed to query data store for available regions: %s", ContextError(err))
-		return
+		return time.Time{}, ContextError(err)
 	}
-	defer rows.Close()
-
-	var regions []string
+	if disabledUntilNano == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, disabledUntilNano), nil
+}
 
-	for rows.Next() {
-		var region string
-		err = rows.Scan(&region)
+func (dataStore *DataStore) incrementServerEntryStat(ipAddress, column string) error {
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or ignore into serverEntryStats (serverEntryId)
+            values (?);
+            `, ipAddress)
 		if err != nil {
-			NoticeAlert("failed to retrieve available regions from data store: %s", ContextError(err))
-			return
+			// Note: ContextError() would break canRetry()
+			return err
 		}
-
-		// Some server entries do not have a region, but it makes no sense to return
-		// an empty string as an "available region".
-		if region != "" {
-			regions = append(regions, region)
+		_, err = transaction.Exec(fmt.Sprintf(`
+            update serverEntryStats set %s = %s + 1
+            where serverEntryId = ?;
+            `, column, column), ipAddress)
+		if err != nil {
+			return err
 		}
-	}
+		return nil
+	})
+}
 
-	NoticeAvailableEgressRegions(regions)
+// GetServerEntrySuccessRatio returns the fraction of recorded tunnel
+// establishment attempts to the specified server which did not fail.
+// The failure count is decayed; see config.ServerEntryFailureHalfLifeSeconds.
+// An error is returned when no attempts have been recorded.
+func (dataStore *DataStore) GetServerEntrySuccessRatio(ipAddress string) (float64, error) {
+	dataStore.checkInit()
+	var attempts, failures int
+	var lastFailureNano int64
+	rows := dataStore.db.QueryRow(`
+        select attempts, failures, coalesce(serverEntryLastFailure.lastFailure, 0)
+        from serverEntryStats left join serverEntryLastFailure
+            on serverEntryLastFailure.serverEntryId = serverEntryStats.serverEntryId
+        where serverEntryStats.serverEntryId = ?;
+        `, ipAddress)
+	err := rows.Scan(&attempts, &failures, &lastFailureNano)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, ContextError(err)
+	}
+	if lastFailureNano != 0 {
+		failures = decayServerEntryFailures(
+			dataStore.config, failures, time.Unix(0, lastFailureNano))
+	}
+	if attempts == 0 {
+		return 0, ContextError(fmt.Errorf("no attempts recorded for server %s", ipAddress))
+	}
+	if failures > attempts {
+		failures = attempts
+	}
+	return float64(attempts-failures) / float64(attempts), nil
 }
 
-// GetServerEntryIpAddresses returns an array containing
-// all stored server IP addresses.
-func GetServerEntryIpAddresses() (ipAddresses []string, err error) {
-	checkInitDataStore()
-	ipAddresses = make([]string, 0)
-	rows, err := singleton.db.Query("select id from serverEntry;")
+// DumpDiagnostics returns a JSON report of the stored server
+// entries, for attaching to bug reports. Only non-secret server entry
+// fields are included, along with ranks and attempt/failure counts.
+// When indent is set, the JSON is indented for readability; otherwise
+// the JSON is compact.
+func (dataStore *DataStore) DumpDiagnostics(indent bool) ([]byte, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query(`
+        select serverEntry.id, serverEntry.data,
+               coalesce(serverEntryStats.attempts, 0),
+               coalesce(serverEntryStats.failures, 0),
+               coalesce(serverEntryLastFailure.lastFailure, 0)
+        from serverEntry left join serverEntryStats
+            on serverEntryStats.serverEntryId = serverEntry.id
+        left join serverEntryLastFailure
+            on serverEntryLastFailure.serverEntryId = serverEntry.id
+        order by serverEntry.rank desc;
+        `)
 	if err != nil {
 		return nil, ContextError(err)
 	}
 	defer rows.Close()
-	for rows.Next() {
-		var ipAddress string
-		err = rows.Scan(&ipAddress)
+	diagnostics := newDataStoreDiagnostics()
+	undecodable := make(undecodableServerEntries)
+	for rank := 0; rows.Next(); rank++ {
+		var id string
+		var data []byte
+		var attempts, failures int
+		var lastFailureNano int64
+		err = rows.Scan(&id, &data, &attempts, &failures, &lastFailureNano)
 		if err != nil {
 			return nil, ContextError(err)
 		}
-		ipAddresses = append(ipAddresses, ipAddress)
+		if lastFailureNano != 0 {
+			failures = decayServerEntryFailures(
+				dataStore.config, failures, time.Unix(0, lastFailureNano))
+		}
+		serverEntry := undecodable.decode(dataStore.codec, id, data)
+		if serverEntry == nil {
+			continue
+		}
+		diagnostics.addServerEntry(serverEntry, rank, attempts, failures)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, ContextError(err)
 	}
-	return ipAddresses, nil
+	rows.Close()
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+	return diagnostics.marshal(indent)
+}
+
+// GetDataStoreStats returns counts of the stored records and the size of
+// the datastore file. The counts are computed in a single query.
+func (dataStore *DataStore) GetDataStoreStats() (*DataStoreStats, error) {
+	dataStore.checkInit()
+	stats := new(DataStoreStats)
+	err := dataStore.db.QueryRow(`
+        select (select count(*) from serverEntry),
+               (select count(distinct region) from serverEntry where region != ''),
+               (select count(*) from splitTunnelRoutes),
+               (select count(*) from urlETags),
+               (select count(*) from keyValue);
+        `).Scan(
+		&stats.ServerEntryCount,
+		&stats.RegionCount,
+		&stats.SplitTunnelRegionCount,
+		&stats.UrlETagCount,
+		&stats.KeyValueCount)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	stats.RankedServerEntryCount = stats.ServerEntryCount
+	stats.FileSize, _, err = dataStore.getSize()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return stats, nil
 }
 
 // SetSplitTunnelRoutes updates the cached routes data for
 // the given region. The associated etag is also stored and
 // used to make efficient web requests for updates to the data.
-func SetSplitTunnelRoutes(region, etag string, data []byte) error {
-	return transactionWithRetry(func(transaction *sql.Tx) error {
+func (dataStore *DataStore) SetSplitTunnelRoutes(region, etag string, data []byte) error {
+	dataStore.recordOperation("SetSplitTunnelRoutes", region)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
 		_, err := transaction.Exec(`
             insert or replace into splitTunnelRoutes (region, etag, data)
             values (?, ?, ?);
@@ -604,9 +2783,9 @@ func SetSplitTunnelRoutes(region, etag string, data []byte) error {
 
 // GetSplitTunnelRoutesETag retrieves the etag for cached routes
 // data for the specified region. If not found, it returns an empty string value.
-func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
-	checkInitDataStore()
-	rows := singleton.db.QueryRow("select etag from splitTunnelRoutes where region = ?;", region)
+func (dataStore *DataStore) GetSplitTunnelRoutesETag(region string) (etag string, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow("select etag from splitTunnelRoutes where region = ?;", region)
 	err = rows.Scan(&etag)
 	if err == sql.ErrNoRows {
 		return "", nil
@@ -619,9 +2798,9 @@ func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
 
 // GetSplitTunnelRoutesData retrieves the cached routes data
 // for the specified region. If not found, it returns a nil value.
-func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
-	checkInitDataStore()
-	rows := singleton.db.QueryRow("select data from splitTunnelRoutes where region = ?;", region)
+func (dataStore *DataStore) GetSplitTunnelRoutesData(region string) (data []byte, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow("select data from splitTunnelRoutes where region = ?;", region)
 	err = rows.Scan(&data)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -635,8 +2814,9 @@ func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
 // SetUrlETag stores an ETag for the specfied URL.
 // Note: input URL is treated as a string, and is not
 // encoded or decoded or otherwise canonicalized.
-func SetUrlETag(url, etag string) error {
-	return transactionWithRetry(func(transaction *sql.Tx) error {
+func (dataStore *DataStore) SetUrlETag(url, etag string) error {
+	dataStore.recordOperation("SetUrlETag", url)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
 		_, err := transaction.Exec(`
             insert or replace into urlETags (url, etag)
             values (?, ?);
@@ -645,15 +2825,22 @@ func SetUrlETag(url, etag string) error {
 			// Note: ContextError() would break canRetry()
 			return err
 		}
+		_, err = transaction.Exec(`
+            insert or replace into urlETagTimestamps (url, stored)
+            values (?, ?);
+            `, url, urlETagClock().UnixNano())
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 }
 
 // GetUrlETag retrieves a previously stored an ETag for the
 // specfied URL. If not found, it returns an empty string value.
-func GetUrlETag(url string) (etag string, err error) {
-	checkInitDataStore()
-	rows := singleton.db.QueryRow("select etag from urlETags where url = ?;", url)
+func (dataStore *DataStore) GetUrlETag(url string) (etag string, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow("select etag from urlETags where url = ?;", url)
 	err = rows.Scan(&etag)
 	if err == sql.ErrNoRows {
 		return "", nil
@@ -664,9 +2851,84 @@ func GetUrlETag(url string) (etag string, err error) {
 	return etag, nil
 }
 
+// pruneUrlETags deletes URL ETags stored before the specified time, along
+// with ETags which have no stored timestamp. The number of deleted ETags is
+// returned.
+func (dataStore *DataStore) pruneUrlETags(before time.Time) (int, error) {
+	var count int64
+	err := dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		result, err := transaction.Exec(`
+            delete from urlETags where url not in
+                (select url from urlETagTimestamps where stored >= ?);
+            `, before.UnixNano())
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		count, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		_, err = transaction.Exec(`
+            delete from urlETagTimestamps where url not in
+                (select url from urlETags);
+            `)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// storeResolvedHost stores the resolved host data, and deletes resolved
+// hosts which expire at or before now.
+func (dataStore *DataStore) storeResolvedHost(host string, data []byte, expiry, now time.Time) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetResolvedHost", host)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(
+			"delete from resolvedHost where expiry <= ?;", now.UnixNano())
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		if !expiry.After(now) {
+			return nil
+		}
+		_, err = transaction.Exec(`
+            insert or replace into resolvedHost (host, expiry, data)
+            values (?, ?, ?);
+            `, host, expiry.UnixNano(), data)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// getResolvedHost retrieves the resolved host data. If not found, it
+// returns nil.
+func (dataStore *DataStore) getResolvedHost(host string) (data []byte, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow("select data from resolvedHost where host = ?;", host)
+	err = rows.Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return data, nil
+}
+
 // SetKeyValue stores a key/value pair.
-func SetKeyValue(key, value string) error {
-	return transactionWithRetry(func(transaction *sql.Tx) error {
+func (dataStore *DataStore) SetKeyValue(key, value string) error {
+	dataStore.recordOperation("SetKeyValue", key)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
 		_, err := transaction.Exec(`
             insert or replace into keyValue (key, value)
             values (?, ?);
@@ -681,9 +2943,41 @@ func SetKeyValue(key, value string) error {
 
 // GetKeyValue retrieves the value for a given key. If not found,
 // it returns an empty string value.
-func GetKeyValue(key string) (value string, err error) {
-	checkInitDataStore()
-	rows := singleton.db.QueryRow("select value from keyValue where key = ?;", key)
+func (dataStore *DataStore) GetKeyValue(key string) (value string, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow("select value from keyValue where key = ?;", key)
+	err = rows.Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return value, nil
+}
+
+// setInternalKeyValue stores a key/value pair used for datastore
+// bookkeeping. Internal key-values are stored separately from the
+// key-values set with SetKeyValue, and aren't recorded in the operation
+// log.
+func (dataStore *DataStore) setInternalKeyValue(key, value string) error {
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or replace into internalKeyValue (key, value)
+            values (?, ?);
+            `, key, value)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		return nil
+	})
+}
+
+// getInternalKeyValue retrieves the value for a given internal key. If not
+// found, it returns an empty string value.
+func (dataStore *DataStore) getInternalKeyValue(key string) (value string, err error) {
+	rows := dataStore.db.QueryRow("select value from internalKeyValue where key = ?;", key)
 	err = rows.Scan(&value)
 	if err == sql.ErrNoRows {
 		return "", nil
@@ -693,3 +2987,251 @@ func GetKeyValue(key string) (value string, err error) {
 	}
 	return value, nil
 }
+
+// SetAppMetadata stores a metadata value for the embedding app. App
+// metadata is stored separately from the internal key-values, and values
+// may be binary.
+func (dataStore *DataStore) SetAppMetadata(key string, value []byte) error {
+	dataStore.recordOperation("SetAppMetadata", key)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or replace into appMetadata (key, value)
+            values (?, ?);
+            `, key, value)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		return nil
+	})
+}
+
+// GetAppMetadata retrieves the app metadata value for a given key. If not
+// found, it returns a nil value.
+func (dataStore *DataStore) GetAppMetadata(key string) (value []byte, err error) {
+	dataStore.checkInit()
+	rows := dataStore.db.QueryRow("select value from appMetadata where key = ?;", key)
+	err = rows.Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return value, nil
+}
+
+// AddRegionTransferStats adds bytes transferred to the persistent total
+// for the specified client region.
+func (dataStore *DataStore) AddRegionTransferStats(region string, bytesTransferred int64) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("AddRegionTransferStats", region)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or ignore into regionTransferStats (region, bytes)
+            values (?, 0);
+            `, region)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		_, err = transaction.Exec(`
+            update regionTransferStats set bytes = bytes + ? where region = ?;
+            `, bytesTransferred, region)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// GetRegionTransferStats returns the persistent bytes transferred totals,
+// keyed by client region.
+func (dataStore *DataStore) GetRegionTransferStats() (map[string]int64, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query("select region, bytes from regionTransferStats;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	regionTransferStats := make(map[string]int64)
+	for rows.Next() {
+		var region string
+		var bytesTransferred int64
+		err = rows.Scan(&region, &bytesTransferred)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		regionTransferStats[region] = bytesTransferred
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return regionTransferStats, nil
+}
+
+// RecordSuccessfulProtocol increments the persistent count of tunnels
+// successfully established using the specified tunnel protocol. When
+// config.MaxProtocolSuccessCount is exceeded, all counts are halved.
+func (dataStore *DataStore) RecordSuccessfulProtocol(protocol string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("RecordSuccessfulProtocol", protocol)
+	return dataStore.transactionWithRetry(func(transaction *sql.Tx) error {
+		_, err := transaction.Exec(`
+            insert or ignore into protocolSuccessStats (protocol, count)
+            values (?, 0);
+            `, protocol)
+		if err != nil {
+			// Note: ContextError() would break canRetry()
+			return err
+		}
+		_, err = transaction.Exec(`
+            update protocolSuccessStats set count = count + 1 where protocol = ?;
+            `, protocol)
+		if err != nil {
+			return err
+		}
+		if dataStore.config.MaxProtocolSuccessCount > 0 {
+			_, err = transaction.Exec(`
+                update protocolSuccessStats set count = count / 2
+                where (select max(count) from protocolSuccessStats) > ?;
+                `, dataStore.config.MaxProtocolSuccessCount)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetProtocolSuccessDistribution returns the persistent counts of tunnels
+// successfully established, keyed by tunnel protocol.
+func (dataStore *DataStore) GetProtocolSuccessDistribution() (map[string]int, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query("select protocol, count from protocolSuccessStats;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	distribution := make(map[string]int)
+	for rows.Next() {
+		var protocol string
+		var count int
+		err = rows.Scan(&protocol, &count)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		distribution[protocol] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return distribution, nil
+}
+
+// AuditServerEntries scans all stored server entries and reports those
+// which advertise a capability without the fields required to use it.
+// See AuditServerEntry.
+func (dataStore *DataStore) AuditServerEntries() ([]ServerEntryAuditIssue, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query("select data from serverEntry;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	issues := make([]ServerEntryAuditIssue, 0)
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		serverEntry := new(ServerEntry)
+		err = dataStore.codec.Unmarshal(data, serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		issues = append(issues, AuditServerEntry(MakeCompatibleServerEntry(serverEntry))...)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return issues, nil
+}
+
+// GetAvailableCapabilities returns the sorted union of the capabilities of
+// all stored server entries.
+func (dataStore *DataStore) GetAvailableCapabilities() ([]string, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query("select data from serverEntry;")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer rows.Close()
+	capabilities := make(map[string]bool)
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		serverEntry := new(ServerEntry)
+		err = dataStore.codec.Unmarshal(data, serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		for _, capability := range serverEntry.Capabilities {
+			capabilities[capability] = true
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	capabilityList := make([]string, 0, len(capabilities))
+	for capability, _ := range capabilities {
+		capabilityList = append(capabilityList, capability)
+	}
+	sort.Strings(capabilityList)
+	return capabilityList, nil
+}
+
+// ExportRankedServerEntries returns the count highest ranked server
+// entries, in rank order, in the list encoding used by remote server lists.
+func (dataStore *DataStore) ExportRankedServerEntries(count int) (string, error) {
+	dataStore.checkInit()
+	rows, err := dataStore.db.Query(
+		"select id, data from serverEntry order by rank desc limit ?;", count)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer rows.Close()
+	serverEntries := make([]*ServerEntry, 0)
+	undecodable := make(undecodableServerEntries)
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		serverEntry := undecodable.decode(dataStore.codec, id, data)
+		if serverEntry == nil {
+			continue
+		}
+		serverEntries = append(serverEntries, serverEntry)
+	}
+	if err = rows.Err(); err != nil {
+		return "", ContextError(err)
+	}
+	rows.Close()
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+	encodedServerEntryList, err := encodeServerEntryList(serverEntries)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return encodedServerEntryList, nil
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// acceptServerEntry reports whether the datastore accepts the server entry
+// for storage. Server entries outside of config.AllowedRegions, or with a
+// web server certificate not matching config.ExpectedWebCertFingerprints,
+// aren't accepted, and a notice is emitted. This is called by the
+// StoreServerEntry implementations, which skip server entries that aren't
+// accepted.
+func (dataStore *DataStore) acceptServerEntry(serverEntry *ServerEntry) bool {
+	allowedRegions := dataStore.config.AllowedRegions
+	if len(allowedRegions) > 0 && !Contains(allowedRegions, serverEntry.Region) {
+		NoticeInfo("skipped server %s in region %s", redactServerAddress(serverEntry.IpAddress), serverEntry.Region)
+		return false
+	}
+
+	err := VerifyWebServerCertificateFingerprint(
+		serverEntry, dataStore.config.ExpectedWebCertFingerprints)
+	if err != nil {
+		NoticeAlert("rejected server %s: %s", redactServerAddress(serverEntry.IpAddress), err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+)
+
+// SharedCandidatePool coordinates handing out server entry candidates to a
+// pool of concurrent establishment workers. It wraps a ServerEntryIterator
+// and guarantees that no candidate is handed out while it's already in use
+// by another worker, and that candidates already attempted in this run are
+// not handed out again ahead of candidates not yet attempted, even after a
+// Reset restarts the underlying iterator. So, for a pool of size N, the
+// first N candidates are distinct and cover the head of the ranking.
+//
+// Candidates which fail are recycled: they're queued behind all remaining
+// fresh candidates and handed out again, in the order in which they were
+// returned, once the iterator is exhausted.
+type SharedCandidatePool struct {
+	mutex     sync.Mutex
+	iterator  *ServerEntryIterator
+	exhausted bool
+	inUse     map[string]bool
+	attempted map[string]bool
+	recycled  []*ServerEntry
+}
+
+// NewSharedCandidatePool creates a new SharedCandidatePool over the
+// candidates selected by config, as with NewServerEntryIterator.
+func (dataStore *DataStore) NewSharedCandidatePool(config *Config) (*SharedCandidatePool, error) {
+	iterator, err := dataStore.NewServerEntryIterator(config)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return &SharedCandidatePool{
+		iterator:  iterator,
+		inUse:     make(map[string]bool),
+		attempted: make(map[string]bool),
+	}, nil
+}
+
+// Next returns the next candidate to hand out: the next fresh candidate
+// from the iterator or, once the iterator is exhausted, the least recently
+// failed recycled candidate. Returns nil with no error when there is no
+// candidate available; all remaining candidates may be in use. Each
+// candidate handed out must be passed to Return once its attempt completes.
+func (pool *SharedCandidatePool) Next() (*ServerEntry, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for !pool.exhausted {
+		serverEntry, err := pool.iterator.Next()
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if serverEntry == nil {
+			pool.exhausted = true
+			break
+		}
+		if pool.inUse[serverEntry.IpAddress] || pool.attempted[serverEntry.IpAddress] {
+			continue
+		}
+		pool.inUse[serverEntry.IpAddress] = true
+		return serverEntry, nil
+	}
+
+	if len(pool.recycled) > 0 {
+		serverEntry := pool.recycled[0]
+		pool.recycled = pool.recycled[1:]
+		pool.inUse[serverEntry.IpAddress] = true
+		return serverEntry, nil
+	}
+
+	return nil, nil
+}
+
+// Return records the outcome of an attempt with a candidate handed out by
+// Next. A failed candidate is recycled. A successful candidate isn't handed
+// out again.
+func (pool *SharedCandidatePool) Return(serverEntry *ServerEntry, success bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if !pool.inUse[serverEntry.IpAddress] {
+		return
+	}
+	delete(pool.inUse, serverEntry.IpAddress)
+	pool.attempted[serverEntry.IpAddress] = true
+	if !success {
+		pool.recycled = append(pool.recycled, serverEntry)
+	}
+}
+
+// Reset restarts the underlying iterator, picking up any newly stored
+// server entries. Candidates in use, attempted, or recycled remain so.
+func (pool *SharedCandidatePool) Reset() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	err := pool.iterator.Reset()
+	if err != nil {
+		return ContextError(err)
+	}
+	pool.exhausted = false
+	return nil
+}
+
+// Close cleans up resources associated with the pool.
+func (pool *SharedCandidatePool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.iterator.Close()
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// GetCandidateServerEntries returns up to limit server entries, in the order
+// in which a ServerEntryIterator created with the same config would yield
+// them, honoring its filters, ranking, and shuffling. This allows callers to
+// implement their own establishment strategy, such as parallel dialing. When
+// limit is 0, all candidates are returned.
+func (dataStore *DataStore) GetCandidateServerEntries(config *Config, limit int) ([]*ServerEntry, error) {
+	iterator, err := dataStore.NewServerEntryIterator(config)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer iterator.Close()
+
+	serverEntries := make([]*ServerEntry, 0)
+	for limit <= 0 || len(serverEntries) < limit {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		serverEntries = append(serverEntries, serverEntry)
+	}
+	return serverEntries, nil
+}
+
+// makeServerEntryIdSet returns a set containing the specified server
+// entry IDs.
+func makeServerEntryIdSet(serverEntryIds []string) map[string]bool {
+	serverEntryIdSet := make(map[string]bool)
+	for _, serverEntryId := range serverEntryIds {
+		serverEntryIdSet[serverEntryId] = true
+	}
+	return serverEntryIdSet
+}
+
+// shuffleCandidateServerEntryIds applies the Psiphon server candidate
+// selection algorithm to a list of server entry IDs in rank order: the
+// first headLength IDs are left in rank order, to favor previously
+// successful servers; then the remaining long tail is shuffled to raise up
+// less recent candidates. The shuffle uses math/rand, so the candidate
+// order is the same in every datastore backend for a fixed seed.
+//
+// When latencies is not nil, the tail is then ordered by ascending latency.
+// As the sort is stable, server entries without a recorded latency remain
+// shuffled.
+func shuffleCandidateServerEntryIds(
+	serverEntryIds []string, headLength int, latencies map[string]time.Duration) {
+
+	for i := len(serverEntryIds) - 1; i > headLength-1; i-- {
+		j := rand.Intn(i)
+		serverEntryIds[i], serverEntryIds[j] = serverEntryIds[j], serverEntryIds[i]
+	}
+
+	if latencies != nil && len(serverEntryIds) > headLength {
+		sort.Stable(&serverEntryIdsByLatency{
+			serverEntryIds: serverEntryIds[headLength:],
+			latencies:      latencies,
+		})
+	}
+}
+
+// serverEntryIdsByLatency sorts server entry IDs in ascending latency
+// order. Server entries without a latency sort after those with a latency.
+type serverEntryIdsByLatency struct {
+	serverEntryIds []string
+	latencies      map[string]time.Duration
+}
+
+func (s *serverEntryIdsByLatency) Len() int {
+	return len(s.serverEntryIds)
+}
+
+func (s *serverEntryIdsByLatency) Less(i, j int) bool {
+	latencyI, okI := s.latencies[s.serverEntryIds[i]]
+	latencyJ, okJ := s.latencies[s.serverEntryIds[j]]
+	if !okI || !okJ {
+		return okI && !okJ
+	}
+	return latencyI < latencyJ
+}
+
+func (s *serverEntryIdsByLatency) Swap(i, j int) {
+	s.serverEntryIds[i], s.serverEntryIds[j] = s.serverEntryIds[j], s.serverEntryIds[i]
+}
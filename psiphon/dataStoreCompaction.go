@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+)
+
+// dataStoreCompactionScheduler periodically checks the size of the datastore
+// and compacts it when either the free space in the file or the fraction of
+// the file which is free space exceeds a threshold. This type is shared by
+// both dataStore implementations, which supply the size source, the
+// compaction function and, where compaction is deferred, a check for a
+// pending compaction.
+type dataStoreCompactionScheduler struct {
+	checkPeriod            time.Duration
+	freeSizeThreshold      int64
+	fragmentationThreshold float64
+	getSize                func() (size, freeSize int64, err error)
+	isPending              func() (bool, error)
+	compact                func() error
+	stopOnce               sync.Once
+	stopBroadcast          chan struct{}
+	waitGroup              *sync.WaitGroup
+}
+
+// newDataStoreCompactionScheduler creates a scheduler. isPending may be nil
+// when compaction is performed immediately.
+func newDataStoreCompactionScheduler(
+	getSize func() (size, freeSize int64, err error),
+	isPending func() (bool, error),
+	compact func() error) *dataStoreCompactionScheduler {
+
+	return &dataStoreCompactionScheduler{
+		checkPeriod:            DATA_STORE_COMPACTION_CHECK_PERIOD,
+		freeSizeThreshold:      DATA_STORE_COMPACTION_FREE_SIZE_THRESHOLD,
+		fragmentationThreshold: DATA_STORE_COMPACTION_FRAGMENTATION_THRESHOLD,
+		getSize:                getSize,
+		isPending:              isPending,
+		compact:                compact,
+		stopBroadcast:          make(chan struct{}),
+		waitGroup:              new(sync.WaitGroup),
+	}
+}
+
+// start launches the periodic check goroutine.
+func (scheduler *dataStoreCompactionScheduler) start() {
+	scheduler.waitGroup.Add(1)
+	go scheduler.run()
+}
+
+// stop halts the periodic check goroutine and waits for it to exit.
+// Supports multiple calls to stop().
+func (scheduler *dataStoreCompactionScheduler) stop() {
+	scheduler.stopOnce.Do(func() {
+		close(scheduler.stopBroadcast)
+	})
+	scheduler.waitGroup.Wait()
+}
+
+func (scheduler *dataStoreCompactionScheduler) run() {
+	defer scheduler.waitGroup.Done()
+
+	ticker := time.NewTicker(scheduler.checkPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := scheduler.checkAndCompact()
+			if err != nil {
+				NoticeAlert("datastore compaction failed: %s", err)
+			}
+		case <-scheduler.stopBroadcast:
+			return
+		}
+	}
+}
+
+// shouldCompact applies the free size and fragmentation thresholds. The
+// thresholds apply to free space, as a large datastore which is mostly in
+// use gains little from compaction.
+func (scheduler *dataStoreCompactionScheduler) shouldCompact(size, freeSize int64) bool {
+	if size <= 0 {
+		return false
+	}
+	return freeSize >= scheduler.freeSizeThreshold ||
+		float64(freeSize)/float64(size) >= scheduler.fragmentationThreshold
+}
+
+// checkAndCompact compacts the datastore when a threshold is exceeded. No
+// check is made while a deferred compaction is pending, as the datastore
+// size doesn't change until the compaction is performed. The return value
+// indicates whether compaction was performed.
+func (scheduler *dataStoreCompactionScheduler) checkAndCompact() (bool, error) {
+	if scheduler.isPending != nil {
+		isPending, err := scheduler.isPending()
+		if err != nil {
+			return false, ContextError(err)
+		}
+		if isPending {
+			return false, nil
+		}
+	}
+	size, freeSize, err := scheduler.getSize()
+	if err != nil {
+		return false, ContextError(err)
+	}
+	if !scheduler.shouldCompact(size, freeSize) {
+		return false, nil
+	}
+	NoticeInfo("compacting datastore: size %d bytes, free %d bytes", size, freeSize)
+	err = scheduler.compact()
+	if err != nil {
+		return false, ContextError(err)
+	}
+	return true, nil
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDataStoreSizeSource is a fake datastore size source and compaction
+// function for driving dataStoreCompactionScheduler.
+type testDataStoreSizeSource struct {
+	mutex        sync.Mutex
+	size         int64
+	freeSize     int64
+	err          error
+	compactCount int
+}
+
+func (source *testDataStoreSizeSource) getSize() (int64, int64, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	return source.size, source.freeSize, source.err
+}
+
+func (source *testDataStoreSizeSource) compact() error {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.compactCount += 1
+	source.freeSize = 0
+	return nil
+}
+
+func (source *testDataStoreSizeSource) getCompactCount() int {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	return source.compactCount
+}
+
+func TestDataStoreCompactionThresholds(t *testing.T) {
+
+	source := &testDataStoreSizeSource{}
+	scheduler := newDataStoreCompactionScheduler(source.getSize, nil, source.compact)
+	scheduler.freeSizeThreshold = 1000
+	scheduler.fragmentationThreshold = 0.5
+
+	testCases := []struct {
+		description     string
+		size            int64
+		freeSize        int64
+		expectCompacted bool
+	}{
+		{"empty", 0, 0, false},
+		{"under thresholds", 500, 100, false},
+		{"large and in use", 10000, 999, false},
+		{"free size threshold", 10000, 1000, true},
+		{"fragmentation threshold", 500, 250, true},
+		{"under fragmentation threshold", 500, 249, false},
+	}
+
+	for _, testCase := range testCases {
+		source.size = testCase.size
+		source.freeSize = testCase.freeSize
+		compactCount := source.getCompactCount()
+
+		compacted, err := scheduler.checkAndCompact()
+		if err != nil {
+			t.Fatalf("checkAndCompact failed for %s: %s", testCase.description, err)
+		}
+		if compacted != testCase.expectCompacted {
+			t.Errorf("unexpected compaction for %s: %t", testCase.description, compacted)
+		}
+		if compacted && source.getCompactCount() != compactCount+1 {
+			t.Errorf("compaction not performed for %s", testCase.description)
+		}
+	}
+
+	source.err = errors.New("size source error")
+	compacted, err := scheduler.checkAndCompact()
+	if err == nil || compacted {
+		t.Errorf("unexpected checkAndCompact result with size source error")
+	}
+}
+
+func TestDataStoreCompactionSchedulerStop(t *testing.T) {
+
+	source := &testDataStoreSizeSource{size: 1000, freeSize: 1000}
+	scheduler := newDataStoreCompactionScheduler(
+		func() (int64, int64, error) {
+			// Keep exceeding the fragmentation threshold
+			source.mutex.Lock()
+			defer source.mutex.Unlock()
+			return source.size, source.size, nil
+		},
+		nil,
+		source.compact)
+	scheduler.checkPeriod = 10 * time.Millisecond
+
+	scheduler.start()
+	time.Sleep(100 * time.Millisecond)
+	scheduler.stop()
+
+	compactCount := source.getCompactCount()
+	if compactCount == 0 {
+		t.Errorf("scheduler did not compact")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if source.getCompactCount() != compactCount {
+		t.Errorf("scheduler compacted after stop")
+	}
+
+	// Multiple calls to stop are allowed
+	scheduler.stop()
+}
+
+func TestDataStoreCompactionPending(t *testing.T) {
+
+	source := &testDataStoreSizeSource{size: 1000, freeSize: 1000}
+	isPending := false
+	scheduler := newDataStoreCompactionScheduler(
+		source.getSize,
+		func() (bool, error) { return isPending, nil },
+		func() error {
+			isPending = true
+			return source.compact()
+		})
+
+	compacted, err := scheduler.checkAndCompact()
+	if err != nil || !compacted {
+		t.Fatalf("unexpected checkAndCompact result: %t, %v", compacted, err)
+	}
+
+	// While a deferred compaction is pending, the threshold isn't checked
+	// and compaction isn't repeated.
+	source.freeSize = 1000
+	compacted, err = scheduler.checkAndCompact()
+	if err != nil || compacted {
+		t.Errorf("unexpected checkAndCompact result while pending: %t, %v", compacted, err)
+	}
+	if source.getCompactCount() != 1 {
+		t.Errorf("unexpected compaction count: %d", source.getCompactCount())
+	}
+}
+
+func TestCloseDataStoreStopsCompactionScheduler(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	err := CompactDataStore()
+	if err != nil {
+		t.Fatalf("CompactDataStore failed: %s", err)
+	}
+
+	dataStoreDirectory, removeDataStoreDirectory := makeTestDataStoreDirectory(t)
+	defer removeDataStoreDirectory()
+
+	CloseDataStore()
+	err = InitDataStore(
+		&Config{DataStoreDirectory: dataStoreDirectory, CompactDataStoreAutomatically: true})
+	if err != nil {
+		t.Fatalf("error initializing datastore: %s", err)
+	}
+
+	scheduler := singleton.compactionScheduler
+	if scheduler == nil {
+		t.Fatalf("compaction scheduler not started")
+	}
+
+	CloseDataStore()
+
+	select {
+	case <-scheduler.stopBroadcast:
+	default:
+		t.Errorf("compaction scheduler not stopped")
+	}
+}
@@ -0,0 +1,506 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// singleton is the default DataStore, which is opened by InitDataStore and
+// used by the package-level datastore functions. singleton is read and
+// replaced under singletonMutex.
+var singleton = new(DataStore)
+
+var singletonMutex sync.RWMutex
+
+// singletonInitMutex serializes InitDataStore and CloseDataStore, and guards
+// singletonInit. It is held while opening and closing the default DataStore,
+// which emit notices, so it is separate from singletonMutex: a notice
+// receiver may call the package-level datastore functions.
+var singletonInitMutex sync.Mutex
+
+var singletonInit sync.Once
+
+// defaultDataStore returns the current default DataStore.
+func defaultDataStore() *DataStore {
+	singletonMutex.RLock()
+	defer singletonMutex.RUnlock()
+	return singleton
+}
+
+// setDefaultDataStore replaces the default DataStore and returns the
+// previous one.
+func setDefaultDataStore(dataStore *DataStore) *DataStore {
+	singletonMutex.Lock()
+	defer singletonMutex.Unlock()
+	previous := singleton
+	singleton = dataStore
+	return previous
+}
+
+// InitDataStore opens the default DataStore. This function uses a sync.Once
+// and is safe for use by concurrent goroutines, including concurrently with
+// CloseDataStore.
+//
+// Note: the sync.Once was more useful when initDataStore was private and
+// called on-demand by the public functions below. Now we require an explicit
+// InitDataStore() call with the filename passed in. The package-level
+// functions assert that Init was called.
+//
+// Calling InitDataStore again with a config that resolves to a different
+// datastore file than the one already opened is an error.
+//
+// When config.EmbeddedServerEntryList is set, the embedded server entries
+// are imported when the default DataStore is opened, unless the same list
+// was already imported. Import failures are reported in a notice and don't
+// fail InitDataStore.
+func InitDataStore(config *Config) (err error) {
+	filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
+	resolvedFilename, absErr := filepath.Abs(filename)
+	if absErr != nil {
+		resolvedFilename = filepath.Clean(filename)
+	}
+	singletonInitMutex.Lock()
+	defer singletonInitMutex.Unlock()
+	singletonInit.Do(func() {
+		var dataStore *DataStore
+		dataStore, err = OpenDataStore(config)
+		if err != nil {
+			// Note: intending to set the err return value for InitDataStore
+			err = fmt.Errorf("initDataStore failed: %s", err)
+			return
+		}
+		setDefaultDataStore(dataStore)
+		if config.EmbeddedServerEntryList != "" {
+			importErr := dataStore.importEmbeddedServerEntries(config.EmbeddedServerEntryList)
+			if importErr != nil {
+				NoticeAlert("failed to import embedded server entries: %s", importErr)
+			}
+		}
+	})
+	dataStore := defaultDataStore()
+	if err == nil && dataStore.db != nil && dataStore.filename != resolvedFilename {
+		err = fmt.Errorf(
+			"initDataStore failed: already initialized with %s, not %s",
+			dataStore.filename, resolvedFilename)
+	}
+	return err
+}
+
+// CloseDataStore stops the default datastore compaction scheduler, if
+// running, and closes the default datastore. InitDataStore may be called
+// again after CloseDataStore.
+//
+// The default DataStore is replaced before it is closed, so package-level
+// datastore functions called after CloseDataStore returns see an
+// uninitialized datastore. Calls already in progress on the closed
+// datastore are not waited for, so CloseDataStore should still not be called
+// while other datastore functions are in use.
+func CloseDataStore() {
+	singletonInitMutex.Lock()
+	defer singletonInitMutex.Unlock()
+	setDefaultDataStore(new(DataStore)).Close()
+	singletonInit = sync.Once{}
+}
+
+// SyncDataStore is a wrapper around the default DataStore Sync.
+func SyncDataStore() error {
+	return defaultDataStore().Sync()
+}
+
+// CompactDataStore is a wrapper around the default DataStore Compact.
+func CompactDataStore() error {
+	return defaultDataStore().Compact()
+}
+
+// SnapshotDataStore is a wrapper around the default DataStore Snapshot.
+func SnapshotDataStore(path string) error {
+	return defaultDataStore().Snapshot(path)
+}
+
+// StoreServerEntry is a wrapper around the default DataStore StoreServerEntry.
+func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
+	return defaultDataStore().StoreServerEntry(serverEntry, replaceIfExists)
+}
+
+// acceptServerEntry is a wrapper around the default DataStore acceptServerEntry.
+func acceptServerEntry(serverEntry *ServerEntry) bool {
+	return defaultDataStore().acceptServerEntry(serverEntry)
+}
+
+// GetServerEntrySeen is a wrapper around the default DataStore GetServerEntrySeen.
+func GetServerEntrySeen(ipAddress string) (firstSeen, lastSeen time.Time, err error) {
+	return defaultDataStore().GetServerEntrySeen(ipAddress)
+}
+
+// StoreServerEntries is a wrapper around the default DataStore StoreServerEntries.
+func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	return defaultDataStore().StoreServerEntries(serverEntries, replaceIfExists)
+}
+
+// StoreServerEntriesByPriority is a wrapper around the default DataStore StoreServerEntriesByPriority.
+func StoreServerEntriesByPriority(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	return defaultDataStore().StoreServerEntriesByPriority(serverEntries, replaceIfExists)
+}
+
+// StoreServerEntriesResumable is a wrapper around the default DataStore StoreServerEntriesResumable.
+func StoreServerEntriesResumable(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	return defaultDataStore().StoreServerEntriesResumable(serverEntries, replaceIfExists)
+}
+
+// PromoteServerEntry is a wrapper around the default DataStore PromoteServerEntry.
+func PromoteServerEntry(ipAddress string) error {
+	return defaultDataStore().PromoteServerEntry(ipAddress)
+}
+
+// GetPromotionHistory is a wrapper around the default DataStore GetPromotionHistory.
+func GetPromotionHistory() ([]PromotionEvent, error) {
+	return defaultDataStore().GetPromotionHistory()
+}
+
+// ResetPromotionHistory is a wrapper around the default DataStore ResetPromotionHistory.
+func ResetPromotionHistory() error {
+	return defaultDataStore().ResetPromotionHistory()
+}
+
+// RebuildRankedServerEntries is a wrapper around the default DataStore RebuildRankedServerEntries.
+func RebuildRankedServerEntries() error {
+	return defaultDataStore().RebuildRankedServerEntries()
+}
+
+// ArchiveServerEntry is a wrapper around the default DataStore ArchiveServerEntry.
+func ArchiveServerEntry(ipAddress string) error {
+	return defaultDataStore().ArchiveServerEntry(ipAddress)
+}
+
+// RevalidateServerEntries is a wrapper around the default DataStore RevalidateServerEntries.
+func RevalidateServerEntries() (removed int, err error) {
+	return defaultDataStore().RevalidateServerEntries()
+}
+
+// RestoreServerEntry is a wrapper around the default DataStore RestoreServerEntry.
+func RestoreServerEntry(ipAddress string) error {
+	return defaultDataStore().RestoreServerEntry(ipAddress)
+}
+
+// GetServerEntry is a wrapper around the default DataStore GetServerEntry.
+func GetServerEntry(ipAddress string) (*ServerEntry, error) {
+	return defaultDataStore().GetServerEntry(ipAddress)
+}
+
+// GetServerEntries is a wrapper around the default DataStore GetServerEntries.
+func GetServerEntries(ipAddresses []string) ([]*ServerEntry, error) {
+	return defaultDataStore().GetServerEntries(ipAddresses)
+}
+
+// SetServerEntryPreferredProtocol is a wrapper around the default DataStore SetServerEntryPreferredProtocol.
+func SetServerEntryPreferredProtocol(ipAddress, protocol string) error {
+	return defaultDataStore().SetServerEntryPreferredProtocol(ipAddress, protocol)
+}
+
+// GetServerEntryPreferredProtocol is a wrapper around the default DataStore GetServerEntryPreferredProtocol.
+func GetServerEntryPreferredProtocol(ipAddress string) (protocol string, err error) {
+	return defaultDataStore().GetServerEntryPreferredProtocol(ipAddress)
+}
+
+// SetServerEntryPinned is a wrapper around the default DataStore SetServerEntryPinned.
+func SetServerEntryPinned(ipAddress string, pinned bool) error {
+	return defaultDataStore().SetServerEntryPinned(ipAddress, pinned)
+}
+
+// IsServerEntryPinned is a wrapper around the default DataStore IsServerEntryPinned.
+func IsServerEntryPinned(ipAddress string) (bool, error) {
+	return defaultDataStore().IsServerEntryPinned(ipAddress)
+}
+
+// NewServerEntryIterator is a wrapper around the default DataStore NewServerEntryIterator.
+func NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+	return defaultDataStore().NewServerEntryIterator(config)
+}
+
+// NewSharedCandidatePool is a wrapper around the default DataStore NewSharedCandidatePool.
+func NewSharedCandidatePool(config *Config) (*SharedCandidatePool, error) {
+	return defaultDataStore().NewSharedCandidatePool(config)
+}
+
+// NewChronologicalServerEntryIterator is a wrapper around the default DataStore NewChronologicalServerEntryIterator.
+func NewChronologicalServerEntryIterator(config *Config) (*ServerEntryIterator, error) {
+	return defaultDataStore().NewChronologicalServerEntryIterator(config)
+}
+
+// CountServerEntries is a wrapper around the default DataStore CountServerEntries.
+func CountServerEntries(region, protocol string) int {
+	return defaultDataStore().CountServerEntries(region, protocol)
+}
+
+// CountServerEntriesMatching is a wrapper around the default DataStore CountServerEntriesMatching.
+func CountServerEntriesMatching(predicate func(*ServerEntry) bool) (int, error) {
+	return defaultDataStore().CountServerEntriesMatching(predicate)
+}
+
+// GetRandomServerEntry is a wrapper around the default DataStore GetRandomServerEntry.
+func GetRandomServerEntry(region, protocol string) (*ServerEntry, error) {
+	return defaultDataStore().GetRandomServerEntry(region, protocol)
+}
+
+// GetReachableProtocols is a wrapper around the default DataStore GetReachableProtocols.
+func GetReachableProtocols(region string) ([]string, error) {
+	return defaultDataStore().GetReachableProtocols(region)
+}
+
+// GetQuarantinedServerEntryIds is a wrapper around the default DataStore GetQuarantinedServerEntryIds.
+func GetQuarantinedServerEntryIds() ([]string, error) {
+	return defaultDataStore().GetQuarantinedServerEntryIds()
+}
+
+// StageServerEntries is a wrapper around the default DataStore StageServerEntries.
+func StageServerEntries(stagingId string, serverEntries []*ServerEntry) error {
+	return defaultDataStore().StageServerEntries(stagingId, serverEntries)
+}
+
+// StoreStagedServerEntries is a wrapper around the default DataStore StoreStagedServerEntries.
+func StoreStagedServerEntries(
+	stagingId string, batchSize int, replaceIfExists, byPriority bool) (int, error) {
+	return defaultDataStore().StoreStagedServerEntries(stagingId, batchSize, replaceIfExists, byPriority)
+}
+
+// ScanStagedServerEntries is a wrapper around the default DataStore ScanStagedServerEntries.
+func ScanStagedServerEntries(stagingId string, batchSize int, scanner func([]*ServerEntry) error) error {
+	return defaultDataStore().ScanStagedServerEntries(stagingId, batchSize, scanner)
+}
+
+// DeleteStagedServerEntries is a wrapper around the default DataStore DeleteStagedServerEntries.
+func DeleteStagedServerEntries(stagingId string) error {
+	return defaultDataStore().DeleteStagedServerEntries(stagingId)
+}
+
+// GetDataStoreOperationLog is a wrapper around the default DataStore GetDataStoreOperationLog.
+func GetDataStoreOperationLog() []DataStoreOperation {
+	return defaultDataStore().GetDataStoreOperationLog()
+}
+
+// MergeDataStore is a wrapper around the default DataStore MergeDataStore.
+func MergeDataStore(otherPath string, replaceIfExists, mergeKeyValues bool) error {
+	return defaultDataStore().MergeDataStore(otherPath, replaceIfExists, mergeKeyValues)
+}
+
+// VerifyDataStoreIntegrity is a wrapper around the default DataStore VerifyDataStoreIntegrity.
+func VerifyDataStoreIntegrity() ([]string, error) {
+	return defaultDataStore().VerifyDataStoreIntegrity()
+}
+
+// ReportAvailableRegions is a wrapper around the default DataStore ReportAvailableRegions.
+func ReportAvailableRegions() {
+	defaultDataStore().ReportAvailableRegions()
+}
+
+// SuggestEgressRegion is a wrapper around the default DataStore SuggestEgressRegion.
+func SuggestEgressRegion() (string, error) {
+	return defaultDataStore().SuggestEgressRegion()
+}
+
+// GetServerEntryIpAddresses is a wrapper around the default DataStore GetServerEntryIpAddresses.
+func GetServerEntryIpAddresses() (ipAddresses []string, err error) {
+	return defaultDataStore().GetServerEntryIpAddresses()
+}
+
+// GetServerEntryIpAddressesLimited is a wrapper around the default DataStore GetServerEntryIpAddressesLimited.
+func GetServerEntryIpAddressesLimited(limit int, order IpAddressOrder) ([]string, error) {
+	return defaultDataStore().GetServerEntryIpAddressesLimited(limit, order)
+}
+
+// RecordServerEntryAttempt is a wrapper around the default DataStore RecordServerEntryAttempt.
+func RecordServerEntryAttempt(ipAddress string) error {
+	return defaultDataStore().RecordServerEntryAttempt(ipAddress)
+}
+
+// RecordServerEntryFailure is a wrapper around the default DataStore RecordServerEntryFailure.
+func RecordServerEntryFailure(ipAddress string) error {
+	return defaultDataStore().RecordServerEntryFailure(ipAddress)
+}
+
+// RecordServerEntrySuccess is a wrapper around the default DataStore RecordServerEntrySuccess.
+func RecordServerEntrySuccess(ipAddress string) error {
+	return defaultDataStore().RecordServerEntrySuccess(ipAddress)
+}
+
+// SetServerEntryDisabledUntil is a wrapper around the default DataStore SetServerEntryDisabledUntil.
+func SetServerEntryDisabledUntil(ipAddress string, disabledUntil time.Time) error {
+	return defaultDataStore().SetServerEntryDisabledUntil(ipAddress, disabledUntil)
+}
+
+// DisableRegion is a wrapper around the default DataStore DisableRegion.
+func DisableRegion(region string, disabledUntil time.Time) error {
+	return defaultDataStore().DisableRegion(region, disabledUntil)
+}
+
+// ClearRegionDisable is a wrapper around the default DataStore ClearRegionDisable.
+func ClearRegionDisable(region string) error {
+	return defaultDataStore().ClearRegionDisable(region)
+}
+
+// GetServerEntryDisabledUntil is a wrapper around the default DataStore GetServerEntryDisabledUntil.
+func GetServerEntryDisabledUntil(ipAddress string) (time.Time, error) {
+	return defaultDataStore().GetServerEntryDisabledUntil(ipAddress)
+}
+
+// SetServerEntryLatency is a wrapper around the default DataStore SetServerEntryLatency.
+func SetServerEntryLatency(ipAddress string, latency time.Duration) error {
+	return defaultDataStore().SetServerEntryLatency(ipAddress, latency)
+}
+
+// GetServerEntrySuccessRatio is a wrapper around the default DataStore GetServerEntrySuccessRatio.
+func GetServerEntrySuccessRatio(ipAddress string) (float64, error) {
+	return defaultDataStore().GetServerEntrySuccessRatio(ipAddress)
+}
+
+// DumpDataStoreDiagnostics is a wrapper around the default DataStore DumpDiagnostics.
+func DumpDataStoreDiagnostics(indent bool) ([]byte, error) {
+	return defaultDataStore().DumpDiagnostics(indent)
+}
+
+// GetDataStoreStats is a wrapper around the default DataStore GetDataStoreStats.
+func GetDataStoreStats() (*DataStoreStats, error) {
+	return defaultDataStore().GetDataStoreStats()
+}
+
+// SetSplitTunnelRoutes is a wrapper around the default DataStore SetSplitTunnelRoutes.
+func SetSplitTunnelRoutes(region, etag string, data []byte) error {
+	return defaultDataStore().SetSplitTunnelRoutes(region, etag, data)
+}
+
+// GetSplitTunnelRoutesETag is a wrapper around the default DataStore GetSplitTunnelRoutesETag.
+func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
+	return defaultDataStore().GetSplitTunnelRoutesETag(region)
+}
+
+// GetSplitTunnelRoutesData is a wrapper around the default DataStore GetSplitTunnelRoutesData.
+func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
+	return defaultDataStore().GetSplitTunnelRoutesData(region)
+}
+
+// SetUrlETag is a wrapper around the default DataStore SetUrlETag.
+func SetUrlETag(url, etag string) error {
+	return defaultDataStore().SetUrlETag(url, etag)
+}
+
+// GetUrlETag is a wrapper around the default DataStore GetUrlETag.
+func GetUrlETag(url string) (etag string, err error) {
+	return defaultDataStore().GetUrlETag(url)
+}
+
+// PruneUrlETags is a wrapper around the default DataStore PruneUrlETags.
+func PruneUrlETags(maxAge time.Duration) error {
+	return defaultDataStore().PruneUrlETags(maxAge)
+}
+
+// SetResolvedHost is a wrapper around the default DataStore SetResolvedHost.
+func SetResolvedHost(host string, ips []net.IP, expiry time.Time) error {
+	return defaultDataStore().SetResolvedHost(host, ips, expiry)
+}
+
+// GetResolvedHost is a wrapper around the default DataStore GetResolvedHost.
+func GetResolvedHost(host string) ([]net.IP, error) {
+	return defaultDataStore().GetResolvedHost(host)
+}
+
+// SetKeyValue is a wrapper around the default DataStore SetKeyValue.
+func SetKeyValue(key, value string) error {
+	return defaultDataStore().SetKeyValue(key, value)
+}
+
+// GetKeyValue is a wrapper around the default DataStore GetKeyValue.
+func GetKeyValue(key string) (value string, err error) {
+	return defaultDataStore().GetKeyValue(key)
+}
+
+// setInternalKeyValue is a wrapper around the default DataStore setInternalKeyValue.
+func setInternalKeyValue(key, value string) error {
+	return defaultDataStore().setInternalKeyValue(key, value)
+}
+
+// getInternalKeyValue is a wrapper around the default DataStore getInternalKeyValue.
+func getInternalKeyValue(key string) (value string, err error) {
+	return defaultDataStore().getInternalKeyValue(key)
+}
+
+// SetEncryptedKeyValue is a wrapper around the default DataStore SetEncryptedKeyValue.
+func SetEncryptedKeyValue(key, value string) error {
+	return defaultDataStore().SetEncryptedKeyValue(key, value)
+}
+
+// GetEncryptedKeyValue is a wrapper around the default DataStore GetEncryptedKeyValue.
+func GetEncryptedKeyValue(key string) (value string, err error) {
+	return defaultDataStore().GetEncryptedKeyValue(key)
+}
+
+// SetAppMetadata is a wrapper around the default DataStore SetAppMetadata.
+func SetAppMetadata(key string, value []byte) error {
+	return defaultDataStore().SetAppMetadata(key, value)
+}
+
+// GetAppMetadata is a wrapper around the default DataStore GetAppMetadata.
+func GetAppMetadata(key string) (value []byte, err error) {
+	return defaultDataStore().GetAppMetadata(key)
+}
+
+// AddRegionTransferStats is a wrapper around the default DataStore AddRegionTransferStats.
+func AddRegionTransferStats(region string, bytesTransferred int64) error {
+	return defaultDataStore().AddRegionTransferStats(region, bytesTransferred)
+}
+
+// GetRegionTransferStats is a wrapper around the default DataStore GetRegionTransferStats.
+func GetRegionTransferStats() (map[string]int64, error) {
+	return defaultDataStore().GetRegionTransferStats()
+}
+
+// RecordSuccessfulProtocol is a wrapper around the default DataStore RecordSuccessfulProtocol.
+func RecordSuccessfulProtocol(protocol string) error {
+	return defaultDataStore().RecordSuccessfulProtocol(protocol)
+}
+
+// GetProtocolSuccessDistribution is a wrapper around the default DataStore GetProtocolSuccessDistribution.
+func GetProtocolSuccessDistribution() (map[string]int, error) {
+	return defaultDataStore().GetProtocolSuccessDistribution()
+}
+
+// GetCandidateServerEntries is a wrapper around the default DataStore GetCandidateServerEntries.
+func GetCandidateServerEntries(config *Config, limit int) ([]*ServerEntry, error) {
+	return defaultDataStore().GetCandidateServerEntries(config, limit)
+}
+
+// AuditServerEntries is a wrapper around the default DataStore AuditServerEntries.
+func AuditServerEntries() ([]ServerEntryAuditIssue, error) {
+	return defaultDataStore().AuditServerEntries()
+}
+
+// GetAvailableCapabilities is a wrapper around the default DataStore GetAvailableCapabilities.
+func GetAvailableCapabilities() ([]string, error) {
+	return defaultDataStore().GetAvailableCapabilities()
+}
+
+// ExportRankedServerEntries is a wrapper around the default DataStore ExportRankedServerEntries.
+func ExportRankedServerEntries(count int) (string, error) {
+	return defaultDataStore().ExportRankedServerEntries(count)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// dataStoreDiagnostics is the report produced by DumpDataStoreDiagnostics.
+// This type is shared by both dataStore implementations.
+type dataStoreDiagnostics struct {
+	ServerEntryCount int                       `json:"serverEntryCount"`
+	RegionCounts     map[string]int            `json:"regionCounts"`
+	ServerEntries    []*serverEntryDiagnostics `json:"serverEntries"`
+}
+
+// serverEntryDiagnostics contains the non-secret server entry fields and
+// related datastore metadata. Credentials, keys, and certificates are
+// never included. Rank is the server entry's position in the rank order,
+// where 0 is the top rank, or -1 when the server entry is not ranked.
+type serverEntryDiagnostics struct {
+	IpAddress    string   `json:"ipAddress"`
+	Region       string   `json:"region"`
+	Capabilities []string `json:"capabilities"`
+	Rank         int      `json:"rank"`
+	Attempts     int      `json:"attempts"`
+	Failures     int      `json:"failures"`
+}
+
+func newDataStoreDiagnostics() *dataStoreDiagnostics {
+	return &dataStoreDiagnostics{
+		RegionCounts:  make(map[string]int),
+		ServerEntries: make([]*serverEntryDiagnostics, 0),
+	}
+}
+
+func (diagnostics *dataStoreDiagnostics) addServerEntry(
+	serverEntry *ServerEntry, rank, attempts, failures int) {
+
+	diagnostics.ServerEntryCount += 1
+	diagnostics.RegionCounts[serverEntry.Region] += 1
+	diagnostics.ServerEntries = append(
+		diagnostics.ServerEntries,
+		&serverEntryDiagnostics{
+			IpAddress:    serverEntry.IpAddress,
+			Region:       serverEntry.Region,
+			Capabilities: serverEntry.Capabilities,
+			Rank:         rank,
+			Attempts:     attempts,
+			Failures:     failures,
+		})
+}
+
+// marshal encodes the report with the server entries listed in rank
+// order, followed by any unranked server entries. When indent is set,
+// the output is pretty-printed.
+func (diagnostics *dataStoreDiagnostics) marshal(indent bool) ([]byte, error) {
+	sort.Stable(serverEntryDiagnosticsByRank(diagnostics.ServerEntries))
+	var data []byte
+	var err error
+	if indent {
+		data, err = json.MarshalIndent(diagnostics, "", "    ")
+	} else {
+		data, err = json.Marshal(diagnostics)
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return data, nil
+}
+
+type serverEntryDiagnosticsByRank []*serverEntryDiagnostics
+
+func (entries serverEntryDiagnosticsByRank) Len() int {
+	return len(entries)
+}
+
+func (entries serverEntryDiagnosticsByRank) Less(i, j int) bool {
+	if entries[j].Rank == -1 {
+		return entries[i].Rank != -1
+	}
+	return entries[i].Rank != -1 && entries[i].Rank < entries[j].Rank
+}
+
+func (entries serverEntryDiagnosticsByRank) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const DATA_STORE_EMBEDDED_SERVER_ENTRIES_KEY = "embeddedServerEntriesImported"
+
+// importEmbeddedServerEntries decodes and stores the embedded server entry
+// list. The list is imported only once: a marker, which is the hash of the
+// list, is stored in the key-value store after a successful import and
+// subsequent calls with the same list do nothing. A different list, such as
+// the list embedded in an upgraded client, is imported.
+//
+// Since embedded server list entries may become stale, they will not
+// overwrite existing stored entries for the same server.
+func (dataStore *DataStore) importEmbeddedServerEntries(encodedServerEntryList string) error {
+
+	digest := sha256.Sum256([]byte(encodedServerEntryList))
+	listHash := hex.EncodeToString(digest[:])
+
+	importedListHash, err := dataStore.GetKeyValue(DATA_STORE_EMBEDDED_SERVER_ENTRIES_KEY)
+	if err != nil {
+		return ContextError(err)
+	}
+	if importedListHash == listHash {
+		return nil
+	}
+
+	serverEntries, err := DecodeAndValidateServerEntryList(encodedServerEntryList)
+	if err != nil {
+		return ContextError(err)
+	}
+	err = dataStore.StoreServerEntries(serverEntries, false)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	err = dataStore.SetKeyValue(DATA_STORE_EMBEDDED_SERVER_ENTRIES_KEY, listHash)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	NoticeInfo("imported %d embedded server entries", len(serverEntries))
+
+	return nil
+}
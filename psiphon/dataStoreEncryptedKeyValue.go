@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ENCRYPTED_KEY_VALUE_MARKER prefixes values stored by SetEncryptedKeyValue,
+// distinguishing them from plaintext values in the same key/value store.
+const ENCRYPTED_KEY_VALUE_MARKER = "encrypted:"
+
+// SetEncryptedKeyValue stores a key/value pair with the value encrypted,
+// using NaCl secretbox, with config.KeyValueEncryptionKey. Encrypted values
+// are stored alongside plaintext key/values and are retrieved with
+// GetEncryptedKeyValue.
+func (dataStore *DataStore) SetEncryptedKeyValue(key, value string) error {
+	secretKey, err := getKeyValueEncryptionKey(dataStore.config)
+	if err != nil {
+		return ContextError(err)
+	}
+	nonceBytes, err := MakeSecureRandomBytes(24)
+	if err != nil {
+		return ContextError(err)
+	}
+	var nonce [24]byte
+	copy(nonce[:], nonceBytes)
+	box := secretbox.Seal(nonce[:], []byte(value), &nonce, secretKey)
+	return dataStore.SetKeyValue(
+		key, ENCRYPTED_KEY_VALUE_MARKER+base64.StdEncoding.EncodeToString(box))
+}
+
+// GetEncryptedKeyValue retrieves and decrypts the value for a given key
+// stored with SetEncryptedKeyValue. If not found, it returns an empty string
+// value. An error is returned when the stored value is not encrypted or
+// can't be decrypted with config.KeyValueEncryptionKey.
+func (dataStore *DataStore) GetEncryptedKeyValue(key string) (value string, err error) {
+	secretKey, err := getKeyValueEncryptionKey(dataStore.config)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	storedValue, err := dataStore.GetKeyValue(key)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	if storedValue == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(storedValue, ENCRYPTED_KEY_VALUE_MARKER) {
+		return "", ContextError(errors.New("value is not encrypted"))
+	}
+	box, err := base64.StdEncoding.DecodeString(
+		storedValue[len(ENCRYPTED_KEY_VALUE_MARKER):])
+	if err != nil {
+		return "", ContextError(err)
+	}
+	if len(box) < 24 {
+		return "", ContextError(errors.New("invalid encrypted value"))
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, secretKey)
+	if !ok {
+		return "", ContextError(errors.New("failed to decrypt value"))
+	}
+	return string(plaintext), nil
+}
+
+func getKeyValueEncryptionKey(config *Config) (*[32]byte, error) {
+	if config.KeyValueEncryptionKey == "" {
+		return nil, ContextError(errors.New("missing key/value encryption key"))
+	}
+	decodedKey, err := base64.StdEncoding.DecodeString(config.KeyValueEncryptionKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if len(decodedKey) != 32 {
+		return nil, ContextError(errors.New("invalid key/value encryption key length"))
+	}
+	var secretKey [32]byte
+	copy(secretKey[:], decodedKey)
+	return &secretKey, nil
+}
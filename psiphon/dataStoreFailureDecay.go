@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"time"
+)
+
+// serverEntryFailureClock returns the time recorded as a server entry's
+// last failure and used to decay its failure counts. Tests replace it to
+// simulate elapsed time.
+var serverEntryFailureClock = time.Now
+
+// decayServerEntryFailures returns the specified failure count, halved for
+// each config.ServerEntryFailureHalfLifeSeconds elapsed since lastFailure.
+// When no half-life is configured or no last failure time is recorded, the
+// count is returned unchanged.
+func decayServerEntryFailures(config *Config, failures int, lastFailure time.Time) int {
+	if config.ServerEntryFailureHalfLifeSeconds <= 0 || lastFailure.IsZero() || failures == 0 {
+		return failures
+	}
+	elapsed := serverEntryFailureClock().Sub(lastFailure)
+	if elapsed <= 0 {
+		return failures
+	}
+	halfLife := time.Duration(config.ServerEntryFailureHalfLifeSeconds) * time.Second
+	return int(float64(failures) * math.Pow(0.5, float64(elapsed)/float64(halfLife)))
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+)
+
+const (
+	DATA_STORE_IMPORT_PROGRESS_KEY = "serverEntryImportProgress"
+	DATA_STORE_IMPORT_BATCH_SIZE   = 100
+)
+
+// serverEntryImportProgress is the import-progress marker, stored in the
+// key-value store, for StoreServerEntriesResumable. ListHash identifies
+// the server entry list being imported and StoredCount is the number of
+// server entries, in import order, which have been stored.
+type serverEntryImportProgress struct {
+	ListHash    string `json:"listHash"`
+	StoredCount int    `json:"storedCount"`
+}
+
+// StoreServerEntriesResumable stores a list of server entries, as
+// StoreServerEntries does, and records import progress so that, if the
+// import is interrupted, a subsequent call with the same list resumes where
+// the previous import stopped instead of importing from scratch.
+//
+// The import order follows config.ServerEntryStoreOrder, except that any
+// shuffle is seeded with the list hash, so the import order is the same for
+// each call with the same list. Progress is recorded after each batch of
+// DATA_STORE_IMPORT_BATCH_SIZE server entries, so an interrupted import
+// may store up to one batch again when resumed.
+func (dataStore *DataStore) StoreServerEntriesResumable(serverEntries []*ServerEntry, replaceIfExists bool) error {
+
+	listHash, err := makeServerEntryListHash(serverEntries)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	progress, err := dataStore.getServerEntryImportProgress()
+	if err != nil {
+		return ContextError(err)
+	}
+	startIndex := 0
+	if progress.ListHash == listHash && progress.StoredCount <= len(serverEntries) {
+		startIndex = progress.StoredCount
+		NoticeInfo("resuming server entry import at %d of %d", startIndex, len(serverEntries))
+	}
+
+	serverEntries = orderServerEntriesForImport(dataStore.config, serverEntries, listHash)
+
+	for index := startIndex; index < len(serverEntries); index += DATA_STORE_IMPORT_BATCH_SIZE {
+		endIndex := index + DATA_STORE_IMPORT_BATCH_SIZE
+		if endIndex > len(serverEntries) {
+			endIndex = len(serverEntries)
+		}
+		err = dataStore.storeServerEntries(serverEntries[index:endIndex], replaceIfExists)
+		if err != nil {
+			return ContextError(err)
+		}
+		err = dataStore.setServerEntryImportProgress(
+			&serverEntryImportProgress{ListHash: listHash, StoredCount: endIndex})
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	// As in StoreServerEntries, the whole list is interleaved once all of
+	// its server entries are stored. This is repeated when an import that
+	// was interrupted after its last batch is resumed.
+	if dataStore.config.ServerEntryStoreOrder == SERVER_ENTRY_STORE_ORDER_INTERLEAVE {
+		err = dataStore.interleaveRankedServerEntries(makeServerEntryBatch(serverEntries))
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	// The import is complete, so clear the marker
+	err = dataStore.SetKeyValue(DATA_STORE_IMPORT_PROGRESS_KEY, "")
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
+
+// makeServerEntryListHash returns a hex-encoded SHA-256 digest of the
+// server entry list.
+func makeServerEntryListHash(serverEntries []*ServerEntry) (string, error) {
+	hash := sha256.New()
+	for _, serverEntry := range serverEntries {
+		data, err := json.Marshal(serverEntry)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		hash.Write(data)
+		hash.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// orderServerEntriesForImport returns a copy of the server entry list in
+// import order. This is the order orderServerEntriesForStore would use, but
+// with any shuffle seeded with the list hash.
+func orderServerEntriesForImport(
+	config *Config, serverEntries []*ServerEntry, listHash string) []*ServerEntry {
+
+	orderedServerEntries := make([]*ServerEntry, len(serverEntries))
+	if config.ServerEntryStoreOrder == SERVER_ENTRY_STORE_ORDER_INPUT_ORDER {
+		copy(orderedServerEntries, serverEntries)
+		orderServerEntriesForStore(config, orderedServerEntries)
+		return orderedServerEntries
+	}
+	digest, _ := hex.DecodeString(listHash)
+	seed := int64(0)
+	if len(digest) >= 8 {
+		seed = int64(binary.BigEndian.Uint64(digest))
+	}
+	for index, permutedIndex := range rand.New(rand.NewSource(seed)).Perm(len(serverEntries)) {
+		orderedServerEntries[index] = serverEntries[permutedIndex]
+	}
+	return orderedServerEntries
+}
+
+func (dataStore *DataStore) getServerEntryImportProgress() (*serverEntryImportProgress, error) {
+	progress := new(serverEntryImportProgress)
+	value, err := dataStore.GetKeyValue(DATA_STORE_IMPORT_PROGRESS_KEY)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if value == "" {
+		return progress, nil
+	}
+	err = json.Unmarshal([]byte(value), progress)
+	if err != nil {
+		// A malformed marker is ignored and the import starts from scratch
+		NoticeAlert("invalid server entry import progress: %s", err)
+		return new(serverEntryImportProgress), nil
+	}
+	return progress, nil
+}
+
+func (dataStore *DataStore) setServerEntryImportProgress(progress *serverEntryImportProgress) error {
+	value, err := json.Marshal(progress)
+	if err != nil {
+		return ContextError(err)
+	}
+	err = dataStore.SetKeyValue(DATA_STORE_IMPORT_PROGRESS_KEY, string(value))
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
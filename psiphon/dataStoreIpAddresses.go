@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// IpAddressOrder specifies the order of the server IP addresses returned by
+// GetServerEntryIpAddressesLimited.
+type IpAddressOrder int
+
+const (
+	// IP_ADDRESS_ORDER_MOST_RECENT orders servers from most to least
+	// recently seen, by server entry lastSeen time.
+	IP_ADDRESS_ORDER_MOST_RECENT IpAddressOrder = iota
+
+	// IP_ADDRESS_ORDER_RANKED orders servers by rank, as used by
+	// ServerEntryIterator, with the top ranked server first.
+	IP_ADDRESS_ORDER_RANKED
+
+	// IP_ADDRESS_ORDER_RANDOM orders servers randomly.
+	IP_ADDRESS_ORDER_RANDOM
+)
+
+// GetServerEntryIpAddressesLimited returns up to limit of the IP addresses of
+// the stored server entries, selected and ordered according to order. When
+// limit is 0, all IP addresses are returned.
+func (dataStore *DataStore) GetServerEntryIpAddressesLimited(
+	limit int, order IpAddressOrder) ([]string, error) {
+
+	var ipAddresses []string
+	var err error
+
+	switch order {
+	case IP_ADDRESS_ORDER_MOST_RECENT:
+		ipAddresses, err = dataStore.GetServerEntryIpAddresses()
+		if err == nil {
+			err = dataStore.sortIpAddressesByLastSeen(ipAddresses)
+		}
+	case IP_ADDRESS_ORDER_RANKED:
+		ipAddresses, err = dataStore.getRankedServerEntryIpAddresses()
+	case IP_ADDRESS_ORDER_RANDOM:
+		ipAddresses, err = dataStore.GetServerEntryIpAddresses()
+		if err == nil {
+			for index := len(ipAddresses) - 1; index > 0; index-- {
+				swapIndex := rand.Intn(index + 1)
+				ipAddresses[index], ipAddresses[swapIndex] = ipAddresses[swapIndex], ipAddresses[index]
+			}
+		}
+	default:
+		err = errors.New("unknown IP address order")
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if limit > 0 && len(ipAddresses) > limit {
+		ipAddresses = ipAddresses[:limit]
+	}
+	return ipAddresses, nil
+}
+
+// sortIpAddressesByLastSeen sorts the specified server IP addresses in
+// descending lastSeen order. Servers with the same lastSeen time retain
+// their relative order.
+func (dataStore *DataStore) sortIpAddressesByLastSeen(ipAddresses []string) error {
+	knownServers := make(knownServersByLastSeen, 0, len(ipAddresses))
+	for _, ipAddress := range ipAddresses {
+		_, lastSeen, err := dataStore.GetServerEntrySeen(ipAddress)
+		if err != nil {
+			return ContextError(err)
+		}
+		knownServers = append(knownServers, knownServer{ipAddress, lastSeen})
+	}
+	sort.Stable(knownServers)
+	for i, knownServer := range knownServers {
+		ipAddresses[i] = knownServer.ipAddress
+	}
+	return nil
+}
+
+type knownServer struct {
+	ipAddress string
+	lastSeen  time.Time
+}
+
+// knownServersByLastSeen sorts known servers in descending lastSeen order.
+type knownServersByLastSeen []knownServer
+
+func (list knownServersByLastSeen) Len() int      { return len(list) }
+func (list knownServersByLastSeen) Swap(i, j int) { list[i], list[j] = list[j], list[i] }
+func (list knownServersByLastSeen) Less(i, j int) bool {
+	return list[i].lastSeen.After(list[j].lastSeen)
+}
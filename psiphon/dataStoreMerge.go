@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// MergeDataStore imports the server entries stored in another datastore
+// file, such as a file created by Snapshot, into this datastore. The other
+// datastore is opened read-only. Invalid server entries are skipped and,
+// when replaceIfExists is false, so are server entries which are already
+// stored. When mergeKeyValues is set, the other datastore's key-values are
+// also imported, subject to the same replaceIfExists rule. The merge counts
+// are reported in a DataStoreMerged notice.
+func (dataStore *DataStore) MergeDataStore(otherPath string, replaceIfExists, mergeKeyValues bool) error {
+	dataStore.checkInit()
+
+	serverEntries, keyValues, skipped, err := readDataStoreFile(otherPath)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	stored := 0
+	for _, serverEntry := range serverEntries {
+		if ValidateServerEntry(serverEntry) != nil {
+			skipped += 1
+			continue
+		}
+		if !replaceIfExists {
+			existingServerEntry, err := dataStore.GetServerEntry(serverEntry.IpAddress)
+			if err != nil {
+				return ContextError(err)
+			}
+			if existingServerEntry != nil {
+				skipped += 1
+				continue
+			}
+		}
+		err = dataStore.StoreServerEntry(serverEntry, replaceIfExists)
+		if err != nil {
+			return ContextError(err)
+		}
+		stored += 1
+	}
+
+	storedKeyValues := 0
+	if mergeKeyValues {
+		for key, value := range keyValues {
+			if !replaceIfExists {
+				existingValue, err := dataStore.GetKeyValue(key)
+				if err != nil {
+					return ContextError(err)
+				}
+				if existingValue != "" {
+					continue
+				}
+			}
+			err = dataStore.SetKeyValue(key, value)
+			if err != nil {
+				return ContextError(err)
+			}
+			storedKeyValues += 1
+		}
+	}
+
+	dataStore.ReportAvailableRegions()
+
+	NoticeDataStoreMerged(otherPath, stored, skipped, storedKeyValues)
+
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+)
+
+// DataStoreOperation is a record of a datastore mutation in the
+// datastore operation log. See config.DataStoreOperationLogSize.
+type DataStoreOperation struct {
+	Name      string
+	Key       string
+	Timestamp time.Time
+}
+
+// dataStoreOperationLog is an in-memory ring buffer of the most recent
+// datastore mutations. It's a diagnostic aid, for debugging anomalies such
+// as unexpected ranked server entry orderings under concurrency, and is not
+// persisted.
+type dataStoreOperationLog struct {
+	mutex      sync.Mutex
+	operations []DataStoreOperation
+	next       int
+	full       bool
+}
+
+func newDataStoreOperationLog(size int) *dataStoreOperationLog {
+	return &dataStoreOperationLog{
+		operations: make([]DataStoreOperation, size),
+	}
+}
+
+func (log *dataStoreOperationLog) record(name, key string) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.operations[log.next] = DataStoreOperation{
+		Name:      name,
+		Key:       key,
+		Timestamp: time.Now(),
+	}
+	log.next = (log.next + 1) % len(log.operations)
+	if log.next == 0 {
+		log.full = true
+	}
+}
+
+// get returns a copy of the logged operations, oldest first.
+func (log *dataStoreOperationLog) get() []DataStoreOperation {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if !log.full {
+		return append([]DataStoreOperation(nil), log.operations[:log.next]...)
+	}
+	operations := make([]DataStoreOperation, 0, len(log.operations))
+	operations = append(operations, log.operations[log.next:]...)
+	return append(operations, log.operations[:log.next]...)
+}
+
+// recordOperation adds a mutation to the datastore operation log, when
+// enabled. Operations are recorded as they start, so an operation which
+// fails is also recorded.
+func (dataStore *DataStore) recordOperation(name, key string) {
+	if dataStore.operationLog == nil {
+		return
+	}
+	dataStore.operationLog.record(name, key)
+}
+
+// GetDataStoreOperationLog returns the most recent datastore mutations,
+// oldest first. Returns nil when the operation log isn't enabled.
+func (dataStore *DataStore) GetDataStoreOperationLog() []DataStoreOperation {
+	if dataStore.operationLog == nil {
+		return nil
+	}
+	return dataStore.operationLog.get()
+}
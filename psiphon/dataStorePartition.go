@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// getServerEntryPartition returns the propagation channel under which server
+// entries are stored and selected, or a blank string when server entries are
+// not partitioned by propagation channel.
+func getServerEntryPartition(config *Config) string {
+	if !config.PartitionServerEntriesByPropagationChannel {
+		return ""
+	}
+	if config.PropagationChannelId == "" {
+		return DATA_STORE_DEFAULT_PROPAGATION_CHANNEL_ID
+	}
+	return config.PropagationChannelId
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+)
+
+// validateServerEntryPreferredProtocol checks that the protocol is a
+// supported tunnel protocol and that the server entry stored in dataStore
+// has the required capability.
+func validateServerEntryPreferredProtocol(dataStore *DataStore, ipAddress, protocol string) error {
+	if !Contains(SupportedTunnelProtocols, protocol) {
+		return ContextError(fmt.Errorf("unsupported tunnel protocol: %s", protocol))
+	}
+	serverEntry, err := dataStore.GetServerEntry(ipAddress)
+	if err != nil {
+		return ContextError(err)
+	}
+	if serverEntry == nil {
+		return ContextError(fmt.Errorf("server entry not found: %s", ipAddress))
+	}
+	if !serverEntry.SupportsProtocol(protocol) {
+		return ContextError(fmt.Errorf("server %s does not support protocol %s", ipAddress, protocol))
+	}
+	return nil
+}
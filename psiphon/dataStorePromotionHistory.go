@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DATA_STORE_PROMOTION_HISTORY_KEY        = "promotionHistory"
+	DATA_STORE_PROMOTION_HISTORY_MAX_EVENTS = 100
+)
+
+// PromotionEvent records a PromoteServerEntry call. The promotion history
+// may be used to determine why a server entry is top ranked.
+type PromotionEvent struct {
+	IpAddress string    `json:"ipAddress"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GetPromotionHistory returns the recorded promotion events, oldest first.
+// At most DATA_STORE_PROMOTION_HISTORY_MAX_EVENTS of the most recent events
+// are retained.
+func (dataStore *DataStore) GetPromotionHistory() ([]PromotionEvent, error) {
+	encodedHistory, err := dataStore.GetKeyValue(DATA_STORE_PROMOTION_HISTORY_KEY)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	history, err := decodePromotionHistory([]byte(encodedHistory))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return history, nil
+}
+
+// ResetPromotionHistory discards all recorded promotion events.
+func (dataStore *DataStore) ResetPromotionHistory() error {
+	err := dataStore.SetKeyValue(DATA_STORE_PROMOTION_HISTORY_KEY, "")
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+func decodePromotionHistory(encodedHistory []byte) ([]PromotionEvent, error) {
+	history := make([]PromotionEvent, 0)
+	if len(encodedHistory) == 0 {
+		return history, nil
+	}
+	err := json.Unmarshal(encodedHistory, &history)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return history, nil
+}
+
+// appendPromotionEvent adds a promotion event to the encoded promotion
+// history. When the history is full, the oldest event is discarded. This
+// is called by PromoteServerEntry within its datastore transaction.
+func appendPromotionEvent(encodedHistory []byte, ipAddress string) ([]byte, error) {
+	history, err := decodePromotionHistory(encodedHistory)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	history = append(history, PromotionEvent{IpAddress: ipAddress, Timestamp: time.Now()})
+	if len(history) > DATA_STORE_PROMOTION_HISTORY_MAX_EVENTS {
+		history = history[len(history)-DATA_STORE_PROMOTION_HISTORY_MAX_EVENTS:]
+	}
+	encodedHistory, err = json.Marshal(history)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return encodedHistory, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+)
+
+// decodeStoredServerEntry decodes a stored server entry record. A panic
+// raised by the codec, as may happen with a corrupt record, is recovered
+// and returned as an error so that a single bad record does not take down
+// the client.
+func decodeStoredServerEntry(codec serverEntryCodec, data []byte) (serverEntry *ServerEntry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			serverEntry = nil
+			err = fmt.Errorf("server entry decode panic: %v", r)
+		}
+	}()
+	serverEntry = new(ServerEntry)
+	err = codec.Unmarshal(data, serverEntry)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return serverEntry, nil
+}
+
+// quarantineServerEntry moves a server entry which cannot be decoded out of
+// the server entry store and into the quarantine store, where the raw record
+// is retained for diagnosis but is no longer visited by iterators and scans.
+// Failure to quarantine is reported but not returned, as callers continue
+// iterating regardless.
+func (dataStore *DataStore) quarantineServerEntry(serverEntryId string, data []byte, decodeErr error) {
+	NoticeAlert("quarantining undecodable server entry %s: %s",
+		redactServerAddress(serverEntryId), decodeErr)
+	err := dataStore.moveServerEntryToQuarantine(serverEntryId, data)
+	if err != nil {
+		NoticeAlert("failed to quarantine server entry %s: %s",
+			redactServerAddress(serverEntryId), ContextError(err))
+	}
+}
+
+// undecodableServerEntries records the stored server entries which a scan
+// can't decode, keyed by server entry ID, so that they may be quarantined
+// once the scan's transaction is complete.
+type undecodableServerEntries map[string]undecodableServerEntry
+
+type undecodableServerEntry struct {
+	data []byte
+	err  error
+}
+
+// decode decodes a stored server entry record read by a scan. When the
+// record can't be decoded, a copy of the record is recorded, as the data
+// may only be valid for the life of the transaction, and nil is returned.
+func (undecodable undecodableServerEntries) decode(
+	codec serverEntryCodec, serverEntryId string, data []byte) *ServerEntry {
+
+	serverEntry, err := decodeStoredServerEntry(codec, data)
+	if err != nil {
+		undecodable[serverEntryId] = undecodableServerEntry{
+			data: append([]byte(nil), data...),
+			err:  err,
+		}
+		return nil
+	}
+	return serverEntry
+}
+
+// quarantineUndecodableServerEntries quarantines each of the recorded
+// server entries. This must be called after the scan's transaction is
+// complete, as quarantining uses its own transaction.
+func (dataStore *DataStore) quarantineUndecodableServerEntries(undecodable undecodableServerEntries) {
+	for serverEntryId, record := range undecodable {
+		dataStore.quarantineServerEntry(serverEntryId, record.data, record.err)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+// isServerEntryReachable applies the ServerEntryIterator filters which
+// don't depend on the tunnel protocol: the server entry must not be
+// disabled, must accept the client version, and must pass
+// ValidateServerEntry, as server entries stored before a validation rule
+// was added may no longer be valid.
+func isServerEntryReachable(
+	config *Config, serverEntry *ServerEntry, disabledUntil time.Time) bool {
+
+	return !time.Now().Before(disabledUntil) &&
+		serverEntry.supportsClientVersion(config.ClientVersion) &&
+		ValidateServerEntry(serverEntry) == nil
+}
+
+// makeReachableProtocolList returns the reachable protocols in
+// SupportedTunnelProtocols order.
+func makeReachableProtocolList(reachableProtocols map[string]bool) []string {
+	protocols := make([]string, 0)
+	for _, protocol := range SupportedTunnelProtocols {
+		if reachableProtocols[protocol] {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return protocols
+}
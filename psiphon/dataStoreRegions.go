@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"reflect"
+	"sort"
+)
+
+// reportAvailableRegions emits the AvailableEgressRegions notice and, when
+// the available regions differ from the last reported regions, invokes the
+// OnAvailableEgressRegionsChanged callback. This is called by the datastore
+// ReportAvailableRegions implementations.
+func (dataStore *DataStore) reportAvailableRegions(regions []string) {
+
+	NoticeAvailableEgressRegions(regions)
+
+	sortedRegions := append(make([]string, 0, len(regions)), regions...)
+	sort.Strings(sortedRegions)
+
+	dataStore.regionsMutex.Lock()
+	changed := dataStore.availableRegions == nil ||
+		!reflect.DeepEqual(dataStore.availableRegions, sortedRegions)
+	dataStore.availableRegions = sortedRegions
+	dataStore.regionsMutex.Unlock()
+
+	if changed && dataStore.config.OnAvailableEgressRegionsChanged != nil {
+		dataStore.config.OnAvailableEgressRegionsChanged(
+			append([]string(nil), sortedRegions...))
+	}
+}
+
+// selectEgressRegion returns the region with the largest server entry
+// count. Ties are broken by selecting the first region in sorted order, so
+// the selection is stable.
+func selectEgressRegion(regionCounts map[string]int) string {
+	selectedRegion := ""
+	selectedCount := 0
+	for region, count := range regionCounts {
+		if count > selectedCount ||
+			(count == selectedCount && region < selectedRegion) {
+			selectedRegion = region
+			selectedCount = count
+		}
+	}
+	return selectedRegion
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// resolvedHostClock returns the current time used to expire cached
+// resolved hosts. Tests replace it to control expiry.
+var resolvedHostClock = time.Now
+
+// resolvedHost is a cached ResolveHost result.
+type resolvedHost struct {
+	IPs    []net.IP  `json:"ips"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// SetResolvedHost caches the resolved IP addresses for the host until
+// expiry. Resolved hosts are kept apart from the key-values set with
+// SetKeyValue. Expired resolved hosts are deleted whenever a resolved host
+// is stored, so the cache doesn't grow as different hosts are resolved.
+func (dataStore *DataStore) SetResolvedHost(host string, ips []net.IP, expiry time.Time) error {
+	data, err := json.Marshal(&resolvedHost{IPs: ips, Expiry: expiry})
+	if err != nil {
+		return ContextError(err)
+	}
+	err = dataStore.storeResolvedHost(host, data, expiry, resolvedHostClock())
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// GetResolvedHost retrieves the cached resolved IP addresses for the host.
+// If not found, or expired, it returns nil.
+func (dataStore *DataStore) GetResolvedHost(host string) ([]net.IP, error) {
+	data, err := dataStore.getResolvedHost(host)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var cached resolvedHost
+	err = json.Unmarshal(data, &cached)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if !resolvedHostClock().Before(cached.Expiry) {
+		return nil, nil
+	}
+	return cached.IPs, nil
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+// getServerEntryDisablePeriod returns the period for which a server is
+// disabled after the specified number of consecutive failures, or 0 when
+// the server is not to be disabled. The period doubles with each failure
+// past the threshold.
+func getServerEntryDisablePeriod(consecutiveFailures, threshold int) time.Duration {
+	if threshold <= 0 || consecutiveFailures < threshold {
+		return 0
+	}
+	period := SERVER_ENTRY_DISABLE_BASE_PERIOD
+	for i := threshold; i < consecutiveFailures; i++ {
+		period *= 2
+		if period >= SERVER_ENTRY_DISABLE_MAX_PERIOD {
+			return SERVER_ENTRY_DISABLE_MAX_PERIOD
+		}
+	}
+	return period
+}
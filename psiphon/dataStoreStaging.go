@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sort"
+)
+
+// stagedServerEntryKey identifies a staged server entry by its staging
+// sequence, and records its ServerPriority for ordering.
+type stagedServerEntryKey struct {
+	sequence int64
+	priority int
+}
+
+// stagedServerEntryKeys implements sort.Interface to sort staged server
+// entry keys in ascending priority order.
+type stagedServerEntryKeys []stagedServerEntryKey
+
+func (keys stagedServerEntryKeys) Len() int {
+	return len(keys)
+}
+
+func (keys stagedServerEntryKeys) Less(i, j int) bool {
+	return keys[i].priority < keys[j].priority
+}
+
+func (keys stagedServerEntryKeys) Swap(i, j int) {
+	keys[i], keys[j] = keys[j], keys[i]
+}
+
+// StoreStagedServerEntries stores the server entries in the staging area
+// identified by stagingId, with the same ordering, ranking and egress
+// region report as storing the entire list with StoreServerEntries or, when
+// byPriority is set, with StoreServerEntriesByPriority. Only a key for each
+// staged server entry is held in memory: the server entries are read from
+// the staging area, and stored, in batches of at most batchSize. The number
+// of staged server entries is returned.
+// There is an independent transaction for each entry insert/update.
+func (dataStore *DataStore) StoreStagedServerEntries(
+	stagingId string, batchSize int, replaceIfExists, byPriority bool) (int, error) {
+
+	keys, err := dataStore.getStagedServerEntryKeys(stagingId)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	if byPriority {
+		shuffleItems(len(keys), keys.Swap)
+		sort.Stable(keys)
+	} else {
+		orderForStore(dataStore.config, len(keys), keys.Swap)
+	}
+
+	// The interleave batch holds only the server entry IDs.
+	var interleaveBatch map[string]bool
+	if !byPriority &&
+		dataStore.config.ServerEntryStoreOrder == SERVER_ENTRY_STORE_ORDER_INTERLEAVE {
+		interleaveBatch = make(map[string]bool)
+	}
+
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		sequences := make([]int64, 0, end-start)
+		for _, key := range keys[start:end] {
+			sequences = append(sequences, key.sequence)
+		}
+		serverEntries, err := dataStore.getStagedServerEntries(stagingId, sequences)
+		if err != nil {
+			return 0, ContextError(err)
+		}
+		for _, serverEntry := range serverEntries {
+			err := dataStore.StoreServerEntry(serverEntry, replaceIfExists)
+			if err != nil {
+				return 0, ContextError(err)
+			}
+			if interleaveBatch != nil {
+				interleaveBatch[serverEntry.IpAddress] = true
+			}
+		}
+	}
+
+	if interleaveBatch != nil {
+		err = dataStore.interleaveRankedServerEntries(interleaveBatch)
+		if err != nil {
+			return 0, ContextError(err)
+		}
+	}
+
+	// Since there has possibly been a significant change in the server entries,
+	// take this opportunity to update the available egress regions.
+	dataStore.ReportAvailableRegions()
+
+	return len(keys), nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// DataStoreStats is the summary of datastore contents returned by
+// GetDataStoreStats. This type is shared by both dataStore implementations.
+type DataStoreStats struct {
+
+	// ServerEntryCount is the number of stored server entries.
+	ServerEntryCount int `json:"serverEntryCount"`
+
+	// RankedServerEntryCount is the number of stored server entries which
+	// are ranked. All sqlite server entries are ranked, while the BoltDB
+	// rank order is capped at rankedServerEntryCount entries.
+	RankedServerEntryCount int `json:"rankedServerEntryCount"`
+
+	// RegionCount is the number of distinct server entry regions. Server
+	// entries without a region are ignored.
+	RegionCount int `json:"regionCount"`
+
+	// SplitTunnelRegionCount is the number of regions with cached split
+	// tunnel routes.
+	SplitTunnelRegionCount int `json:"splitTunnelRegionCount"`
+
+	// UrlETagCount is the number of stored URL ETags.
+	UrlETagCount int `json:"urlETagCount"`
+
+	// KeyValueCount is the number of stored key/value pairs.
+	KeyValueCount int `json:"keyValueCount"`
+
+	// FileSize is the size, in bytes, of the datastore file.
+	FileSize int64 `json:"fileSize"`
+}
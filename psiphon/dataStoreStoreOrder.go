@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math/rand"
+)
+
+// orderServerEntriesForStore orders, in place, a list of server entries
+// which StoreServerEntries is about to store, one at a time, at
+// config.ServerEntryInsertPosition, according to config.ServerEntryStoreOrder.
+//
+// With the input-order policy, the list is reversed for the top and
+// next-to-top insert positions, as each entry is ranked above the entries
+// stored before it. With the interleave policy, the list is shuffled and
+// the entries are later re-ranked by interleaveRankedServerEntries.
+func orderServerEntriesForStore(config *Config, serverEntries []*ServerEntry) {
+	orderForStore(config, len(serverEntries), func(i, j int) {
+		serverEntries[i], serverEntries[j] = serverEntries[j], serverEntries[i]
+	})
+}
+
+// orderForStore applies the orderServerEntriesForStore policy to a list of
+// count items, which are reordered with swap. This allows a list which
+// stands in for the server entries, such as a staging index, to be
+// ordered as the server entries would be.
+func orderForStore(config *Config, count int, swap func(i, j int)) {
+	switch config.ServerEntryStoreOrder {
+	case SERVER_ENTRY_STORE_ORDER_INPUT_ORDER:
+		if config.ServerEntryInsertPosition != SERVER_ENTRY_INSERT_POSITION_TAIL {
+			for i, j := 0, count-1; i < j; i, j = i+1, j-1 {
+				swap(i, j)
+			}
+		}
+	default:
+		shuffleItems(count, swap)
+	}
+}
+
+// shuffleItems shuffles a list of count items, which are reordered with
+// swap, in the same way as shuffleServerEntries.
+func shuffleItems(count int, swap func(i, j int)) {
+	for index := count - 1; index > 0; index-- {
+		swap(index, rand.Intn(index+1))
+	}
+}
+
+// interleaveServerEntryIds returns the ranked server entry IDs with the
+// IDs in batch ranked alternately with the other IDs: the top ranked other
+// ID, followed by the top ranked batch ID, followed by the next other ID,
+// and so on. The relative order within each group is preserved. Once
+// either group is exhausted, the remaining IDs follow in order.
+func interleaveServerEntryIds(rankedServerEntryIds []string, batch map[string]bool) []string {
+	var batchIds, otherIds []string
+	for _, serverEntryId := range rankedServerEntryIds {
+		if batch[serverEntryId] {
+			batchIds = append(batchIds, serverEntryId)
+		} else {
+			otherIds = append(otherIds, serverEntryId)
+		}
+	}
+	interleavedIds := make([]string, 0, len(rankedServerEntryIds))
+	for i := 0; i < len(otherIds) || i < len(batchIds); i++ {
+		if i < len(otherIds) {
+			interleavedIds = append(interleavedIds, otherIds[i])
+		}
+		if i < len(batchIds) {
+			interleavedIds = append(interleavedIds, batchIds[i])
+		}
+	}
+	return interleavedIds
+}
+
+// makeServerEntryBatch returns the set of IDs of the server entries.
+func makeServerEntryBatch(serverEntries []*ServerEntry) map[string]bool {
+	batch := make(map[string]bool)
+	for _, serverEntry := range serverEntries {
+		batch[serverEntry.IpAddress] = true
+	}
+	return batch
+}
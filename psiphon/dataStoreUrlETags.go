@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+// urlETagClock returns the time recorded when a URL ETag is stored. Tests
+// replace it to control ETag ages.
+var urlETagClock = time.Now
+
+// PruneUrlETags deletes stored URL ETags which are older than maxAge, so
+// that the stored ETags don't grow without bound as different URLs are
+// fetched. ETags stored before timestamps were recorded are treated as the
+// oldest and are always deleted. The number of deleted ETags is reported
+// in a notice.
+func (dataStore *DataStore) PruneUrlETags(maxAge time.Duration) error {
+	count, err := dataStore.pruneUrlETags(urlETagClock().Add(-maxAge))
+	if err != nil {
+		return ContextError(err)
+	}
+	NoticeInfo("pruned %d URL ETags", count)
+	return nil
+}
@@ -26,8 +26,10 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -41,10 +43,21 @@ import (
 // building sqlite3/CGO (e.g., currently go mobile due to
 // https://github.com/mattn/go-sqlite3/issues/201), and perhaps ultimately as
 // the primary dataStore implementation.
-//
-type dataStore struct {
-	init sync.Once
-	db   *bolt.DB
+
+// DataStore is a handle to an open datastore. A process may open several
+// independent datastores, each in its own config.DataStoreDirectory, and
+// operate on them concurrently. The package-level datastore functions
+// operate on the default DataStore opened by InitDataStore.
+type DataStore struct {
+	config              *Config
+	filename            string
+	db                  *bolt.DB
+	archiveDB           *bolt.DB
+	compactionScheduler *dataStoreCompactionScheduler
+	codec               serverEntryCodec
+	operationLog        *dataStoreOperationLog
+	regionsMutex        sync.Mutex
+	availableRegions    []string
 }
 
 const (
@@ -54,62 +67,386 @@ const (
 	splitTunnelRouteETagsBucket = "splitTunnelRouteETags"
 	splitTunnelRouteDataBucket  = "splitTunnelRouteData"
 	urlETagsBucket              = "urlETags"
+	urlETagTimestampsBucket     = "urlETagTimestamps"
 	keyValueBucket              = "keyValues"
+	internalKeyValueBucket      = "internalKeyValues"
+	serverEntryStatsBucket      = "serverEntryStats"
+	archivedServerEntriesBucket = "archivedServerEntries"
+	preferredProtocolsBucket    = "preferredProtocols"
+	propagationChannelsBucket   = "propagationChannels"
+	regionTransferStatsBucket   = "regionTransferStats"
+	pinnedServerEntriesBucket   = "pinnedServerEntries"
+	serverEntrySeenBucket       = "serverEntrySeen"
+	protocolSuccessStatsBucket  = "protocolSuccessStats"
+	appMetadataBucket           = "appMetadata"
+	quarantineBucket            = "quarantinedServerEntries"
+	serverEntriesByRegionBucket = "serverEntriesByRegion"
+	stagedServerEntriesBucket   = "stagedServerEntries"
+	resolvedHostsBucket         = "resolvedHosts"
 	rankedServerEntryCount      = 100
+	compactionPendingKey        = "compactionPending"
 )
 
-var singleton dataStore
+// requiredBuckets are the buckets which OpenDataStore creates in the
+// live database.
+var requiredBuckets = []string{
+	serverEntriesBucket,
+	rankedServerEntriesBucket,
+	splitTunnelRouteETagsBucket,
+	splitTunnelRouteDataBucket,
+	urlETagsBucket,
+	urlETagTimestampsBucket,
+	keyValueBucket,
+	internalKeyValueBucket,
+	serverEntryStatsBucket,
+	preferredProtocolsBucket,
+	propagationChannelsBucket,
+	regionTransferStatsBucket,
+	pinnedServerEntriesBucket,
+	serverEntrySeenBucket,
+	protocolSuccessStatsBucket,
+	appMetadataBucket,
+	quarantineBucket,
+	serverEntriesByRegionBucket,
+	stagedServerEntriesBucket,
+	resolvedHostsBucket,
+}
+
+// OpenDataStore opens the datastore in config.DataStoreDirectory, creating
+// it if necessary, and returns a handle to it. The handle is safe for use
+// by concurrent goroutines. The caller must call Close when done with the
+// datastore.
+func OpenDataStore(config *Config) (*DataStore, error) {
+	filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
+	resolvedFilename, absErr := filepath.Abs(filename)
+	if absErr != nil {
+		resolvedFilename = filepath.Clean(filename)
+	}
+	db, err := openBoltDB(filename, config.DataStoreOpenRetryCount)
+	if err != nil {
+		return nil, fmt.Errorf("openDataStore failed to open database: %s", err)
+	}
+
+	db, err = compactDataStoreIfPending(db, filename)
+	if err != nil {
+		return nil, fmt.Errorf("openDataStore failed to compact database: %s", err)
+	}
+
+	regionIndexMissing := false
+	err = updateBoltDB(db, func(tx *bolt.Tx) error {
+		regionIndexMissing = (tx.Bucket([]byte(serverEntriesByRegionBucket)) == nil)
+		// Server entries staged by a handshake which didn't complete, as when
+		// the process exited mid-handshake, are discarded.
+		err := tx.DeleteBucket([]byte(stagedServerEntriesBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		for _, bucket := range requiredBuckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openDataStore failed to create buckets: %s", err)
+	}
+
+	// Archived server entries are kept in a separate file, so that cold
+	// server entries don't add to the size of the live database.
+	archiveFilename := filepath.Join(config.DataStoreDirectory, DATA_STORE_ARCHIVE_FILENAME)
+	archiveDB, err := openBoltDB(archiveFilename, config.DataStoreOpenRetryCount)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openDataStore failed to open archive database: %s", err)
+	}
+
+	err = updateBoltDB(archiveDB, func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(archivedServerEntriesBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		archiveDB.Close()
+		return nil, fmt.Errorf("openDataStore failed to create archive buckets: %s", err)
+	}
+
+	dataStore := &DataStore{
+		config:    config,
+		filename:  resolvedFilename,
+		db:        db,
+		archiveDB: archiveDB,
+	}
+	if config.DataStoreOperationLogSize > 0 {
+		dataStore.operationLog = newDataStoreOperationLog(config.DataStoreOperationLogSize)
+	}
+
+	err = dataStore.initServerEntryCodec()
+	if err != nil {
+		db.Close()
+		archiveDB.Close()
+		return nil, fmt.Errorf("openDataStore failed to initialize server entry codec: %s", err)
+	}
+
+	// Databases created before the region index was added are indexed
+	// when first opened.
+	if regionIndexMissing {
+		err = dataStore.rebuildServerEntryRegionIndex()
+		if err != nil {
+			db.Close()
+			archiveDB.Close()
+			return nil, fmt.Errorf("openDataStore failed to rebuild region index: %s", err)
+		}
+	}
+
+	if config.CompactDataStoreAutomatically {
+		dataStore.compactionScheduler = newDataStoreCompactionScheduler(
+			dataStore.getSize, dataStore.isCompactionPending, dataStore.Compact)
+		dataStore.compactionScheduler.start()
+	}
+
+	return dataStore, nil
+}
+
+// openBoltDB opens the BoltDB file. bolt.Open fails when the file lock
+// can't be obtained within its timeout, as happens when another process
+// has the file open. In that case, the open is retried up to retryCount
+// times, with exponential backoff.
+func openBoltDB(filename string, retryCount int) (*bolt.DB, error) {
+	retryDelay := DATA_STORE_OPEN_RETRY_INITIAL_DELAY
+	for attempt := 0; ; attempt++ {
+		db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		if err == nil {
+			return db, nil
+		}
+		if err != bolt.ErrTimeout || attempt >= retryCount {
+			return nil, ContextError(err)
+		}
+		NoticeAlert(
+			"failed to open datastore %s, retrying in %s (%d/%d): %s",
+			filename, retryDelay, attempt+1, retryCount, err)
+		time.Sleep(retryDelay)
+		retryDelay *= 2
+		if retryDelay > DATA_STORE_OPEN_RETRY_MAX_DELAY {
+			retryDelay = DATA_STORE_OPEN_RETRY_MAX_DELAY
+		}
+	}
+}
+
+func (dataStore *DataStore) checkInit() {
+	if dataStore.db == nil {
+		panic("checkInit: datastore not initialized")
+	}
+}
+
+// updateBoltDB runs updater in a read-write transaction on db. A failed
+// transaction is reported in a DataStoreError notice.
+func updateBoltDB(db *bolt.DB, updater func(*bolt.Tx) error) error {
+	err := db.Update(updater)
+	if err != nil {
+		NoticeDataStoreError("write", err)
+	}
+	return err
+}
+
+// viewBoltDB runs viewer in a read-only transaction on db. A failed
+// transaction is reported in a DataStoreError notice.
+func viewBoltDB(db *bolt.DB, viewer func(*bolt.Tx) error) error {
+	err := db.View(viewer)
+	if err != nil {
+		NoticeDataStoreError("read", err)
+	}
+	return err
+}
+
+// Close stops the datastore compaction scheduler, if running, and closes
+// the datastore. Close must not be called concurrently with any other
+// DataStore method.
+func (dataStore *DataStore) Close() {
+	if dataStore.compactionScheduler != nil {
+		dataStore.compactionScheduler.stop()
+	}
+	if dataStore.db != nil {
+		dataStore.db.Close()
+	}
+	if dataStore.archiveDB != nil {
+		dataStore.archiveDB.Close()
+	}
+	dataStore.compactionScheduler = nil
+	dataStore.db = nil
+	dataStore.archiveDB = nil
+}
+
+// Sync forces pending data store writes to be flushed to disk.
+// This may be called before the process is backgrounded or killed, as
+// is common on mobile platforms. Each bolt transaction is already synced
+// on commit; this additionally fsyncs the database files.
+func (dataStore *DataStore) Sync() error {
+	dataStore.checkInit()
+	for _, db := range []*bolt.DB{dataStore.db, dataStore.archiveDB} {
+		err := db.Sync()
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+	return nil
+}
 
-// InitDataStore initializes the singleton instance of dataStore. This
-// function uses a sync.Once and is safe for use by concurrent goroutines.
-// The underlying sql.DB connection pool is also safe.
+// Compact schedules the datastore file to be rebuilt, reclaiming
+// free space.
 //
-// Note: the sync.Once was more useful when initDataStore was private and
-// called on-demand by the public functions below. Now we require an explicit
-// InitDataStore() call with the filename passed in. The on-demand calls
-// have been replaced by checkInitDataStore() to assert that Init was called.
-func InitDataStore(config *Config) (err error) {
-	singleton.init.Do(func() {
-		filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
-		var db *bolt.DB
-		db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
-		if err != nil {
-			// Note: intending to set the err return value for InitDataStore
-			err = fmt.Errorf("initDataStore failed to open database: %s", err)
-			return
-		}
-
-		err = db.Update(func(tx *bolt.Tx) error {
-			requiredBuckets := []string{
-				serverEntriesBucket,
-				rankedServerEntriesBucket,
-				splitTunnelRouteETagsBucket,
-				splitTunnelRouteDataBucket,
-				urlETagsBucket,
-				keyValueBucket,
-			}
-			for _, bucket := range requiredBuckets {
-				_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+// BoltDB implementation note:
+// BoltDB files don't shrink in place. Compaction copies the database into a
+// new file, which requires exclusive access to the database. So compaction
+// is deferred until the next OpenDataStore, before the database is in use.
+func (dataStore *DataStore) Compact() error {
+	dataStore.checkInit()
+
+	err := dataStore.setInternalKeyValue(compactionPendingKey, "true")
+	if err != nil {
+		return ContextError(err)
+	}
+	NoticeInfo("scheduled datastore compaction")
+	return nil
+}
+
+// isCompactionPending indicates whether a compaction has been scheduled by
+// Compact and not yet performed.
+func (dataStore *DataStore) isCompactionPending() (bool, error) {
+	dataStore.checkInit()
+
+	value, err := dataStore.getInternalKeyValue(compactionPendingKey)
+	if err != nil {
+		return false, ContextError(err)
+	}
+	return value != "", nil
+}
+
+// Snapshot writes a consistent copy of the datastore to the specified file,
+// which may be opened as a datastore for offline analysis. The copy is
+// written within a read transaction, which doesn't block writers. Archived
+// server entries are not included in the snapshot.
+func (dataStore *DataStore) Snapshot(path string) error {
+	dataStore.checkInit()
+
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// compactDataStoreIfPending performs a compaction scheduled by
+// CompactDataStore. The live data is copied into a new file, which
+// replaces the existing file. The returned db replaces the input db,
+// which is closed.
+func compactDataStoreIfPending(db *bolt.DB, filename string) (*bolt.DB, error) {
+
+	isPending := false
+	err := viewBoltDB(db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(internalKeyValueBucket))
+		isPending = (bucket != nil && bucket.Get([]byte(compactionPendingKey)) != nil)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, ContextError(err)
+	}
+	if !isPending {
+		return db, nil
+	}
+
+	compactFilename := filename + ".compact"
+	os.Remove(compactFilename)
+	compactDB, err := bolt.Open(compactFilename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		db.Close()
+		return nil, ContextError(err)
+	}
+
+	err = viewBoltDB(db, func(tx *bolt.Tx) error {
+		return compactDB.Update(func(compactTx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				compactBucket, err := compactTx.CreateBucket(name)
 				if err != nil {
 					return err
 				}
-			}
-			return nil
+				return copyBucket(bucket, compactBucket)
+			})
 		})
-		if err != nil {
-			err = fmt.Errorf("initDataStore failed to create buckets: %s", err)
-			return
-		}
+	})
+	if err == nil {
+		err = updateBoltDB(compactDB, func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(internalKeyValueBucket)).Delete([]byte(compactionPendingKey))
+		})
+	}
+	compactDB.Close()
+	db.Close()
+	if err == nil {
+		err = os.Rename(compactFilename, filename)
+	}
+	if err != nil {
+		os.Remove(compactFilename)
+		NoticeAlert("datastore compaction failed: %s", err)
+	} else {
+		NoticeInfo("compacted datastore")
+	}
+
+	// The original file is reopened when compaction fails.
+	db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return db, nil
+}
 
-		singleton.db = db
+// copyBucket copies all keys, values, and nested buckets.
+func copyBucket(source, destination *bolt.Bucket) error {
+	return source.ForEach(func(key, value []byte) error {
+		if value == nil {
+			nestedBucket, err := destination.CreateBucket(key)
+			if err != nil {
+				return err
+			}
+			return copyBucket(source.Bucket(key), nestedBucket)
+		}
+		return destination.Put(key, value)
 	})
-	return err
 }
 
-func checkInitDataStore() {
-	if singleton.db == nil {
-		panic("checkInitDataStore: datastore not initialized")
+// getSize returns the size of the datastore file and the number
+// of bytes in the file which are not in use by buckets.
+func (dataStore *DataStore) getSize() (size, freeSize int64, err error) {
+	dataStore.checkInit()
+
+	fileInfo, err := os.Stat(dataStore.filename)
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+	size = fileInfo.Size()
+
+	inUse := int64(0)
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, bucket *bolt.Bucket) error {
+			stats := bucket.Stats()
+			inUse += int64(stats.BranchInuse + stats.LeafInuse)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, ContextError(err)
 	}
+
+	freeSize = size - inUse
+	if freeSize < 0 {
+		freeSize = 0
+	}
+	return size, freeSize, nil
 }
 
 // StoreServerEntry adds the server entry to the data store.
@@ -117,12 +454,18 @@ func checkInitDataStore() {
 // rank for iteration order (the previous top ranked entry is promoted). The
 // purpose of inserting at next-to-top is to keep the last selected server
 // as the top ranked server.
+// config.ServerEntryInsertPosition may instead specify the top or the
+// tail rank.
 // When replaceIfExists is true, an existing server entry record is
 // overwritten; otherwise, the existing record is unchanged.
 // If the server entry data is malformed, an alert notice is issued and
 // the entry is skipped; no error is returned.
-func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
-	checkInitDataStore()
+// Server entries outside of config.AllowedRegions, or with a web server
+// certificate not matching config.ExpectedWebCertFingerprints, are also
+// skipped with a notice and no error.
+func (dataStore *DataStore) StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("StoreServerEntry", serverEntry.IpAddress)
 
 	// Server entries should already be validated before this point,
 	// so instead of skipping we fail with an error.
@@ -131,16 +474,42 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 		return ContextError(errors.New("invalid server entry"))
 	}
 
+	if !dataStore.acceptServerEntry(serverEntry) {
+		return nil
+	}
+
 	// BoltDB implementation note:
-	// For simplicity, we don't maintain indexes on server entry
-	// region or supported protocols. Instead, we perform full-bucket
-	// scans with a filter. With a small enough database (thousands or
-	// even tens of thousand of server entries) and common enough
-	// values (e.g., many servers support all protocols), performance
-	// is expected to be acceptable.
+	// Server entries are indexed by region; see indexServerEntryRegion.
+	// For simplicity, we don't maintain an index on supported protocols.
+	// Instead, we perform scans with a filter. As many servers support
+	// all protocols, performance is expected to be acceptable.
+
+	partition := getServerEntryPartition(dataStore.config)
+	seen := serverEntrySeenClock()
 
 	serverEntryExists := false
-	err = singleton.db.Update(func(tx *bolt.Tx) error {
+	err = updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+
+		// The last seen timestamp is updated even when an existing server
+		// entry isn't replaced, as the server entry was re-delivered.
+		err := updateServerEntrySeen(tx, serverEntry.IpAddress, seen)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		// Each propagation channel partition is a sub-bucket of the
+		// propagation channels bucket, keyed by server entry ID.
+		if partition != "" {
+			propagationChannels := tx.Bucket([]byte(propagationChannelsBucket))
+			bucket, err := propagationChannels.CreateBucketIfNotExists([]byte(partition))
+			if err != nil {
+				return ContextError(err)
+			}
+			err = bucket.Put([]byte(serverEntry.IpAddress), []byte{1})
+			if err != nil {
+				return ContextError(err)
+			}
+		}
 
 		serverEntries := tx.Bucket([]byte(serverEntriesBucket))
 		serverEntryExists = (serverEntries.Get([]byte(serverEntry.IpAddress)) != nil)
@@ -153,7 +522,7 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 			return nil
 		}
 
-		data, err := json.Marshal(serverEntry)
+		data, err := dataStore.codec.Marshal(serverEntry)
 		if err != nil {
 			return ContextError(err)
 		}
@@ -162,7 +531,20 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 			return ContextError(err)
 		}
 
-		err = insertRankedServerEntry(tx, serverEntry.IpAddress, 1)
+		// A replaced server entry may have a different region.
+		err = indexServerEntryRegion(tx, serverEntry.IpAddress, serverEntry.Region)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		position := 1
+		switch dataStore.config.ServerEntryInsertPosition {
+		case SERVER_ENTRY_INSERT_POSITION_TOP:
+			position = 0
+		case SERVER_ENTRY_INSERT_POSITION_TAIL:
+			position = rankedServerEntryCount
+		}
+		err = insertRankedServerEntry(tx, serverEntry.IpAddress, position)
 		if err != nil {
 			return ContextError(err)
 		}
@@ -174,25 +556,124 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 	}
 
 	if !serverEntryExists {
-		NoticeInfo("updated server %s", serverEntry.IpAddress)
+		NoticeInfo("updated server %s", redactServerAddress(serverEntry.IpAddress))
+	}
+	return nil
+}
+
+// serverEntrySeen is the record stored in serverEntrySeenBucket,
+// keyed by server entry IP address.
+type serverEntrySeen struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func getServerEntrySeen(tx *bolt.Tx, ipAddress string) (*serverEntrySeen, error) {
+	seen := new(serverEntrySeen)
+	bucket := tx.Bucket([]byte(serverEntrySeenBucket))
+	data := bucket.Get([]byte(ipAddress))
+	if data == nil {
+		return seen, nil
+	}
+	err := json.Unmarshal(data, seen)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return seen, nil
+}
+
+func updateServerEntrySeen(tx *bolt.Tx, ipAddress string, now time.Time) error {
+	seen, err := getServerEntrySeen(tx, ipAddress)
+	if err != nil {
+		return ContextError(err)
+	}
+	if seen.FirstSeen.IsZero() {
+		seen.FirstSeen = now
+	}
+	seen.LastSeen = now
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return ContextError(err)
+	}
+	bucket := tx.Bucket([]byte(serverEntrySeenBucket))
+	err = bucket.Put([]byte(ipAddress), data)
+	if err != nil {
+		return ContextError(err)
 	}
 	return nil
 }
 
+// GetServerEntrySeen returns the times when the specified server entry was
+// first stored and last stored or re-delivered. Zero times are returned
+// when there is no record for the server entry.
+func (dataStore *DataStore) GetServerEntrySeen(ipAddress string) (firstSeen, lastSeen time.Time, err error) {
+	dataStore.checkInit()
+
+	var seen *serverEntrySeen
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		seen, err = getServerEntrySeen(tx, ipAddress)
+		return err
+	})
+
+	if err != nil {
+		return time.Time{}, time.Time{}, ContextError(err)
+	}
+	return seen.FirstSeen, seen.LastSeen, nil
+}
+
 // StoreServerEntries shuffles and stores a list of server entries.
 // Shuffling is performed on imported server entrues as part of client-side
-// load balancing.
+// load balancing. config.ServerEntryStoreOrder may instead specify that the
+// list is ranked in input order, or interleaved with the existing ranked
+// server entries.
+// There is an independent transaction for each entry insert/update.
+func (dataStore *DataStore) StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	dataStore.checkInit()
+
+	orderServerEntriesForStore(dataStore.config, serverEntries)
+
+	err := dataStore.storeServerEntries(serverEntries, replaceIfExists)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if dataStore.config.ServerEntryStoreOrder == SERVER_ENTRY_STORE_ORDER_INTERLEAVE {
+		err = dataStore.interleaveRankedServerEntries(makeServerEntryBatch(serverEntries))
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	return nil
+}
+
+// StoreServerEntriesByPriority stores a list of server entries, seeding the
+// rank order with the server entries in descending ServerPriority order
+// instead of shuffling. Entries with equal priority are shuffled.
 // There is an independent transaction for each entry insert/update.
-func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
-	checkInitDataStore()
+func (dataStore *DataStore) StoreServerEntriesByPriority(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	dataStore.checkInit()
+
+	// Each stored entry is assigned the next-to-top rank, so the entries
+	// are stored in ascending priority order: the highest priority entry
+	// is stored last and ends up ranked just below the top ranked entry.
+	shuffleServerEntries(serverEntries)
+	sort.Stable(serverEntriesByPriority(serverEntries))
 
+	return dataStore.storeServerEntries(serverEntries, replaceIfExists)
+}
+
+func shuffleServerEntries(serverEntries []*ServerEntry) {
 	for index := len(serverEntries) - 1; index > 0; index-- {
 		swapIndex := rand.Intn(index + 1)
 		serverEntries[index], serverEntries[swapIndex] = serverEntries[swapIndex], serverEntries[index]
 	}
+}
 
+func (dataStore *DataStore) storeServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
 	for _, serverEntry := range serverEntries {
-		err := StoreServerEntry(serverEntry, replaceIfExists)
+		err := dataStore.StoreServerEntry(serverEntry, replaceIfExists)
 		if err != nil {
 			return ContextError(err)
 		}
@@ -200,7 +681,7 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 
 	// Since there has possibly been a significant change in the server entries,
 	// take this opportunity to update the available egress regions.
-	ReportAvailableRegions()
+	dataStore.ReportAvailableRegions()
 
 	return nil
 }
@@ -208,12 +689,24 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 // PromoteServerEntry assigns the top rank (one more than current
 // max rank) to the specified server entry. Server candidates are
 // iterated in decending rank order, so this server entry will be
-// the first candidate in a subsequent tunnel establishment.
-func PromoteServerEntry(ipAddress string) error {
-	checkInitDataStore()
-
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
-		return insertRankedServerEntry(tx, ipAddress, 0)
+// the first candidate in a subsequent tunnel establishment. The promotion
+// is recorded in the promotion history; see GetPromotionHistory.
+func (dataStore *DataStore) PromoteServerEntry(ipAddress string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("PromoteServerEntry", ipAddress)
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		err := insertRankedServerEntry(tx, ipAddress, 0)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(keyValueBucket))
+		encodedHistory, err := appendPromotionEvent(
+			bucket.Get([]byte(DATA_STORE_PROMOTION_HISTORY_KEY)), ipAddress)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(DATA_STORE_PROMOTION_HISTORY_KEY), encodedHistory)
 	})
 
 	if err != nil {
@@ -253,6 +746,25 @@ func setRankedServerEntries(tx *bolt.Tx, rankedServerEntries []string) error {
 	return nil
 }
 
+// interleaveRankedServerEntries re-ranks the ranked server entries in
+// batch alternately with the other ranked server entries. See
+// interleaveServerEntryIds. Unranked server entries remain unranked.
+func (dataStore *DataStore) interleaveRankedServerEntries(batch map[string]bool) error {
+	dataStore.recordOperation("InterleaveRankedServerEntries", "")
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		rankedServerEntries, err := getRankedServerEntries(tx)
+		if err != nil {
+			return ContextError(err)
+		}
+		return setRankedServerEntries(
+			tx, interleaveServerEntryIds(rankedServerEntries, batch))
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
 func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) error {
 	rankedServerEntries, err := getRankedServerEntries(tx)
 	if err != nil {
@@ -267,17 +779,39 @@ func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) er
 	// any reasonable configuration of config.TunnelPoolSize.
 
 	if position >= len(rankedServerEntries) {
-		rankedServerEntries = append(rankedServerEntries, serverEntryId)
+		// When the list is full, a server entry inserted at the tail is
+		// left unranked, which is after all ranked server entries.
+		if len(rankedServerEntries) < rankedServerEntryCount {
+			rankedServerEntries = append(rankedServerEntries, serverEntryId)
+		}
 	} else {
-		end := len(rankedServerEntries)
-		if end+1 > rankedServerEntryCount {
-			end = rankedServerEntryCount
+		if len(rankedServerEntries) >= rankedServerEntryCount {
+			// When the list is full, the lowest ranked server entry which
+			// is not pinned is evicted to make room. When all ranked server
+			// entries are pinned, the new server entry is left unranked.
+			evictIndex := -1
+			bucket := tx.Bucket([]byte(pinnedServerEntriesBucket))
+			for i := len(rankedServerEntries) - 1; i >= 0; i-- {
+				if bucket.Get([]byte(rankedServerEntries[i])) == nil {
+					evictIndex = i
+					break
+				}
+			}
+			if evictIndex == -1 {
+				return nil
+			}
+			rankedServerEntries = append(
+				rankedServerEntries[:evictIndex],
+				rankedServerEntries[evictIndex+1:]...)
+			if evictIndex < position {
+				position -= 1
+			}
 		}
 		// insert: https://github.com/golang/go/wiki/SliceTricks
 		rankedServerEntries = append(
 			rankedServerEntries[:position],
 			append([]string{serverEntryId},
-				rankedServerEntries[position:end]...)...)
+				rankedServerEntries[position:]...)...)
 	}
 
 	err = setRankedServerEntries(tx, rankedServerEntries)
@@ -288,236 +822,1831 @@ func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) er
 	return nil
 }
 
-func serverEntrySupportsProtocol(serverEntry *ServerEntry, protocol string) bool {
-	// Note: for meek, the capabilities are FRONTED-MEEK and UNFRONTED-MEEK
-	// and the additonal OSSH service is assumed to be available internally.
-	requiredCapability := strings.TrimSuffix(protocol, "-OSSH")
-	return Contains(serverEntry.Capabilities, requiredCapability)
+// moveServerEntryToQuarantine stores the raw server entry record in the
+// quarantine bucket and removes the server entry from the store.
+func (dataStore *DataStore) moveServerEntryToQuarantine(serverEntryId string, data []byte) error {
+	dataStore.recordOperation("QuarantineServerEntry", serverEntryId)
+	return updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(quarantineBucket))
+		err := bucket.Put([]byte(serverEntryId), data)
+		if err != nil {
+			return ContextError(err)
+		}
+		return deleteServerEntry(tx, serverEntryId)
+	})
 }
 
-// ServerEntryIterator is used to iterate over
-// stored server entries in rank order.
-type ServerEntryIterator struct {
-	region                      string
-	protocol                    string
-	shuffleHeadLength           int
-	serverEntryIds              []string
-	serverEntryIndex            int
-	isTargetServerEntryIterator bool
-	hasNextTargetServerEntry    bool
-	targetServerEntry           *ServerEntry
+// GetQuarantinedServerEntryIds returns the IDs of all server entries which
+// have been quarantined.
+func (dataStore *DataStore) GetQuarantinedServerEntryIds() ([]string, error) {
+	dataStore.checkInit()
+	serverEntryIds := make([]string, 0)
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(quarantineBucket))
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			serverEntryIds = append(serverEntryIds, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return serverEntryIds, nil
 }
 
-// NewServerEntryIterator creates a new ServerEntryIterator
-func NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
-
-	// When configured, this target server entry is the only candidate
-	if config.TargetServerEntry != "" {
+// StageServerEntries appends server entries to the staging area identified
+// by stagingId. Staged server entries aren't candidates and aren't seen by
+// any other DataStore function; they're read back, in the order staged,
+// with ScanStagedServerEntries. This allows a large server list to be
+// written in bounded batches before it's known whether the list will be
+// kept.
+func (dataStore *DataStore) StageServerEntries(stagingId string, serverEntries []*ServerEntry) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("StageServerEntries", stagingId)
+	return updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(stagedServerEntriesBucket))
+		staging, err := bucket.CreateBucketIfNotExists([]byte(stagingId))
+		if err != nil {
+			return ContextError(err)
+		}
+		for _, serverEntry := range serverEntries {
+			data, err := json.Marshal(serverEntry)
+			if err != nil {
+				return ContextError(err)
+			}
+			sequence, err := staging.NextSequence()
+			if err != nil {
+				return ContextError(err)
+			}
+			// The keys are fixed width, so the key order is the staging order.
+			err = staging.Put([]byte(fmt.Sprintf("%016x", sequence)), data)
+			if err != nil {
+				return ContextError(err)
+			}
+		}
+		return nil
+	})
+}
+
+// ScanStagedServerEntries reads the server entries in the staging area
+// identified by stagingId, in the order they were staged, and calls scanner
+// with each batch of at most batchSize server entries. Each batch is read in
+// its own transaction, which is closed before scanner is called, so scanner
+// may store the server entries.
+func (dataStore *DataStore) ScanStagedServerEntries(
+	stagingId string, batchSize int, scanner func([]*ServerEntry) error) error {
+
+	dataStore.checkInit()
+	var lastKey []byte
+	for {
+		var serverEntries []*ServerEntry
+		err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+			staging := tx.Bucket([]byte(stagedServerEntriesBucket)).Bucket([]byte(stagingId))
+			if staging == nil {
+				return nil
+			}
+			cursor := staging.Cursor()
+			key, value := cursor.First()
+			if lastKey != nil {
+				key, value = cursor.Seek(lastKey)
+				if key != nil && string(key) == string(lastKey) {
+					key, value = cursor.Next()
+				}
+			}
+			for ; key != nil && len(serverEntries) < batchSize; key, value = cursor.Next() {
+				serverEntry := new(ServerEntry)
+				err := json.Unmarshal(value, serverEntry)
+				if err != nil {
+					return ContextError(err)
+				}
+				serverEntries = append(serverEntries, serverEntry)
+				lastKey = append([]byte(nil), key...)
+			}
+			return nil
+		})
+		if err != nil {
+			return ContextError(err)
+		}
+		if len(serverEntries) == 0 {
+			return nil
+		}
+		err = scanner(serverEntries)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+}
+
+// getStagedServerEntryKeys returns the key of each server entry in the
+// staging area identified by stagingId, in the order staged.
+func (dataStore *DataStore) getStagedServerEntryKeys(stagingId string) (stagedServerEntryKeys, error) {
+	dataStore.checkInit()
+
+	var keys stagedServerEntryKeys
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		staging := tx.Bucket([]byte(stagedServerEntriesBucket)).Bucket([]byte(stagingId))
+		if staging == nil {
+			return nil
+		}
+		cursor := staging.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			sequence, err := strconv.ParseInt(string(key), 16, 64)
+			if err != nil {
+				return ContextError(err)
+			}
+			var priority struct {
+				ServerPriority int `json:"serverPriority"`
+			}
+			err = json.Unmarshal(value, &priority)
+			if err != nil {
+				return ContextError(err)
+			}
+			keys = append(keys, stagedServerEntryKey{
+				sequence: sequence, priority: priority.ServerPriority})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return keys, nil
+}
+
+// getStagedServerEntries returns the server entries with the specified
+// staging sequences, in the order specified.
+func (dataStore *DataStore) getStagedServerEntries(
+	stagingId string, sequences []int64) ([]*ServerEntry, error) {
+
+	dataStore.checkInit()
+
+	serverEntries := make([]*ServerEntry, 0, len(sequences))
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		staging := tx.Bucket([]byte(stagedServerEntriesBucket)).Bucket([]byte(stagingId))
+		if staging == nil {
+			return ContextError(errors.New("staging area not found"))
+		}
+		for _, sequence := range sequences {
+			data := staging.Get([]byte(fmt.Sprintf("%016x", sequence)))
+			if data == nil {
+				return ContextError(fmt.Errorf("staged server entry %d not found", sequence))
+			}
+			serverEntry := new(ServerEntry)
+			err := json.Unmarshal(data, serverEntry)
+			if err != nil {
+				return ContextError(err)
+			}
+			serverEntries = append(serverEntries, serverEntry)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return serverEntries, nil
+}
+
+// DeleteStagedServerEntries discards the staging area identified by
+// stagingId. Staging areas which aren't discarded are discarded when the
+// datastore is next opened.
+func (dataStore *DataStore) DeleteStagedServerEntries(stagingId string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("DeleteStagedServerEntries", stagingId)
+	return updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(stagedServerEntriesBucket))
+		err := bucket.DeleteBucket([]byte(stagingId))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return ContextError(err)
+		}
+		return nil
+	})
+}
+
+// deleteServerEntry removes a server entry from the server entries bucket
+// and from the ranked server entries list.
+func deleteServerEntry(tx *bolt.Tx, serverEntryId string) error {
+	bucket := tx.Bucket([]byte(serverEntriesBucket))
+	err := bucket.Delete([]byte(serverEntryId))
+	if err != nil {
+		return ContextError(err)
+	}
+
+	rankedServerEntries, err := getRankedServerEntries(tx)
+	if err != nil {
+		return ContextError(err)
+	}
+	remainingServerEntries := make([]string, 0, len(rankedServerEntries))
+	for _, rankedServerEntryId := range rankedServerEntries {
+		if rankedServerEntryId != serverEntryId {
+			remainingServerEntries = append(remainingServerEntries, rankedServerEntryId)
+		}
+	}
+	err = setRankedServerEntries(tx, remainingServerEntries)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	propagationChannels := tx.Bucket([]byte(propagationChannelsBucket))
+	err = propagationChannels.ForEach(func(partition, _ []byte) error {
+		return propagationChannels.Bucket(partition).Delete([]byte(serverEntryId))
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	err = unindexServerEntryRegion(tx, serverEntryId)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
+
+// indexServerEntryRegion records the server entry in the region index,
+// replacing any record for a previous region. Each region is a sub-bucket
+// of the region index bucket, keyed by server entry ID. Server entries
+// with no region aren't indexed; they match only when no region is
+// specified, which doesn't use the index.
+func indexServerEntryRegion(tx *bolt.Tx, serverEntryId, region string) error {
+	err := unindexServerEntryRegion(tx, serverEntryId)
+	if err != nil {
+		return ContextError(err)
+	}
+	if region == "" {
+		return nil
+	}
+	index := tx.Bucket([]byte(serverEntriesByRegionBucket))
+	bucket, err := index.CreateBucketIfNotExists([]byte(region))
+	if err != nil {
+		return ContextError(err)
+	}
+	err = bucket.Put([]byte(serverEntryId), []byte{1})
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// unindexServerEntryRegion removes the server entry from the region index.
+func unindexServerEntryRegion(tx *bolt.Tx, serverEntryId string) error {
+	index := tx.Bucket([]byte(serverEntriesByRegionBucket))
+	err := index.ForEach(func(region, _ []byte) error {
+		return index.Bucket(region).Delete([]byte(serverEntryId))
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// getRegionIndexedServerEntryIds returns the IDs of the server entries in
+// any of the specified regions, as recorded in the region index.
+func getRegionIndexedServerEntryIds(tx *bolt.Tx, regions []string) map[string]bool {
+	serverEntryIds := make(map[string]bool)
+	index := tx.Bucket([]byte(serverEntriesByRegionBucket))
+	for _, region := range regions {
+		bucket := index.Bucket([]byte(region))
+		if bucket == nil {
+			continue
+		}
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			serverEntryIds[string(key)] = true
+		}
+	}
+	return serverEntryIds
+}
+
+// rebuildServerEntryRegionIndex recreates the region index from the
+// stored server entries. Server entries which can't be decoded aren't
+// indexed, and are quarantined.
+func (dataStore *DataStore) rebuildServerEntryRegionIndex() error {
+	var undecodable undecodableServerEntries
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(serverEntriesByRegionBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return ContextError(err)
+		}
+		index, err := tx.CreateBucket([]byte(serverEntriesByRegionBucket))
+		if err != nil {
+			return ContextError(err)
+		}
+		// As the new index is empty, each server entry is put directly into
+		// its region bucket, skipping the unindexing step of
+		// indexServerEntryRegion, which scans every region.
+		regionBuckets := make(map[string]*bolt.Bucket)
+		undecodable, err = dataStore.forEachDecodedServerEntry(
+			tx, func(serverEntryId string, serverEntry *ServerEntry) error {
+				if serverEntry.Region == "" {
+					return nil
+				}
+				regionBucket, ok := regionBuckets[serverEntry.Region]
+				if !ok {
+					var err error
+					regionBucket, err = index.CreateBucket([]byte(serverEntry.Region))
+					if err != nil {
+						return ContextError(err)
+					}
+					regionBuckets[serverEntry.Region] = regionBucket
+				}
+				err := regionBucket.Put([]byte(serverEntryId), []byte{1})
+				if err != nil {
+					return ContextError(err)
+				}
+				return nil
+			})
+		return err
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return nil
+}
+
+// RevalidateServerEntries runs ValidateServerEntry on all stored server
+// entries and deletes those which are no longer valid, such as server
+// entries stored before a validation rule was added. Server entries which
+// can't be decoded are also deleted. The server entries are deleted from
+// the ranked server entries list as well. The number of deleted server
+// entries is returned.
+func (dataStore *DataStore) RevalidateServerEntries() (removed int, err error) {
+	dataStore.checkInit()
+	dataStore.recordOperation("RevalidateServerEntries", "")
+
+	err = updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var invalidIds []string
+		undecodable, err := dataStore.forEachDecodedServerEntry(
+			tx, func(serverEntryId string, serverEntry *ServerEntry) error {
+				err := ValidateServerEntry(serverEntry)
+				if err != nil {
+					NoticeAlert("invalid stored server %s: %s", redactServerAddress(serverEntryId), err)
+					invalidIds = append(invalidIds, serverEntryId)
+				}
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+
+		// Undecodable server entries are deleted, rather than quarantined,
+		// along with the invalid server entries.
+		for serverEntryId, record := range undecodable {
+			NoticeAlert("invalid stored server %s: %s", redactServerAddress(serverEntryId), record.err)
+			invalidIds = append(invalidIds, serverEntryId)
+		}
+
+		for _, id := range invalidIds {
+			err := deleteServerEntry(tx, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		removed = len(invalidIds)
+		return nil
+	})
+
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return removed, nil
+}
+
+// RebuildRankedServerEntries discards the ranked server entries list and
+// rebuilds it from all stored server entries, in random order, capped at
+// rankedServerEntryCount. This recovers from a ranked list which has been
+// externally manipulated or corrupted. Pinned server entries are ranked
+// first, so that they remain ranked.
+func (dataStore *DataStore) RebuildRankedServerEntries() error {
+	dataStore.checkInit()
+	dataStore.recordOperation("RebuildRankedServerEntries", "")
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		pinned := tx.Bucket([]byte(pinnedServerEntriesBucket))
+		var pinnedServerEntryIds, serverEntryIds []string
+		cursor := tx.Bucket([]byte(serverEntriesBucket)).Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			if pinned.Get(key) != nil {
+				pinnedServerEntryIds = append(pinnedServerEntryIds, string(key))
+			} else {
+				serverEntryIds = append(serverEntryIds, string(key))
+			}
+		}
+
+		for _, ids := range [][]string{pinnedServerEntryIds, serverEntryIds} {
+			for index := len(ids) - 1; index > 0; index-- {
+				swapIndex := rand.Intn(index + 1)
+				ids[index], ids[swapIndex] = ids[swapIndex], ids[index]
+			}
+		}
+
+		rankedServerEntries := append(pinnedServerEntryIds, serverEntryIds...)
+		if len(rankedServerEntries) > rankedServerEntryCount {
+			rankedServerEntries = rankedServerEntries[:rankedServerEntryCount]
+		}
+		if rankedServerEntries == nil {
+			rankedServerEntries = []string{}
+		}
+
+		return setRankedServerEntries(tx, rankedServerEntries)
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// ArchiveServerEntry moves the specified server entry from the live
+// database to the archive database. Archived server entries are not
+// candidates for tunnel establishment.
+// The record is written to the archive before it's deleted from the
+// live database, so a failure may leave a duplicate, but never loses
+// the record.
+func (dataStore *DataStore) ArchiveServerEntry(ipAddress string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("ArchiveServerEntry", ipAddress)
+
+	var data []byte
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(serverEntriesBucket))
+		value := bucket.Get([]byte(ipAddress))
+		if value != nil {
+			// Copy, as the value is only valid during the transaction
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+	if data == nil {
+		return ContextError(fmt.Errorf("server entry not found: %s", ipAddress))
+	}
+
+	err = updateBoltDB(dataStore.archiveDB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(archivedServerEntriesBucket))
+		return bucket.Put([]byte(ipAddress), data)
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	err = updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		return deleteServerEntry(tx, ipAddress)
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
+
+// RestoreServerEntry moves the specified server entry from the archive
+// database back to the live database. The restored server entry is
+// stored as with StoreServerEntry. A server entry which the datastore
+// doesn't accept, such as one outside of config.AllowedRegions, isn't
+// restored; an error is returned and the server entry remains archived.
+func (dataStore *DataStore) RestoreServerEntry(ipAddress string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("RestoreServerEntry", ipAddress)
+
+	var data []byte
+	err := viewBoltDB(dataStore.archiveDB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(archivedServerEntriesBucket))
+		value := bucket.Get([]byte(ipAddress))
+		if value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+	if data == nil {
+		return ContextError(fmt.Errorf("archived server entry not found: %s", ipAddress))
+	}
+
+	serverEntry := new(ServerEntry)
+	err = dataStore.codec.Unmarshal(data, serverEntry)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	// StoreServerEntry skips, without an error, server entries which aren't
+	// accepted, so acceptance is checked before the archived record is
+	// deleted.
+	if !dataStore.acceptServerEntry(serverEntry) {
+		return ContextError(fmt.Errorf("archived server entry not accepted: %s", ipAddress))
+	}
+	err = dataStore.StoreServerEntry(serverEntry, true)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	err = updateBoltDB(dataStore.archiveDB, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(archivedServerEntriesBucket))
+		return bucket.Delete([]byte(ipAddress))
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
+
+// GetServerEntry returns the stored server entry with the specified
+// IP address. If not found, it returns a nil value.
+func (dataStore *DataStore) GetServerEntry(ipAddress string) (*ServerEntry, error) {
+	serverEntries, err := dataStore.GetServerEntries([]string{ipAddress})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if len(serverEntries) == 0 {
+		return nil, nil
+	}
+	return serverEntries[0], nil
+}
+
+// GetServerEntries returns the stored server entries with the specified
+// IP addresses, in the same order. IP addresses with no stored server entry
+// are skipped. All server entries are read in a single transaction.
+func (dataStore *DataStore) GetServerEntries(ipAddresses []string) ([]*ServerEntry, error) {
+	dataStore.checkInit()
+
+	serverEntries := make([]*ServerEntry, 0, len(ipAddresses))
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		undecodable, err = dataStore.forEachDecodedServerEntryId(
+			tx, ipAddresses, func(_ string, serverEntry *ServerEntry) error {
+				serverEntries = append(serverEntries, MakeCompatibleServerEntry(serverEntry))
+				return nil
+			})
+		return err
+	})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return serverEntries, nil
+}
+
+// SetServerEntryPreferredProtocol records the protocol which successfully
+// established a tunnel to the specified server. The protocol must be a
+// supported tunnel protocol and the server entry must have the required
+// capability.
+func (dataStore *DataStore) SetServerEntryPreferredProtocol(ipAddress, protocol string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetServerEntryPreferredProtocol", ipAddress)
+
+	err := validateServerEntryPreferredProtocol(dataStore, ipAddress, protocol)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	err = updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(preferredProtocolsBucket))
+		return bucket.Put([]byte(ipAddress), []byte(protocol))
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// GetServerEntryPreferredProtocol retrieves the recorded preferred protocol
+// for the specified server. If not found, it returns an empty string value.
+func (dataStore *DataStore) GetServerEntryPreferredProtocol(ipAddress string) (protocol string, err error) {
+	dataStore.checkInit()
+
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(preferredProtocolsBucket))
+		protocol = string(bucket.Get([]byte(ipAddress)))
+		return nil
+	})
+
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return protocol, nil
+}
+
+// SetServerEntryPinned marks or unmarks the specified server entry as
+// pinned. Pinned server entries are never evicted from the ranked server
+// entries list. The pinned mark is retained when the server entry is
+// archived.
+func (dataStore *DataStore) SetServerEntryPinned(ipAddress string, pinned bool) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetServerEntryPinned", ipAddress)
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pinnedServerEntriesBucket))
+		if pinned {
+			return bucket.Put([]byte(ipAddress), []byte{1})
+		}
+		return bucket.Delete([]byte(ipAddress))
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// IsServerEntryPinned returns true when the specified server entry is
+// pinned.
+func (dataStore *DataStore) IsServerEntryPinned(ipAddress string) (pinned bool, err error) {
+	dataStore.checkInit()
+
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pinnedServerEntriesBucket))
+		pinned = (bucket.Get([]byte(ipAddress)) != nil)
+		return nil
+	})
+
+	if err != nil {
+		return false, ContextError(err)
+	}
+	return pinned, nil
+}
+
+// getChronologicalServerEntryIds returns all server entry IDs in ascending
+// firstSeen order. Server entries with no firstSeen record sort last.
+func (dataStore *DataStore) getChronologicalServerEntryIds() ([]string, error) {
+	sortable := &serverEntryIdsByFirstSeen{
+		serverEntryIds: make([]string, 0),
+		firstSeen:      make(map[string]time.Time),
+	}
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(serverEntriesBucket)).Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			serverEntryId := string(key)
+			seen, err := getServerEntrySeen(tx, serverEntryId)
+			if err != nil {
+				return err
+			}
+			sortable.serverEntryIds = append(sortable.serverEntryIds, serverEntryId)
+			sortable.firstSeen[serverEntryId] = seen.FirstSeen
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	sort.Stable(sortable)
+	return sortable.serverEntryIds, nil
+}
+
+// serverEntryIdsByFirstSeen sorts server entry IDs in ascending firstSeen
+// order. Server entries without a firstSeen time sort after those with one.
+type serverEntryIdsByFirstSeen struct {
+	serverEntryIds []string
+	firstSeen      map[string]time.Time
+}
+
+func (s *serverEntryIdsByFirstSeen) Len() int {
+	return len(s.serverEntryIds)
+}
+
+func (s *serverEntryIdsByFirstSeen) Less(i, j int) bool {
+	firstSeenI := s.firstSeen[s.serverEntryIds[i]]
+	firstSeenJ := s.firstSeen[s.serverEntryIds[j]]
+	if firstSeenI.IsZero() || firstSeenJ.IsZero() {
+		return !firstSeenI.IsZero() && firstSeenJ.IsZero()
+	}
+	return firstSeenI.Before(firstSeenJ)
+}
+
+func (s *serverEntryIdsByFirstSeen) Swap(i, j int) {
+	s.serverEntryIds[i], s.serverEntryIds[j] = s.serverEntryIds[j], s.serverEntryIds[i]
+}
+
+// ServerEntryIterator is used to iterate over
+// stored server entries in rank order.
+type ServerEntryIterator struct {
+	dataStore                   *DataStore
+	region                      string
+	regions                     []string
+	protocol                    string
+	shuffleHeadLength           int
+	usePreferredProtocol        bool
+	latencyWeighted             bool
+	reshuffleOnReset            bool
+	chronological               bool
+	partition                   string
+	clientVersion               string
+	onCandidate                 func(*ServerEntry, bool, string)
+	shuffledServerEntryIds      []string
+	serverEntryIds              []string
+	serverEntryIndex            int
+	isTargetServerEntryIterator bool
+	hasNextTargetServerEntry    bool
+	targetServerEntry           *ServerEntry
+}
+
+// NewServerEntryIterator creates a new ServerEntryIterator
+func (dataStore *DataStore) NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+
+	if config.RequireEgressRegion && config.EgressRegion == "" {
+		return nil, ContextError(errors.New("egress region required"))
+	}
+
+	// When configured, this target server entry is the only candidate
+	if config.TargetServerEntry != "" && !config.TargetServerEntryPreferred {
 		return newTargetServerEntryIterator(config)
 	}
 
-	checkInitDataStore()
-	iterator = &ServerEntryIterator{
-		region:                      config.EgressRegion,
-		protocol:                    config.TunnelProtocol,
-		shuffleHeadLength:           config.TunnelPoolSize,
-		isTargetServerEntryIterator: false,
+	dataStore.checkInit()
+	iterator = &ServerEntryIterator{
+		dataStore:                   dataStore,
+		region:                      config.EgressRegion,
+		regions:                     getRegionGroupMembers(config.EgressRegionGroups, config.EgressRegion),
+		protocol:                    config.TunnelProtocol,
+		shuffleHeadLength:           config.TunnelPoolSize,
+		usePreferredProtocol:        config.UseServerEntryPreferredProtocol,
+		latencyWeighted:             config.LatencyWeightedServerEntries,
+		reshuffleOnReset:            config.ReshuffleOnReset == nil || *config.ReshuffleOnReset,
+		partition:                   getServerEntryPartition(config),
+		clientVersion:               config.ClientVersion,
+		onCandidate:                 config.OnCandidate,
+		isTargetServerEntryIterator: false,
+	}
+
+	// When configured as preferred, the target server entry is the first
+	// candidate, followed by the stored server entries
+	if config.TargetServerEntry != "" {
+		iterator.targetServerEntry, err = decodeTargetServerEntry(config)
+		if err != nil {
+			return nil, err
+		}
+		NoticeInfo("using preferred TargetServerEntry: %s",
+			redactServerAddress(iterator.targetServerEntry.IpAddress))
+	}
+
+	err = iterator.Reset()
+	if err != nil {
+		return nil, err
+	}
+	return iterator, nil
+}
+
+// NewChronologicalServerEntryIterator creates a new ServerEntryIterator which
+// returns server entries in ascending firstSeen order, instead of in rank
+// order; see GetServerEntrySeen. Server entries with no firstSeen record are
+// returned last. The config region, protocol, and propagation channel filters
+// apply as for NewServerEntryIterator; TargetServerEntry is not used.
+func (dataStore *DataStore) NewChronologicalServerEntryIterator(config *Config) (*ServerEntryIterator, error) {
+
+	if config.RequireEgressRegion && config.EgressRegion == "" {
+		return nil, ContextError(errors.New("egress region required"))
+	}
+
+	dataStore.checkInit()
+	iterator := &ServerEntryIterator{
+		dataStore:            dataStore,
+		region:               config.EgressRegion,
+		regions:              getRegionGroupMembers(config.EgressRegionGroups, config.EgressRegion),
+		protocol:             config.TunnelProtocol,
+		usePreferredProtocol: config.UseServerEntryPreferredProtocol,
+		reshuffleOnReset:     true,
+		chronological:        true,
+		partition:            getServerEntryPartition(config),
+		clientVersion:        config.ClientVersion,
+		onCandidate:          config.OnCandidate,
+	}
+
+	err := iterator.Reset()
+	if err != nil {
+		return nil, err
+	}
+	return iterator, nil
+}
+
+// newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
+func newTargetServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+	serverEntry, err := decodeTargetServerEntry(config)
+	if err != nil {
+		return nil, err
+	}
+	iterator = &ServerEntryIterator{
+		isTargetServerEntryIterator: true,
+		hasNextTargetServerEntry:    true,
+		targetServerEntry:           serverEntry,
+	}
+	NoticeInfo("using TargetServerEntry: %s", redactServerAddress(serverEntry.IpAddress))
+	return iterator, nil
+}
+
+// decodeTargetServerEntry decodes config.TargetServerEntry and checks that
+// it's compatible with the configured EgressRegion and TunnelProtocol.
+func decodeTargetServerEntry(config *Config) (*ServerEntry, error) {
+	serverEntry, err := DecodeServerEntry(config.TargetServerEntry)
+	if err != nil {
+		return nil, err
+	}
+	if !regionMatches(
+		getRegionGroupMembers(config.EgressRegionGroups, config.EgressRegion), serverEntry.Region) {
+
+		return nil, errors.New("TargetServerEntry does not support EgressRegion")
+	}
+	if config.TunnelProtocol != "" {
+		if !serverEntry.SupportsProtocol(config.TunnelProtocol) {
+			return nil, errors.New("TargetServerEntry does not support TunnelProtocol")
+		}
+	}
+	return serverEntry, nil
+}
+
+// Reset a NewServerEntryIterator to the start of its cycle. The next
+// call to Next will return the first server entry.
+func (iterator *ServerEntryIterator) Reset() error {
+	iterator.Close()
+
+	iterator.hasNextTargetServerEntry = (iterator.targetServerEntry != nil)
+
+	if iterator.isTargetServerEntryIterator {
+		return nil
+	}
+
+	// When no protocol is specified, the iterator accepts all supported
+	// protocols, so the count is also broken down by protocol. The region
+	// and protocol count doesn't reflect the other filters applied by Next,
+	// so NoCandidateServers is determined by the candidate count, which is
+	// made in the same scan.
+	count, protocolCounts, candidateCount, err := iterator.countCandidates()
+	if err != nil {
+		return ContextError(err)
+	}
+	NoticeCandidateServers(iterator.region, iterator.protocol, count, protocolCounts)
+	if candidateCount == 0 {
+		NoticeNoCandidateServers(iterator.region, iterator.protocol)
+	}
+
+	if iterator.chronological {
+		serverEntryIds, err := iterator.dataStore.getChronologicalServerEntryIds()
+		if err != nil {
+			return ContextError(err)
+		}
+		iterator.serverEntryIds = serverEntryIds
+		iterator.serverEntryIndex = 0
+		return nil
+	}
+
+	// When ReshuffleOnReset is disabled, the candidate order computed by
+	// the first Reset is reused.
+	if !iterator.reshuffleOnReset && iterator.shuffledServerEntryIds != nil {
+		iterator.serverEntryIds = iterator.shuffledServerEntryIds
+		iterator.serverEntryIndex = 0
+		return nil
+	}
+
+	// This query implements the Psiphon server candidate selection
+	// algorithm: the first TunnelPoolSize server candidates are in rank
+	// (priority) order, to favor previously successful servers; then the
+	// remaining long tail is shuffled to raise up less recent candidates.
+
+	// BoltDB implementation note:
+	// We don't keep a transaction open for the duration of the iterator
+	// because this would expose the following semantics to consumer code:
+	//
+	//     Read-only transactions and read-write transactions ... generally
+	//     shouldn't be opened simultaneously in the same goroutine. This can
+	//     cause a deadlock as the read-write transaction needs to periodically
+	//     re-map the data file but it cannot do so while a read-only
+	//     transaction is open.
+	//     (https://github.com/boltdb/bolt)
+	//
+	// So the uderlying serverEntriesBucket could change after the serverEntryIds
+	// list is built.
+
+	var serverEntryIds []string
+	latencies := make(map[string]time.Duration)
+
+	err = viewBoltDB(iterator.dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		serverEntryIds, err = getRankedServerEntries(tx)
+		if err != nil {
+			return err
+		}
+
+		// When a region is specified, the candidates are limited to the
+		// server entries in the region index. Otherwise, all server entries
+		// are candidates. The index isn't used when there's an OnCandidate
+		// callback, which reports server entries skipped due to region.
+		var regionServerEntryIds map[string]bool
+		if len(iterator.regions) > 0 && iterator.onCandidate == nil {
+			regionServerEntryIds = getRegionIndexedServerEntryIds(tx, iterator.regions)
+			rankedServerEntryIds := serverEntryIds
+			serverEntryIds = make([]string, 0, len(rankedServerEntryIds))
+			for _, serverEntryId := range rankedServerEntryIds {
+				if regionServerEntryIds[serverEntryId] {
+					serverEntryIds = append(serverEntryIds, serverEntryId)
+				}
+			}
+		}
+
+		skipServerEntryIds := make(map[string]bool)
+		for _, serverEntryId := range serverEntryIds {
+			skipServerEntryIds[serverEntryId] = true
+		}
+
+		if regionServerEntryIds != nil {
+			var unrankedServerEntryIds []string
+			for serverEntryId := range regionServerEntryIds {
+				if !skipServerEntryIds[serverEntryId] {
+					unrankedServerEntryIds = append(unrankedServerEntryIds, serverEntryId)
+				}
+			}
+			sort.Sort(sort.Reverse(sort.StringSlice(unrankedServerEntryIds)))
+			serverEntryIds = append(serverEntryIds, unrankedServerEntryIds...)
+		} else {
+			bucket := tx.Bucket([]byte(serverEntriesBucket))
+			cursor := bucket.Cursor()
+			for key, _ := cursor.Last(); key != nil; key, _ = cursor.Prev() {
+				serverEntryId := string(key)
+				if _, ok := skipServerEntryIds[serverEntryId]; ok {
+					continue
+				}
+				serverEntryIds = append(serverEntryIds, serverEntryId)
+			}
+		}
+
+		if iterator.latencyWeighted {
+			cursor := tx.Bucket([]byte(serverEntryStatsBucket)).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				stats := new(serverEntryStats)
+				err := json.Unmarshal(value, stats)
+				if err != nil {
+					return err
+				}
+				if stats.Latency > 0 {
+					latencies[string(key)] = stats.Latency
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if !iterator.latencyWeighted {
+		latencies = nil
+	}
+	shuffleCandidateServerEntryIds(serverEntryIds, iterator.shuffleHeadLength, latencies)
+
+	iterator.serverEntryIds = serverEntryIds
+	iterator.serverEntryIndex = 0
+
+	if !iterator.reshuffleOnReset {
+		iterator.shuffledServerEntryIds = serverEntryIds
+	}
+
+	return nil
+}
+
+// Reshuffle discards any candidate order retained when ReshuffleOnReset
+// is disabled and resets the iterator with a newly computed order.
+func (iterator *ServerEntryIterator) Reshuffle() error {
+	iterator.shuffledServerEntryIds = nil
+	return iterator.Reset()
+}
+
+// RefreshRanked merges ranked server entries stored since the iterator was
+// reset, such as server entries received in a handshake, into the remaining
+// candidates. The new server entries, in rank order, are the next
+// candidates; the order of the remaining candidates is unchanged and
+// iteration isn't restarted. RefreshRanked has no effect for target server
+// entry iterators or in chronological mode.
+func (iterator *ServerEntryIterator) RefreshRanked() error {
+	if iterator.isTargetServerEntryIterator ||
+		iterator.chronological ||
+		iterator.serverEntryIds == nil {
+		return nil
+	}
+
+	knownServerEntryIds := makeServerEntryIdSet(iterator.serverEntryIds)
+	var newServerEntryIds []string
+	err := viewBoltDB(iterator.dataStore.db, func(tx *bolt.Tx) error {
+		rankedServerEntries, err := getRankedServerEntries(tx)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(serverEntriesBucket))
+		for _, serverEntryId := range rankedServerEntries {
+			if !knownServerEntryIds[serverEntryId] &&
+				bucket.Get([]byte(serverEntryId)) != nil {
+
+				newServerEntryIds = append(newServerEntryIds, serverEntryId)
+				knownServerEntryIds[serverEntryId] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if len(newServerEntryIds) == 0 {
+		return nil
+	}
+
+	// A new list is made as iterator.serverEntryIds may be the retained
+	// candidate order, which is not modified.
+	serverEntryIds := make([]string, 0, len(iterator.serverEntryIds)+len(newServerEntryIds))
+	serverEntryIds = append(serverEntryIds, iterator.serverEntryIds[:iterator.serverEntryIndex]...)
+	serverEntryIds = append(serverEntryIds, newServerEntryIds...)
+	serverEntryIds = append(serverEntryIds, iterator.serverEntryIds[iterator.serverEntryIndex:]...)
+	iterator.serverEntryIds = serverEntryIds
+
+	return nil
+}
+
+// Close cleans up resources associated with a ServerEntryIterator.
+func (iterator *ServerEntryIterator) Close() {
+	iterator.serverEntryIds = nil
+	iterator.serverEntryIndex = 0
+}
+
+// Next returns the next server entry, by rank, for a ServerEntryIterator.
+// Returns nil with no error when there is no next item.
+func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error) {
+	defer func() {
+		if err != nil {
+			iterator.Close()
+		}
+	}()
+
+	if iterator.hasNextTargetServerEntry {
+		iterator.hasNextTargetServerEntry = false
+		iterator.reportCandidate(iterator.targetServerEntry, true, "")
+		return MakeCompatibleServerEntry(iterator.targetServerEntry), nil
+	}
+
+	if iterator.isTargetServerEntryIterator {
+		return nil, nil
+	}
+
+	// When a region is specified and there's no OnCandidate callback, Reset
+	// limits serverEntryIds to the server entries in the region index.
+	// Otherwise, and for all other filters, including protocol, for which
+	// there's no index, loop until we have the next server entry that
+	// matches the iterator filter requirements.
+	for {
+		if iterator.serverEntryIndex >= len(iterator.serverEntryIds) {
+			// There is no next item
+			return nil, nil
+		}
+
+		serverEntryId := iterator.serverEntryIds[iterator.serverEntryIndex]
+		iterator.serverEntryIndex += 1
+
+		var data []byte
+		inPartition := true
+		var stats *serverEntryStats
+		err = viewBoltDB(iterator.dataStore.db, func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(serverEntriesBucket))
+			// Copy the record, as it may be quarantined after the
+			// transaction ends.
+			if value := bucket.Get([]byte(serverEntryId)); value != nil {
+				data = append([]byte(nil), value...)
+			}
+			if iterator.partition != "" {
+				partition := tx.Bucket([]byte(propagationChannelsBucket)).Bucket([]byte(iterator.partition))
+				inPartition = (partition != nil && partition.Get([]byte(serverEntryId)) != nil)
+			}
+			var err error
+			stats, err = getServerEntryStats(tx, serverEntryId)
+			return err
+		})
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		if data == nil {
+			// The server entry was archived after the serverEntryIds
+			// list was built.
+			continue
+		}
+
+		var decodeErr error
+		serverEntry, decodeErr = decodeStoredServerEntry(iterator.dataStore.codec, data)
+		if decodeErr != nil {
+			iterator.dataStore.quarantineServerEntry(serverEntryId, data, decodeErr)
+			continue
+		}
+
+		skipReason := iterator.getSkipReason(serverEntry, inPartition, stats)
+		if skipReason != "" {
+			iterator.reportCandidate(serverEntry, false, skipReason)
+			continue
+		}
+
+		break
+	}
+
+	if iterator.usePreferredProtocol {
+		serverEntry.PreferredProtocol, err = iterator.dataStore.GetServerEntryPreferredProtocol(serverEntry.IpAddress)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	iterator.reportCandidate(serverEntry, true, "")
+
+	return MakeCompatibleServerEntry(serverEntry), nil
+}
+
+// getSkipReason returns the reason Next skips the server entry, or "" when
+// the server entry is a candidate.
+func (iterator *ServerEntryIterator) getSkipReason(
+	serverEntry *ServerEntry, inPartition bool, stats *serverEntryStats) string {
+
+	// Skip the preferred target server entry, if any, as it's already
+	// been returned as the first candidate.
+	if iterator.targetServerEntry != nil &&
+		serverEntry.IpAddress == iterator.targetServerEntry.IpAddress {
+		return SERVER_ENTRY_SKIP_REASON_TARGET
+	}
+	if !regionMatches(iterator.regions, serverEntry.Region) {
+		return SERVER_ENTRY_SKIP_REASON_REGION
+	}
+	if iterator.protocol != "" && !serverEntry.SupportsProtocol(iterator.protocol) {
+		return SERVER_ENTRY_SKIP_REASON_PROTOCOL
+	}
+	if !inPartition {
+		return SERVER_ENTRY_SKIP_REASON_PROPAGATION_CHANNEL
+	}
+	if time.Now().Before(stats.DisabledUntil) {
+		return SERVER_ENTRY_SKIP_REASON_DISABLED
+	}
+	if !serverEntry.supportsClientVersion(iterator.clientVersion) {
+		return SERVER_ENTRY_SKIP_REASON_CLIENT_VERSION
+	}
+	return ""
+}
+
+// countCandidates returns counts of the stored server entries in the
+// iterator region: count and protocolCounts, for NoticeCandidateServers, are
+// the server entries which support the iterator protocol and, when no
+// protocol is specified, each supported protocol; candidateCount is the
+// server entries which Next would return, applying the same filters as
+// Next. All counts are made in a single scan. Server entries which can't be
+// decoded aren't counted; they're quarantined by Next.
+func (iterator *ServerEntryIterator) countCandidates() (
+	count int, protocolCounts map[string]int, candidateCount int, err error) {
+
+	if iterator.protocol == "" {
+		protocolCounts = make(map[string]int)
+		for _, supportedProtocol := range SupportedTunnelProtocols {
+			protocolCounts[supportedProtocol] = 0
+		}
+	}
+	countProtocols := func(serverEntry *ServerEntry) {
+		if iterator.protocol == "" || serverEntry.SupportsProtocol(iterator.protocol) {
+			count += 1
+		}
+		for supportedProtocol := range protocolCounts {
+			if serverEntry.SupportsProtocol(supportedProtocol) {
+				protocolCounts[supportedProtocol] += 1
+			}
+		}
+	}
+
+	err = viewBoltDB(iterator.dataStore.db, func(tx *bolt.Tx) error {
+		var partition *bolt.Bucket
+		if iterator.partition != "" {
+			partition = tx.Bucket([]byte(propagationChannelsBucket)).Bucket([]byte(iterator.partition))
+		}
+		countCandidate := func(serverEntryId string, serverEntry *ServerEntry) error {
+			if !regionMatches(iterator.regions, serverEntry.Region) {
+				return nil
+			}
+			countProtocols(serverEntry)
+			if iterator.partition != "" && partition == nil {
+				return nil
+			}
+			inPartition := (partition == nil || partition.Get([]byte(serverEntryId)) != nil)
+			stats, err := getServerEntryStats(tx, serverEntryId)
+			if err != nil {
+				return err
+			}
+			if iterator.getSkipReason(serverEntry, inPartition, stats) == "" {
+				candidateCount += 1
+			}
+			return nil
+		}
+		// The undecodable server entries are left for Next to quarantine.
+		if len(iterator.regions) > 0 {
+			var serverEntryIds []string
+			for serverEntryId := range getRegionIndexedServerEntryIds(tx, iterator.regions) {
+				serverEntryIds = append(serverEntryIds, serverEntryId)
+			}
+			_, err := iterator.dataStore.forEachDecodedServerEntryId(
+				tx, serverEntryIds, countCandidate)
+			return err
+		}
+		_, err := iterator.dataStore.forEachDecodedServerEntry(tx, countCandidate)
+		return err
+	})
+	if err != nil {
+		return 0, nil, 0, ContextError(err)
+	}
+	return count, protocolCounts, candidateCount, nil
+}
+
+// reportCandidate invokes the OnCandidate callback, when configured.
+func (iterator *ServerEntryIterator) reportCandidate(
+	serverEntry *ServerEntry, yielded bool, skipReason string) {
+
+	if iterator.onCandidate != nil {
+		iterator.onCandidate(serverEntry, yielded, skipReason)
+	}
+}
+
+// MakeCompatibleServerEntry provides backwards compatibility with old server entries
+// which have a single meekFrontingDomain and not a meekFrontingAddresses array.
+// By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
+// uses that single value as legacy clients do.
+func MakeCompatibleServerEntry(serverEntry *ServerEntry) *ServerEntry {
+	if len(serverEntry.MeekFrontingAddresses) == 0 && serverEntry.MeekFrontingDomain != "" {
+		serverEntry.MeekFrontingAddresses =
+			append(serverEntry.MeekFrontingAddresses, serverEntry.MeekFrontingDomain)
+	}
+
+	return serverEntry
+}
+
+// errStopDecodedServerEntries may be returned by a forEachDecodedServerEntry
+// or forEachDecodedServerEntryId callback to end the iteration without error.
+var errStopDecodedServerEntries = errors.New("stop decoded server entries")
+
+// forEachDecodedServerEntry invokes fn with each stored server entry, in key
+// order, which can be decoded. The server entries which can't be decoded
+// are skipped and returned for quarantineUndecodableServerEntries, which
+// must be called once the transaction is complete. An error returned by fn
+// ends the iteration and is returned.
+func (dataStore *DataStore) forEachDecodedServerEntry(
+	tx *bolt.Tx,
+	fn func(serverEntryId string, serverEntry *ServerEntry) error) (undecodableServerEntries, error) {
+
+	undecodable := make(undecodableServerEntries)
+	cursor := tx.Bucket([]byte(serverEntriesBucket)).Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		serverEntry := undecodable.decode(dataStore.codec, string(key), value)
+		if serverEntry == nil {
+			continue
+		}
+		err := fn(string(key), serverEntry)
+		if err == errStopDecodedServerEntries {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return undecodable, nil
+}
+
+// forEachDecodedServerEntryId is forEachDecodedServerEntry limited to the
+// specified server entries, in the order specified. IDs with no stored
+// server entry are skipped.
+func (dataStore *DataStore) forEachDecodedServerEntryId(
+	tx *bolt.Tx,
+	serverEntryIds []string,
+	fn func(serverEntryId string, serverEntry *ServerEntry) error) (undecodableServerEntries, error) {
+
+	undecodable := make(undecodableServerEntries)
+	bucket := tx.Bucket([]byte(serverEntriesBucket))
+	for _, serverEntryId := range serverEntryIds {
+		value := bucket.Get([]byte(serverEntryId))
+		if value == nil {
+			continue
+		}
+		serverEntry := undecodable.decode(dataStore.codec, serverEntryId, value)
+		if serverEntry == nil {
+			continue
+		}
+		err := fn(serverEntryId, serverEntry)
+		if err == errStopDecodedServerEntries {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return undecodable, nil
+}
+
+func (dataStore *DataStore) scanServerEntries(scanner func(*ServerEntry)) error {
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		undecodable, err = dataStore.forEachDecodedServerEntry(
+			tx, func(_ string, serverEntry *ServerEntry) error {
+				scanner(serverEntry)
+				return nil
+			})
+		return err
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+
+	// Undecodable server entries are quarantined once the read transaction
+	// is complete.
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return nil
+}
+
+// scanRegionServerEntries is scanServerEntries limited, using the region
+// index, to the server entries in the specified regions. When no regions
+// are specified, all server entries are scanned.
+func (dataStore *DataStore) scanRegionServerEntries(regions []string, scanner func(*ServerEntry)) error {
+	if len(regions) == 0 {
+		return dataStore.scanServerEntries(scanner)
+	}
+
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var serverEntryIds []string
+		for serverEntryId := range getRegionIndexedServerEntryIds(tx, regions) {
+			serverEntryIds = append(serverEntryIds, serverEntryId)
+		}
+		var err error
+		undecodable, err = dataStore.forEachDecodedServerEntryId(
+			tx, serverEntryIds, func(_ string, serverEntry *ServerEntry) error {
+				scanner(serverEntry)
+				return nil
+			})
+		return err
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return nil
+}
+
+// CountServerEntriesMatching returns a count of stored servers for
+// which predicate returns true. All server entries are scanned once.
+func (dataStore *DataStore) CountServerEntriesMatching(predicate func(*ServerEntry) bool) (int, error) {
+	dataStore.checkInit()
+
+	count := 0
+	err := dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		if predicate(serverEntry) {
+			count += 1
+		}
+	})
+
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	return count, nil
+}
+
+// CountServerEntries returns a count of stored servers for the
+// specified region and protocol. The region may be a group name in
+// config.EgressRegionGroups.
+func (dataStore *DataStore) CountServerEntries(region, protocol string) int {
+	regions := getRegionGroupMembers(dataStore.config.EgressRegionGroups, region)
+	count := 0
+	err := dataStore.scanRegionServerEntries(regions, func(serverEntry *ServerEntry) {
+		if regionMatches(regions, serverEntry.Region) &&
+			(protocol == "" || serverEntry.SupportsProtocol(protocol)) {
+
+			count += 1
+		}
+	})
+
+	if err != nil {
+		NoticeAlert("CountServerEntries failed: %s", err)
+		return 0
+	}
+
+	return count
+}
+
+// GetRandomServerEntry returns a stored server entry selected uniformly at
+// random, using math/rand, from the server entries matching the specified
+// region and protocol. The region may be a group name in
+// config.EgressRegionGroups. The selection is made in a single scan, using
+// reservoir sampling. nil is returned when no server entry matches.
+func (dataStore *DataStore) GetRandomServerEntry(region, protocol string) (*ServerEntry, error) {
+	dataStore.checkInit()
+
+	regions := getRegionGroupMembers(dataStore.config.EgressRegionGroups, region)
+	var selectedServerEntry *ServerEntry
+	count := 0
+	err := dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		if regionMatches(regions, serverEntry.Region) &&
+			(protocol == "" || serverEntry.SupportsProtocol(protocol)) {
+
+			count += 1
+			if rand.Intn(count) == 0 {
+				selectedServerEntry = serverEntry
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if selectedServerEntry == nil {
+		return nil, nil
+	}
+	return MakeCompatibleServerEntry(selectedServerEntry), nil
+}
+
+// GetReachableProtocols returns the tunnel protocols, in
+// SupportedTunnelProtocols order, for which at least one server entry in
+// the specified region is not disabled, accepts the client version, and is
+// valid. The region may be a group name in config.EgressRegionGroups. All
+// server entries are scanned once.
+func (dataStore *DataStore) GetReachableProtocols(region string) ([]string, error) {
+	dataStore.checkInit()
+
+	regions := getRegionGroupMembers(dataStore.config.EgressRegionGroups, region)
+	reachableProtocols := make(map[string]bool)
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		undecodable, err = dataStore.forEachDecodedServerEntry(
+			tx, func(serverEntryId string, serverEntry *ServerEntry) error {
+				if !regionMatches(regions, serverEntry.Region) {
+					return nil
+				}
+				stats, err := getServerEntryStats(tx, serverEntryId)
+				if err != nil {
+					return err
+				}
+				if !isServerEntryReachable(dataStore.config, serverEntry, stats.DisabledUntil) {
+					return nil
+				}
+				for _, protocol := range serverEntry.GetSupportedProtocols() {
+					reachableProtocols[protocol] = true
+				}
+				return nil
+			})
+		return err
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	return makeReachableProtocolList(reachableProtocols), nil
+}
+
+// readDataStoreFile opens the datastore file at path, read-only, and reads
+// its server entries and key-values. Server entries which can't be decoded
+// are skipped and counted in undecodable.
+func readDataStoreFile(path string) (
+	serverEntries []*ServerEntry, keyValues map[string]string, undecodable int, err error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, nil, 0, ContextError(err)
 	}
-	err = iterator.Reset()
+	defer db.Close()
+
+	serverEntries = make([]*ServerEntry, 0)
+	keyValues = make(map[string]string)
+	err = viewBoltDB(db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(keyValueBucket))
+		if bucket != nil {
+			err := bucket.ForEach(func(key, value []byte) error {
+				keyValues[string(key)] = string(value)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		var codecName string
+		bucket = tx.Bucket([]byte(internalKeyValueBucket))
+		if bucket != nil {
+			codecName = string(bucket.Get([]byte(DATA_STORE_SERVER_ENTRY_CODEC_KEY)))
+		}
+		codec, err := newServerEntryCodec(codecName)
+		if err != nil {
+			return err
+		}
+		bucket = tx.Bucket([]byte(serverEntriesBucket))
+		if bucket == nil {
+			return errors.New("missing server entries bucket")
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			serverEntry := new(ServerEntry)
+			err := codec.Unmarshal(value, serverEntry)
+			if err != nil {
+				undecodable += 1
+				return nil
+			}
+			serverEntries = append(serverEntries, serverEntry)
+			return nil
+		})
+	})
+
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, ContextError(err)
 	}
-	return iterator, nil
+	return serverEntries, keyValues, undecodable, nil
 }
 
-// newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
-func newTargetServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
-	serverEntry, err := DecodeServerEntry(config.TargetServerEntry)
+// VerifyDataStoreIntegrity checks that every required bucket exists in the
+// live database. The returned report lists the number of keys in each
+// bucket, and flags each missing required bucket and each unexpected
+// bucket. The report is intended for diagnostics.
+func (dataStore *DataStore) VerifyDataStoreIntegrity() ([]string, error) {
+	dataStore.checkInit()
+
+	report := make([]string, 0)
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		for _, bucket := range requiredBuckets {
+			if tx.Bucket([]byte(bucket)) == nil {
+				report = append(report, fmt.Sprintf("missing bucket: %s", bucket))
+			}
+		}
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if !Contains(requiredBuckets, string(name)) {
+				report = append(report, fmt.Sprintf("unexpected bucket: %s", name))
+			}
+			count := 0
+			cursor := bucket.Cursor()
+			for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+				count++
+			}
+			report = append(report, fmt.Sprintf("bucket %s: %d keys", name, count))
+			return nil
+		})
+	})
+
 	if err != nil {
-		return nil, err
+		return nil, ContextError(err)
 	}
-	if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
-		return nil, errors.New("TargetServerEntry does not support EgressRegion")
+	return report, nil
+}
+
+// ReportAvailableRegions prints a notice with the available egress regions
+// and, when the regions have changed, invokes OnAvailableEgressRegionsChanged.
+// Note that this report ignores config.TunnelProtocol.
+func (dataStore *DataStore) ReportAvailableRegions() {
+	dataStore.checkInit()
+
+	regions := make(map[string]bool)
+	err := dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		regions[serverEntry.Region] = true
+	})
+
+	if err != nil {
+		NoticeAlert("ReportAvailableRegions failed: %s", err)
+		return
 	}
-	if config.TunnelProtocol != "" {
-		// Note: same capability/protocol mapping as in StoreServerEntry
-		requiredCapability := strings.TrimSuffix(config.TunnelProtocol, "-OSSH")
-		if !Contains(serverEntry.Capabilities, requiredCapability) {
-			return nil, errors.New("TargetServerEntry does not support TunnelProtocol")
+
+	regionList := make([]string, 0, len(regions))
+	for region, _ := range regions {
+		// Some server entries do not have a region, but it makes no sense to return
+		// an empty string as an "available region".
+		if region != "" {
+			regionList = append(regionList, region)
 		}
 	}
-	iterator = &ServerEntryIterator{
-		isTargetServerEntryIterator: true,
-		hasNextTargetServerEntry:    true,
-		targetServerEntry:           serverEntry,
-	}
-	NoticeInfo("using TargetServerEntry: %s", serverEntry.IpAddress)
-	return iterator, nil
+
+	dataStore.reportAvailableRegions(regionList)
 }
 
-// Reset a NewServerEntryIterator to the start of its cycle. The next
-// call to Next will return the first server entry.
-func (iterator *ServerEntryIterator) Reset() error {
-	iterator.Close()
+// SuggestEgressRegion returns the region with the most stored server
+// entries, which may be used as a default egress region. Server entries
+// without a region are ignored. A blank region is returned when there are
+// no server entries with a region.
+func (dataStore *DataStore) SuggestEgressRegion() (string, error) {
+	dataStore.checkInit()
+
+	regionCounts := make(map[string]int)
+	err := dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		if serverEntry.Region != "" {
+			regionCounts[serverEntry.Region] += 1
+		}
+	})
 
-	if iterator.isTargetServerEntryIterator {
-		iterator.hasNextTargetServerEntry = true
-		return nil
+	if err != nil {
+		return "", ContextError(err)
 	}
+	return selectEgressRegion(regionCounts), nil
+}
 
-	count := CountServerEntries(iterator.region, iterator.protocol)
-	NoticeCandidateServers(iterator.region, iterator.protocol, count)
+// GetServerEntryIpAddresses returns an array containing
+// all stored server IP addresses.
+func (dataStore *DataStore) GetServerEntryIpAddresses() (ipAddresses []string, err error) {
+	dataStore.checkInit()
 
-	// This query implements the Psiphon server candidate selection
-	// algorithm: the first TunnelPoolSize server candidates are in rank
-	// (priority) order, to favor previously successful servers; then the
-	// remaining long tail is shuffled to raise up less recent candidates.
+	ipAddresses = make([]string, 0)
+	err = dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	})
 
-	// BoltDB implementation note:
-	// We don't keep a transaction open for the duration of the iterator
-	// because this would expose the following semantics to consumer code:
-	//
-	//     Read-only transactions and read-write transactions ... generally
-	//     shouldn't be opened simultaneously in the same goroutine. This can
-	//     cause a deadlock as the read-write transaction needs to periodically
-	//     re-map the data file but it cannot do so while a read-only
-	//     transaction is open.
-	//     (https://github.com/boltdb/bolt)
-	//
-	// So the uderlying serverEntriesBucket could change after the serverEntryIds
-	// list is built.
+	if err != nil {
+		return nil, ContextError(err)
+	}
 
-	var serverEntryIds []string
+	return ipAddresses, nil
+}
 
-	err := singleton.db.View(func(tx *bolt.Tx) error {
-		var err error
-		serverEntryIds, err = getRankedServerEntries(tx)
+// getRankedServerEntryIpAddresses returns the IP addresses of the stored
+// server entries, with the top ranked server entry first. Only the top
+// rankedServerEntryCount server entries are ranked; the remaining server
+// entries follow, in key order.
+func (dataStore *DataStore) getRankedServerEntryIpAddresses() (ipAddresses []string, err error) {
+	dataStore.checkInit()
+
+	ipAddresses = make([]string, 0)
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		rankedServerEntries, err := getRankedServerEntries(tx)
 		if err != nil {
 			return err
 		}
-
-		skipServerEntryIds := make(map[string]bool)
-		for _, serverEntryId := range serverEntryIds {
-			skipServerEntryIds[serverEntryId] = true
-		}
-
 		bucket := tx.Bucket([]byte(serverEntriesBucket))
-		cursor := bucket.Cursor()
-		for key, _ := cursor.Last(); key != nil; key, _ = cursor.Prev() {
-			serverEntryId := string(key)
-			if _, ok := skipServerEntryIds[serverEntryId]; ok {
+		included := make(map[string]bool)
+		for _, serverEntryId := range rankedServerEntries {
+			if included[serverEntryId] || bucket.Get([]byte(serverEntryId)) == nil {
 				continue
 			}
-			serverEntryIds = append(serverEntryIds, serverEntryId)
+			included[serverEntryId] = true
+			ipAddresses = append(ipAddresses, serverEntryId)
 		}
-		return nil
+		return bucket.ForEach(func(key, _ []byte) error {
+			if !included[string(key)] {
+				ipAddresses = append(ipAddresses, string(key))
+			}
+			return nil
+		})
 	})
-	if err != nil {
-		return ContextError(err)
-	}
 
-	for i := len(serverEntryIds) - 1; i > iterator.shuffleHeadLength-1; i-- {
-		j := rand.Intn(i)
-		serverEntryIds[i], serverEntryIds[j] = serverEntryIds[j], serverEntryIds[i]
+	if err != nil {
+		return nil, ContextError(err)
 	}
-
-	iterator.serverEntryIds = serverEntryIds
-	iterator.serverEntryIndex = 0
-
-	return nil
+	return ipAddresses, nil
 }
 
-// Close cleans up resources associated with a ServerEntryIterator.
-func (iterator *ServerEntryIterator) Close() {
-	iterator.serverEntryIds = nil
-	iterator.serverEntryIndex = 0
+// serverEntryStats is the record stored in serverEntryStatsBucket,
+// keyed by server entry IP address.
+type serverEntryStats struct {
+	Attempts            int           `json:"attempts"`
+	Failures            int           `json:"failures"`
+	ConsecutiveFailures int           `json:"consecutiveFailures,omitempty"`
+	DisabledUntil       time.Time     `json:"disabledUntil,omitempty"`
+	Latency             time.Duration `json:"latency,omitempty"`
+	LastFailure         time.Time     `json:"lastFailure,omitempty"`
 }
 
-// Next returns the next server entry, by rank, for a ServerEntryIterator.
-// Returns nil with no error when there is no next item.
-func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error) {
-	defer func() {
-		if err != nil {
-			iterator.Close()
-		}
-	}()
-
-	if iterator.isTargetServerEntryIterator {
-		if iterator.hasNextTargetServerEntry {
-			iterator.hasNextTargetServerEntry = false
-			return MakeCompatibleServerEntry(iterator.targetServerEntry), nil
-		}
-		return nil, nil
+func getServerEntryStats(tx *bolt.Tx, ipAddress string) (*serverEntryStats, error) {
+	stats := new(serverEntryStats)
+	bucket := tx.Bucket([]byte(serverEntryStatsBucket))
+	data := bucket.Get([]byte(ipAddress))
+	if data == nil {
+		return stats, nil
 	}
+	err := json.Unmarshal(data, stats)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return stats, nil
+}
 
-	// There are no region/protocol indexes for the server entries bucket.
-	// Loop until we have the next server entry that matches the iterator
-	// filter requirements.
-	for {
-		if iterator.serverEntryIndex >= len(iterator.serverEntryIds) {
-			// There is no next item
-			return nil, nil
-		}
-
-		serverEntryId := iterator.serverEntryIds[iterator.serverEntryIndex]
-		iterator.serverEntryIndex += 1
+func (dataStore *DataStore) updateServerEntryStats(ipAddress string, updater func(*serverEntryStats)) error {
+	dataStore.checkInit()
 
-		var data []byte
-		err = singleton.db.View(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte(serverEntriesBucket))
-			data = bucket.Get([]byte(serverEntryId))
-			return nil
-		})
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		stats, err := getServerEntryStats(tx, ipAddress)
 		if err != nil {
-			return nil, ContextError(err)
-		}
-
-		if data == nil {
-			return nil, ContextError(
-				fmt.Errorf("Unexpected missing server entry: %s", serverEntryId))
+			return err
 		}
-
-		serverEntry = new(ServerEntry)
-		err = json.Unmarshal(data, serverEntry)
+		updater(stats)
+		data, err := json.Marshal(stats)
 		if err != nil {
-			return nil, ContextError(err)
+			return err
 		}
+		bucket := tx.Bucket([]byte(serverEntryStatsBucket))
+		return bucket.Put([]byte(ipAddress), data)
+	})
 
-		if (iterator.region == "" || serverEntry.Region == iterator.region) &&
-			(iterator.protocol == "" || serverEntrySupportsProtocol(serverEntry, iterator.protocol)) {
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
 
-			break
+// RecordServerEntryAttempt increments the count of tunnel establishment
+// attempts made to the specified server.
+func (dataStore *DataStore) RecordServerEntryAttempt(ipAddress string) error {
+	dataStore.recordOperation("RecordServerEntryAttempt", ipAddress)
+	return dataStore.updateServerEntryStats(ipAddress, func(stats *serverEntryStats) {
+		stats.Attempts += 1
+	})
+}
+
+// RecordServerEntryFailure increments the count of failed tunnel
+// establishment attempts made to the specified server. When
+// config.ServerEntryFailureThreshold is set and the count of consecutive
+// failures reaches it, the server is disabled for a period that doubles
+// with each additional failure. When config.ServerEntryFailureHalfLifeSeconds
+// is set, the existing failure counts are decayed before being incremented.
+func (dataStore *DataStore) RecordServerEntryFailure(ipAddress string) error {
+	dataStore.recordOperation("RecordServerEntryFailure", ipAddress)
+	return dataStore.updateServerEntryStats(ipAddress, func(stats *serverEntryStats) {
+		stats.Failures = decayServerEntryFailures(
+			dataStore.config, stats.Failures, stats.LastFailure) + 1
+		stats.ConsecutiveFailures = decayServerEntryFailures(
+			dataStore.config, stats.ConsecutiveFailures, stats.LastFailure) + 1
+		stats.LastFailure = serverEntryFailureClock()
+		disablePeriod := getServerEntryDisablePeriod(
+			stats.ConsecutiveFailures, dataStore.config.ServerEntryFailureThreshold)
+		if disablePeriod > 0 {
+			stats.DisabledUntil = time.Now().Add(disablePeriod)
 		}
-	}
+	})
+}
 
-	return MakeCompatibleServerEntry(serverEntry), nil
+// RecordServerEntrySuccess resets the count of consecutive failed tunnel
+// establishment attempts made to the specified server and re-enables the
+// server if it was disabled.
+func (dataStore *DataStore) RecordServerEntrySuccess(ipAddress string) error {
+	dataStore.recordOperation("RecordServerEntrySuccess", ipAddress)
+	return dataStore.updateServerEntryStats(ipAddress, func(stats *serverEntryStats) {
+		stats.ConsecutiveFailures = 0
+		stats.DisabledUntil = time.Time{}
+	})
 }
 
-// MakeCompatibleServerEntry provides backwards compatibility with old server entries
-// which have a single meekFrontingDomain and not a meekFrontingAddresses array.
-// By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
-// uses that single value as legacy clients do.
-func MakeCompatibleServerEntry(serverEntry *ServerEntry) *ServerEntry {
-	if len(serverEntry.MeekFrontingAddresses) == 0 && serverEntry.MeekFrontingDomain != "" {
-		serverEntry.MeekFrontingAddresses =
-			append(serverEntry.MeekFrontingAddresses, serverEntry.MeekFrontingDomain)
-	}
+// SetServerEntryDisabledUntil disables the specified server until the
+// given time. ServerEntryIterator skips disabled servers. A zero time
+// re-enables the server.
+func (dataStore *DataStore) SetServerEntryDisabledUntil(ipAddress string, disabledUntil time.Time) error {
+	dataStore.recordOperation("SetServerEntryDisabledUntil", ipAddress)
+	return dataStore.updateServerEntryStats(ipAddress, func(stats *serverEntryStats) {
+		stats.DisabledUntil = disabledUntil
+	})
+}
 
-	return serverEntry
+// DisableRegion disables all stored servers in the specified region until
+// the given time. The servers are updated in a single transaction.
+// ServerEntryIterator skips disabled servers.
+func (dataStore *DataStore) DisableRegion(region string, disabledUntil time.Time) error {
+	dataStore.recordOperation("DisableRegion", region)
+	return dataStore.setRegionDisabledUntil(region, disabledUntil)
+}
+
+// ClearRegionDisable re-enables all stored servers in the specified region,
+// including servers disabled individually.
+func (dataStore *DataStore) ClearRegionDisable(region string) error {
+	dataStore.recordOperation("ClearRegionDisable", region)
+	return dataStore.setRegionDisabledUntil(region, time.Time{})
 }
 
-func scanServerEntries(scanner func(*ServerEntry)) error {
-	err := singleton.db.View(func(tx *bolt.Tx) error {
+func (dataStore *DataStore) setRegionDisabledUntil(region string, disabledUntil time.Time) error {
+	dataStore.checkInit()
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(serverEntriesBucket))
-		cursor := bucket.Cursor()
+		statsBucket := tx.Bucket([]byte(serverEntryStatsBucket))
 
-		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
-			serverEntry := new(ServerEntry)
-			err := json.Unmarshal(value, serverEntry)
+		for ipAddress := range getRegionIndexedServerEntryIds(tx, []string{region}) {
+			if bucket.Get([]byte(ipAddress)) == nil {
+				continue
+			}
+			stats, err := getServerEntryStats(tx, ipAddress)
+			if err != nil {
+				return err
+			}
+			stats.DisabledUntil = disabledUntil
+			data, err := json.Marshal(stats)
+			if err != nil {
+				return err
+			}
+			err = statsBucket.Put([]byte(ipAddress), data)
 			if err != nil {
 				return err
 			}
-			scanner(serverEntry)
 		}
 
 		return nil
@@ -526,82 +2655,189 @@ func scanServerEntries(scanner func(*ServerEntry)) error {
 	if err != nil {
 		return ContextError(err)
 	}
-
 	return nil
 }
 
-// CountServerEntries returns a count of stored servers for the
-// specified region and protocol.
-func CountServerEntries(region, protocol string) int {
-	checkInitDataStore()
+// GetServerEntryDisabledUntil returns the time until which the specified
+// server is disabled. A zero time is returned when the server has not
+// been disabled.
+func (dataStore *DataStore) GetServerEntryDisabledUntil(ipAddress string) (time.Time, error) {
+	dataStore.checkInit()
 
-	count := 0
-	err := scanServerEntries(func(serverEntry *ServerEntry) {
-		if (region == "" || serverEntry.Region == region) &&
-			(protocol == "" || serverEntrySupportsProtocol(serverEntry, protocol)) {
-			count += 1
-		}
+	var stats *serverEntryStats
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		stats, err = getServerEntryStats(tx, ipAddress)
+		return err
 	})
 
 	if err != nil {
-		NoticeAlert("CountServerEntries failed: %s", err)
-		return 0
+		return time.Time{}, ContextError(err)
+	}
+	return stats.DisabledUntil, nil
+}
+
+// SetServerEntryLatency records the latency measured for the specified
+// server. See config.LatencyWeightedServerEntries.
+func (dataStore *DataStore) SetServerEntryLatency(ipAddress string, latency time.Duration) error {
+	dataStore.recordOperation("SetServerEntryLatency", ipAddress)
+	return dataStore.updateServerEntryStats(ipAddress, func(stats *serverEntryStats) {
+		stats.Latency = latency
+	})
+}
+
+// GetServerEntrySuccessRatio returns the fraction of recorded tunnel
+// establishment attempts to the specified server which did not fail.
+// The failure count is decayed; see config.ServerEntryFailureHalfLifeSeconds.
+// An error is returned when no attempts have been recorded.
+func (dataStore *DataStore) GetServerEntrySuccessRatio(ipAddress string) (float64, error) {
+	dataStore.checkInit()
+
+	var stats *serverEntryStats
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		stats, err = getServerEntryStats(tx, ipAddress)
+		return err
+	})
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	if stats.Attempts == 0 {
+		return 0, ContextError(fmt.Errorf("no attempts recorded for server %s", ipAddress))
+	}
+	failures := decayServerEntryFailures(dataStore.config, stats.Failures, stats.LastFailure)
+	if failures > stats.Attempts {
+		failures = stats.Attempts
+	}
+	return float64(stats.Attempts-failures) / float64(stats.Attempts), nil
+}
+
+// DumpDiagnostics returns a JSON report of the stored server
+// entries, for attaching to bug reports. Only non-secret server entry
+// fields are included, along with ranks and attempt/failure counts.
+// When indent is set, the JSON is indented for readability; otherwise
+// the JSON is compact.
+func (dataStore *DataStore) DumpDiagnostics(indent bool) ([]byte, error) {
+	dataStore.checkInit()
+
+	diagnostics := newDataStoreDiagnostics()
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		rankedServerEntries, err := getRankedServerEntries(tx)
+		if err != nil {
+			return err
+		}
+		ranks := make(map[string]int)
+		for index, serverEntryId := range rankedServerEntries {
+			if _, ok := ranks[serverEntryId]; !ok {
+				ranks[serverEntryId] = index
+			}
+		}
+
+		undecodable, err = dataStore.forEachDecodedServerEntry(
+			tx, func(_ string, serverEntry *ServerEntry) error {
+				rank, ok := ranks[serverEntry.IpAddress]
+				if !ok {
+					rank = -1
+				}
+				stats, err := getServerEntryStats(tx, serverEntry.IpAddress)
+				if err != nil {
+					return err
+				}
+				failures := decayServerEntryFailures(dataStore.config, stats.Failures, stats.LastFailure)
+				diagnostics.addServerEntry(serverEntry, rank, stats.Attempts, failures)
+				return nil
+			})
+		return err
+	})
+	if err != nil {
+		return nil, ContextError(err)
 	}
 
-	return count
-}
-
-// ReportAvailableRegions prints a notice with the available egress regions.
-// Note that this report ignores config.TunnelProtocol.
-func ReportAvailableRegions() {
-	checkInitDataStore()
+	dataStore.quarantineUndecodableServerEntries(undecodable)
 
-	regions := make(map[string]bool)
-	err := scanServerEntries(func(serverEntry *ServerEntry) {
-		regions[serverEntry.Region] = true
-	})
+	return diagnostics.marshal(indent)
+}
 
-	if err != nil {
-		NoticeAlert("ReportAvailableRegions failed: %s", err)
-		return
-	}
+// GetDataStoreStats returns counts of the stored records and the size of
+// the datastore file. The server entries are scanned once, and the other
+// buckets are counted by key, in a single transaction.
+func (dataStore *DataStore) GetDataStoreStats() (*DataStoreStats, error) {
+	dataStore.checkInit()
 
-	regionList := make([]string, 0, len(regions))
-	for region, _ := range regions {
-		// Some server entries do not have a region, but it makes no sense to return
-		// an empty string as an "available region".
-		if region != "" {
-			regionList = append(regionList, region)
+	stats := new(DataStoreStats)
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		regions := make(map[string]bool)
+		var err error
+		undecodable, err = dataStore.forEachDecodedServerEntry(
+			tx, func(_ string, serverEntry *ServerEntry) error {
+				stats.ServerEntryCount += 1
+				if serverEntry.Region != "" {
+					regions[serverEntry.Region] = true
+				}
+				return nil
+			})
+		if err != nil {
+			return err
 		}
-	}
+		stats.RegionCount = len(regions)
 
-	NoticeAvailableEgressRegions(regionList)
-}
+		rankedServerEntries, err := getRankedServerEntries(tx)
+		if err != nil {
+			return err
+		}
+		ranked := make(map[string]bool)
+		bucket := tx.Bucket([]byte(serverEntriesBucket))
+		for _, serverEntryId := range rankedServerEntries {
+			_, isUndecodable := undecodable[serverEntryId]
+			if !ranked[serverEntryId] &&
+				bucket.Get([]byte(serverEntryId)) != nil &&
+				!isUndecodable {
 
-// GetServerEntryIpAddresses returns an array containing
-// all stored server IP addresses.
-func GetServerEntryIpAddresses() (ipAddresses []string, err error) {
-	checkInitDataStore()
+				ranked[serverEntryId] = true
+			}
+		}
+		stats.RankedServerEntryCount = len(ranked)
 
-	ipAddresses = make([]string, 0)
-	err = scanServerEntries(func(serverEntry *ServerEntry) {
-		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		stats.SplitTunnelRegionCount = countBucketKeys(tx, splitTunnelRouteDataBucket)
+		stats.UrlETagCount = countBucketKeys(tx, urlETagsBucket)
+		stats.KeyValueCount = countBucketKeys(tx, keyValueBucket)
+		return nil
 	})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	dataStore.quarantineUndecodableServerEntries(undecodable)
 
+	fileInfo, err := os.Stat(dataStore.filename)
 	if err != nil {
 		return nil, ContextError(err)
 	}
+	stats.FileSize = fileInfo.Size()
 
-	return ipAddresses, nil
+	return stats, nil
+}
+
+func countBucketKeys(tx *bolt.Tx, name string) int {
+	count := 0
+	cursor := tx.Bucket([]byte(name)).Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		count++
+	}
+	return count
 }
 
 // SetSplitTunnelRoutes updates the cached routes data for
 // the given region. The associated etag is also stored and
 // used to make efficient web requests for updates to the data.
-func SetSplitTunnelRoutes(region, etag string, data []byte) error {
-	checkInitDataStore()
+func (dataStore *DataStore) SetSplitTunnelRoutes(region, etag string, data []byte) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetSplitTunnelRoutes", region)
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(splitTunnelRouteETagsBucket))
 		err := bucket.Put([]byte(region), []byte(etag))
 
@@ -618,10 +2854,10 @@ func SetSplitTunnelRoutes(region, etag string, data []byte) error {
 
 // GetSplitTunnelRoutesETag retrieves the etag for cached routes
 // data for the specified region. If not found, it returns an empty string value.
-func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
-	checkInitDataStore()
+func (dataStore *DataStore) GetSplitTunnelRoutesETag(region string) (etag string, err error) {
+	dataStore.checkInit()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(splitTunnelRouteETagsBucket))
 		etag = string(bucket.Get([]byte(region)))
 		return nil
@@ -635,10 +2871,10 @@ func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
 
 // GetSplitTunnelRoutesData retrieves the cached routes data
 // for the specified region. If not found, it returns a nil value.
-func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
-	checkInitDataStore()
+func (dataStore *DataStore) GetSplitTunnelRoutesData(region string) (data []byte, err error) {
+	dataStore.checkInit()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(splitTunnelRouteDataBucket))
 		data = bucket.Get([]byte(region))
 		return nil
@@ -653,13 +2889,23 @@ func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
 // SetUrlETag stores an ETag for the specfied URL.
 // Note: input URL is treated as a string, and is not
 // encoded or decoded or otherwise canonicalized.
-func SetUrlETag(url, etag string) error {
-	checkInitDataStore()
+func (dataStore *DataStore) SetUrlETag(url, etag string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetUrlETag", url)
+
+	timestamp, err := urlETagClock().MarshalText()
+	if err != nil {
+		return ContextError(err)
+	}
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err = updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(urlETagsBucket))
 		err := bucket.Put([]byte(url), []byte(etag))
-		return err
+		if err != nil {
+			return err
+		}
+		bucket = tx.Bucket([]byte(urlETagTimestampsBucket))
+		return bucket.Put([]byte(url), timestamp)
 	})
 
 	if err != nil {
@@ -670,10 +2916,10 @@ func SetUrlETag(url, etag string) error {
 
 // GetUrlETag retrieves a previously stored an ETag for the
 // specfied URL. If not found, it returns an empty string value.
-func GetUrlETag(url string) (etag string, err error) {
-	checkInitDataStore()
+func (dataStore *DataStore) GetUrlETag(url string) (etag string, err error) {
+	dataStore.checkInit()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(urlETagsBucket))
 		etag = string(bucket.Get([]byte(url)))
 		return nil
@@ -685,11 +2931,122 @@ func GetUrlETag(url string) (etag string, err error) {
 	return etag, nil
 }
 
+// pruneUrlETags deletes URL ETags stored before the specified time, along
+// with ETags which have no stored timestamp. The number of deleted ETags is
+// returned.
+func (dataStore *DataStore) pruneUrlETags(before time.Time) (int, error) {
+	dataStore.checkInit()
+
+	count := 0
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(urlETagsBucket))
+		timestampsBucket := tx.Bucket([]byte(urlETagTimestampsBucket))
+
+		// Keys are collected first as bolt cursors don't support
+		// deleting while iterating.
+		var staleUrls [][]byte
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			var timestamp time.Time
+			data := timestampsBucket.Get(key)
+			if data != nil {
+				err := timestamp.UnmarshalText(data)
+				if err != nil {
+					return err
+				}
+			}
+			if timestamp.Before(before) {
+				staleUrls = append(staleUrls, append([]byte(nil), key...))
+			}
+		}
+
+		for _, url := range staleUrls {
+			err := bucket.Delete(url)
+			if err != nil {
+				return err
+			}
+			err = timestampsBucket.Delete(url)
+			if err != nil {
+				return err
+			}
+		}
+
+		count = len(staleUrls)
+		return nil
+	})
+
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return count, nil
+}
+
+// storeResolvedHost stores the resolved host data, and deletes resolved
+// hosts which expire at or before now.
+func (dataStore *DataStore) storeResolvedHost(host string, data []byte, expiry, now time.Time) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetResolvedHost", host)
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(resolvedHostsBucket))
+
+		// Keys are collected first as bolt cursors don't support
+		// deleting while iterating.
+		var expiredHosts [][]byte
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var cached resolvedHost
+			err := json.Unmarshal(value, &cached)
+			if err != nil || !cached.Expiry.After(now) {
+				expiredHosts = append(expiredHosts, append([]byte(nil), key...))
+			}
+		}
+
+		for _, expiredHost := range expiredHosts {
+			err := bucket.Delete(expiredHost)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !expiry.After(now) {
+			return nil
+		}
+		return bucket.Put([]byte(host), data)
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// getResolvedHost retrieves the resolved host data. If not found, it
+// returns nil.
+func (dataStore *DataStore) getResolvedHost(host string) (data []byte, err error) {
+	dataStore.checkInit()
+
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(resolvedHostsBucket))
+		value := bucket.Get([]byte(host))
+		if value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return data, nil
+}
+
 // SetKeyValue stores a key/value pair.
-func SetKeyValue(key, value string) error {
-	checkInitDataStore()
+func (dataStore *DataStore) SetKeyValue(key, value string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetKeyValue", key)
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(keyValueBucket))
 		err := bucket.Put([]byte(key), []byte(value))
 		return err
@@ -703,10 +3060,10 @@ func SetKeyValue(key, value string) error {
 
 // GetKeyValue retrieves the value for a given key. If not found,
 // it returns an empty string value.
-func GetKeyValue(key string) (value string, err error) {
-	checkInitDataStore()
+func (dataStore *DataStore) GetKeyValue(key string) (value string, err error) {
+	dataStore.checkInit()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(keyValueBucket))
 		value = string(bucket.Get([]byte(key)))
 		return nil
@@ -717,3 +3074,297 @@ func GetKeyValue(key string) (value string, err error) {
 	}
 	return value, nil
 }
+
+// setInternalKeyValue stores a key/value pair used for datastore
+// bookkeeping. Internal key-values are stored separately from the
+// key-values set with SetKeyValue, and aren't recorded in the operation
+// log.
+func (dataStore *DataStore) setInternalKeyValue(key, value string) error {
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(internalKeyValueBucket))
+		return bucket.Put([]byte(key), []byte(value))
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// getInternalKeyValue retrieves the value for a given internal key. If not
+// found, it returns an empty string value.
+func (dataStore *DataStore) getInternalKeyValue(key string) (value string, err error) {
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(internalKeyValueBucket))
+		value = string(bucket.Get([]byte(key)))
+		return nil
+	})
+
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return value, nil
+}
+
+// SetAppMetadata stores a metadata value for the embedding app. App
+// metadata is stored separately from the internal key-values, and values
+// may be binary.
+func (dataStore *DataStore) SetAppMetadata(key string, value []byte) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("SetAppMetadata", key)
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(appMetadataBucket))
+		return bucket.Put([]byte(key), value)
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// GetAppMetadata retrieves the app metadata value for a given key. If not
+// found, it returns a nil value.
+func (dataStore *DataStore) GetAppMetadata(key string) (value []byte, err error) {
+	dataStore.checkInit()
+
+	err = viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(appMetadataBucket))
+		data := bucket.Get([]byte(key))
+		if data != nil {
+			// Copy, as the value is only valid during the transaction
+			value = append([]byte{}, data...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return value, nil
+}
+
+// AddRegionTransferStats adds bytes transferred to the persistent total
+// for the specified client region.
+func (dataStore *DataStore) AddRegionTransferStats(region string, bytesTransferred int64) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("AddRegionTransferStats", region)
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(regionTransferStatsBucket))
+		total := int64(0)
+		data := bucket.Get([]byte(region))
+		if data != nil {
+			var err error
+			total, err = strconv.ParseInt(string(data), 10, 64)
+			if err != nil {
+				return ContextError(err)
+			}
+		}
+		total += bytesTransferred
+		return bucket.Put([]byte(region), []byte(strconv.FormatInt(total, 10)))
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// GetRegionTransferStats returns the persistent bytes transferred totals,
+// keyed by client region.
+func (dataStore *DataStore) GetRegionTransferStats() (map[string]int64, error) {
+	dataStore.checkInit()
+
+	regionTransferStats := make(map[string]int64)
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(regionTransferStatsBucket))
+		return bucket.ForEach(func(key, value []byte) error {
+			total, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return ContextError(err)
+			}
+			regionTransferStats[string(key)] = total
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return regionTransferStats, nil
+}
+
+// RecordSuccessfulProtocol increments the persistent count of tunnels
+// successfully established using the specified tunnel protocol. When
+// config.MaxProtocolSuccessCount is exceeded, all counts are halved.
+func (dataStore *DataStore) RecordSuccessfulProtocol(protocol string) error {
+	dataStore.checkInit()
+	dataStore.recordOperation("RecordSuccessfulProtocol", protocol)
+
+	err := updateBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(protocolSuccessStatsBucket))
+		count := 0
+		data := bucket.Get([]byte(protocol))
+		if data != nil {
+			var err error
+			count, err = strconv.Atoi(string(data))
+			if err != nil {
+				return ContextError(err)
+			}
+		}
+		count += 1
+		err := bucket.Put([]byte(protocol), []byte(strconv.Itoa(count)))
+		if err != nil {
+			return ContextError(err)
+		}
+		if dataStore.config.MaxProtocolSuccessCount > 0 &&
+			count > dataStore.config.MaxProtocolSuccessCount {
+
+			distribution, err := getProtocolSuccessDistribution(bucket)
+			if err != nil {
+				return ContextError(err)
+			}
+			for protocol, count := range distribution {
+				err := bucket.Put([]byte(protocol), []byte(strconv.Itoa(count/2)))
+				if err != nil {
+					return ContextError(err)
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// GetProtocolSuccessDistribution returns the persistent counts of tunnels
+// successfully established, keyed by tunnel protocol.
+func (dataStore *DataStore) GetProtocolSuccessDistribution() (map[string]int, error) {
+	dataStore.checkInit()
+
+	var distribution map[string]int
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		var err error
+		distribution, err = getProtocolSuccessDistribution(
+			tx.Bucket([]byte(protocolSuccessStatsBucket)))
+		return err
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return distribution, nil
+}
+
+func getProtocolSuccessDistribution(bucket *bolt.Bucket) (map[string]int, error) {
+	distribution := make(map[string]int)
+	err := bucket.ForEach(func(key, value []byte) error {
+		count, err := strconv.Atoi(string(value))
+		if err != nil {
+			return ContextError(err)
+		}
+		distribution[string(key)] = count
+		return nil
+	})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return distribution, nil
+}
+
+// AuditServerEntries scans all stored server entries and reports those
+// which advertise a capability without the fields required to use it.
+// See AuditServerEntry.
+func (dataStore *DataStore) AuditServerEntries() ([]ServerEntryAuditIssue, error) {
+	dataStore.checkInit()
+
+	issues := make([]ServerEntryAuditIssue, 0)
+	err := dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		issues = append(issues, AuditServerEntry(MakeCompatibleServerEntry(serverEntry))...)
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return issues, nil
+}
+
+// GetAvailableCapabilities returns the sorted union of the capabilities of
+// all stored server entries.
+func (dataStore *DataStore) GetAvailableCapabilities() ([]string, error) {
+	dataStore.checkInit()
+
+	capabilities := make(map[string]bool)
+	err := dataStore.scanServerEntries(func(serverEntry *ServerEntry) {
+		for _, capability := range serverEntry.Capabilities {
+			capabilities[capability] = true
+		}
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	capabilityList := make([]string, 0, len(capabilities))
+	for capability, _ := range capabilities {
+		capabilityList = append(capabilityList, capability)
+	}
+	sort.Strings(capabilityList)
+	return capabilityList, nil
+}
+
+// ExportRankedServerEntries returns the count highest ranked server
+// entries, in rank order, in the list encoding used by remote server lists.
+// Only server entries in the ranked list are exported, so fewer than count
+// entries may be returned.
+func (dataStore *DataStore) ExportRankedServerEntries(count int) (string, error) {
+	dataStore.checkInit()
+
+	serverEntries := make([]*ServerEntry, 0)
+	var undecodable undecodableServerEntries
+	err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+		rankedServerEntries, err := getRankedServerEntries(tx)
+		if err != nil {
+			return err
+		}
+		// The ranked list may contain duplicate IDs; each server entry is
+		// exported once, at its highest rank.
+		exported := make(map[string]bool)
+		var serverEntryIds []string
+		for _, serverEntryId := range rankedServerEntries {
+			if !exported[serverEntryId] {
+				exported[serverEntryId] = true
+				serverEntryIds = append(serverEntryIds, serverEntryId)
+			}
+		}
+		if count <= 0 {
+			return nil
+		}
+		undecodable, err = dataStore.forEachDecodedServerEntryId(
+			tx, serverEntryIds, func(_ string, serverEntry *ServerEntry) error {
+				serverEntries = append(serverEntries, serverEntry)
+				if len(serverEntries) >= count {
+					return errStopDecodedServerEntries
+				}
+				return nil
+			})
+		return err
+	})
+
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	dataStore.quarantineUndecodableServerEntries(undecodable)
+
+	encodedServerEntryList, err := encodeServerEntryList(serverEntries)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return encodedServerEntryList, nil
+}
@@ -0,0 +1,224 @@
+// +build !windows
+
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/bolt"
+)
+
+// removeTestDataStoreBucket deletes the bucket from the live database.
+func removeTestDataStoreBucket(t *testing.T, dataStore *DataStore, name string) {
+	err := dataStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(name))
+	})
+	if err != nil {
+		t.Fatalf("error deleting bucket: %s", err)
+	}
+}
+
+// storeTestServerEntryWithoutValidation stores the server entry, bypassing
+// StoreServerEntry validation.
+func storeTestServerEntryWithoutValidation(t *testing.T, dataStore *DataStore, serverEntry *ServerEntry) {
+	err := dataStore.db.Update(func(tx *bolt.Tx) error {
+		data, err := dataStore.codec.Marshal(serverEntry)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(serverEntriesBucket)).Put([]byte(serverEntry.IpAddress), data)
+		if err != nil {
+			return err
+		}
+		err = indexServerEntryRegion(tx, serverEntry.IpAddress, serverEntry.Region)
+		if err != nil {
+			return err
+		}
+		return insertRankedServerEntry(tx, serverEntry.IpAddress, 0)
+	})
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+}
+
+func TestServerEntryRegionIndex(t *testing.T) {
+
+	config := &Config{}
+	dataStore, closeDataStore := openTestDataStore(t, config)
+	defer closeDataStore()
+	defer func() { dataStore.Close() }()
+
+	storeServerEntry := func(ipAddress, region string, replaceIfExists bool) {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, region), replaceIfExists)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	checkRegion := func(description, region string, expectedIpAddresses ...string) {
+		var indexedIds map[string]bool
+		err := viewBoltDB(dataStore.db, func(tx *bolt.Tx) error {
+			indexedIds = getRegionIndexedServerEntryIds(tx, []string{region})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error reading region index: %s", err)
+		}
+		expectedIds := makeServerEntryIdSet(expectedIpAddresses)
+		if !reflect.DeepEqual(indexedIds, expectedIds) {
+			t.Errorf("%s: unexpected %s index: %v", description, region, indexedIds)
+		}
+		count := dataStore.CountServerEntries(region, "")
+		if count != len(expectedIpAddresses) {
+			t.Errorf("%s: unexpected %s count: %d", description, region, count)
+		}
+
+		iterator, err := dataStore.NewServerEntryIterator(&Config{EgressRegion: region, TunnelPoolSize: 1})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		defer iterator.Close()
+		iteratedIds := make(map[string]bool)
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			iteratedIds[serverEntry.IpAddress] = true
+		}
+		if !reflect.DeepEqual(iteratedIds, expectedIds) {
+			t.Errorf("%s: unexpected %s candidates: %v", description, region, iteratedIds)
+		}
+	}
+
+	storeServerEntry("10.0.66.1", "YL", true)
+	storeServerEntry("10.0.66.2", "YL", true)
+	storeServerEntry("10.0.66.3", "YM", true)
+	checkRegion("stored", "YL", "10.0.66.1", "10.0.66.2")
+	checkRegion("stored", "YM", "10.0.66.3")
+
+	// Replacing a server entry with a new region moves its index record
+	storeServerEntry("10.0.66.2", "YM", true)
+	checkRegion("region changed", "YL", "10.0.66.1")
+	checkRegion("region changed", "YM", "10.0.66.2", "10.0.66.3")
+
+	// A server entry which isn't replaced keeps its index record
+	storeServerEntry("10.0.66.1", "YM", false)
+	checkRegion("not replaced", "YL", "10.0.66.1")
+	checkRegion("not replaced", "YM", "10.0.66.2", "10.0.66.3")
+
+	// Deleted server entries are removed from the index
+	err := dataStore.ArchiveServerEntry("10.0.66.3")
+	if err != nil {
+		t.Fatalf("ArchiveServerEntry failed: %s", err)
+	}
+	checkRegion("archived", "YM", "10.0.66.2")
+
+	// A missing index is rebuilt when the datastore is opened, and server
+	// entries which can't be decoded are quarantined
+	err = dataStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(serverEntriesBucket)).Put([]byte("10.0.66.4"), []byte("invalid"))
+	})
+	if err != nil {
+		t.Fatalf("error storing invalid server entry: %s", err)
+	}
+	removeTestDataStoreBucket(t, dataStore, serverEntriesByRegionBucket)
+	dataStore.Close()
+	dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	checkRegion("rebuilt", "YL", "10.0.66.1")
+	checkRegion("rebuilt", "YM", "10.0.66.2")
+	quarantinedIds, err := dataStore.GetQuarantinedServerEntryIds()
+	if err != nil {
+		t.Fatalf("GetQuarantinedServerEntryIds failed: %s", err)
+	}
+	if !reflect.DeepEqual(quarantinedIds, []string{"10.0.66.4"}) {
+		t.Errorf("unexpected quarantined server entries: %v", quarantinedIds)
+	}
+
+	// DisableRegion uses the index
+	disabledUntil := time.Now().Add(time.Hour)
+	err = dataStore.DisableRegion("YM", disabledUntil)
+	if err != nil {
+		t.Fatalf("DisableRegion failed: %s", err)
+	}
+	for _, ipAddress := range []string{"10.0.66.1", "10.0.66.2"} {
+		serverEntryDisabledUntil, err := dataStore.GetServerEntryDisabledUntil(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryDisabledUntil failed: %s", err)
+		}
+		if serverEntryDisabledUntil.Equal(disabledUntil) != (ipAddress == "10.0.66.2") {
+			t.Errorf("unexpected disabled until for %s: %s", ipAddress, serverEntryDisabledUntil)
+		}
+	}
+}
+
+func TestCompactionPending(t *testing.T) {
+
+	config := &Config{}
+	dataStore, closeDataStore := openTestDataStore(t, config)
+	defer closeDataStore()
+	defer func() { dataStore.Close() }()
+
+	err := dataStore.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %s", err)
+	}
+	isPending, err := dataStore.isCompactionPending()
+	if err != nil {
+		t.Fatalf("isCompactionPending failed: %s", err)
+	}
+	if !isPending {
+		t.Errorf("compaction not pending")
+	}
+
+	// The pending flag is internal and isn't visible to GetKeyValue
+	value, err := dataStore.GetKeyValue(compactionPendingKey)
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if value != "" {
+		t.Errorf("unexpected key value: %s", value)
+	}
+
+	// The pending compaction is performed, and the flag cleared, when the
+	// datastore is reopened
+	dataStore.Close()
+	dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	isPending, err = dataStore.isCompactionPending()
+	if err != nil {
+		t.Fatalf("isCompactionPending failed: %s", err)
+	}
+	if isPending {
+		t.Errorf("compaction still pending")
+	}
+}
@@ -0,0 +1,4118 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeTestDataStoreDirectory creates a new, empty datastore directory for
+// the exclusive use of one test. The returned function deletes it.
+func makeTestDataStoreDirectory(t *testing.T) (string, func()) {
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon_datastore_test")
+	if err != nil {
+		t.Fatalf("error creating datastore directory: %s", err)
+	}
+	return dataStoreDirectory, func() { os.RemoveAll(dataStoreDirectory) }
+}
+
+// openTestDataStore opens a new, empty DataStore for the exclusive use of
+// one test. config.DataStoreDirectory is set to a new directory. The
+// returned function closes the datastore and deletes the directory.
+func openTestDataStore(t *testing.T, config *Config) (*DataStore, func()) {
+	dataStoreDirectory, removeDirectory := makeTestDataStoreDirectory(t)
+	config.DataStoreDirectory = dataStoreDirectory
+	dataStore, err := OpenDataStore(config)
+	if err != nil {
+		removeDirectory()
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	return dataStore, func() {
+		dataStore.Close()
+		removeDirectory()
+	}
+}
+
+// initTestDataStore initializes the default DataStore, used by the
+// package-level datastore functions, as a new, empty datastore for the
+// exclusive use of one test. The returned function closes the default
+// DataStore and deletes its directory.
+func initTestDataStore(t *testing.T) func() {
+	dataStoreDirectory, removeDirectory := makeTestDataStoreDirectory(t)
+	CloseDataStore()
+	err := InitDataStore(&Config{DataStoreDirectory: dataStoreDirectory})
+	if err != nil {
+		removeDirectory()
+		t.Fatalf("error initializing datastore: %s", err)
+	}
+	return func() {
+		CloseDataStore()
+		removeDirectory()
+	}
+}
+
+func makeTestServerEntry(ipAddress, region string) *ServerEntry {
+	return &ServerEntry{
+		IpAddress:     ipAddress,
+		WebServerPort: "80",
+		SshPort:       22,
+		Capabilities:  []string{"handshake", "SSH", "OSSH"},
+		Region:        region,
+	}
+}
+
+func makeTestEncodedServerEntry(t *testing.T, serverEntry *ServerEntry) string {
+	serverEntryJson, err := json.Marshal(serverEntry)
+	if err != nil {
+		t.Fatalf("error encoding server entry: %s", err)
+	}
+	return hex.EncodeToString([]byte(fmt.Sprintf(
+		"%s %s <webServerSecret> <webServerCertificate> %s",
+		serverEntry.IpAddress, serverEntry.WebServerPort, serverEntryJson)))
+}
+
+// storeTestServerEntries stores count server entries with IP addresses
+// in the subnet ipAddressPrefix.0/24.
+func storeTestServerEntries(t *testing.T, ipAddressPrefix, region string, count int) []string {
+	ipAddresses := make([]string, 0)
+	for i := 0; i < count; i++ {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("%s.%d", ipAddressPrefix, i+1), region)
+		err := StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+	return ipAddresses
+}
+
+func TestTargetServerEntryPreferred(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	region := "XA"
+	storedIpAddresses := storeTestServerEntries(t, "10.0.1", region, 5)
+	targetServerEntry := makeTestServerEntry("10.0.1.100", region)
+
+	config := &Config{
+		EgressRegion:               region,
+		TunnelPoolSize:             1,
+		TargetServerEntry:          makeTestEncodedServerEntry(t, targetServerEntry),
+		TargetServerEntryPreferred: true,
+	}
+
+	iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+
+	// Check twice, to exercise Reset
+	for i := 0; i < 2; i++ {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil || serverEntry.IpAddress != targetServerEntry.IpAddress {
+			t.Fatalf("expected target server entry first")
+		}
+
+		remaining := make(map[string]bool)
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			if remaining[serverEntry.IpAddress] {
+				t.Errorf("unexpected repeat server entry: %s", serverEntry.IpAddress)
+			}
+			remaining[serverEntry.IpAddress] = true
+		}
+		if len(remaining) != len(storedIpAddresses) {
+			t.Errorf("unexpected server entry count: %d", len(remaining))
+		}
+		for _, ipAddress := range storedIpAddresses {
+			if !remaining[ipAddress] {
+				t.Errorf("missing stored server entry: %s", ipAddress)
+			}
+		}
+
+		err = iterator.Reset()
+		if err != nil {
+			t.Fatalf("error resetting iterator: %s", err)
+		}
+	}
+}
+
+func TestServerEntrySuccessRatio(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	ipAddress := "10.0.2.1"
+
+	_, err := GetServerEntrySuccessRatio(ipAddress)
+	if err == nil {
+		t.Errorf("expected error with no recorded attempts")
+	}
+
+	testCases := []struct {
+		success       bool
+		expectedRatio float64
+	}{
+		{true, 1.0},
+		{false, 0.5},
+		{false, 1.0 / 3.0},
+		{true, 0.5},
+	}
+
+	for _, testCase := range testCases {
+		err := RecordServerEntryAttempt(ipAddress)
+		if err != nil {
+			t.Fatalf("RecordServerEntryAttempt failed: %s", err)
+		}
+		if !testCase.success {
+			err = RecordServerEntryFailure(ipAddress)
+			if err != nil {
+				t.Fatalf("RecordServerEntryFailure failed: %s", err)
+			}
+		}
+		ratio, err := GetServerEntrySuccessRatio(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntrySuccessRatio failed: %s", err)
+		}
+		if ratio != testCase.expectedRatio {
+			t.Errorf("unexpected success ratio: %f != %f", ratio, testCase.expectedRatio)
+		}
+	}
+}
+
+func TestStoreServerEntriesByPriority(t *testing.T) {
+	for _, staged := range []bool{false, true} {
+		testStoreServerEntriesByPriority(t, staged)
+	}
+}
+
+func testStoreServerEntriesByPriority(t *testing.T, staged bool) {
+	defer initTestDataStore(t)()
+
+	// Ensure there's a top ranked server entry, in another region, as
+	// imported server entries are ranked below the top ranked entry.
+	storeTestServerEntries(t, "10.0.3", "XC", 1)
+
+	region := "XB"
+	priorities := []int{3, 1, 4, 2}
+	serverEntries := make([]*ServerEntry, 0)
+	for i, priority := range priorities {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.4.%d", i+1), region)
+		serverEntry.ServerPriority = priority
+		serverEntries = append(serverEntries, serverEntry)
+	}
+
+	if staged {
+		// Staged server entries are stored in batches smaller than the list,
+		// and are still ordered by priority across the entire list.
+		err := StageServerEntries("staging", serverEntries)
+		if err != nil {
+			t.Fatalf("StageServerEntries failed: %s", err)
+		}
+		count, err := StoreStagedServerEntries("staging", 3, true, true)
+		if err != nil {
+			t.Fatalf("StoreStagedServerEntries failed: %s", err)
+		}
+		if count != len(serverEntries) {
+			t.Errorf("unexpected stored server entry count: %d", count)
+		}
+	} else {
+		err := StoreServerEntriesByPriority(serverEntries, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntriesByPriority failed: %s", err)
+		}
+	}
+
+	// A large TunnelPoolSize disables shuffling in the iterator
+	config := &Config{
+		EgressRegion:   region,
+		TunnelPoolSize: 1000,
+	}
+	iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+
+	expectedPriorities := []int{4, 3, 2, 1}
+	for _, expectedPriority := range expectedPriorities {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			t.Fatalf("missing server entry")
+		}
+		if serverEntry.ServerPriority != expectedPriority {
+			t.Errorf("unexpected server entry priority for staged %t: %d != %d",
+				staged, serverEntry.ServerPriority, expectedPriority)
+		}
+	}
+}
+
+func TestDumpDataStoreDiagnostics(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverEntry := makeTestServerEntry("10.0.5.1", "XD")
+	serverEntry.SshUsername = "secret-ssh-username"
+	serverEntry.SshPassword = "secret-ssh-password"
+	serverEntry.SshHostKey = "secret-ssh-host-key"
+	serverEntry.SshObfuscatedKey = "secret-ssh-obfuscated-key"
+	serverEntry.WebServerSecret = "secret-web-server-secret"
+	serverEntry.WebServerCertificate = "secret-web-server-certificate"
+	serverEntry.MeekObfuscatedKey = "secret-meek-obfuscated-key"
+	serverEntry.MeekCookieEncryptionPublicKey = "secret-meek-cookie-encryption-public-key"
+	err := StoreServerEntry(serverEntry, true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	data, err := DumpDataStoreDiagnostics(false)
+	if err != nil {
+		t.Fatalf("DumpDataStoreDiagnostics failed: %s", err)
+	}
+
+	if strings.Contains(string(data), "secret-") {
+		t.Errorf("unexpected secret in diagnostics: %s", string(data))
+	}
+
+	var diagnostics dataStoreDiagnostics
+	err = json.Unmarshal(data, &diagnostics)
+	if err != nil {
+		t.Fatalf("error decoding diagnostics: %s", err)
+	}
+	if diagnostics.ServerEntryCount != len(diagnostics.ServerEntries) {
+		t.Errorf("unexpected server entry count: %d", diagnostics.ServerEntryCount)
+	}
+	if diagnostics.RegionCounts[serverEntry.Region] != 1 {
+		t.Errorf("unexpected region count: %d", diagnostics.RegionCounts[serverEntry.Region])
+	}
+	found := false
+	for _, entry := range diagnostics.ServerEntries {
+		if entry.IpAddress == serverEntry.IpAddress {
+			found = true
+			if entry.Region != serverEntry.Region {
+				t.Errorf("unexpected region: %s", entry.Region)
+			}
+			if entry.Rank < 0 {
+				t.Errorf("unexpected rank: %d", entry.Rank)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("missing server entry in diagnostics")
+	}
+}
+
+func TestDumpDataStoreDiagnosticsIndent(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	storeTestServerEntries(t, "10.0.12", "XL", 2)
+
+	compactData, err := DumpDataStoreDiagnostics(false)
+	if err != nil {
+		t.Fatalf("DumpDataStoreDiagnostics failed: %s", err)
+	}
+	indentedData, err := DumpDataStoreDiagnostics(true)
+	if err != nil {
+		t.Fatalf("DumpDataStoreDiagnostics failed: %s", err)
+	}
+
+	if strings.Contains(string(compactData), "\n") {
+		t.Errorf("unexpected newline in compact diagnostics")
+	}
+	if !strings.Contains(string(indentedData), "\n    ") {
+		t.Errorf("missing indentation in indented diagnostics")
+	}
+
+	var compactDiagnostics, indentedDiagnostics dataStoreDiagnostics
+	err = json.Unmarshal(compactData, &compactDiagnostics)
+	if err != nil {
+		t.Fatalf("error decoding compact diagnostics: %s", err)
+	}
+	err = json.Unmarshal(indentedData, &indentedDiagnostics)
+	if err != nil {
+		t.Fatalf("error decoding indented diagnostics: %s", err)
+	}
+	if !reflect.DeepEqual(compactDiagnostics, indentedDiagnostics) {
+		t.Errorf("compact and indented diagnostics differ")
+	}
+}
+
+// iterateTestServerEntries returns the IP addresses of all server
+// entries yielded by an iterator for the specified region.
+func iterateTestServerEntries(t *testing.T, region string) map[string]bool {
+	iterator, err := NewServerEntryIterator(&Config{EgressRegion: region, TunnelPoolSize: 1})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+	ipAddresses := make(map[string]bool)
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		ipAddresses[serverEntry.IpAddress] = true
+	}
+	return ipAddresses
+}
+
+func TestArchiveServerEntry(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	region := "XE"
+	ipAddresses := storeTestServerEntries(t, "10.0.6", region, 2)
+
+	err := ArchiveServerEntry(ipAddresses[0])
+	if err != nil {
+		t.Fatalf("ArchiveServerEntry failed: %s", err)
+	}
+
+	candidates := iterateTestServerEntries(t, region)
+	if len(candidates) != 1 || !candidates[ipAddresses[1]] {
+		t.Errorf("unexpected candidates after archive: %+v", candidates)
+	}
+
+	err = ArchiveServerEntry(ipAddresses[0])
+	if err == nil {
+		t.Errorf("unexpected archive of already archived server entry")
+	}
+
+	err = RestoreServerEntry(ipAddresses[0])
+	if err != nil {
+		t.Fatalf("RestoreServerEntry failed: %s", err)
+	}
+
+	candidates = iterateTestServerEntries(t, region)
+	if len(candidates) != 2 || !candidates[ipAddresses[0]] || !candidates[ipAddresses[1]] {
+		t.Errorf("unexpected candidates after restore: %+v", candidates)
+	}
+
+	err = RestoreServerEntry(ipAddresses[0])
+	if err == nil {
+		t.Errorf("unexpected restore of server entry that is not archived")
+	}
+
+	// A server entry which isn't accepted by the datastore isn't restored,
+	// and remains archived.
+
+	err = ArchiveServerEntry(ipAddresses[0])
+	if err != nil {
+		t.Fatalf("ArchiveServerEntry failed: %s", err)
+	}
+
+	singleton.config.AllowedRegions = []string{"XF"}
+	err = RestoreServerEntry(ipAddresses[0])
+	singleton.config.AllowedRegions = nil
+	if err == nil {
+		t.Errorf("unexpected restore of server entry that is not accepted")
+	}
+
+	err = RestoreServerEntry(ipAddresses[0])
+	if err != nil {
+		t.Fatalf("RestoreServerEntry failed: %s", err)
+	}
+}
+
+func TestAllowedRegions(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	singleton.config.AllowedRegions = []string{"XF"}
+	defer func() {
+		singleton.config.AllowedRegions = nil
+	}()
+
+	serverEntries := []*ServerEntry{
+		makeTestServerEntry("10.0.7.1", "XF"),
+		makeTestServerEntry("10.0.7.2", "XG"),
+		makeTestServerEntry("10.0.7.3", "XF"),
+		makeTestServerEntry("10.0.7.4", "XG"),
+	}
+	err := StoreServerEntries(serverEntries, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	count := CountServerEntries("XF", "")
+	if count != 2 {
+		t.Errorf("unexpected allowed region server entry count: %d", count)
+	}
+	count = CountServerEntries("XG", "")
+	if count != 0 {
+		t.Errorf("unexpected disallowed region server entry count: %d", count)
+	}
+}
+
+func TestExpectedWebCertFingerprints(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	certificate := []byte("test-web-server-certificate")
+	digest := sha256.Sum256(certificate)
+
+	singleton.config.ExpectedWebCertFingerprints = []string{hex.EncodeToString(digest[:])}
+	defer func() {
+		singleton.config.ExpectedWebCertFingerprints = nil
+	}()
+
+	matchingServerEntry := makeTestServerEntry("10.0.8.1", "XH")
+	matchingServerEntry.WebServerCertificate = base64.StdEncoding.EncodeToString(certificate)
+
+	mismatchingServerEntry := makeTestServerEntry("10.0.8.2", "XH")
+	mismatchingServerEntry.WebServerCertificate = base64.StdEncoding.EncodeToString(
+		[]byte("other-web-server-certificate"))
+
+	for _, serverEntry := range []*ServerEntry{matchingServerEntry, mismatchingServerEntry} {
+		err := StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	candidates := iterateTestServerEntries(t, "XH")
+	if len(candidates) != 1 || !candidates[matchingServerEntry.IpAddress] {
+		t.Errorf("unexpected stored server entries: %+v", candidates)
+	}
+}
+
+func TestGetServerEntries(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	ipAddresses := storeTestServerEntries(t, "10.0.9", "XI", 3)
+	requestIpAddresses := []string{ipAddresses[2], "10.0.9.100", ipAddresses[0], ipAddresses[1]}
+
+	serverEntries, err := GetServerEntries(requestIpAddresses)
+	if err != nil {
+		t.Fatalf("GetServerEntries failed: %s", err)
+	}
+	if len(serverEntries) != len(ipAddresses) {
+		t.Fatalf("unexpected server entry count: %d", len(serverEntries))
+	}
+
+	index := 0
+	for _, ipAddress := range requestIpAddresses {
+		serverEntry, err := GetServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if serverEntry == nil {
+			continue
+		}
+		expectedJson, _ := json.Marshal(serverEntry)
+		actualJson, _ := json.Marshal(serverEntries[index])
+		if string(expectedJson) != string(actualJson) {
+			t.Errorf("unexpected server entry: %s != %s", actualJson, expectedJson)
+		}
+		index += 1
+	}
+	if index != len(serverEntries) {
+		t.Errorf("unexpected individual server entry count: %d", index)
+	}
+}
+
+func TestServerEntryPreferredProtocol(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	ipAddresses := storeTestServerEntries(t, "10.0.10", "XJ", 2)
+
+	err := SetServerEntryPreferredProtocol(ipAddresses[0], TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+	if err != nil {
+		t.Fatalf("SetServerEntryPreferredProtocol failed: %s", err)
+	}
+
+	for _, invalidProtocol := range []string{
+		TUNNEL_PROTOCOL_FRONTED_MEEK, "VPN", "handshake", "invalid"} {
+		err = SetServerEntryPreferredProtocol(ipAddresses[0], invalidProtocol)
+		if err == nil {
+			t.Errorf("SetServerEntryPreferredProtocol unexpectedly accepted %s", invalidProtocol)
+		}
+	}
+
+	err = SetServerEntryPreferredProtocol("10.0.10.100", TUNNEL_PROTOCOL_SSH)
+	if err == nil {
+		t.Errorf("SetServerEntryPreferredProtocol unexpectedly accepted unknown server")
+	}
+
+	protocol, err := GetServerEntryPreferredProtocol(ipAddresses[0])
+	if err != nil {
+		t.Fatalf("GetServerEntryPreferredProtocol failed: %s", err)
+	}
+	if protocol != TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		t.Errorf("unexpected preferred protocol: %s", protocol)
+	}
+
+	protocol, err = GetServerEntryPreferredProtocol(ipAddresses[1])
+	if err != nil {
+		t.Fatalf("GetServerEntryPreferredProtocol failed: %s", err)
+	}
+	if protocol != "" {
+		t.Errorf("unexpected preferred protocol: %s", protocol)
+	}
+
+	iterator, err := NewServerEntryIterator(
+		&Config{EgressRegion: "XJ", TunnelPoolSize: 1, UseServerEntryPreferredProtocol: true})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		expectedProtocol := ""
+		if serverEntry.IpAddress == ipAddresses[0] {
+			expectedProtocol = TUNNEL_PROTOCOL_OBFUSCATED_SSH
+		}
+		if serverEntry.PreferredProtocol != expectedProtocol {
+			t.Errorf("unexpected preferred protocol for %s: %s",
+				serverEntry.IpAddress, serverEntry.PreferredProtocol)
+		}
+	}
+}
+
+func TestSyncDataStore(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	storeTestServerEntries(t, "10.0.11", "XK", 1)
+
+	err := SyncDataStore()
+	if err != nil {
+		t.Fatalf("SyncDataStore failed: %s", err)
+	}
+
+	db := singleton.db
+	singleton.db = nil
+	defer func() {
+		singleton.db = db
+		if recover() == nil {
+			t.Errorf("SyncDataStore unexpectedly succeeded when not initialized")
+		}
+	}()
+	SyncDataStore()
+}
+
+func TestPartitionServerEntriesByPropagationChannel(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	singleton.config.PartitionServerEntriesByPropagationChannel = true
+	defer func() {
+		singleton.config.PartitionServerEntriesByPropagationChannel = false
+		singleton.config.PropagationChannelId = ""
+	}()
+
+	singleton.config.PropagationChannelId = "channel-A"
+	channelAIpAddresses := storeTestServerEntries(t, "10.0.13", "XM", 2)
+
+	singleton.config.PropagationChannelId = "channel-B"
+	channelBIpAddresses := []string{"10.0.13.10", "10.0.13.11"}
+	for _, ipAddress := range channelBIpAddresses {
+		err := StoreServerEntry(makeTestServerEntry(ipAddress, "XM"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	for channel, expectedIpAddresses := range map[string][]string{
+		"channel-A": channelAIpAddresses,
+		"channel-B": channelBIpAddresses,
+		"channel-C": []string{},
+	} {
+		iterator, err := NewServerEntryIterator(
+			&Config{
+				EgressRegion:         "XM",
+				TunnelPoolSize:       1,
+				PropagationChannelId: channel,
+				PartitionServerEntriesByPropagationChannel: true,
+			})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		candidates := make(map[string]bool)
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			candidates[serverEntry.IpAddress] = true
+		}
+		iterator.Close()
+
+		if len(candidates) != len(expectedIpAddresses) {
+			t.Errorf("unexpected %s candidates: %+v", channel, candidates)
+		}
+		for _, ipAddress := range expectedIpAddresses {
+			if !candidates[ipAddress] {
+				t.Errorf("missing %s candidate: %s", channel, ipAddress)
+			}
+		}
+	}
+
+	// Without partitioning, all server entries are candidates
+	candidates := iterateTestServerEntries(t, "XM")
+	if len(candidates) != len(channelAIpAddresses)+len(channelBIpAddresses) {
+		t.Errorf("unexpected unpartitioned candidates: %+v", candidates)
+	}
+}
+
+func TestIteratorOnCandidate(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	yieldedIpAddresses := storeTestServerEntries(t, "10.0.14", "XN", 2)
+
+	protocolMismatchServerEntry := makeTestServerEntry("10.0.14.10", "XN")
+	protocolMismatchServerEntry.Capabilities = []string{"handshake", "SSH"}
+	regionMismatchServerEntry := makeTestServerEntry("10.0.14.20", "XO")
+	for _, serverEntry := range []*ServerEntry{protocolMismatchServerEntry, regionMismatchServerEntry} {
+		err := StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	yielded := make(map[string]bool)
+	skipReasons := make(map[string]string)
+	onCandidate := func(serverEntry *ServerEntry, isYielded bool, skipReason string) {
+		if isYielded {
+			yielded[serverEntry.IpAddress] = true
+		} else {
+			skipReasons[serverEntry.IpAddress] = skipReason
+		}
+	}
+
+	iterator, err := NewServerEntryIterator(
+		&Config{
+			EgressRegion:   "XN",
+			TunnelProtocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			TunnelPoolSize: 1,
+			OnCandidate:    onCandidate,
+		})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+	}
+
+	if len(yielded) != len(yieldedIpAddresses) {
+		t.Errorf("unexpected yielded candidates: %+v", yielded)
+	}
+	for _, ipAddress := range yieldedIpAddresses {
+		if !yielded[ipAddress] {
+			t.Errorf("missing yielded candidate: %s", ipAddress)
+		}
+		if _, ok := skipReasons[ipAddress]; ok {
+			t.Errorf("unexpected skipped candidate: %s", ipAddress)
+		}
+	}
+	if skipReasons[protocolMismatchServerEntry.IpAddress] != SERVER_ENTRY_SKIP_REASON_PROTOCOL {
+		t.Errorf("unexpected protocol mismatch skip reason: %s",
+			skipReasons[protocolMismatchServerEntry.IpAddress])
+	}
+	if skipReasons[regionMismatchServerEntry.IpAddress] != SERVER_ENTRY_SKIP_REASON_REGION {
+		t.Errorf("unexpected region mismatch skip reason: %s",
+			skipReasons[regionMismatchServerEntry.IpAddress])
+	}
+}
+
+func TestInitDataStoreTwice(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	dataStoreDirectory := filepath.Dir(singleton.filename)
+
+	err := InitDataStore(&Config{DataStoreDirectory: dataStoreDirectory})
+	if err != nil {
+		t.Errorf("InitDataStore with same directory failed: %s", err)
+	}
+
+	err = InitDataStore(&Config{DataStoreDirectory: filepath.Join(dataStoreDirectory, ".")})
+	if err != nil {
+		t.Errorf("InitDataStore with equivalent directory failed: %s", err)
+	}
+
+	otherDataStoreDirectory, removeOtherDataStoreDirectory := makeTestDataStoreDirectory(t)
+	defer removeOtherDataStoreDirectory()
+	err = InitDataStore(&Config{DataStoreDirectory: otherDataStoreDirectory})
+	if err == nil {
+		t.Errorf("InitDataStore with different directory unexpectedly succeeded")
+	}
+}
+
+func TestInitDataStoreConcurrentWithClose(t *testing.T) {
+	dataStoreDirectory, removeDataStoreDirectory := makeTestDataStoreDirectory(t)
+	defer removeDataStoreDirectory()
+	defer CloseDataStore()
+
+	config := &Config{DataStoreDirectory: dataStoreDirectory}
+
+	CloseDataStore()
+
+	var waitGroup sync.WaitGroup
+	initErrors := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(2)
+		go func() {
+			defer waitGroup.Done()
+			initErrors <- InitDataStore(config)
+		}()
+		go func() {
+			defer waitGroup.Done()
+			CloseDataStore()
+		}()
+	}
+	waitGroup.Wait()
+	close(initErrors)
+
+	for err := range initErrors {
+		if err != nil {
+			t.Errorf("InitDataStore failed: %s", err)
+		}
+	}
+
+	err := InitDataStore(config)
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+	if defaultDataStore().db == nil {
+		t.Fatalf("default datastore not open after concurrent InitDataStore and CloseDataStore")
+	}
+	if CountServerEntries("", "") != 0 {
+		t.Errorf("unexpected server entries")
+	}
+}
+
+func TestAuditServerEntries(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	completeServerEntry := makeTestServerEntry("10.0.15.1", "XR")
+	completeServerEntry.WebServerSecret = "<webServerSecret>"
+	completeServerEntry.WebServerCertificate = "<webServerCertificate>"
+	completeServerEntry.SshUsername = "<sshUsername>"
+	completeServerEntry.SshPassword = "<sshPassword>"
+	completeServerEntry.SshHostKey = "<sshHostKey>"
+	completeServerEntry.SshObfuscatedPort = 443
+	completeServerEntry.SshObfuscatedKey = "<sshObfuscatedKey>"
+
+	brokenServerEntry := *completeServerEntry
+	brokenServerEntry.IpAddress = "10.0.15.2"
+	brokenServerEntry.SshObfuscatedKey = ""
+	brokenServerEntry.Capabilities = []string{"handshake", "SSH", "OSSH", "FRONTED-MEEK"}
+	brokenServerEntry.MeekFrontingAddresses = []string{"example.org"}
+
+	for _, serverEntry := range []*ServerEntry{completeServerEntry, &brokenServerEntry} {
+		err := StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	issues, err := AuditServerEntries()
+	if err != nil {
+		t.Fatalf("AuditServerEntries failed: %s", err)
+	}
+
+	missingFields := make(map[string][]string)
+	for _, issue := range issues {
+		if issue.IpAddress == completeServerEntry.IpAddress {
+			t.Errorf("unexpected issue for complete server entry: %+v", issue)
+		}
+		if issue.IpAddress == brokenServerEntry.IpAddress {
+			missingFields[issue.Capability] = issue.MissingFields
+		}
+	}
+
+	expectedMissingFields := map[string][]string{
+		"OSSH": []string{"sshObfuscatedKey"},
+		"FRONTED-MEEK": []string{
+			"meekFrontingHost", "meekCookieEncryptionPublicKey", "meekObfuscatedKey",
+			"sshObfuscatedKey"},
+	}
+	if !reflect.DeepEqual(missingFields, expectedMissingFields) {
+		t.Errorf("unexpected missing fields: %+v", missingFields)
+	}
+}
+
+func TestStoreServerEntriesResumable(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverEntries := make([]*ServerEntry, 0)
+	for i := 0; i < 5; i++ {
+		serverEntries = append(serverEntries, makeTestServerEntry(fmt.Sprintf("10.0.16.%d", i+1), "XS"))
+	}
+
+	listHash, err := makeServerEntryListHash(serverEntries)
+	if err != nil {
+		t.Fatalf("makeServerEntryListHash failed: %s", err)
+	}
+	importOrder := orderServerEntriesForImport(singleton.config, serverEntries, listHash)
+
+	// Simulate an import interrupted after storing two server entries: the
+	// marker records progress, but those entries are not in the datastore,
+	// so the resumed import can be observed skipping them.
+	err = singleton.setServerEntryImportProgress(
+		&serverEntryImportProgress{ListHash: listHash, StoredCount: 2})
+	if err != nil {
+		t.Fatalf("setServerEntryImportProgress failed: %s", err)
+	}
+
+	err = StoreServerEntriesResumable(serverEntries, false)
+	if err != nil {
+		t.Fatalf("StoreServerEntriesResumable failed: %s", err)
+	}
+
+	for index, serverEntry := range importOrder {
+		storedServerEntry, err := GetServerEntry(serverEntry.IpAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if (storedServerEntry != nil) != (index >= 2) {
+			t.Errorf("unexpected stored state for import index %d", index)
+		}
+	}
+
+	progress, err := singleton.getServerEntryImportProgress()
+	if err != nil {
+		t.Fatalf("getServerEntryImportProgress failed: %s", err)
+	}
+	if progress.ListHash != "" || progress.StoredCount != 0 {
+		t.Errorf("import progress not cleared: %+v", progress)
+	}
+
+	// A marker for a different list is ignored, and the import starts from scratch
+	err = singleton.setServerEntryImportProgress(
+		&serverEntryImportProgress{ListHash: "other-list", StoredCount: 5})
+	if err != nil {
+		t.Fatalf("setServerEntryImportProgress failed: %s", err)
+	}
+
+	err = StoreServerEntriesResumable(serverEntries, false)
+	if err != nil {
+		t.Fatalf("StoreServerEntriesResumable failed: %s", err)
+	}
+
+	for _, serverEntry := range serverEntries {
+		storedServerEntry, err := GetServerEntry(serverEntry.IpAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if storedServerEntry == nil {
+			t.Errorf("server entry not stored: %s", serverEntry.IpAddress)
+		}
+	}
+}
+
+func TestServerEntryInsertPosition(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	defer func() {
+		singleton.config.ServerEntryInsertPosition = ""
+	}()
+
+	for _, testCase := range []struct {
+		insertPosition string
+		ipAddress      string
+	}{
+		// A seed server entry is stored at the top first, so that the
+		// next-to-top inserts are ranked below an existing top entry.
+		{SERVER_ENTRY_INSERT_POSITION_TOP, "10.0.17.5"},
+		{SERVER_ENTRY_INSERT_POSITION_NEXT_TO_TOP, "10.0.17.1"},
+		{"", "10.0.17.2"},
+		{SERVER_ENTRY_INSERT_POSITION_TOP, "10.0.17.3"},
+		{SERVER_ENTRY_INSERT_POSITION_TAIL, "10.0.17.4"},
+	} {
+		singleton.config.ServerEntryInsertPosition = testCase.insertPosition
+		err := StoreServerEntry(makeTestServerEntry(testCase.ipAddress, "XT"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	// Each next-to-top insert is ranked directly below the top entry, and
+	// so above the previous next-to-top insert; the top insert is ranked
+	// first, and the tail insert is ranked last.
+	expectedOrder := []string{"10.0.17.3", "10.0.17.5", "10.0.17.2", "10.0.17.1", "10.0.17.4"}
+
+	// A large TunnelPoolSize disables the shuffle, so all candidates are
+	// iterated in rank order.
+	iterator, err := NewServerEntryIterator(&Config{EgressRegion: "XT", TunnelPoolSize: 1000})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+	order := make([]string, 0)
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		order = append(order, serverEntry.IpAddress)
+	}
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Errorf("unexpected rank order: %+v", order)
+	}
+}
+
+func TestOpenDataStoreConcurrently(t *testing.T) {
+
+	regions := []string{"XV", "XW"}
+	ipAddressPrefixes := []string{"10.0.19", "10.0.20"}
+	const count = 20
+
+	dataStores := make([]*DataStore, len(regions))
+	for i := range dataStores {
+		var closeDataStore func()
+		dataStores[i], closeDataStore = openTestDataStore(t, &Config{})
+		defer closeDataStore()
+	}
+
+	var waitGroup sync.WaitGroup
+	operationErrors := make(chan error, len(dataStores))
+	for i, dataStore := range dataStores {
+		waitGroup.Add(1)
+		go func(dataStore *DataStore, region, ipAddressPrefix string) {
+			defer waitGroup.Done()
+			for j := 0; j < count; j++ {
+				serverEntry := makeTestServerEntry(fmt.Sprintf("%s.%d", ipAddressPrefix, j+1), region)
+				err := dataStore.StoreServerEntry(serverEntry, true)
+				if err == nil {
+					err = dataStore.SetKeyValue("region", region)
+				}
+				if err != nil {
+					operationErrors <- err
+					return
+				}
+			}
+		}(dataStore, regions[i], ipAddressPrefixes[i])
+	}
+	waitGroup.Wait()
+	close(operationErrors)
+	for err := range operationErrors {
+		t.Fatalf("concurrent datastore operation failed: %s", err)
+	}
+
+	for i, dataStore := range dataStores {
+		if dataStore.CountServerEntries("", "") != count {
+			t.Errorf("unexpected server entry count in datastore %d", i)
+		}
+		if dataStore.CountServerEntries(regions[(i+1)%len(regions)], "") != 0 {
+			t.Errorf("unexpected server entries from other datastore in datastore %d", i)
+		}
+		value, err := dataStore.GetKeyValue("region")
+		if err != nil {
+			t.Fatalf("GetKeyValue failed: %s", err)
+		}
+		if value != regions[i] {
+			t.Errorf("unexpected key value in datastore %d: %s", i, value)
+		}
+	}
+}
+
+func TestServerEntryPinned(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	defer func() {
+		singleton.config.ServerEntryInsertPosition = ""
+	}()
+	singleton.config.ServerEntryInsertPosition = SERVER_ENTRY_INSERT_POSITION_TOP
+
+	// The pinned server entry is stored last, so it's ranked above the
+	// unpinned server entry.
+	pinnedIpAddress := "10.0.21.1"
+	unpinnedIpAddress := "10.0.21.2"
+	for _, ipAddress := range []string{unpinnedIpAddress, pinnedIpAddress} {
+		err := StoreServerEntry(makeTestServerEntry(ipAddress, "XX"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	err := SetServerEntryPinned(pinnedIpAddress, true)
+	if err != nil {
+		t.Fatalf("SetServerEntryPinned failed: %s", err)
+	}
+	for ipAddress, expectedPinned := range map[string]bool{
+		pinnedIpAddress:   true,
+		unpinnedIpAddress: false,
+	} {
+		pinned, err := IsServerEntryPinned(ipAddress)
+		if err != nil {
+			t.Fatalf("IsServerEntryPinned failed: %s", err)
+		}
+		if pinned != expectedPinned {
+			t.Errorf("unexpected pinned value for %s: %t", ipAddress, pinned)
+		}
+	}
+
+	// Storing more server entries than the rank capacity would push both
+	// server entries out of rank order, leaving them in datastore key order.
+	// The pinned server entry keeps its rank.
+	storeTestServerEntries(t, "10.0.22", "XY", 100)
+
+	iterator, err := NewServerEntryIterator(&Config{EgressRegion: "XX", TunnelPoolSize: 1000})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+	order := make([]string, 0)
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		order = append(order, serverEntry.IpAddress)
+	}
+	expectedOrder := []string{pinnedIpAddress, unpinnedIpAddress}
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Errorf("unexpected rank order: %+v", order)
+	}
+
+	err = SetServerEntryPinned(pinnedIpAddress, false)
+	if err != nil {
+		t.Fatalf("SetServerEntryPinned failed: %s", err)
+	}
+	pinned, err := IsServerEntryPinned(pinnedIpAddress)
+	if err != nil {
+		t.Fatalf("IsServerEntryPinned failed: %s", err)
+	}
+	if pinned {
+		t.Errorf("server entry still pinned")
+	}
+}
+
+func TestSuggestEgressRegion(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	nextAddress := 1
+	storeServerEntries := func(region string, count int) {
+		for i := 0; i < count; i++ {
+			serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.25.%d", nextAddress), region)
+			nextAddress += 1
+			err := dataStore.StoreServerEntry(serverEntry, true)
+			if err != nil {
+				t.Fatalf("error storing server entry: %s", err)
+			}
+		}
+	}
+
+	// Server entries without a region are never suggested, even when they
+	// are the majority.
+	for _, testCase := range []struct {
+		region         string
+		count          int
+		expectedRegion string
+	}{
+		{"", 10, ""},
+		{"YB", 3, "YB"},
+		{"YC", 5, "YC"},
+		{"YB", 4, "YB"},
+	} {
+		storeServerEntries(testCase.region, testCase.count)
+		region, err := dataStore.SuggestEgressRegion()
+		if err != nil {
+			t.Fatalf("SuggestEgressRegion failed: %s", err)
+		}
+		if region != testCase.expectedRegion {
+			t.Errorf("unexpected suggested region: '%s'", region)
+		}
+	}
+}
+
+func TestOpenDataStoreRetry(t *testing.T) {
+
+	config := &Config{}
+	lockHolder, closeLockHolder := openTestDataStore(t, config)
+	defer closeLockHolder()
+	dataStoreDirectory := config.DataStoreDirectory
+
+	// Only the BoltDB datastore locks its file, so only it fails to open
+	// while the lock is held.
+	if runtime.GOOS != "windows" {
+		_, err := OpenDataStore(&Config{DataStoreDirectory: dataStoreDirectory})
+		if err == nil {
+			t.Fatalf("OpenDataStore unexpectedly succeeded while locked")
+		}
+	}
+
+	// The lock is released during the retries
+	lockReleased := make(chan struct{})
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		lockHolder.Close()
+		close(lockReleased)
+	}()
+	defer func() { <-lockReleased }()
+
+	dataStore, err := OpenDataStore(
+		&Config{DataStoreDirectory: dataStoreDirectory, DataStoreOpenRetryCount: 3})
+	if err != nil {
+		t.Fatalf("OpenDataStore with retries failed: %s", err)
+	}
+	dataStore.Close()
+}
+
+func TestPromotionHistory(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	err := ResetPromotionHistory()
+	if err != nil {
+		t.Fatalf("ResetPromotionHistory failed: %s", err)
+	}
+
+	ipAddresses := storeTestServerEntries(
+		t, "10.0.26", "YD", DATA_STORE_PROMOTION_HISTORY_MAX_EVENTS+10)
+
+	getPromotedIpAddresses := func() []string {
+		history, err := GetPromotionHistory()
+		if err != nil {
+			t.Fatalf("GetPromotionHistory failed: %s", err)
+		}
+		promotedIpAddresses := make([]string, 0)
+		for i, event := range history {
+			if i > 0 && event.Timestamp.Before(history[i-1].Timestamp) {
+				t.Errorf("promotion events out of order")
+			}
+			promotedIpAddresses = append(promotedIpAddresses, event.IpAddress)
+		}
+		return promotedIpAddresses
+	}
+
+	for _, ipAddress := range ipAddresses[:3] {
+		err := PromoteServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("PromoteServerEntry failed: %s", err)
+		}
+	}
+	promotedIpAddresses := getPromotedIpAddresses()
+	if !reflect.DeepEqual(promotedIpAddresses, ipAddresses[:3]) {
+		t.Errorf("unexpected promotion history: %+v", promotedIpAddresses)
+	}
+
+	// Only the most recent events are retained
+	for _, ipAddress := range ipAddresses[3:] {
+		err := PromoteServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("PromoteServerEntry failed: %s", err)
+		}
+	}
+	promotedIpAddresses = getPromotedIpAddresses()
+	if !reflect.DeepEqual(
+		promotedIpAddresses,
+		ipAddresses[len(ipAddresses)-DATA_STORE_PROMOTION_HISTORY_MAX_EVENTS:]) {
+		t.Errorf("unexpected capped promotion history: %+v", promotedIpAddresses)
+	}
+
+	err = ResetPromotionHistory()
+	if err != nil {
+		t.Fatalf("ResetPromotionHistory failed: %s", err)
+	}
+	promotedIpAddresses = getPromotedIpAddresses()
+	if len(promotedIpAddresses) != 0 {
+		t.Errorf("unexpected promotion history after reset: %+v", promotedIpAddresses)
+	}
+}
+
+func TestRequireEgressRegion(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	storeTestServerEntries(t, "10.0.27", "YE", 1)
+
+	for _, testCase := range []struct {
+		config        *Config
+		expectSuccess bool
+	}{
+		{&Config{TunnelPoolSize: 1}, true},
+		{&Config{TunnelPoolSize: 1, RequireEgressRegion: true}, false},
+		{&Config{TunnelPoolSize: 1, RequireEgressRegion: true, EgressRegion: "YE"}, true},
+	} {
+		iterator, err := NewServerEntryIterator(testCase.config)
+		if testCase.expectSuccess != (err == nil) {
+			t.Errorf("unexpected NewServerEntryIterator result for %+v: %v", testCase.config, err)
+		}
+		if iterator != nil {
+			iterator.Close()
+		}
+	}
+}
+
+func TestGetAvailableCapabilities(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	capabilities, err := dataStore.GetAvailableCapabilities()
+	if err != nil {
+		t.Fatalf("GetAvailableCapabilities failed: %s", err)
+	}
+	if len(capabilities) != 0 {
+		t.Errorf("unexpected capabilities for empty datastore: %+v", capabilities)
+	}
+
+	for i, serverEntryCapabilities := range [][]string{
+		{"SSH", "handshake"},
+		{"OSSH", "SSH"},
+		{"UNFRONTED-MEEK", "handshake"},
+		{},
+	} {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.28.%d", i+1), "YF")
+		serverEntry.Capabilities = serverEntryCapabilities
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	capabilities, err = dataStore.GetAvailableCapabilities()
+	if err != nil {
+		t.Fatalf("GetAvailableCapabilities failed: %s", err)
+	}
+	expectedCapabilities := []string{"OSSH", "SSH", "UNFRONTED-MEEK", "handshake"}
+	if !reflect.DeepEqual(capabilities, expectedCapabilities) {
+		t.Errorf("unexpected capabilities: %+v", capabilities)
+	}
+}
+
+func TestServerEntryFailureThreshold(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{
+		ServerEntryFailureThreshold: 2,
+	})
+	defer closeDataStore()
+
+	for i := 1; i <= 2; i++ {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.29.%d", i), "YG"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	ipAddress := "10.0.29.1"
+
+	iterate := func() []string {
+		iterator, err := dataStore.NewServerEntryIterator(&Config{EgressRegion: "YG", TunnelPoolSize: 1000})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		defer iterator.Close()
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		return ipAddresses
+	}
+
+	// The first failure is below the threshold.
+	err := dataStore.RecordServerEntryFailure(ipAddress)
+	if err != nil {
+		t.Fatalf("RecordServerEntryFailure failed: %s", err)
+	}
+	disabledUntil, err := dataStore.GetServerEntryDisabledUntil(ipAddress)
+	if err != nil {
+		t.Fatalf("GetServerEntryDisabledUntil failed: %s", err)
+	}
+	if !disabledUntil.IsZero() {
+		t.Errorf("unexpected disable below threshold: %s", disabledUntil)
+	}
+
+	// Each additional failure doubles the disable period.
+	for _, expectedPeriod := range []time.Duration{
+		SERVER_ENTRY_DISABLE_BASE_PERIOD,
+		2 * SERVER_ENTRY_DISABLE_BASE_PERIOD,
+		4 * SERVER_ENTRY_DISABLE_BASE_PERIOD,
+	} {
+		before := time.Now()
+		err = dataStore.RecordServerEntryFailure(ipAddress)
+		if err != nil {
+			t.Fatalf("RecordServerEntryFailure failed: %s", err)
+		}
+		after := time.Now()
+		disabledUntil, err := dataStore.GetServerEntryDisabledUntil(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryDisabledUntil failed: %s", err)
+		}
+		if disabledUntil.Before(before.Add(expectedPeriod)) ||
+			disabledUntil.After(after.Add(expectedPeriod)) {
+			t.Errorf("unexpected disabled until %s for period %s", disabledUntil, expectedPeriod)
+		}
+	}
+
+	ipAddresses := iterate()
+	if len(ipAddresses) != 1 || ipAddresses[0] != "10.0.29.2" {
+		t.Errorf("unexpected server entries while disabled: %+v", ipAddresses)
+	}
+
+	err = dataStore.RecordServerEntrySuccess(ipAddress)
+	if err != nil {
+		t.Fatalf("RecordServerEntrySuccess failed: %s", err)
+	}
+
+	ipAddresses = iterate()
+	if len(ipAddresses) != 2 {
+		t.Errorf("unexpected server entries after success: %+v", ipAddresses)
+	}
+
+	if getServerEntryDisablePeriod(100, 2) != SERVER_ENTRY_DISABLE_MAX_PERIOD {
+		t.Errorf("disable period not capped")
+	}
+}
+
+func TestExportRankedServerEntries(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	ipAddresses := []string{"10.0.30.1", "10.0.30.2", "10.0.30.3"}
+	for _, ipAddress := range ipAddresses {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, "YH"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	// Promote in reverse so that the ranked order is ipAddresses.
+	for i := len(ipAddresses) - 1; i >= 0; i-- {
+		err := dataStore.PromoteServerEntry(ipAddresses[i])
+		if err != nil {
+			t.Fatalf("PromoteServerEntry failed: %s", err)
+		}
+	}
+
+	for _, testCase := range []struct {
+		count               int
+		expectedIpAddresses []string
+	}{
+		{0, []string{}},
+		{2, ipAddresses[:2]},
+		{len(ipAddresses) + 1, ipAddresses},
+	} {
+		encodedServerEntryList, err := dataStore.ExportRankedServerEntries(testCase.count)
+		if err != nil {
+			t.Fatalf("ExportRankedServerEntries failed: %s", err)
+		}
+		serverEntries, err := DecodeAndValidateServerEntryList(encodedServerEntryList)
+		if err != nil {
+			t.Fatalf("DecodeAndValidateServerEntryList failed: %s", err)
+		}
+		exportedIpAddresses := make([]string, 0)
+		for _, serverEntry := range serverEntries {
+			exportedIpAddresses = append(exportedIpAddresses, serverEntry.IpAddress)
+		}
+		if !reflect.DeepEqual(exportedIpAddresses, testCase.expectedIpAddresses) {
+			t.Errorf("unexpected export for count %d: %+v", testCase.count, exportedIpAddresses)
+		}
+	}
+}
+
+func TestCountServerEntriesMatching(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 0; i < 6; i++ {
+		region := "YI"
+		if i%2 == 1 {
+			region = "YJ"
+		}
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.31.%d", i+1), region)
+		if i < 2 {
+			serverEntry.Capabilities = append(serverEntry.Capabilities, "FRONTED-MEEK")
+			serverEntry.MeekFrontingAddresses = []string{"example.org"}
+		}
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	for _, testCase := range []struct {
+		description   string
+		predicate     func(*ServerEntry) bool
+		expectedCount int
+	}{
+		{
+			"all",
+			func(*ServerEntry) bool { return true },
+			6,
+		},
+		{
+			"region",
+			func(serverEntry *ServerEntry) bool { return serverEntry.Region == "YI" },
+			3,
+		},
+		{
+			"capability",
+			func(serverEntry *ServerEntry) bool { return Contains(serverEntry.Capabilities, "FRONTED-MEEK") },
+			2,
+		},
+		{
+			"fronting addresses",
+			func(serverEntry *ServerEntry) bool { return len(serverEntry.MeekFrontingAddresses) > 0 },
+			2,
+		},
+		{
+			"none",
+			func(*ServerEntry) bool { return false },
+			0,
+		},
+	} {
+		count, err := dataStore.CountServerEntriesMatching(testCase.predicate)
+		if err != nil {
+			t.Fatalf("CountServerEntriesMatching failed: %s", err)
+		}
+		if count != testCase.expectedCount {
+			t.Errorf("unexpected count for %s: %d", testCase.description, count)
+		}
+	}
+}
+
+func TestSnapshotDataStore(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 5; i++ {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.32.%d", i), "YK"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	err := dataStore.PromoteServerEntry("10.0.32.3")
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+	err = dataStore.SetKeyValue("snapshotKey", "snapshotValue")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+
+	snapshotDirectory, removeSnapshotDirectory := makeTestDataStoreDirectory(t)
+	defer removeSnapshotDirectory()
+	err = dataStore.Snapshot(filepath.Join(snapshotDirectory, DATA_STORE_FILENAME))
+	if err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	// Writes after the snapshot must not appear in the snapshot.
+	err = dataStore.SetKeyValue("snapshotKey", "modifiedValue")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+
+	snapshot, err := OpenDataStore(&Config{DataStoreDirectory: snapshotDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed for snapshot: %s", err)
+	}
+	defer snapshot.Close()
+
+	ipAddresses, err := dataStore.GetServerEntryIpAddresses()
+	if err != nil {
+		t.Fatalf("GetServerEntryIpAddresses failed: %s", err)
+	}
+	snapshotIpAddresses, err := snapshot.GetServerEntryIpAddresses()
+	if err != nil {
+		t.Fatalf("GetServerEntryIpAddresses failed for snapshot: %s", err)
+	}
+	sort.Strings(ipAddresses)
+	sort.Strings(snapshotIpAddresses)
+	if !reflect.DeepEqual(ipAddresses, snapshotIpAddresses) {
+		t.Errorf("unexpected snapshot server entries: %+v", snapshotIpAddresses)
+	}
+
+	rankedServerEntries, err := dataStore.ExportRankedServerEntries(len(ipAddresses))
+	if err != nil {
+		t.Fatalf("ExportRankedServerEntries failed: %s", err)
+	}
+	snapshotRankedServerEntries, err := snapshot.ExportRankedServerEntries(len(ipAddresses))
+	if err != nil {
+		t.Fatalf("ExportRankedServerEntries failed for snapshot: %s", err)
+	}
+	if rankedServerEntries != snapshotRankedServerEntries {
+		t.Errorf("unexpected snapshot server entry ranking")
+	}
+
+	value, err := snapshot.GetKeyValue("snapshotKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed for snapshot: %s", err)
+	}
+	if value != "snapshotValue" {
+		t.Errorf("unexpected snapshot key value: %s", value)
+	}
+}
+
+func TestServerEntrySeen(t *testing.T) {
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	serverEntrySeenClock = func() time.Time { return now }
+	defer func() { serverEntrySeenClock = time.Now }()
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	serverEntry := makeTestServerEntry("10.0.33.1", "YL")
+
+	firstSeen, lastSeen, err := dataStore.GetServerEntrySeen(serverEntry.IpAddress)
+	if err != nil {
+		t.Fatalf("GetServerEntrySeen failed: %s", err)
+	}
+	if !firstSeen.IsZero() || !lastSeen.IsZero() {
+		t.Errorf("unexpected timestamps for unknown server entry: %s, %s", firstSeen, lastSeen)
+	}
+
+	storedAt := now
+
+	for _, replaceIfExists := range []bool{true, false, true} {
+		err := dataStore.StoreServerEntry(serverEntry, replaceIfExists)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+		firstSeen, lastSeen, err := dataStore.GetServerEntrySeen(serverEntry.IpAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntrySeen failed: %s", err)
+		}
+		if !firstSeen.Equal(storedAt) {
+			t.Errorf("unexpected first seen: %s", firstSeen)
+		}
+		if !lastSeen.Equal(now) {
+			t.Errorf("unexpected last seen: %s", lastSeen)
+		}
+		now = now.Add(1 * time.Hour)
+	}
+}
+
+func TestRebuildRankedServerEntries(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	const serverEntryCount = 150
+	for i := 1; i <= serverEntryCount; i++ {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.35.%d", i), "YN"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	pinnedIpAddress := fmt.Sprintf("10.0.35.%d", serverEntryCount)
+	err := dataStore.SetServerEntryPinned(pinnedIpAddress, true)
+	if err != nil {
+		t.Fatalf("SetServerEntryPinned failed: %s", err)
+	}
+
+	err = dataStore.RebuildRankedServerEntries()
+	if err != nil {
+		t.Fatalf("RebuildRankedServerEntries failed: %s", err)
+	}
+
+	encodedServerEntryList, err := dataStore.ExportRankedServerEntries(2 * serverEntryCount)
+	if err != nil {
+		t.Fatalf("ExportRankedServerEntries failed: %s", err)
+	}
+	serverEntries, err := DecodeAndValidateServerEntryList(encodedServerEntryList)
+	if err != nil {
+		t.Fatalf("DecodeAndValidateServerEntryList failed: %s", err)
+	}
+
+	// The BoltDB ranked list is capped; the sqlite ranking includes all
+	// server entries.
+	expectedCount := 100
+	if runtime.GOOS == "windows" {
+		expectedCount = serverEntryCount
+	}
+	if len(serverEntries) != expectedCount {
+		t.Errorf("unexpected ranked server entry count: %d", len(serverEntries))
+	}
+
+	rankedIpAddresses := make(map[string]bool)
+	for _, serverEntry := range serverEntries {
+		if rankedIpAddresses[serverEntry.IpAddress] {
+			t.Errorf("duplicate ranked server entry: %s", serverEntry.IpAddress)
+		}
+		rankedIpAddresses[serverEntry.IpAddress] = true
+		storedServerEntry, err := dataStore.GetServerEntry(serverEntry.IpAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if storedServerEntry == nil {
+			t.Errorf("ranked server entry not stored: %s", serverEntry.IpAddress)
+		}
+	}
+	if !rankedIpAddresses[pinnedIpAddress] {
+		t.Errorf("pinned server entry not ranked")
+	}
+}
+
+func TestEgressRegionGroups(t *testing.T) {
+
+	regionGroups := map[string][]string{"GROUP": {"YO", "YP"}}
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{
+		EgressRegionGroups: regionGroups,
+	})
+	defer closeDataStore()
+
+	for i, region := range []string{"YO", "YO", "YP", "YQ"} {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.36.%d", i+1), region), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	for _, testCase := range []struct {
+		region        string
+		expectedCount int
+	}{
+		{"GROUP", 3},
+		{"YO", 2},
+		{"YQ", 1},
+		{"", 4},
+	} {
+		count := dataStore.CountServerEntries(testCase.region, "")
+		if count != testCase.expectedCount {
+			t.Errorf("unexpected count for region %s: %d", testCase.region, count)
+		}
+
+		iterator, err := dataStore.NewServerEntryIterator(&Config{
+			EgressRegion:       testCase.region,
+			EgressRegionGroups: regionGroups,
+			TunnelPoolSize:     1000,
+		})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		count = 0
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			if testCase.region == "GROUP" && serverEntry.Region == "YQ" {
+				t.Errorf("unexpected server entry region: %s", serverEntry.Region)
+			}
+			count += 1
+		}
+		iterator.Close()
+		if count != testCase.expectedCount {
+			t.Errorf("unexpected iterated count for region %s: %d", testCase.region, count)
+		}
+	}
+}
+
+func TestServerEntryCodecs(t *testing.T) {
+
+	for _, codec := range SupportedServerEntryCodecs {
+
+		config := &Config{ServerEntryCodec: codec}
+		dataStore, closeDataStore := openTestDataStore(t, config)
+		defer closeDataStore()
+		dataStoreDirectory := config.DataStoreDirectory
+
+		serverEntry := makeTestServerEntry("10.0.37.1", "YR")
+		serverEntry.ObfuscationParams = &ServerEntryObfuscationParams{
+			PaddingProfile: OBFUSCATION_PADDING_PROFILE_DEFAULT,
+			MaxPadding:     128,
+		}
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry for %s: %s", codec, err)
+		}
+		dataStore.Close()
+
+		// Reopening with another codec must fail, as the stored server
+		// entries can't be read.
+		for _, otherCodec := range SupportedServerEntryCodecs {
+			if otherCodec == codec {
+				continue
+			}
+			otherDataStore, err := OpenDataStore(
+				&Config{DataStoreDirectory: dataStoreDirectory, ServerEntryCodec: otherCodec})
+			if err == nil {
+				otherDataStore.Close()
+				t.Errorf("unexpected OpenDataStore success for %s with %s", codec, otherCodec)
+			}
+		}
+
+		dataStore, err = OpenDataStore(config)
+		if err != nil {
+			t.Fatalf("OpenDataStore failed for %s: %s", codec, err)
+		}
+		storedServerEntry, err := dataStore.GetServerEntry(serverEntry.IpAddress)
+		dataStore.Close()
+		if err != nil {
+			t.Fatalf("GetServerEntry failed for %s: %s", codec, err)
+		}
+		if storedServerEntry == nil {
+			t.Fatalf("server entry not found for %s", codec)
+		}
+		expectedJson, _ := json.Marshal(serverEntry)
+		storedJson, _ := json.Marshal(storedServerEntry)
+		if string(expectedJson) != string(storedJson) {
+			t.Errorf("unexpected server entry for %s: %s", codec, storedJson)
+		}
+	}
+}
+
+func TestGetRandomServerEntry(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i, region := range []string{"YS", "YS", "YS", "YS", "YT"} {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.38.%d", i+1), region), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	serverEntry, err := dataStore.GetRandomServerEntry("YU", "")
+	if err != nil {
+		t.Fatalf("GetRandomServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Errorf("unexpected server entry for region without servers: %s", serverEntry.IpAddress)
+	}
+
+	rand.Seed(1)
+	defer rand.Seed(time.Now().UnixNano())
+
+	const draws = 4000
+	selections := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		serverEntry, err := dataStore.GetRandomServerEntry("YS", TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+		if err != nil {
+			t.Fatalf("GetRandomServerEntry failed: %s", err)
+		}
+		if serverEntry == nil || serverEntry.Region != "YS" {
+			t.Fatalf("unexpected server entry: %+v", serverEntry)
+		}
+		selections[serverEntry.IpAddress] += 1
+	}
+
+	// Each of the 4 matching server entries is expected to be selected
+	// about a quarter of the time.
+	if len(selections) != 4 {
+		t.Errorf("unexpected selected server entries: %+v", selections)
+	}
+	for ipAddress, count := range selections {
+		if count < draws/4*8/10 || count > draws/4*12/10 {
+			t.Errorf("non-uniform selection of %s: %d of %d", ipAddress, count, draws)
+		}
+	}
+}
+
+func TestLatencyWeightedServerEntries(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 6; i++ {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.40.%d", i), "YW"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	latencies := map[string]time.Duration{
+		"10.0.40.1": 300 * time.Millisecond,
+		"10.0.40.2": 100 * time.Millisecond,
+		"10.0.40.3": 200 * time.Millisecond,
+	}
+	for ipAddress, latency := range latencies {
+		err := dataStore.SetServerEntryLatency(ipAddress, latency)
+		if err != nil {
+			t.Fatalf("SetServerEntryLatency failed: %s", err)
+		}
+	}
+
+	iterator, err := dataStore.NewServerEntryIterator(&Config{
+		EgressRegion:                 "YW",
+		TunnelPoolSize:               1,
+		LatencyWeightedServerEntries: true,
+	})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+
+	var ipAddresses []string
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+
+	if len(ipAddresses) != 6 {
+		t.Fatalf("unexpected server entries: %+v", ipAddresses)
+	}
+
+	// The first server entry is the ranked head. In the tail, measured
+	// server entries are in ascending latency order, followed by the
+	// unmeasured server entries.
+	var previousLatency time.Duration
+	unmeasured := false
+	for _, ipAddress := range ipAddresses[1:] {
+		latency, ok := latencies[ipAddress]
+		if !ok {
+			unmeasured = true
+			continue
+		}
+		if unmeasured || latency < previousLatency {
+			t.Errorf("unexpected latency order: %+v", ipAddresses)
+			break
+		}
+		previousLatency = latency
+	}
+}
+
+func TestServerEntryIteratorReshuffleOnReset(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 20; i++ {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(fmt.Sprintf("10.0.42.%d", i), "YY"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	reshuffleOnReset := false
+	iterator, err := dataStore.NewServerEntryIterator(&Config{
+		EgressRegion:     "YY",
+		TunnelPoolSize:   1,
+		ReshuffleOnReset: &reshuffleOnReset,
+	})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+
+	iterate := func() []string {
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		return ipAddresses
+	}
+
+	order := iterate()
+	if len(order) != 20 {
+		t.Fatalf("unexpected server entries: %+v", order)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = iterator.Reset()
+		if err != nil {
+			t.Fatalf("error resetting iterator: %s", err)
+		}
+		resetOrder := iterate()
+		if !reflect.DeepEqual(resetOrder, order) {
+			t.Fatalf("unexpected order after reset: %+v", resetOrder)
+		}
+	}
+
+	err = iterator.Reshuffle()
+	if err != nil {
+		t.Fatalf("error reshuffling iterator: %s", err)
+	}
+	reshuffledOrder := iterate()
+	sort.Strings(reshuffledOrder)
+	sort.Strings(order)
+	if !reflect.DeepEqual(reshuffledOrder, order) {
+		t.Errorf("unexpected server entries after reshuffle: %+v", reshuffledOrder)
+	}
+}
+
+func TestAvailableEgressRegionsChanged(t *testing.T) {
+
+	var reports [][]string
+	dataStore, closeDataStore := openTestDataStore(t, &Config{
+		OnAvailableEgressRegionsChanged: func(regions []string) {
+			reports = append(reports, regions)
+		},
+	})
+	defer closeDataStore()
+
+	storeServerEntry := func(ipAddress, region string) {
+		err := dataStore.StoreServerEntries(
+			[]*ServerEntry{makeTestServerEntry(ipAddress, region)}, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntries failed: %s", err)
+		}
+	}
+
+	storeServerEntry("10.0.43.1", "YZ")
+	storeServerEntry("10.0.43.2", "YZ")
+	storeServerEntry("10.0.43.3", "ZA")
+	storeServerEntry("10.0.43.4", "ZA")
+	dataStore.ReportAvailableRegions()
+
+	err := dataStore.ArchiveServerEntry("10.0.43.1")
+	if err != nil {
+		t.Fatalf("ArchiveServerEntry failed: %s", err)
+	}
+	dataStore.ReportAvailableRegions()
+
+	err = dataStore.ArchiveServerEntry("10.0.43.2")
+	if err != nil {
+		t.Fatalf("ArchiveServerEntry failed: %s", err)
+	}
+	dataStore.ReportAvailableRegions()
+	dataStore.ReportAvailableRegions()
+
+	expectedReports := [][]string{{"YZ"}, {"YZ", "ZA"}, {"ZA"}}
+	if !reflect.DeepEqual(reports, expectedReports) {
+		t.Errorf("unexpected available egress regions reports: %+v", reports)
+	}
+}
+
+func TestVerifyDataStoreIntegrity(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	storeTestServerEntry := func(ipAddress string) {
+		err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, "ZC"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	storeTestServerEntry("10.0.45.1")
+	storeTestServerEntry("10.0.45.2")
+
+	// The bucket names are the same as the sqlite table names, except
+	// for the server entries.
+	serverEntriesName, seenName := "serverEntries", "serverEntrySeen"
+	if runtime.GOOS == "windows" {
+		serverEntriesName = "serverEntry"
+	}
+
+	report, err := dataStore.VerifyDataStoreIntegrity()
+	if err != nil {
+		t.Fatalf("VerifyDataStoreIntegrity failed: %s", err)
+	}
+	for _, line := range report {
+		if strings.HasPrefix(line, "missing") || strings.HasPrefix(line, "unexpected") {
+			t.Errorf("unexpected report for healthy datastore: %s", line)
+		}
+	}
+	if !Contains(report, fmt.Sprintf("bucket %s: 2 keys", serverEntriesName)) &&
+		!Contains(report, fmt.Sprintf("table %s: 2 rows", serverEntriesName)) {
+		t.Errorf("server entry count not reported: %+v", report)
+	}
+
+	removeTestDataStoreBucket(t, dataStore, seenName)
+
+	report, err = dataStore.VerifyDataStoreIntegrity()
+	if err != nil {
+		t.Fatalf("VerifyDataStoreIntegrity failed: %s", err)
+	}
+	if !Contains(report, "missing bucket: "+seenName) &&
+		!Contains(report, "missing table: "+seenName) {
+		t.Errorf("missing bucket not reported: %+v", report)
+	}
+}
+
+func TestMergeDataStore(t *testing.T) {
+
+	storeTestServerEntries := func(dataStore *DataStore, region string, ipAddresses ...string) {
+		for _, ipAddress := range ipAddresses {
+			err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, region), true)
+			if err != nil {
+				t.Fatalf("error storing server entry: %s", err)
+			}
+		}
+	}
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+	storeTestServerEntries(dataStore, "ZD", "10.0.46.1", "10.0.46.2")
+
+	otherDataStore, closeOtherDataStore := openTestDataStore(t, &Config{})
+	defer closeOtherDataStore()
+	storeTestServerEntries(otherDataStore, "ZE", "10.0.46.2", "10.0.46.3")
+	err := otherDataStore.SetKeyValue("mergeTestKey", "mergeTestValue")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	snapshotDirectory, removeSnapshotDirectory := makeTestDataStoreDirectory(t)
+	defer removeSnapshotDirectory()
+	otherPath := filepath.Join(snapshotDirectory, "merge.db")
+	err = otherDataStore.Snapshot(otherPath)
+	otherDataStore.Close()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	checkRegions := func(expectedRegions map[string]string) {
+		for ipAddress, expectedRegion := range expectedRegions {
+			serverEntry, err := dataStore.GetServerEntry(ipAddress)
+			if err != nil {
+				t.Fatalf("GetServerEntry failed: %s", err)
+			}
+			if serverEntry == nil || serverEntry.Region != expectedRegion {
+				t.Errorf("unexpected server entry %s: %+v", ipAddress, serverEntry)
+			}
+		}
+	}
+
+	err = dataStore.MergeDataStore(otherPath, false, false)
+	if err != nil {
+		t.Fatalf("MergeDataStore failed: %s", err)
+	}
+	checkRegions(map[string]string{"10.0.46.1": "ZD", "10.0.46.2": "ZD", "10.0.46.3": "ZE"})
+	value, err := dataStore.GetKeyValue("mergeTestKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if value != "" {
+		t.Errorf("unexpected merged key-value: %s", value)
+	}
+
+	err = dataStore.MergeDataStore(otherPath, true, true)
+	if err != nil {
+		t.Fatalf("MergeDataStore failed: %s", err)
+	}
+	checkRegions(map[string]string{"10.0.46.1": "ZD", "10.0.46.2": "ZE", "10.0.46.3": "ZE"})
+	value, err = dataStore.GetKeyValue("mergeTestKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if value != "mergeTestValue" {
+		t.Errorf("unexpected merged key-value: %s", value)
+	}
+}
+
+func TestCandidateServersProtocolCounts(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	// Two server entries support SSH and OSSH; one also supports
+	// UNFRONTED-MEEK.
+	for i := 1; i <= 2; i++ {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.47.%d", i), "ZF")
+		if i == 1 {
+			serverEntry.Capabilities = append(serverEntry.Capabilities, "UNFRONTED-MEEK")
+		}
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	var notices []map[string]interface{}
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err == nil && noticeType == "CandidateServers" {
+				notices = append(notices, payload)
+			}
+		}))
+	defer SetNoticeOutput(os.Stderr)
+
+	for _, protocol := range []string{"", TUNNEL_PROTOCOL_SSH} {
+		iterator, err := dataStore.NewServerEntryIterator(
+			&Config{EgressRegion: "ZF", TunnelProtocol: protocol, TunnelPoolSize: 1})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		iterator.Close()
+	}
+
+	if len(notices) != 2 {
+		t.Fatalf("unexpected CandidateServers notices: %+v", notices)
+	}
+
+	expectedProtocolCounts := map[string]interface{}{
+		TUNNEL_PROTOCOL_SSH:               float64(2),
+		TUNNEL_PROTOCOL_OBFUSCATED_SSH:    float64(2),
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK:    float64(1),
+		TUNNEL_PROTOCOL_FRONTED_MEEK:      float64(0),
+		TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP: float64(0),
+	}
+	if notices[0]["count"] != float64(2) ||
+		!reflect.DeepEqual(notices[0]["protocolCounts"], expectedProtocolCounts) {
+		t.Errorf("unexpected CandidateServers notice: %+v", notices[0])
+	}
+
+	if _, ok := notices[1]["protocolCounts"]; ok || notices[1]["count"] != float64(2) {
+		t.Errorf("unexpected CandidateServers notice: %+v", notices[1])
+	}
+}
+
+func TestChronologicalServerEntryIterator(t *testing.T) {
+
+	defer func() { serverEntrySeenClock = time.Now }()
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	// Server entries are stored out of firstSeen order, and the first
+	// server entry is re-delivered last, which updates only its lastSeen.
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	storeTestServerEntry := func(ipAddress, region string, offset int) {
+		serverEntrySeenClock = func() time.Time {
+			return base.Add(time.Duration(offset) * time.Hour)
+		}
+		err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, region), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	storeTestServerEntry("10.0.49.1", "ZH", 3)
+	storeTestServerEntry("10.0.49.2", "ZH", 1)
+	storeTestServerEntry("10.0.49.3", "ZH", 2)
+	storeTestServerEntry("10.0.49.4", "ZI", 0)
+	storeTestServerEntry("10.0.49.1", "ZH", 4)
+
+	iterator, err := dataStore.NewChronologicalServerEntryIterator(&Config{EgressRegion: "ZH"})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+
+	for i := 0; i < 2; i++ {
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		expectedIpAddresses := []string{"10.0.49.2", "10.0.49.3", "10.0.49.1"}
+		if !reflect.DeepEqual(ipAddresses, expectedIpAddresses) {
+			t.Errorf("unexpected chronological order: %+v", ipAddresses)
+		}
+		err = iterator.Reset()
+		if err != nil {
+			t.Fatalf("error resetting iterator: %s", err)
+		}
+	}
+}
+
+func TestProtocolSuccessDistribution(t *testing.T) {
+
+	config := &Config{}
+	dataStore, closeDataStore := openTestDataStore(t, config)
+	defer closeDataStore()
+
+	distribution, err := dataStore.GetProtocolSuccessDistribution()
+	if err != nil {
+		t.Fatalf("GetProtocolSuccessDistribution failed: %s", err)
+	}
+	if len(distribution) != 0 {
+		t.Errorf("unexpected initial distribution: %+v", distribution)
+	}
+
+	for _, protocol := range []string{"OSSH", "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "OSSH"} {
+		err := dataStore.RecordSuccessfulProtocol(protocol)
+		if err != nil {
+			t.Fatalf("RecordSuccessfulProtocol failed: %s", err)
+		}
+	}
+
+	distribution, err = dataStore.GetProtocolSuccessDistribution()
+	if err != nil {
+		t.Fatalf("GetProtocolSuccessDistribution failed: %s", err)
+	}
+	expectedDistribution := map[string]int{"OSSH": 3, "SSH": 1, "UNFRONTED-MEEK-OSSH": 1}
+	if !reflect.DeepEqual(distribution, expectedDistribution) {
+		t.Errorf("unexpected distribution: %+v", distribution)
+	}
+
+	// Exceeding the limit halves all counts.
+
+	config.MaxProtocolSuccessCount = 3
+	err = dataStore.RecordSuccessfulProtocol("OSSH")
+	if err != nil {
+		t.Fatalf("RecordSuccessfulProtocol failed: %s", err)
+	}
+
+	distribution, err = dataStore.GetProtocolSuccessDistribution()
+	if err != nil {
+		t.Fatalf("GetProtocolSuccessDistribution failed: %s", err)
+	}
+	expectedDistribution = map[string]int{"OSSH": 2, "SSH": 0, "UNFRONTED-MEEK-OSSH": 0}
+	if !reflect.DeepEqual(distribution, expectedDistribution) {
+		t.Errorf("unexpected bounded distribution: %+v", distribution)
+	}
+}
+
+func TestServerEntryFailureDecay(t *testing.T) {
+
+	now := time.Now()
+	serverEntryFailureClock = func() time.Time { return now }
+	defer func() { serverEntryFailureClock = time.Now }()
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{
+		ServerEntryFailureThreshold:       3,
+		ServerEntryFailureHalfLifeSeconds: 3600,
+	})
+	defer closeDataStore()
+
+	ipAddress := "10.0.49.1"
+	err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, "ZH"), true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	checkSuccessRatio := func(expectedRatio float64) {
+		ratio, err := dataStore.GetServerEntrySuccessRatio(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntrySuccessRatio failed: %s", err)
+		}
+		if ratio != expectedRatio {
+			t.Errorf("unexpected success ratio: %f, expected %f", ratio, expectedRatio)
+		}
+	}
+
+	recordFailure := func() {
+		err := dataStore.RecordServerEntryAttempt(ipAddress)
+		if err != nil {
+			t.Fatalf("RecordServerEntryAttempt failed: %s", err)
+		}
+		err = dataStore.RecordServerEntryFailure(ipAddress)
+		if err != nil {
+			t.Fatalf("RecordServerEntryFailure failed: %s", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		recordFailure()
+	}
+	checkSuccessRatio(0)
+
+	// After one half-life, half of the failures remain.
+
+	now = now.Add(time.Hour)
+	checkSuccessRatio(0.5)
+
+	// After many half-lives, the consecutive failures have decayed, so a
+	// new failure doesn't reach the disable threshold.
+
+	now = now.Add(10 * time.Hour)
+	checkSuccessRatio(1)
+
+	recordFailure()
+	disabledUntil, err := dataStore.GetServerEntryDisabledUntil(ipAddress)
+	if err != nil {
+		t.Fatalf("GetServerEntryDisabledUntil failed: %s", err)
+	}
+	if !disabledUntil.IsZero() {
+		t.Errorf("unexpected disable after decay: %s", disabledUntil)
+	}
+	checkSuccessRatio(2.0 / 3.0)
+
+	// Without decay, failures in quick succession reach the threshold.
+
+	recordFailure()
+	recordFailure()
+	disabledUntil, err = dataStore.GetServerEntryDisabledUntil(ipAddress)
+	if err != nil {
+		t.Fatalf("GetServerEntryDisabledUntil failed: %s", err)
+	}
+	if disabledUntil.IsZero() {
+		t.Errorf("server entry unexpectedly not disabled")
+	}
+}
+
+func TestGetCandidateServerEntries(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	storeTestServerEntries(t, "10.0.50", "ZI", 10)
+	config := &Config{EgressRegion: "ZI", TunnelPoolSize: 4}
+
+	getIpAddresses := func(serverEntries []*ServerEntry) []string {
+		ipAddresses := make([]string, len(serverEntries))
+		for i, serverEntry := range serverEntries {
+			ipAddresses[i] = serverEntry.IpAddress
+		}
+		return ipAddresses
+	}
+
+	defer rand.Seed(time.Now().UnixNano())
+
+	rand.Seed(1)
+	iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	var iteratorServerEntries []*ServerEntry
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		iteratorServerEntries = append(iteratorServerEntries, serverEntry)
+	}
+	iterator.Close()
+	expectedIpAddresses := getIpAddresses(iteratorServerEntries)
+	if len(expectedIpAddresses) != 10 {
+		t.Fatalf("unexpected iterator server entry count: %d", len(expectedIpAddresses))
+	}
+
+	rand.Seed(1)
+	serverEntries, err := GetCandidateServerEntries(config, 0)
+	if err != nil {
+		t.Fatalf("GetCandidateServerEntries failed: %s", err)
+	}
+	ipAddresses := getIpAddresses(serverEntries)
+	if !reflect.DeepEqual(ipAddresses, expectedIpAddresses) {
+		t.Errorf("unexpected candidates: %+v, expected %+v", ipAddresses, expectedIpAddresses)
+	}
+
+	rand.Seed(1)
+	serverEntries, err = GetCandidateServerEntries(config, 5)
+	if err != nil {
+		t.Fatalf("GetCandidateServerEntries failed: %s", err)
+	}
+	ipAddresses = getIpAddresses(serverEntries)
+	if !reflect.DeepEqual(ipAddresses, expectedIpAddresses[:5]) {
+		t.Errorf("unexpected limited candidates: %+v, expected %+v", ipAddresses, expectedIpAddresses[:5])
+	}
+}
+
+func TestDataStoreErrorNotice(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	var notices []map[string]interface{}
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err == nil && noticeType == "DataStoreError" {
+				notices = append(notices, payload)
+			}
+		}))
+	defer SetNoticeOutput(os.Stderr)
+
+	err := dataStore.SetKeyValue("dataStoreErrorTestKey", "value")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	if len(notices) != 0 {
+		t.Errorf("unexpected DataStoreError notices: %+v", notices)
+	}
+
+	// Closing the underlying database forces write failures.
+	dataStore.db.Close()
+
+	err = dataStore.SetKeyValue("dataStoreErrorTestKey", "value")
+	if err == nil {
+		t.Fatalf("SetKeyValue unexpectedly succeeded")
+	}
+	if len(notices) != 1 || notices[0]["operation"] != "write" || notices[0]["message"] == "" {
+		t.Errorf("unexpected DataStoreError notices: %+v", notices)
+	}
+}
+
+func TestGetServerEntryIpAddressesLimited(t *testing.T) {
+
+	defer func() { serverEntrySeenClock = time.Now }()
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	// Store server entries seen at various times; each server entry N is
+	// last seen at base+offsets[N-1] hours.
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	offsets := []int{3, 1, 5, 2, 4}
+	var ipAddresses []string
+	for i, offset := range offsets {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.41.%d", i+1), "YX")
+		serverEntrySeenClock = func() time.Time {
+			return base.Add(time.Duration(offset) * time.Hour)
+		}
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+
+	for _, ipAddress := range []string{"10.0.41.4", "10.0.41.2", "10.0.41.5"} {
+		err := dataStore.PromoteServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("PromoteServerEntry failed: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		limit    int
+		order    IpAddressOrder
+		expected []string
+	}{
+		{3, IP_ADDRESS_ORDER_MOST_RECENT, []string{"10.0.41.3", "10.0.41.5", "10.0.41.1"}},
+		{0, IP_ADDRESS_ORDER_MOST_RECENT, []string{"10.0.41.3", "10.0.41.5", "10.0.41.1", "10.0.41.4", "10.0.41.2"}},
+		{3, IP_ADDRESS_ORDER_RANKED, []string{"10.0.41.5", "10.0.41.2", "10.0.41.4"}},
+		{10, IP_ADDRESS_ORDER_RANDOM, nil},
+		{2, IP_ADDRESS_ORDER_RANDOM, nil},
+	}
+
+	for _, testCase := range testCases {
+		selected, err := dataStore.GetServerEntryIpAddressesLimited(testCase.limit, testCase.order)
+		if err != nil {
+			t.Fatalf("GetServerEntryIpAddressesLimited failed: %s", err)
+		}
+		if testCase.expected != nil {
+			if !reflect.DeepEqual(selected, testCase.expected) {
+				t.Errorf("unexpected IP addresses for %+v: %v", testCase, selected)
+			}
+			continue
+		}
+		expectedCount := len(ipAddresses)
+		if testCase.limit < expectedCount {
+			expectedCount = testCase.limit
+		}
+		if len(selected) != expectedCount {
+			t.Errorf("unexpected IP address count for %+v: %v", testCase, selected)
+		}
+		for _, ipAddress := range selected {
+			if !Contains(ipAddresses, ipAddress) {
+				t.Errorf("unexpected IP address for %+v: %s", testCase, ipAddress)
+			}
+		}
+	}
+
+	_, err := dataStore.GetServerEntryIpAddressesLimited(0, IpAddressOrder(-1))
+	if err == nil {
+		t.Errorf("GetServerEntryIpAddressesLimited unexpectedly accepted unknown order")
+	}
+}
+
+func TestAppMetadata(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	value, err := GetAppMetadata("appMetadataTestMissing")
+	if err != nil {
+		t.Fatalf("GetAppMetadata failed: %s", err)
+	}
+	if value != nil {
+		t.Errorf("unexpected value for missing key: %x", value)
+	}
+
+	values := map[string][]byte{
+		"appMetadataTestInstallId": {0x00, 0x01, 0xfe, 0xff, 0x00},
+		"appMetadataTestConsent":   []byte("true"),
+	}
+	for key, value := range values {
+		err := SetAppMetadata(key, value)
+		if err != nil {
+			t.Fatalf("SetAppMetadata failed: %s", err)
+		}
+	}
+	for key, expectedValue := range values {
+		value, err := GetAppMetadata(key)
+		if err != nil {
+			t.Fatalf("GetAppMetadata failed: %s", err)
+		}
+		if !reflect.DeepEqual(value, expectedValue) {
+			t.Errorf("unexpected value for %s: %x", key, value)
+		}
+	}
+
+	// App metadata is isolated from the internal key-values.
+
+	err = SetKeyValue("appMetadataTestInstallId", "internal")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	value, err = GetAppMetadata("appMetadataTestInstallId")
+	if err != nil {
+		t.Fatalf("GetAppMetadata failed: %s", err)
+	}
+	if !reflect.DeepEqual(value, values["appMetadataTestInstallId"]) {
+		t.Errorf("app metadata overwritten by key-value: %x", value)
+	}
+	keyValue, err := GetKeyValue("appMetadataTestConsent")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if keyValue != "" {
+		t.Errorf("unexpected key-value for app metadata key: %s", keyValue)
+	}
+}
+
+func TestServerEntryMinClientVersion(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	region := "ZJ"
+	minClientVersions := map[string]string{
+		"10.0.51.1": "",
+		"10.0.51.2": "99",
+		"10.0.51.3": "100",
+		"10.0.51.4": "101",
+		"10.0.51.5": "100.1",
+	}
+	for ipAddress, minClientVersion := range minClientVersions {
+		serverEntry := makeTestServerEntry(ipAddress, region)
+		serverEntry.MinClientVersion = minClientVersion
+		err := StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	config := &Config{
+		EgressRegion:   region,
+		TunnelPoolSize: 1,
+		ClientVersion:  "100",
+	}
+
+	iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	ipAddresses := make([]string, 0)
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+	sort.Strings(ipAddresses)
+
+	expectedIpAddresses := []string{"10.0.51.1", "10.0.51.2", "10.0.51.3"}
+	if !reflect.DeepEqual(ipAddresses, expectedIpAddresses) {
+		t.Errorf("unexpected server entries: %+v, expected %+v", ipAddresses, expectedIpAddresses)
+	}
+}
+
+func TestDisableRegion(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	region := "ZK"
+	otherRegion := "ZL"
+	storeTestServerEntries(t, "10.0.52", region, 5)
+	storeTestServerEntries(t, "10.0.53", otherRegion, 5)
+
+	countIteratorServerEntries := func(region string) int {
+		iterator, err := NewServerEntryIterator(&Config{EgressRegion: region, TunnelPoolSize: 1})
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+		count := 0
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			count += 1
+		}
+		return count
+	}
+
+	err := DisableRegion(region, time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("DisableRegion failed: %s", err)
+	}
+	if count := countIteratorServerEntries(region); count != 0 {
+		t.Errorf("unexpected server entry count for disabled region: %d", count)
+	}
+	if count := countIteratorServerEntries(otherRegion); count != 5 {
+		t.Errorf("unexpected server entry count for other region: %d", count)
+	}
+
+	disabledUntil, err := GetServerEntryDisabledUntil("10.0.52.1")
+	if err != nil {
+		t.Fatalf("GetServerEntryDisabledUntil failed: %s", err)
+	}
+	if !disabledUntil.After(time.Now()) {
+		t.Errorf("unexpected disabled until: %s", disabledUntil)
+	}
+
+	err = DisableRegion(region, time.Now().Add(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("DisableRegion failed: %s", err)
+	}
+	if count := countIteratorServerEntries(region); count != 0 {
+		t.Errorf("unexpected server entry count for disabled region: %d", count)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if count := countIteratorServerEntries(region); count != 5 {
+		t.Errorf("unexpected server entry count after disable expired: %d", count)
+	}
+
+	err = DisableRegion(region, time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("DisableRegion failed: %s", err)
+	}
+	err = ClearRegionDisable(region)
+	if err != nil {
+		t.Fatalf("ClearRegionDisable failed: %s", err)
+	}
+	if count := countIteratorServerEntries(region); count != 5 {
+		t.Errorf("unexpected server entry count after clear: %d", count)
+	}
+}
+
+func TestEncryptedKeyValue(t *testing.T) {
+
+	makeKey := func(b byte) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+	}
+
+	config := &Config{KeyValueEncryptionKey: makeKey(1)}
+	dataStore, closeDataStore := openTestDataStore(t, config)
+	defer closeDataStore()
+
+	err := dataStore.SetEncryptedKeyValue("encryptedKey", "encryptedValue")
+	if err != nil {
+		t.Fatalf("SetEncryptedKeyValue failed: %s", err)
+	}
+	err = dataStore.SetKeyValue("plaintextKey", "plaintextValue")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+
+	value, err := dataStore.GetEncryptedKeyValue("encryptedKey")
+	if err != nil {
+		t.Fatalf("GetEncryptedKeyValue failed: %s", err)
+	}
+	if value != "encryptedValue" {
+		t.Errorf("unexpected encrypted value: %s", value)
+	}
+
+	storedValue, err := dataStore.GetKeyValue("encryptedKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if !strings.HasPrefix(storedValue, ENCRYPTED_KEY_VALUE_MARKER) ||
+		strings.Contains(storedValue, "encryptedValue") {
+		t.Errorf("unexpected stored value: %s", storedValue)
+	}
+
+	value, err = dataStore.GetKeyValue("plaintextKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if value != "plaintextValue" {
+		t.Errorf("unexpected plaintext value: %s", value)
+	}
+
+	_, err = dataStore.GetEncryptedKeyValue("plaintextKey")
+	if err == nil {
+		t.Errorf("unexpected GetEncryptedKeyValue success for plaintext value")
+	}
+
+	value, err = dataStore.GetEncryptedKeyValue("missingKey")
+	if err != nil {
+		t.Fatalf("GetEncryptedKeyValue failed: %s", err)
+	}
+	if value != "" {
+		t.Errorf("unexpected value for missing key: %s", value)
+	}
+
+	dataStore.Close()
+
+	dataStore, err = OpenDataStore(&Config{
+		DataStoreDirectory:    config.DataStoreDirectory,
+		KeyValueEncryptionKey: makeKey(2),
+	})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer dataStore.Close()
+
+	_, err = dataStore.GetEncryptedKeyValue("encryptedKey")
+	if err == nil {
+		t.Errorf("unexpected GetEncryptedKeyValue success with wrong key")
+	}
+
+	value, err = dataStore.GetKeyValue("plaintextKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if value != "plaintextValue" {
+		t.Errorf("unexpected plaintext value: %s", value)
+	}
+}
+
+func TestPruneUrlETags(t *testing.T) {
+
+	now := time.Now()
+	defer func() { urlETagClock = time.Now }()
+
+	setUrlETag := func(dataStore *DataStore, url string, stored time.Time) {
+		urlETagClock = func() time.Time { return stored }
+		err := dataStore.SetUrlETag(url, "etag-"+url)
+		if err != nil {
+			t.Fatalf("SetUrlETag failed: %s", err)
+		}
+	}
+
+	// Simulate an ETag stored before timestamps were recorded by removing
+	// the timestamps, which are recreated, empty, when reopening.
+
+	config := &Config{}
+	dataStore, closeDataStore := openTestDataStore(t, config)
+	defer closeDataStore()
+	setUrlETag(dataStore, "legacy", now)
+	removeTestDataStoreBucket(t, dataStore, "urlETagTimestamps")
+	dataStore.Close()
+
+	dataStore, err := OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer dataStore.Close()
+
+	setUrlETag(dataStore, "stale", now.Add(-2*time.Hour))
+	setUrlETag(dataStore, "fresh", now.Add(-30*time.Minute))
+
+	urlETagClock = func() time.Time { return now }
+
+	err = dataStore.PruneUrlETags(1 * time.Hour)
+	if err != nil {
+		t.Fatalf("PruneUrlETags failed: %s", err)
+	}
+
+	for url, expectStored := range map[string]bool{
+		"legacy": false,
+		"stale":  false,
+		"fresh":  true,
+	} {
+		etag, err := dataStore.GetUrlETag(url)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		if (etag != "") != expectStored {
+			t.Errorf("unexpected ETag for %s: '%s'", url, etag)
+		}
+	}
+
+	// Updating an ETag refreshes its timestamp: without the update, "fresh"
+	// would be 2 hours old, and pruned, at now+90m.
+
+	setUrlETag(dataStore, "fresh", now.Add(60*time.Minute))
+	urlETagClock = func() time.Time { return now.Add(90 * time.Minute) }
+
+	err = dataStore.PruneUrlETags(1 * time.Hour)
+	if err != nil {
+		t.Fatalf("PruneUrlETags failed: %s", err)
+	}
+	etag, err := dataStore.GetUrlETag("fresh")
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != "etag-fresh" {
+		t.Errorf("unexpected ETag after update: '%s'", etag)
+	}
+}
+
+func TestResolvedHostExpiry(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	now := time.Now()
+	defer func() { resolvedHostClock = time.Now }()
+	resolvedHostClock = func() time.Time { return now }
+
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+
+	for host, expiry := range map[string]time.Time{
+		"short.example.org": now.Add(1 * time.Minute),
+		"long.example.org":  now.Add(2 * time.Hour),
+	} {
+		err := dataStore.SetResolvedHost(host, ips, expiry)
+		if err != nil {
+			t.Fatalf("SetResolvedHost failed: %s", err)
+		}
+	}
+
+	// An expired resolved host isn't returned, and is deleted when
+	// another resolved host is stored.
+
+	resolvedHostClock = func() time.Time { return now.Add(30 * time.Minute) }
+
+	cachedIPs, err := dataStore.GetResolvedHost("short.example.org")
+	if err != nil {
+		t.Fatalf("GetResolvedHost failed: %s", err)
+	}
+	if cachedIPs != nil {
+		t.Errorf("unexpected expired resolved host: %+v", cachedIPs)
+	}
+
+	err = dataStore.SetResolvedHost("other.example.org", ips, now.Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("SetResolvedHost failed: %s", err)
+	}
+
+	for host, expectStored := range map[string]bool{
+		"short.example.org": false,
+		"long.example.org":  true,
+		"other.example.org": true,
+	} {
+		data, err := dataStore.getResolvedHost(host)
+		if err != nil {
+			t.Fatalf("getResolvedHost failed: %s", err)
+		}
+		if (data != nil) != expectStored {
+			t.Errorf("unexpected stored state for %s", host)
+		}
+	}
+
+	cachedIPs, err = dataStore.GetResolvedHost("long.example.org")
+	if err != nil {
+		t.Fatalf("GetResolvedHost failed: %s", err)
+	}
+	if !reflect.DeepEqual(cachedIPs, ips) {
+		t.Errorf("unexpected resolved host: %+v", cachedIPs)
+	}
+}
+
+func TestGetDataStoreStats(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for _, serverEntry := range []*ServerEntry{
+		makeTestServerEntry("10.0.54.1", "ZM"),
+		makeTestServerEntry("10.0.54.2", "ZM"),
+		makeTestServerEntry("10.0.54.3", "ZN"),
+		makeTestServerEntry("10.0.54.4", ""),
+	} {
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	for _, region := range []string{"ZM", "ZN"} {
+		err := dataStore.SetSplitTunnelRoutes(region, "etag", []byte("routes"))
+		if err != nil {
+			t.Fatalf("SetSplitTunnelRoutes failed: %s", err)
+		}
+	}
+	err := dataStore.SetUrlETag("http://example.com", "etag")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		err := dataStore.SetKeyValue(key, "value")
+		if err != nil {
+			t.Fatalf("SetKeyValue failed: %s", err)
+		}
+	}
+
+	stats, err := dataStore.GetDataStoreStats()
+	if err != nil {
+		t.Fatalf("GetDataStoreStats failed: %s", err)
+	}
+	if stats.FileSize <= 0 {
+		t.Errorf("unexpected file size: %d", stats.FileSize)
+	}
+	stats.FileSize = 0
+
+	expectedStats := &DataStoreStats{
+		ServerEntryCount:       4,
+		RankedServerEntryCount: 4,
+		RegionCount:            2,
+		SplitTunnelRegionCount: 2,
+		UrlETagCount:           1,
+		KeyValueCount:          3,
+	}
+	if !reflect.DeepEqual(stats, expectedStats) {
+		t.Errorf("unexpected stats: %+v, expected %+v", stats, expectedStats)
+	}
+}
+
+func TestServerEntryIteratorRefreshRanked(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	region := "ZO"
+	storeTestServerEntries(t, "10.0.55", region, 5)
+
+	iterator, err := NewServerEntryIterator(&Config{EgressRegion: region, TunnelPoolSize: 1})
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	next := func() *ServerEntry {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		return serverEntry
+	}
+
+	offered := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		offered[next().IpAddress] = true
+	}
+
+	newServerEntry := makeTestServerEntry("10.0.55.100", region)
+	err = StoreServerEntry(newServerEntry, true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	err = iterator.RefreshRanked()
+	if err != nil {
+		t.Fatalf("RefreshRanked failed: %s", err)
+	}
+
+	serverEntry := next()
+	if serverEntry == nil || serverEntry.IpAddress != newServerEntry.IpAddress {
+		t.Fatalf("unexpected next server entry after refresh: %+v", serverEntry)
+	}
+	offered[serverEntry.IpAddress] = true
+
+	// A refresh with no new server entries doesn't repeat candidates.
+	err = iterator.RefreshRanked()
+	if err != nil {
+		t.Fatalf("RefreshRanked failed: %s", err)
+	}
+
+	for {
+		serverEntry := next()
+		if serverEntry == nil {
+			break
+		}
+		if offered[serverEntry.IpAddress] {
+			t.Errorf("server entry offered twice: %s", serverEntry.IpAddress)
+		}
+		offered[serverEntry.IpAddress] = true
+	}
+	if len(offered) != 6 {
+		t.Errorf("unexpected offered server entry count: %d", len(offered))
+	}
+}
+
+func TestRevalidateServerEntries(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 3; i++ {
+		err := dataStore.StoreServerEntry(
+			makeTestServerEntry(fmt.Sprintf("10.0.56.%d", i), "ZP"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	// These server entries predate the alternate web server port
+	// validation rule.
+	for i := 4; i <= 5; i++ {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.56.%d", i), "ZP")
+		serverEntry.AlternateWebServerPorts = []string{"http"}
+		storeTestServerEntryWithoutValidation(t, dataStore, serverEntry)
+	}
+
+	// This server entry can't be decoded.
+	err := dataStore.StoreServerEntry(makeTestServerEntry("10.0.56.6", "ZP"), true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+	codec := dataStore.codec
+	dataStore.codec = &faultyServerEntryCodec{
+		serverEntryCodec: codec,
+		errorIpAddresses: []string{"10.0.56.6"},
+	}
+
+	removed, err := dataStore.RevalidateServerEntries()
+	if err != nil {
+		t.Fatalf("RevalidateServerEntries failed: %s", err)
+	}
+	if removed != 3 {
+		t.Errorf("unexpected removed count: %d", removed)
+	}
+
+	dataStore.codec = codec
+
+	for i := 1; i <= 6; i++ {
+		ipAddress := fmt.Sprintf("10.0.56.%d", i)
+		serverEntry, err := dataStore.GetServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if (serverEntry != nil) != (i <= 3) {
+			t.Errorf("unexpected stored state for server entry %s", ipAddress)
+		}
+	}
+
+	stats, err := dataStore.GetDataStoreStats()
+	if err != nil {
+		t.Fatalf("GetDataStoreStats failed: %s", err)
+	}
+	if stats.ServerEntryCount != 3 || stats.RankedServerEntryCount != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	removed, err = dataStore.RevalidateServerEntries()
+	if err != nil {
+		t.Fatalf("RevalidateServerEntries failed: %s", err)
+	}
+	if removed != 0 {
+		t.Errorf("unexpected removed count: %d", removed)
+	}
+}
+
+func TestFrontedMeekHttpServerEntries(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 4; i++ {
+		serverEntry := makeTestServerEntry(fmt.Sprintf("10.0.57.%d", i), "ZQ")
+		if i <= 2 {
+			serverEntry.Capabilities = append(serverEntry.Capabilities, "FRONTED-MEEK-HTTP")
+			serverEntry.MeekFrontingHttpHost = "www.example.org"
+			serverEntry.MeekFrontingAddresses = []string{"example.com"}
+		}
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	// The capability requires an HTTP fronting host
+	serverEntry := makeTestServerEntry("10.0.57.5", "ZQ")
+	serverEntry.Capabilities = append(serverEntry.Capabilities, "FRONTED-MEEK-HTTP")
+	serverEntry.MeekFrontingAddresses = []string{"example.com"}
+	err := dataStore.StoreServerEntry(serverEntry, true)
+	if err == nil {
+		t.Errorf("unexpected success storing server entry without HTTP fronting host")
+	}
+
+	serverEntry, err = dataStore.GetServerEntry("10.0.57.1")
+	if err != nil || serverEntry == nil {
+		t.Fatalf("GetServerEntry failed: %v", err)
+	}
+	if serverEntry.MeekFrontingHttpHost != "www.example.org" ||
+		!Contains(serverEntry.GetSupportedProtocols(), TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP) {
+		t.Errorf("unexpected stored server entry: %+v", serverEntry)
+	}
+
+	// Server entries without the capability are unaffected
+	serverEntry, err = dataStore.GetServerEntry("10.0.57.3")
+	if err != nil || serverEntry == nil {
+		t.Fatalf("GetServerEntry failed: %v", err)
+	}
+	if Contains(serverEntry.GetSupportedProtocols(), TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP) {
+		t.Errorf("unexpected supported protocols: %v", serverEntry.GetSupportedProtocols())
+	}
+
+	if count := dataStore.CountServerEntries("ZQ", TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP); count != 2 {
+		t.Errorf("unexpected FRONTED-MEEK-HTTP-OSSH count: %d", count)
+	}
+	if count := dataStore.CountServerEntries("ZQ", TUNNEL_PROTOCOL_OBFUSCATED_SSH); count != 4 {
+		t.Errorf("unexpected OSSH count: %d", count)
+	}
+
+	iterator, err := dataStore.NewServerEntryIterator(
+		&Config{EgressRegion: "ZQ", TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP, TunnelPoolSize: 1})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	defer iterator.Close()
+	ipAddresses := make([]string, 0)
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+	sort.Strings(ipAddresses)
+	if !reflect.DeepEqual(ipAddresses, []string{"10.0.57.1", "10.0.57.2"}) {
+		t.Errorf("unexpected iterated server entries: %v", ipAddresses)
+	}
+}
+
+func TestInitDataStoreEmbeddedServerEntries(t *testing.T) {
+
+	dataStoreDirectory, removeDataStoreDirectory := makeTestDataStoreDirectory(t)
+	defer removeDataStoreDirectory()
+
+	encodedServerEntries := make([]string, 0)
+	for i := 1; i <= 4; i++ {
+		encodedServerEntries = append(encodedServerEntries, makeTestEncodedServerEntry(
+			t, makeTestServerEntry(fmt.Sprintf("10.0.58.%d", i), "ZR")))
+	}
+	embeddedServerEntryList := strings.Join(encodedServerEntries[0:3], "\n")
+
+	config := &Config{
+		DataStoreDirectory:      dataStoreDirectory,
+		EmbeddedServerEntryList: embeddedServerEntryList,
+	}
+
+	CloseDataStore()
+	err := InitDataStore(config)
+	if err != nil {
+		t.Fatalf("error initializing datastore: %s", err)
+	}
+
+	if count := CountServerEntries("ZR", ""); count != 3 {
+		t.Fatalf("unexpected server entry count after first init: %d", count)
+	}
+
+	// The embedded server entries aren't re-imported on subsequent inits
+	err = ArchiveServerEntry("10.0.58.1")
+	if err != nil {
+		t.Fatalf("ArchiveServerEntry failed: %s", err)
+	}
+	CloseDataStore()
+	err = InitDataStore(config)
+	if err != nil {
+		t.Fatalf("error initializing datastore: %s", err)
+	}
+
+	if count := CountServerEntries("ZR", ""); count != 2 {
+		t.Errorf("unexpected server entry count after subsequent init: %d", count)
+	}
+
+	// A different embedded server entry list is imported
+	config.EmbeddedServerEntryList = strings.Join(encodedServerEntries[1:4], "\n")
+	CloseDataStore()
+	err = InitDataStore(config)
+	if err != nil {
+		t.Fatalf("error initializing datastore: %s", err)
+	}
+
+	if count := CountServerEntries("ZR", ""); count != 3 {
+		t.Errorf("unexpected server entry count after init with new list: %d", count)
+	}
+
+	CloseDataStore()
+}
+
+func TestGetReachableProtocols(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{ClientVersion: "10"})
+	defer closeDataStore()
+
+	storeServerEntry := func(serverEntry *ServerEntry) {
+		err := dataStore.StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	storeServerEntry(makeTestServerEntry("10.0.59.1", "ZS"))
+
+	// Disabled
+	serverEntry := makeTestServerEntry("10.0.59.2", "ZS")
+	serverEntry.Capabilities = []string{"handshake", "UNFRONTED-MEEK"}
+	storeServerEntry(serverEntry)
+	err := dataStore.SetServerEntryDisabledUntil("10.0.59.2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("SetServerEntryDisabledUntil failed: %s", err)
+	}
+
+	// Requires a higher client version
+	serverEntry = makeTestServerEntry("10.0.59.3", "ZS")
+	serverEntry.Capabilities = []string{"handshake", "FRONTED-MEEK"}
+	serverEntry.MeekFrontingAddresses = []string{"example.com"}
+	serverEntry.MinClientVersion = "100"
+	storeServerEntry(serverEntry)
+
+	// Stored before the HTTP fronting host validation rule
+	serverEntry = makeTestServerEntry("10.0.59.4", "ZS")
+	serverEntry.Capabilities = []string{"handshake", "FRONTED-MEEK-HTTP"}
+	serverEntry.MeekFrontingAddresses = []string{"example.com"}
+	storeTestServerEntryWithoutValidation(t, dataStore, serverEntry)
+
+	// In another region
+	serverEntry = makeTestServerEntry("10.0.59.5", "ZT")
+	serverEntry.Capabilities = []string{"handshake", "FRONTED-MEEK"}
+	serverEntry.MeekFrontingAddresses = []string{"example.com"}
+	storeServerEntry(serverEntry)
+
+	testCases := []struct {
+		description       string
+		region            string
+		expectedProtocols []string
+	}{
+		{"region",
+			"ZS", []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH, TUNNEL_PROTOCOL_SSH}},
+		{"any region",
+			"", []string{TUNNEL_PROTOCOL_FRONTED_MEEK, TUNNEL_PROTOCOL_OBFUSCATED_SSH, TUNNEL_PROTOCOL_SSH}},
+		{"no servers",
+			"ZU", []string{}},
+	}
+
+	for _, testCase := range testCases {
+		protocols, err := dataStore.GetReachableProtocols(testCase.region)
+		if err != nil {
+			t.Fatalf("GetReachableProtocols failed: %s", err)
+		}
+		if !reflect.DeepEqual(protocols, testCase.expectedProtocols) {
+			t.Errorf("%s: unexpected reachable protocols: %v", testCase.description, protocols)
+		}
+	}
+
+	// A re-enabled server is reachable
+	err = dataStore.SetServerEntryDisabledUntil("10.0.59.2", time.Time{})
+	if err != nil {
+		t.Fatalf("SetServerEntryDisabledUntil failed: %s", err)
+	}
+	protocols, err := dataStore.GetReachableProtocols("ZS")
+	if err != nil {
+		t.Fatalf("GetReachableProtocols failed: %s", err)
+	}
+	expectedProtocols := []string{
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK, TUNNEL_PROTOCOL_OBFUSCATED_SSH, TUNNEL_PROTOCOL_SSH}
+	if !reflect.DeepEqual(protocols, expectedProtocols) {
+		t.Errorf("unexpected reachable protocols: %v", protocols)
+	}
+}
+
+func TestServerEntryStoreOrder(t *testing.T) {
+
+	defer rand.Seed(time.Now().UnixNano())
+
+	getRankOrder := func(dataStore *DataStore) []string {
+		// A large TunnelPoolSize disables the shuffle, so all candidates are
+		// iterated in rank order.
+		iterator, err := dataStore.NewServerEntryIterator(
+			&Config{EgressRegion: "ZW", TunnelPoolSize: 1000})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		defer iterator.Close()
+		order := make([]string, 0)
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("error getting next server entry: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			order = append(order, serverEntry.IpAddress)
+		}
+		return order
+	}
+
+	makeBatch := func() []*ServerEntry {
+		batch := make([]*ServerEntry, 0)
+		for i := 1; i <= 4; i++ {
+			batch = append(batch, makeTestServerEntry(fmt.Sprintf("10.0.60.%d", i), "ZW"))
+		}
+		return batch
+	}
+
+	// The batch shuffle is determined by the seed.
+	rand.Seed(1)
+	shuffled := make([]string, 0)
+	shuffledBatch := makeBatch()
+	shuffleServerEntries(shuffledBatch)
+	for _, serverEntry := range shuffledBatch {
+		shuffled = append(shuffled, serverEntry.IpAddress)
+	}
+
+	testCases := []struct {
+		storeOrder     string
+		insertPosition string
+		expectedOrder  func(existing []string) []string
+	}{
+		{"", "",
+			func(existing []string) []string {
+				return []string{existing[0],
+					shuffled[3], shuffled[2], shuffled[1], shuffled[0],
+					existing[1], existing[2]}
+			}},
+		{SERVER_ENTRY_STORE_ORDER_SHUFFLE, "",
+			func(existing []string) []string {
+				return []string{existing[0],
+					shuffled[3], shuffled[2], shuffled[1], shuffled[0],
+					existing[1], existing[2]}
+			}},
+		{SERVER_ENTRY_STORE_ORDER_INPUT_ORDER, "",
+			func(existing []string) []string {
+				return []string{existing[0],
+					"10.0.60.1", "10.0.60.2", "10.0.60.3", "10.0.60.4",
+					existing[1], existing[2]}
+			}},
+		{SERVER_ENTRY_STORE_ORDER_INPUT_ORDER, SERVER_ENTRY_INSERT_POSITION_TOP,
+			func(existing []string) []string {
+				return []string{
+					"10.0.60.1", "10.0.60.2", "10.0.60.3", "10.0.60.4",
+					existing[0], existing[1], existing[2]}
+			}},
+		{SERVER_ENTRY_STORE_ORDER_INPUT_ORDER, SERVER_ENTRY_INSERT_POSITION_TAIL,
+			func(existing []string) []string {
+				return []string{existing[0], existing[1], existing[2],
+					"10.0.60.1", "10.0.60.2", "10.0.60.3", "10.0.60.4"}
+			}},
+		{SERVER_ENTRY_STORE_ORDER_INTERLEAVE, "",
+			func(existing []string) []string {
+				return []string{existing[0], shuffled[3], existing[1], shuffled[2],
+					existing[2], shuffled[1], shuffled[0]}
+			}},
+	}
+
+	for _, testCase := range testCases {
+
+		// StoreServerEntriesResumable seeds its shuffle with the list hash, so
+		// it's checked only with the input store order. Staged server entries
+		// are stored in batches smaller than the list.
+		for _, storeMode := range []string{"", "resumable", "staged"} {
+
+			if storeMode == "resumable" && testCase.storeOrder != SERVER_ENTRY_STORE_ORDER_INPUT_ORDER {
+				continue
+			}
+
+			dataStore, closeDataStore := openTestDataStore(t, &Config{
+				ServerEntryStoreOrder:     testCase.storeOrder,
+				ServerEntryInsertPosition: testCase.insertPosition,
+			})
+
+			for i := 1; i <= 3; i++ {
+				err := dataStore.StoreServerEntry(
+					makeTestServerEntry(fmt.Sprintf("10.0.60.%d", 100+i), "ZW"), true)
+				if err != nil {
+					t.Fatalf("error storing server entry: %s", err)
+				}
+			}
+			existing := getRankOrder(dataStore)
+
+			var err error
+			rand.Seed(1)
+			switch storeMode {
+			case "resumable":
+				err = dataStore.StoreServerEntriesResumable(makeBatch(), true)
+			case "staged":
+				err = dataStore.StageServerEntries("staging", makeBatch())
+				if err == nil {
+					_, err = dataStore.StoreStagedServerEntries("staging", 3, true, false)
+				}
+			default:
+				err = dataStore.StoreServerEntries(makeBatch(), true)
+			}
+			if err != nil {
+				t.Fatalf("StoreServerEntries failed: %s", err)
+			}
+
+			order := getRankOrder(dataStore)
+			expectedOrder := testCase.expectedOrder(existing)
+			if !reflect.DeepEqual(order, expectedOrder) {
+				t.Errorf("unexpected rank order for store order '%s', insert position '%s' and store mode '%s': %v, expected %v",
+					testCase.storeOrder, testCase.insertPosition, storeMode, order, expectedOrder)
+			}
+
+			closeDataStore()
+		}
+	}
+}
+
+// faultyServerEntryCodec wraps a codec and fails decoding of records for
+// specific server entries, either by panicking or by returning an error.
+type faultyServerEntryCodec struct {
+	serverEntryCodec
+	panicIpAddresses []string
+	errorIpAddresses []string
+}
+
+func (codec *faultyServerEntryCodec) Unmarshal(data []byte, serverEntry *ServerEntry) error {
+	for _, ipAddress := range codec.panicIpAddresses {
+		if bytes.Contains(data, []byte(ipAddress)) {
+			panic("corrupt server entry record")
+		}
+	}
+	for _, ipAddress := range codec.errorIpAddresses {
+		if bytes.Contains(data, []byte(ipAddress)) {
+			return fmt.Errorf("corrupt server entry record")
+		}
+	}
+	return codec.serverEntryCodec.Unmarshal(data, serverEntry)
+}
+
+func TestQuarantineUndecodableServerEntries(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 6; i++ {
+		region := "YA"
+		if i > 4 {
+			region = "YD"
+		}
+		err := dataStore.StoreServerEntry(
+			makeTestServerEntry(fmt.Sprintf("10.0.61.%d", i), region), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	dataStore.codec = &faultyServerEntryCodec{
+		serverEntryCodec: dataStore.codec,
+		panicIpAddresses: []string{"10.0.61.2", "10.0.61.6"},
+		errorIpAddresses: []string{"10.0.61.3"},
+	}
+
+	// Iteration continues past the undecodable server entries
+
+	iterator, err := dataStore.NewServerEntryIterator(
+		&Config{EgressRegion: "YA", TunnelPoolSize: 1})
+	if err != nil {
+		t.Fatalf("error creating iterator: %s", err)
+	}
+	ipAddresses := make([]string, 0)
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("error getting next server entry: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+	iterator.Close()
+	sort.Strings(ipAddresses)
+	expectedIpAddresses := []string{"10.0.61.1", "10.0.61.4"}
+	if !reflect.DeepEqual(ipAddresses, expectedIpAddresses) {
+		t.Errorf("unexpected iterated server entries: %v", ipAddresses)
+	}
+
+	quarantinedIds, err := dataStore.GetQuarantinedServerEntryIds()
+	if err != nil {
+		t.Fatalf("GetQuarantinedServerEntryIds failed: %s", err)
+	}
+	expectedQuarantinedIds := []string{"10.0.61.2", "10.0.61.3"}
+	if !reflect.DeepEqual(quarantinedIds, expectedQuarantinedIds) {
+		t.Errorf("unexpected quarantined server entries: %v", quarantinedIds)
+	}
+
+	// Quarantined server entries are removed from the store
+
+	serverEntry, err := dataStore.GetServerEntry("10.0.61.2")
+	if err != nil {
+		t.Fatalf("GetServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Errorf("quarantined server entry still stored")
+	}
+
+	// Scans continue past undecodable server entries
+
+	count, err := dataStore.CountServerEntriesMatching(
+		func(serverEntry *ServerEntry) bool { return serverEntry.Region == "YD" })
+	if err != nil {
+		t.Fatalf("CountServerEntriesMatching failed: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("unexpected server entry count: %d", count)
+	}
+
+	quarantinedIds, err = dataStore.GetQuarantinedServerEntryIds()
+	if err != nil {
+		t.Fatalf("GetQuarantinedServerEntryIds failed: %s", err)
+	}
+	expectedQuarantinedIds = []string{"10.0.61.2", "10.0.61.3", "10.0.61.6"}
+	if !reflect.DeepEqual(quarantinedIds, expectedQuarantinedIds) {
+		t.Errorf("unexpected quarantined server entries: %v", quarantinedIds)
+	}
+}
+
+func TestNoticeServerAddressRedaction(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	var notices []string
+	var infoMessages []string
+	var connectingAddresses []interface{}
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			notices = append(notices, string(notice))
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			switch noticeType {
+			case "Info":
+				infoMessages = append(infoMessages, payload["message"].(string))
+			case "ConnectingServer":
+				connectingAddresses = append(connectingAddresses, payload["ipAddress"])
+			}
+		}))
+	defer SetNoticeOutput(os.Stderr)
+
+	SetNoticeServerAddressRedaction(true)
+	defer SetNoticeServerAddressRedaction(false)
+
+	ipAddress := "10.0.62.1"
+	redactedAddress := redactServerAddress(ipAddress)
+	if redactedAddress == ipAddress || redactedAddress != redactServerAddress(ipAddress) {
+		t.Fatalf("unexpected redacted address: %s", redactedAddress)
+	}
+	if redactedAddress == redactServerAddress("10.0.62.2") {
+		t.Errorf("distinct addresses have the same redacted address")
+	}
+
+	err := dataStore.StoreServerEntry(makeTestServerEntry(ipAddress, "YF"), true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+	NoticeConnectingServer(ipAddress, "YF", TUNNEL_PROTOCOL_SSH, "")
+
+	if !Contains(infoMessages, "updated server "+redactedAddress) {
+		t.Errorf("missing redacted updated server notice: %v", infoMessages)
+	}
+
+	// Server entry validation alerts are also redacted
+	SetRejectPrivateServerEntryIpAddresses(true)
+	err = ValidateServerEntry(makeTestServerEntry(ipAddress, "YF"))
+	SetRejectPrivateServerEntryIpAddresses(false)
+	if err == nil {
+		t.Errorf("unexpected valid server entry with private IP address")
+	}
+	serverEntry := makeTestServerEntry(ipAddress, "YF")
+	serverEntry.ObfuscationParams = &ServerEntryObfuscationParams{MaxPadding: -1}
+	validateServerEntryObfuscationParams(serverEntry)
+
+	if !reflect.DeepEqual(connectingAddresses, []interface{}{redactedAddress}) {
+		t.Errorf("unexpected ConnectingServer addresses: %v", connectingAddresses)
+	}
+	for _, notice := range notices {
+		if strings.Contains(notice, ipAddress) {
+			t.Errorf("notice contains server address: %s", notice)
+		}
+	}
+
+	// When redaction is disabled, addresses are emitted as-is
+
+	SetNoticeServerAddressRedaction(false)
+	connectingAddresses = nil
+	NoticeConnectingServer(ipAddress, "YF", TUNNEL_PROTOCOL_SSH, "")
+	if !reflect.DeepEqual(connectingAddresses, []interface{}{ipAddress}) {
+		t.Errorf("unexpected ConnectingServer addresses: %v", connectingAddresses)
+	}
+}
+
+func TestSharedCandidatePool(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	serverEntryCount := 6
+	for i := 1; i <= serverEntryCount; i++ {
+		err := dataStore.StoreServerEntry(
+			makeTestServerEntry(fmt.Sprintf("10.0.63.%d", i), "YH"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	poolSize := 3
+	pool, err := dataStore.NewSharedCandidatePool(
+		&Config{EgressRegion: "YH", TunnelPoolSize: poolSize})
+	if err != nil {
+		t.Fatalf("NewSharedCandidatePool failed: %s", err)
+	}
+	defer pool.Close()
+
+	inUse := make(map[string]*ServerEntry)
+	handedOut := make(map[string]int)
+	next := func() *ServerEntry {
+		serverEntry, err := pool.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if serverEntry != nil {
+			if inUse[serverEntry.IpAddress] != nil {
+				t.Errorf("candidate handed out while in use: %s", serverEntry.IpAddress)
+			}
+			inUse[serverEntry.IpAddress] = serverEntry
+			handedOut[serverEntry.IpAddress] += 1
+		}
+		return serverEntry
+	}
+	fail := func(ipAddress string) {
+		pool.Return(inUse[ipAddress], false)
+		delete(inUse, ipAddress)
+	}
+
+	// The initial pool candidates are distinct
+
+	for i := 0; i < poolSize; i++ {
+		if next() == nil {
+			t.Fatalf("missing initial candidate")
+		}
+	}
+	if len(handedOut) != poolSize {
+		t.Fatalf("unexpected initial candidates: %v", handedOut)
+	}
+
+	// Failures, each followed by a Reset, are replaced with fresh candidates
+	// until the fresh candidates are exhausted
+
+	var failedIpAddresses []string
+	for i := 0; i < serverEntryCount-poolSize; i++ {
+		var ipAddress string
+		for ipAddress = range inUse {
+			break
+		}
+		fail(ipAddress)
+		failedIpAddresses = append(failedIpAddresses, ipAddress)
+		err = pool.Reset()
+		if err != nil {
+			t.Fatalf("Reset failed: %s", err)
+		}
+		if next() == nil {
+			t.Fatalf("missing replacement candidate")
+		}
+	}
+	if len(handedOut) != serverEntryCount {
+		t.Errorf("candidates not covered: %v", handedOut)
+	}
+	for ipAddress, count := range handedOut {
+		if count != 1 {
+			t.Errorf("candidate handed out %d times: %s", count, ipAddress)
+		}
+	}
+
+	// Once exhausted, failed candidates are recycled in failure order
+
+	for _, ipAddress := range failedIpAddresses {
+		serverEntry := next()
+		if serverEntry == nil || serverEntry.IpAddress != ipAddress {
+			t.Fatalf("unexpected recycled candidate: %+v", serverEntry)
+		}
+	}
+	if next() != nil {
+		t.Errorf("unexpected candidate while all candidates are in use")
+	}
+
+	// A successful candidate is not handed out again
+
+	var succeededIpAddress string
+	for succeededIpAddress = range inUse {
+		break
+	}
+	pool.Return(inUse[succeededIpAddress], true)
+	delete(inUse, succeededIpAddress)
+	err = pool.Reset()
+	if err != nil {
+		t.Fatalf("Reset failed: %s", err)
+	}
+	if next() != nil {
+		t.Errorf("unexpected candidate after success")
+	}
+}
+
+func TestNoticeNoCandidateServers(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	err := dataStore.StoreServerEntry(makeTestServerEntry("10.0.64.1", "YI"), true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	// The only YP server entry is stored but is skipped by Next, as it's
+	// disabled
+	err = dataStore.StoreServerEntry(makeTestServerEntry("10.0.64.2", "YP"), true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+	err = dataStore.SetServerEntryDisabledUntil("10.0.64.2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error disabling server entry: %s", err)
+	}
+
+	// The only YQ server entry requires a minimum client version
+	serverEntry := makeTestServerEntry("10.0.64.3", "YQ")
+	serverEntry.MinClientVersion = "10"
+	err = dataStore.StoreServerEntry(serverEntry, true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+
+	var notices []map[string]interface{}
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err == nil && noticeType == "NoCandidateServers" {
+				notices = append(notices, payload)
+			}
+		}))
+	defer SetNoticeOutput(os.Stderr)
+
+	testCases := []struct {
+		description    string
+		region         string
+		protocol       string
+		clientVersion  string
+		expectedNotice bool
+	}{
+		{"populated", "YI", "", "", false},
+		{"populated protocol", "YI", TUNNEL_PROTOCOL_SSH, "", false},
+		{"empty region", "YJ", "", "", true},
+		{"empty protocol", "YI", TUNNEL_PROTOCOL_FRONTED_MEEK, "", true},
+		{"disabled", "YP", "", "", true},
+		{"supported client version", "YQ", "", "10", false},
+		{"unsupported client version", "YQ", "", "5", true},
+	}
+
+	for _, testCase := range testCases {
+		notices = nil
+		iterator, err := dataStore.NewServerEntryIterator(
+			&Config{
+				EgressRegion:   testCase.region,
+				TunnelProtocol: testCase.protocol,
+				ClientVersion:  testCase.clientVersion,
+				TunnelPoolSize: 1,
+			})
+		if err != nil {
+			t.Fatalf("error creating iterator: %s", err)
+		}
+		iterator.Close()
+
+		if !testCase.expectedNotice {
+			if len(notices) != 0 {
+				t.Errorf("%s: unexpected NoCandidateServers notices: %+v", testCase.description, notices)
+			}
+			continue
+		}
+		if len(notices) != 1 ||
+			notices[0]["region"] != testCase.region ||
+			notices[0]["protocol"] != testCase.protocol {
+			t.Errorf("%s: unexpected NoCandidateServers notices: %+v", testCase.description, notices)
+		}
+	}
+}
+
+func TestDataStoreOperationLog(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{DataStoreOperationLogSize: 3})
+	defer closeDataStore()
+
+	checkOperationLog := func(expectedOperations []DataStoreOperation) {
+		operations := dataStore.GetDataStoreOperationLog()
+		if len(operations) != len(expectedOperations) {
+			t.Fatalf("unexpected operation log: %+v", operations)
+		}
+		for i, operation := range operations {
+			if operation.Name != expectedOperations[i].Name ||
+				operation.Key != expectedOperations[i].Key {
+				t.Errorf("unexpected operation %d: %+v", i, operation)
+			}
+			if i > 0 && operation.Timestamp.Before(operations[i-1].Timestamp) {
+				t.Errorf("operation %d out of order: %+v", i, operation)
+			}
+		}
+	}
+
+	err := dataStore.StoreServerEntry(makeTestServerEntry("10.0.65.1", "YK"), true)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+	err = dataStore.PromoteServerEntry("10.0.65.1")
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+	checkOperationLog([]DataStoreOperation{
+		{Name: "StoreServerEntry", Key: "10.0.65.1"},
+		{Name: "PromoteServerEntry", Key: "10.0.65.1"},
+	})
+
+	// The log is bounded, retaining the most recent operations
+
+	err = dataStore.SetKeyValue("operationLogKey", "value")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	err = dataStore.SetServerEntryPinned("10.0.65.1", true)
+	if err != nil {
+		t.Fatalf("SetServerEntryPinned failed: %s", err)
+	}
+	checkOperationLog([]DataStoreOperation{
+		{Name: "PromoteServerEntry", Key: "10.0.65.1"},
+		{Name: "SetKeyValue", Key: "operationLogKey"},
+		{Name: "SetServerEntryPinned", Key: "10.0.65.1"},
+	})
+
+	// Reads are not recorded
+
+	_, err = dataStore.GetKeyValue("operationLogKey")
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	checkOperationLog([]DataStoreOperation{
+		{Name: "PromoteServerEntry", Key: "10.0.65.1"},
+		{Name: "SetKeyValue", Key: "operationLogKey"},
+		{Name: "SetServerEntryPinned", Key: "10.0.65.1"},
+	})
+
+	// By default, no log is kept
+
+	defer initTestDataStore(t)()
+	err = SetKeyValue("operationLogKey", "value")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	if GetDataStoreOperationLog() != nil {
+		t.Errorf("unexpected operation log")
+	}
+}
+
+func TestStagedServerEntries(t *testing.T) {
+
+	config := &Config{}
+	dataStore, closeDataStore := openTestDataStore(t, config)
+	defer closeDataStore()
+	defer func() { dataStore.Close() }()
+
+	stage := func(stagingId string, first, last int) {
+		var serverEntries []*ServerEntry
+		for i := first; i <= last; i++ {
+			serverEntries = append(serverEntries,
+				makeTestServerEntry(fmt.Sprintf("10.0.68.%d", i), "ZC"))
+		}
+		err := dataStore.StageServerEntries(stagingId, serverEntries)
+		if err != nil {
+			t.Fatalf("StageServerEntries failed: %s", err)
+		}
+	}
+
+	scan := func(stagingId string) [][]string {
+		batches := make([][]string, 0)
+		err := dataStore.ScanStagedServerEntries(
+			stagingId, 2, func(serverEntries []*ServerEntry) error {
+				var batch []string
+				for _, serverEntry := range serverEntries {
+					batch = append(batch, serverEntry.IpAddress)
+				}
+				batches = append(batches, batch)
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("ScanStagedServerEntries failed: %s", err)
+		}
+		return batches
+	}
+
+	stage("staging1", 1, 3)
+	stage("staging2", 9, 9)
+	stage("staging1", 4, 5)
+
+	// Staged server entries are read back in batches, in the order staged,
+	// and only from their own staging area
+
+	expectedBatches := [][]string{
+		{"10.0.68.1", "10.0.68.2"},
+		{"10.0.68.3", "10.0.68.4"},
+		{"10.0.68.5"},
+	}
+	if batches := scan("staging1"); !reflect.DeepEqual(batches, expectedBatches) {
+		t.Errorf("unexpected staged server entries: %v", batches)
+	}
+
+	// Staged server entries aren't stored server entries
+
+	serverEntry, err := dataStore.GetServerEntry("10.0.68.1")
+	if err != nil {
+		t.Fatalf("GetServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Errorf("unexpected stored server entry")
+	}
+	if count := dataStore.CountServerEntries("ZC", ""); count != 0 {
+		t.Errorf("unexpected server entry count: %d", count)
+	}
+
+	err = dataStore.DeleteStagedServerEntries("staging1")
+	if err != nil {
+		t.Fatalf("DeleteStagedServerEntries failed: %s", err)
+	}
+	if batches := scan("staging1"); len(batches) != 0 {
+		t.Errorf("unexpected staged server entries after delete: %v", batches)
+	}
+	if batches := scan("staging2"); !reflect.DeepEqual(batches, [][]string{{"10.0.68.9"}}) {
+		t.Errorf("unexpected staged server entries: %v", batches)
+	}
+
+	// Remaining staged server entries are discarded when the datastore is
+	// reopened
+
+	dataStore.Close()
+	dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	if batches := scan("staging2"); len(batches) != 0 {
+		t.Errorf("unexpected staged server entries after reopen: %v", batches)
+	}
+}
+
+func TestQuarantineUndecodableServerEntriesInScans(t *testing.T) {
+
+	dataStore, closeDataStore := openTestDataStore(t, &Config{})
+	defer closeDataStore()
+
+	for i := 1; i <= 6; i++ {
+		err := dataStore.StoreServerEntry(
+			makeTestServerEntry(fmt.Sprintf("10.0.69.%d", i), "ZF"), true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+	codec := dataStore.codec
+
+	scans := []struct {
+		name string
+		scan func(undecodableIpAddress string) error
+	}{
+		{"GetReachableProtocols", func(string) error {
+			_, err := dataStore.GetReachableProtocols("")
+			return err
+		}},
+		{"DumpDiagnostics", func(string) error {
+			_, err := dataStore.DumpDiagnostics(false)
+			return err
+		}},
+		{"ExportRankedServerEntries", func(string) error {
+			_, err := dataStore.ExportRankedServerEntries(10)
+			return err
+		}},
+		{"GetServerEntries", func(undecodableIpAddress string) error {
+			serverEntries, err := dataStore.GetServerEntries(
+				[]string{"10.0.69.1", undecodableIpAddress})
+			if err == nil && len(serverEntries) != 1 {
+				err = fmt.Errorf("unexpected server entry count: %d", len(serverEntries))
+			}
+			return err
+		}},
+	}
+
+	// Each scan continues past, and quarantines, an undecodable server entry
+
+	for i, scan := range scans {
+		undecodableIpAddress := fmt.Sprintf("10.0.69.%d", i+2)
+		dataStore.codec = &faultyServerEntryCodec{
+			serverEntryCodec: codec,
+			errorIpAddresses: []string{undecodableIpAddress},
+		}
+		err := scan.scan(undecodableIpAddress)
+		if err != nil {
+			t.Fatalf("%s failed: %s", scan.name, err)
+		}
+		quarantinedIds, err := dataStore.GetQuarantinedServerEntryIds()
+		if err != nil {
+			t.Fatalf("GetQuarantinedServerEntryIds failed: %s", err)
+		}
+		if !Contains(quarantinedIds, undecodableIpAddress) {
+			t.Errorf("%s did not quarantine server entry: %v", scan.name, quarantinedIds)
+		}
+	}
+
+	dataStore.codec = &faultyServerEntryCodec{
+		serverEntryCodec: codec,
+		errorIpAddresses: []string{"10.0.69.6"},
+	}
+	_, err := dataStore.GetDataStoreStats()
+	if err != nil {
+		t.Fatalf("GetDataStoreStats failed: %s", err)
+	}
+}
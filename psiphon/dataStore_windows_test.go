@@ -0,0 +1,51 @@
+// +build windows
+
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"testing"
+)
+
+// removeTestDataStoreBucket drops the table from the live database.
+func removeTestDataStoreBucket(t *testing.T, dataStore *DataStore, name string) {
+	_, err := dataStore.db.Exec(fmt.Sprintf("drop table %s;", name))
+	if err != nil {
+		t.Fatalf("error dropping table: %s", err)
+	}
+}
+
+// storeTestServerEntryWithoutValidation stores the server entry, bypassing
+// StoreServerEntry validation.
+func storeTestServerEntryWithoutValidation(t *testing.T, dataStore *DataStore, serverEntry *ServerEntry) {
+	data, err := dataStore.codec.Marshal(serverEntry)
+	if err != nil {
+		t.Fatalf("error encoding server entry: %s", err)
+	}
+	_, err = dataStore.db.Exec(`
+        insert or replace into serverEntry (id, rank, region, data)
+        values (?, (select coalesce(max(rank)+1, 0) from serverEntry), ?, ?);
+        `, serverEntry.IpAddress, serverEntry.Region, data)
+	if err != nil {
+		t.Fatalf("error storing server entry: %s", err)
+	}
+}
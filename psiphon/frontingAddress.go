@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"sync"
+
+	regen "github.com/Psiphon-Inc/goregen"
+)
+
+const (
+	FRONTING_ADDRESS_STRATEGY_RANDOM      = "random"
+	FRONTING_ADDRESS_STRATEGY_ROUND_ROBIN = "round-robin"
+	FRONTING_ADDRESS_STRATEGY_STICKY      = "sticky"
+)
+
+var SupportedFrontingAddressStrategies = []string{
+	FRONTING_ADDRESS_STRATEGY_RANDOM,
+	FRONTING_ADDRESS_STRATEGY_ROUND_ROBIN,
+	FRONTING_ADDRESS_STRATEGY_STICKY,
+}
+
+// FrontingAddressSelector selects meek fronting addresses for fronted
+// server connection attempts, according to config.FrontingAddressStrategy.
+// A FrontingAddressSelector holds the round-robin and sticky selection state
+// for one Psiphon API session; the Controller uses one selector for all of
+// its tunnels, which share a session ID.
+type FrontingAddressSelector struct {
+	mutex           sync.Mutex
+	strategy        string
+	nextIndexes     map[string]int
+	stickyAddresses map[string]string
+}
+
+// NewFrontingAddressSelector initializes a new FrontingAddressSelector.
+// For the default strategy, "", a random fronting address is selected.
+func NewFrontingAddressSelector(strategy string) *FrontingAddressSelector {
+	return &FrontingAddressSelector{
+		strategy:        strategy,
+		nextIndexes:     make(map[string]int),
+		stickyAddresses: make(map[string]string),
+	}
+}
+
+// SelectMeekFrontingAddress selects, for one connection attempt, the front
+// address to use for the specified fronting-capable server:
+// - with the random strategy, a random front address is selected;
+// - with the round-robin strategy, each selection for a server uses the next
+//   front address in the server's list;
+// - with the sticky strategy, the first selection for a server is random and
+//   subsequent selections use the same front address.
+// When the server entry specifies MeekFrontingAddressesRegex, front addresses
+// are generated from the regex and the round-robin strategy is the same as
+// the random strategy.
+func (selector *FrontingAddressSelector) SelectMeekFrontingAddress(
+	serverEntry *ServerEntry) (string, error) {
+
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+
+	if selector.strategy == FRONTING_ADDRESS_STRATEGY_STICKY {
+		if frontingAddress, ok := selector.stickyAddresses[serverEntry.IpAddress]; ok {
+			return frontingAddress, nil
+		}
+	}
+
+	frontingAddress, err := selector.selectFrontingAddress(serverEntry)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	if selector.strategy == FRONTING_ADDRESS_STRATEGY_STICKY {
+		selector.stickyAddresses[serverEntry.IpAddress] = frontingAddress
+	}
+
+	return frontingAddress, nil
+}
+
+func (selector *FrontingAddressSelector) selectFrontingAddress(
+	serverEntry *ServerEntry) (string, error) {
+
+	if len(serverEntry.MeekFrontingAddressesRegex) > 0 {
+
+		// Generate a front address based on the regex.
+
+		frontingAddress, err := regen.Generate(serverEntry.MeekFrontingAddressesRegex)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		return frontingAddress, nil
+	}
+
+	if len(serverEntry.MeekFrontingAddresses) == 0 {
+		return "", ContextError(errors.New("MeekFrontingAddresses is empty"))
+	}
+
+	if selector.strategy == FRONTING_ADDRESS_STRATEGY_ROUND_ROBIN {
+		index := selector.nextIndexes[serverEntry.IpAddress] % len(serverEntry.MeekFrontingAddresses)
+		selector.nextIndexes[serverEntry.IpAddress] = index + 1
+		return serverEntry.MeekFrontingAddresses[index], nil
+	}
+
+	index, err := MakeSecureRandomInt(len(serverEntry.MeekFrontingAddresses))
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return serverEntry.MeekFrontingAddresses[index], nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+)
+
+func makeTestFrontedServerEntry(ipAddress string) *ServerEntry {
+	return &ServerEntry{
+		IpAddress:             ipAddress,
+		MeekFrontingAddresses: []string{"front-1.example.com", "front-2.example.com", "front-3.example.com"},
+	}
+}
+
+func TestFrontingAddressStrategyRandom(t *testing.T) {
+	serverEntry := makeTestFrontedServerEntry("10.1.0.1")
+	selector := NewFrontingAddressSelector(FRONTING_ADDRESS_STRATEGY_RANDOM)
+
+	selected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		frontingAddress, err := selector.SelectMeekFrontingAddress(serverEntry)
+		if err != nil {
+			t.Fatalf("SelectMeekFrontingAddress failed: %s", err)
+		}
+		if !Contains(serverEntry.MeekFrontingAddresses, frontingAddress) {
+			t.Fatalf("unexpected fronting address: %s", frontingAddress)
+		}
+		selected[frontingAddress] = true
+	}
+	if len(selected) < 2 {
+		t.Errorf("unexpected random selections: %+v", selected)
+	}
+}
+
+func TestFrontingAddressStrategyRoundRobin(t *testing.T) {
+	serverEntry := makeTestFrontedServerEntry("10.1.0.1")
+	otherServerEntry := makeTestFrontedServerEntry("10.1.0.2")
+	selector := NewFrontingAddressSelector(FRONTING_ADDRESS_STRATEGY_ROUND_ROBIN)
+
+	for i := 0; i < 2*len(serverEntry.MeekFrontingAddresses); i++ {
+		frontingAddress, err := selector.SelectMeekFrontingAddress(serverEntry)
+		if err != nil {
+			t.Fatalf("SelectMeekFrontingAddress failed: %s", err)
+		}
+		expectedFrontingAddress :=
+			serverEntry.MeekFrontingAddresses[i%len(serverEntry.MeekFrontingAddresses)]
+		if frontingAddress != expectedFrontingAddress {
+			t.Errorf("unexpected fronting address: %s != %s", frontingAddress, expectedFrontingAddress)
+		}
+	}
+
+	// Each server has its own round-robin position
+	frontingAddress, err := selector.SelectMeekFrontingAddress(otherServerEntry)
+	if err != nil {
+		t.Fatalf("SelectMeekFrontingAddress failed: %s", err)
+	}
+	if frontingAddress != otherServerEntry.MeekFrontingAddresses[0] {
+		t.Errorf("unexpected fronting address: %s", frontingAddress)
+	}
+}
+
+func TestFrontingAddressStrategySticky(t *testing.T) {
+	serverEntry := makeTestFrontedServerEntry("10.1.0.1")
+	selector := NewFrontingAddressSelector(FRONTING_ADDRESS_STRATEGY_STICKY)
+
+	stickyFrontingAddress, err := selector.SelectMeekFrontingAddress(serverEntry)
+	if err != nil {
+		t.Fatalf("SelectMeekFrontingAddress failed: %s", err)
+	}
+	if !Contains(serverEntry.MeekFrontingAddresses, stickyFrontingAddress) {
+		t.Fatalf("unexpected fronting address: %s", stickyFrontingAddress)
+	}
+
+	for i := 0; i < 100; i++ {
+		frontingAddress, err := selector.SelectMeekFrontingAddress(serverEntry)
+		if err != nil {
+			t.Fatalf("SelectMeekFrontingAddress failed: %s", err)
+		}
+		if frontingAddress != stickyFrontingAddress {
+			t.Fatalf("unexpected fronting address: %s != %s", frontingAddress, stickyFrontingAddress)
+		}
+	}
+}
+
+func TestFrontingAddressEmpty(t *testing.T) {
+	serverEntry := &ServerEntry{IpAddress: "10.1.0.1"}
+	for _, strategy := range SupportedFrontingAddressStrategies {
+		selector := NewFrontingAddressSelector(strategy)
+		_, err := selector.SelectMeekFrontingAddress(serverEntry)
+		if err == nil {
+			t.Errorf("SelectMeekFrontingAddress unexpectedly succeeded for %s", strategy)
+		}
+	}
+}
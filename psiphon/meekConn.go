@@ -101,10 +101,11 @@ type transporter interface {
 // wait for the connection to be "established" before returning. A goroutine
 // is spawned which will eventually start HTTP polling.
 // When frontingAddress is not "", fronting is used. This option assumes caller has
-// already checked server entry capabilities.
+// already checked server entry capabilities. When useHttpFronting is set, fronting
+// is over plain HTTP instead of HTTPS.
 func DialMeek(
 	serverEntry *ServerEntry, sessionId string,
-	frontingAddress string, config *DialConfig) (meek *MeekConn, err error) {
+	frontingAddress string, useHttpFronting bool, config *DialConfig) (meek *MeekConn, err error) {
 
 	// Configure transport
 	// Note: MeekConn has its own PendingConns to manage the underlying HTTP transport connections,
@@ -122,7 +123,18 @@ func DialMeek(
 	var dialer Dialer
 	var proxyUrl func(*http.Request) (*url.URL, error)
 
-	if frontingAddress != "" {
+	if frontingAddress != "" && useHttpFronting {
+		// As with HTTPS fronting, host is not what is dialed but is what ends up in the
+		// HTTP Host header. The dialer ignores the HTTP request address and dials the
+		// fronting address on the plain HTTP port.
+		host = serverEntry.MeekFrontingHttpHost
+
+		tcpDialer := NewTCPDialer(meekConfig)
+		frontingAddr := fmt.Sprintf("%s:%d", frontingAddress, 80)
+		dialer = func(network, _ string) (net.Conn, error) {
+			return tcpDialer(network, frontingAddr)
+		}
+	} else if frontingAddress != "" {
 		// In this case, host is not what is dialed but is what ends up in the HTTP Host header
 		host = serverEntry.MeekFrontingHost
 
@@ -172,7 +184,10 @@ func DialMeek(
 			})
 	} else {
 		// In the unfronted case, host is both what is dialed and what ends up in the HTTP Host header
-		host = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		_, host, err = serverEntry.DialAddress(TUNNEL_PROTOCOL_UNFRONTED_MEEK)
+		if err != nil {
+			return nil, ContextError(err)
+		}
 
 		if meekConfig.UpstreamProxyUrl != "" {
 			// For unfronted meek, we let the http.Transport handle proxying, as the
@@ -21,6 +21,9 @@ package psiphon
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -59,6 +62,46 @@ func SetNoticeOutput(output io.Writer) {
 	noticeLogger = log.New(output, "", 0)
 }
 
+var noticeRedactionMutex sync.Mutex
+var noticeRedactServerAddresses bool
+var noticeRedactionKey []byte
+
+// SetNoticeServerAddressRedaction sets whether notices redact server IP
+// addresses. When enabled, each server IP address is replaced with a keyed
+// hash, so that notices for the same server may still be correlated within
+// a run while the address itself isn't disclosed. The hash key is random
+// and isn't retained across runs. By default, addresses are not redacted.
+//
+// Redaction applies to the server-identifying fields of notices; addresses
+// which appear within underlying error messages are not redacted.
+func SetNoticeServerAddressRedaction(redact bool) {
+	noticeRedactionMutex.Lock()
+	defer noticeRedactionMutex.Unlock()
+	noticeRedactServerAddresses = redact
+	if redact && noticeRedactionKey == nil {
+		key, err := MakeSecureRandomBytes(32)
+		if err == nil {
+			noticeRedactionKey = key
+		}
+	}
+}
+
+// redactServerAddress returns the server IP address to emit in notices.
+// When redaction is enabled, this is a keyed hash of the address.
+func redactServerAddress(ipAddress string) string {
+	noticeRedactionMutex.Lock()
+	defer noticeRedactionMutex.Unlock()
+	if !noticeRedactServerAddresses {
+		return ipAddress
+	}
+	if noticeRedactionKey == nil {
+		return "[redacted]"
+	}
+	mac := hmac.New(sha256.New, noticeRedactionKey)
+	mac.Write([]byte(ipAddress))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
 // outputNotice encodes a notice in JSON and writes it to the output writer.
 func outputNotice(noticeType string, showUser bool, args ...interface{}) {
 	obj := make(map[string]interface{})
@@ -101,11 +144,26 @@ func NoticeError(format string, args ...interface{}) {
 	outputNotice("Error", true, "message", fmt.Sprintf(format, args...))
 }
 
-// NoticeCandidateServers is how many possible servers are available for the selected region and protocol
-func NoticeCandidateServers(region, protocol string, count int) {
+// NoticeCandidateServers is how many possible servers are available for the selected region and protocol.
+// When multiple protocols are accepted, protocolCounts breaks down the count by protocol; a server
+// which supports several accepted protocols is counted for each protocol.
+func NoticeCandidateServers(region, protocol string, count int, protocolCounts map[string]int) {
+	if len(protocolCounts) > 0 {
+		outputNotice("CandidateServers", false, "region", region, "protocol", protocol, "count", count,
+			"protocolCounts", protocolCounts)
+		return
+	}
 	outputNotice("CandidateServers", false, "region", region, "protocol", protocol, "count", count)
 }
 
+// NoticeNoCandidateServers indicates that no stored servers pass the
+// iterator filters, including region and protocol, so establishment can't
+// proceed until the filters are relaxed or a server list with matching
+// servers is fetched.
+func NoticeNoCandidateServers(region, protocol string) {
+	outputNotice("NoCandidateServers", true, "region", region, "protocol", protocol)
+}
+
 // NoticeAvailableEgressRegions is what regions are available for egress from.
 // Consecutive reports of the same list of regions are suppressed.
 func NoticeAvailableEgressRegions(regions []string) {
@@ -119,13 +177,13 @@ func NoticeAvailableEgressRegions(regions []string) {
 
 // NoticeConnectingServer is details on a connection attempt
 func NoticeConnectingServer(ipAddress, region, protocol, frontingAddress string) {
-	outputNotice("ConnectingServer", false, "ipAddress", ipAddress, "region",
+	outputNotice("ConnectingServer", false, "ipAddress", redactServerAddress(ipAddress), "region",
 		region, "protocol", protocol, "frontingAddress", frontingAddress)
 }
 
 // NoticeActiveTunnel is a successful connection that is used as an active tunnel for port forwarding
 func NoticeActiveTunnel(ipAddress, protocol string) {
-	outputNotice("ActiveTunnel", false, "ipAddress", ipAddress, "protocol", protocol)
+	outputNotice("ActiveTunnel", false, "ipAddress", redactServerAddress(ipAddress), "protocol", protocol)
 }
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
@@ -154,6 +212,28 @@ func NoticeClientUpgradeAvailable(version string) {
 	outputNotice("ClientUpgradeAvailable", false, "version", version)
 }
 
+// NoticeHandshakeServerEntriesStored indicates that server entries received
+// in the handshake have been stored. This notice is only emitted when
+// config.StoreHandshakeServerEntriesAsynchronously is set.
+func NoticeHandshakeServerEntriesStored(count int) {
+	outputNotice("HandshakeServerEntriesStored", false, "count", count)
+}
+
+// NoticeDataStoreMerged reports the outcome of MergeDataStore: the number
+// of server entries stored, the number skipped as invalid or, when not
+// replacing, already stored, and the number of key-values stored.
+func NoticeDataStoreMerged(path string, stored, skipped, keyValues int) {
+	outputNotice("DataStoreMerged", false,
+		"path", path, "stored", stored, "skipped", skipped, "keyValues", keyValues)
+}
+
+// NoticeDataStoreError reports a failed datastore read or write
+// transaction. Such failures may indicate conditions, such as a full disk
+// or a corrupt datastore file, which callers don't otherwise report.
+func NoticeDataStoreError(operation string, err error) {
+	outputNotice("DataStoreError", false, "operation", operation, "message", err.Error())
+}
+
 // NoticeClientUpgradeAvailable is a sponsor homepage, as per the handshake. The client
 // should display the sponsor's homepage.
 func NoticeHomepage(url string) {
@@ -204,14 +284,16 @@ func NoticeClientUpgradeDownloaded(filename string) {
 // transferred since the last NoticeBytesTransferred, for the tunnel
 // to the server at ipAddress.
 func NoticeBytesTransferred(ipAddress string, sent, received int64) {
-	outputNotice("BytesTransferred", false, "ipAddress", ipAddress, "sent", sent, "received", received)
+	outputNotice("BytesTransferred", false, "ipAddress", redactServerAddress(ipAddress),
+		"sent", sent, "received", received)
 }
 
 // NoticeTotalBytesTransferred reports how many tunneled bytes have been
 // transferred in total up to this point, for the tunnel to the server
 // at ipAddress.
 func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
-	outputNotice("TotalBytesTransferred", false, "ipAddress", ipAddress, "sent", sent, "received", received)
+	outputNotice("TotalBytesTransferred", false, "ipAddress", redactServerAddress(ipAddress),
+		"sent", sent, "received", received)
 }
 
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
@@ -126,7 +126,16 @@ func FetchRemoteServerList(config *Config, dialConfig *DialConfig) (err error) {
 		return ContextError(err)
 	}
 
-	err = StoreServerEntries(serverEntries, true)
+	err = checkServerListMinimumEntries(serverEntries, config.MinimumServerListEntries)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if config.ImportServerEntriesByPriority {
+		err = StoreServerEntriesByPriority(serverEntries, true)
+	} else {
+		err = StoreServerEntries(serverEntries, true)
+	}
 	if err != nil {
 		return ContextError(err)
 	}
@@ -142,3 +151,17 @@ func FetchRemoteServerList(config *Config, dialConfig *DialConfig) (err error) {
 
 	return nil
 }
+
+// checkServerListMinimumEntries returns an error, and emits an alert, when
+// a decoded server list has fewer than minimumEntries valid server entries.
+// This guards against storing a truncated or compromised list.
+func checkServerListMinimumEntries(serverEntries []*ServerEntry, minimumEntries int) error {
+	if len(serverEntries) < minimumEntries {
+		err := fmt.Errorf(
+			"server list has %d valid server entries, fewer than the minimum %d",
+			len(serverEntries), minimumEntries)
+		NoticeAlert("rejected server list: %s", err)
+		return err
+	}
+	return nil
+}
@@ -20,7 +20,13 @@
 package psiphon
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -28,9 +34,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 )
@@ -40,12 +50,21 @@ import (
 // includes the session ID (used for Psiphon API requests) and a http
 // client configured to make tunneled Psiphon API requests.
 type Session struct {
+	mutex                *sync.Mutex
+	config               *Config
 	sessionId            string
 	baseRequestUrl       string
 	psiphonHttpsClient   *http.Client
+	tunneledHttpClient   *http.Client
 	statsRegexps         *transferstats.Regexps
 	clientRegion         string
+	clientPublicIP       net.IP
 	clientUpgradeVersion string
+	requestSigningKey    []byte
+	serverIpAddress      string
+
+	serverEntryStoreMutex     sync.Mutex
+	serverEntryStoreWaitGroup sync.WaitGroup
 }
 
 // MakeSessionId creates a new session ID. Making the session ID is not done
@@ -65,20 +84,55 @@ func MakeSessionId() (sessionId string, err error) {
 // NewSession makes the tunnelled handshake request to the
 // Psiphon server and returns a Session struct, initialized with the
 // session ID, for use with subsequent Psiphon server API requests (e.g.,
-// periodic connected and status requests).
+// periodic connected and status requests). When the server entry web
+// server certificate is invalid, an InvalidWebServerCertificateError is
+// returned.
 func NewSession(config *Config, tunnel *Tunnel, sessionId string) (session *Session, err error) {
 
-	psiphonHttpsClient, err := makePsiphonHttpsClient(tunnel)
+	// Skip the certificate when it was already found to be invalid. This
+	// check doesn't apply with CA verification, which doesn't use the
+	// server entry certificate.
+	if len(config.AcceptableWebServerCertificateIssuers) == 0 {
+		marked, err := IsWebServerCertificateMarkedInvalid(tunnel.serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if marked {
+			return nil, &InvalidWebServerCertificateError{
+				err: ContextError(errors.New("certificate previously marked invalid"))}
+		}
+	}
+
+	psiphonHttpsClient, err := makePsiphonHttpsClient(config, tunnel)
+	if _, ok := err.(*InvalidWebServerCertificateError); ok {
+		// Note: ContextError() would break the error type check in EstablishTunnel()
+		return nil, err
+	}
 	if err != nil {
 		return nil, ContextError(err)
 	}
+	var requestSigningKey []byte
+	if tunnel.serverEntry.ApiRequestSigningKey != "" {
+		requestSigningKey, err = hex.DecodeString(tunnel.serverEntry.ApiRequestSigningKey)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
 	session = &Session{
+		mutex:              new(sync.Mutex),
+		config:             config,
 		sessionId:          sessionId,
-		baseRequestUrl:     makeBaseRequestUrl(config, tunnel, sessionId),
 		psiphonHttpsClient: psiphonHttpsClient,
+		tunneledHttpClient: makeTunneledHttpClient(tunnel),
+		requestSigningKey:  requestSigningKey,
+		serverIpAddress:    tunnel.serverEntry.IpAddress,
 	}
 
-	err = session.doHandshakeRequest()
+	err = session.doHandshakeRequestWithFallback(
+		tunnel.serverEntry.GetWebServerPorts(),
+		func(webServerPort string) string {
+			return makeBaseRequestUrl(config, tunnel, sessionId, webServerPort)
+		})
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -118,6 +172,15 @@ func (session *Session) DoConnectedRequest() error {
 		return ContextError(err)
 	}
 
+	// A malformed timestamp is not stored, as it would be sent as the
+	// last_connected value in subsequent connected requests. The previous
+	// value is retained.
+	_, err = time.Parse(time.RFC3339, response.ConnectedTimestamp)
+	if err != nil {
+		NoticeAlert("invalid connected_timestamp %q: %s", response.ConnectedTimestamp, err)
+		return nil
+	}
+
 	err = SetKeyValue(DATA_STORE_LAST_CONNECTED_KEY, response.ConnectedTimestamp)
 	if err != nil {
 		return ContextError(err)
@@ -125,16 +188,220 @@ func (session *Session) DoConnectedRequest() error {
 	return nil
 }
 
+// Close releases the session's HTTP clients, closing any idle connections
+// held by their transports. Requests made after Close fail. Close first waits
+// for any asynchronous handshake server entry store to complete, so that the
+// datastore isn't written to after the session is closed. Supports multiple
+// and/or concurrent calls to Close().
+func (session *Session) Close() {
+	session.serverEntryStoreWaitGroup.Wait()
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.psiphonHttpsClient == nil {
+		return
+	}
+	for _, httpClient := range []*http.Client{
+		session.psiphonHttpsClient, session.tunneledHttpClient} {
+
+		if httpClient == nil {
+			continue
+		}
+		if transport, ok := httpClient.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+	session.psiphonHttpsClient = nil
+	session.tunneledHttpClient = nil
+}
+
+// getPsiphonHttpsClient returns the session's HTTPS client, or an error
+// when the session is closed.
+func (session *Session) getPsiphonHttpsClient() (*http.Client, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.psiphonHttpsClient == nil {
+		return nil, errors.New("session is closed")
+	}
+	return session.psiphonHttpsClient, nil
+}
+
+// getTunneledHttpClient returns the session's general purpose tunneled
+// HTTP client, or an error when the session is closed.
+func (session *Session) getTunneledHttpClient() (*http.Client, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.tunneledHttpClient == nil {
+		return nil, errors.New("session is closed")
+	}
+	return session.tunneledHttpClient, nil
+}
+
+// FetchAndStoreServerList downloads an encoded server entry list from the
+// specified URL, through the session's tunnel, and stores the valid server
+// entries. The fetch is a conditional GET using the ETag cached for the URL;
+// when the server responds that the list is unchanged, nothing is stored.
+// The server entries are stored with StoreServerEntries, so the list is
+// ordered as configured by config.ServerEntryStoreOrder and the available
+// egress regions are reported.
+// stored is the number of server entries stored; skipped is the number of
+// server entries which are invalid, which the datastore doesn't accept or,
+// when replaceIfExists is false, which are already stored.
+// Unlike FetchRemoteServerList, the list is not a signed data package.
+// As with Psiphon API responses, reading more than the maximum response body
+// size fails; see getMaxApiResponseBodyBytes.
+func (session *Session) FetchAndStoreServerList(
+	url string, replaceIfExists bool) (stored, skipped int, err error) {
+
+	httpClient, err := session.getTunneledHttpClient()
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+
+	etag, err := GetUrlETag(url)
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+	if etag != "" {
+		request.Header.Add("If-None-Match", etag)
+	}
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := httpClient.Do(request)
+	if err == nil &&
+		(response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotModified) {
+		response.Body.Close()
+		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	}
+	if err == nil {
+		err = decompressResponse(response)
+	}
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return 0, 0, nil
+	}
+
+	body, err := ioutil.ReadAll(
+		newLimitedResponseBody(response.Body, session.getMaxApiResponseBodyBytes()))
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+
+	encodedServerEntryCount := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		if len(line) > 0 {
+			encodedServerEntryCount += 1
+		}
+	}
+
+	serverEntries, err := DecodeAndValidateServerEntryList(string(body))
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+	err = checkServerListMinimumEntries(serverEntries, session.config.MinimumServerListEntries)
+	if err != nil {
+		return 0, 0, ContextError(err)
+	}
+	skipped = encodedServerEntryCount - len(serverEntries)
+
+	// Server entries which are already stored, when replaceIfExists is
+	// false, and server entries which the datastore doesn't accept, such as
+	// those outside of config.AllowedRegions, aren't stored. These are
+	// excluded and counted as skipped, so that stored is the number of
+	// server entries which StoreServerEntries persists.
+	acceptedServerEntries := make([]*ServerEntry, 0, len(serverEntries))
+	for _, serverEntry := range serverEntries {
+		if !replaceIfExists {
+			existingServerEntry, err := GetServerEntry(serverEntry.IpAddress)
+			if err != nil {
+				return 0, skipped, ContextError(err)
+			}
+			if existingServerEntry != nil {
+				skipped += 1
+				continue
+			}
+		}
+		if !acceptServerEntry(serverEntry) {
+			skipped += 1
+			continue
+		}
+		acceptedServerEntries = append(acceptedServerEntries, serverEntry)
+	}
+
+	err = StoreServerEntries(acceptedServerEntries, replaceIfExists)
+	if err != nil {
+		return 0, skipped, ContextError(err)
+	}
+	stored = len(acceptedServerEntries)
+
+	etag = response.Header.Get("ETag")
+	if etag != "" {
+		err := SetUrlETag(url, etag)
+		if err != nil {
+			NoticeAlert("failed to set server list etag: %s", ContextError(err))
+			// This fetch is still reported as a success, even if we can't store the etag
+		}
+	}
+
+	return stored, skipped, nil
+}
+
 // StatsRegexps gets the Regexps used for the statistics for this tunnel.
 func (session *Session) StatsRegexps() *transferstats.Regexps {
 	return session.statsRegexps
 }
 
+// ClientRegion returns the client region reported by the handshake, or ""
+// when the region is unknown.
+func (session *Session) ClientRegion() string {
+	return session.clientRegion
+}
+
+// ClientPublicIP returns the client's public IP address, as seen by the
+// server, when the server echoes it in the handshake. nil is returned when
+// the server doesn't echo the client IP address.
+func (session *Session) ClientPublicIP() net.IP {
+	return session.clientPublicIP
+}
+
+// RecordRegionTransferStats attributes bytes transferred through the
+// session's tunnel to the client region reported by the handshake, and
+// adds them to the persistent per-region totals. Nothing is recorded
+// when the client region is unknown.
+func (session *Session) RecordRegionTransferStats(bytesTransferred int64) error {
+	if session.clientRegion == "" || bytesTransferred == 0 {
+		return nil
+	}
+	err := AddRegionTransferStats(session.clientRegion, bytesTransferred)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// StatusResponse is the server-provided information returned by a /status
+// request.
+type StatusResponse struct {
+	StoredServerEntryCount int
+	UpgradeClientVersion   string
+}
+
 // DoStatusRequest makes a /status request to the server, sending session stats.
-func (session *Session) DoStatusRequest(statsPayload json.Marshaler) error {
+// The response may contain a config line, in the same format as the handshake
+// response, with new server entries, which are stored, and upgrade info. An
+// empty response is valid and results in an empty StatusResponse.
+func (session *Session) DoStatusRequest(statsPayload json.Marshaler) (*StatusResponse, error) {
 	statsPayloadJSON, err := json.Marshal(statsPayload)
 	if err != nil {
-		return ContextError(err)
+		return nil, ContextError(err)
 	}
 
 	// Add a random amount of padding to help prevent stats updates from being
@@ -152,43 +419,296 @@ func (session *Session) DoStatusRequest(statsPayload json.Marshaler) error {
 		// size is not exactly [0, PADDING_MAX_BYTES]
 		&ExtraParam{"padding", base64.StdEncoding.EncodeToString(padding)})
 
-	err = session.doPostRequest(url, "application/json", bytes.NewReader(statsPayloadJSON))
+	responseBody, err := session.doPostRequest(url, "application/json", statsPayloadJSON)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	statusResponse := &StatusResponse{}
+	configLine := getConfigLine(responseBody)
+	if len(configLine) == 0 {
+		return statusResponse, nil
+	}
+
+	var statusConfig struct {
+		UpgradeClientVersion string   `json:"upgrade_client_version"`
+		EncodedServerList    []string `json:"encoded_server_list"`
+	}
+	err = json.Unmarshal(configLine, &statusConfig)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	statusResponse.StoredServerEntryCount, err = session.storeEncodedServerList(
+		statusConfig.EncodedServerList)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	// Only a newly available upgrade is noticed; the upgrade reported in the
+	// handshake has already been noticed.
+	statusResponse.UpgradeClientVersion = statusConfig.UpgradeClientVersion
+	if statusConfig.UpgradeClientVersion != "" &&
+		statusConfig.UpgradeClientVersion != session.clientUpgradeVersion {
+		NoticeClientUpgradeAvailable(statusConfig.UpgradeClientVersion)
+	}
+
+	return statusResponse, nil
+}
+
+// ReportImpairedProtocols sends, to the server, the tunnel protocols which
+// the client has classified as impaired; see Controller.getImpairedProtocols.
+// The server uses these reports to track protocol blocking.
+func (session *Session) ReportImpairedProtocols(protocols []string) error {
+	if protocols == nil {
+		protocols = make([]string, 0)
+	}
+	payload, err := json.Marshal(struct {
+		ImpairedProtocols []string `json:"impaired_protocols"`
+	}{protocols})
 	if err != nil {
 		return ContextError(err)
 	}
 
+	url := session.buildRequestUrl(
+		"impaired_protocols",
+		&ExtraParam{"session_id", session.sessionId})
+
+	_, err = session.doPostRequest(url, "application/json", payload)
+	if err != nil {
+		return ContextError(err)
+	}
 	return nil
 }
 
+const DATA_STORE_SERVER_TIME_SKEW_KEY = "serverTimeSkew"
+
+// SyncTime requests the current time from the server, over the tunnel, and
+// returns the skew of the server clock relative to the local clock; a
+// positive skew means the server clock is ahead. The server time is assumed
+// to be taken midway through the request round trip. The skew is stored,
+// for time-sensitive features, and may be retrieved with GetServerTimeSkew.
+func (session *Session) SyncTime() (skew time.Duration, err error) {
+	url := session.buildRequestUrl(
+		"time",
+		&ExtraParam{"session_id", session.sessionId})
+
+	requestTime := time.Now()
+	responseBody, err := session.doGetRequest(url)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	responseTime := time.Now()
+
+	var response struct {
+		ServerTimestamp string `json:"server_timestamp"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	serverTime, err := time.Parse(time.RFC3339Nano, response.ServerTimestamp)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	skew = serverTime.Sub(requestTime.Add(responseTime.Sub(requestTime) / 2))
+
+	err = SetKeyValue(DATA_STORE_SERVER_TIME_SKEW_KEY, skew.String())
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return skew, nil
+}
+
+// GetServerTimeSkew returns the server clock skew stored by the most
+// recent SyncTime. 0 is returned when no skew has been stored.
+func GetServerTimeSkew() (time.Duration, error) {
+	value, err := GetKeyValue(DATA_STORE_SERVER_TIME_SKEW_KEY)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	skew, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return skew, nil
+}
+
+// ResolveHost resolves the host name to its IPv4 addresses. Resolution
+// is performed by the server, using a DNS-over-HTTPS JSON request made
+// with the session's tunneled Psiphon HTTPS client, so that no DNS request
+// is made outside of the tunnel. Results are cached in the datastore, for
+// the minimum TTL of the answer records.
+func (session *Session) ResolveHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	cachedIPs, err := GetResolvedHost(host)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if cachedIPs != nil {
+		return cachedIPs, nil
+	}
+
+	url := session.buildRequestUrl(
+		"dns_query",
+		&ExtraParam{"name", host},
+		&ExtraParam{"type", "A"})
+	responseBody, err := session.doGetRequest(url)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	// The response is in the DNS-over-HTTPS JSON format. Only A records
+	// are used; other records, such as CNAME records, are ignored.
+	var response struct {
+		Status int `json:"Status"`
+		Answer []struct {
+			Type int    `json:"type"`
+			TTL  int    `json:"TTL"`
+			Data string `json:"data"`
+		} `json:"Answer"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if response.Status != 0 {
+		return nil, ContextError(fmt.Errorf("resolve failed with status %d", response.Status))
+	}
+	var ips []net.IP
+	minTTL := -1
+	for _, answer := range response.Answer {
+		if answer.Type != 1 {
+			continue
+		}
+		ip := net.ParseIP(answer.Data)
+		if ip == nil {
+			return nil, ContextError(fmt.Errorf("invalid A record: %s", answer.Data))
+		}
+		ips = append(ips, ip)
+		if minTTL == -1 || answer.TTL < minTTL {
+			minTTL = answer.TTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, ContextError(fmt.Errorf("no addresses for host: %s", host))
+	}
+
+	if minTTL > 0 {
+		err = SetResolvedHost(
+			host, ips, resolvedHostClock().Add(time.Duration(minTTL)*time.Second))
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	return ips, nil
+}
+
+// doHandshakeRequestWithFallback performs the handshake API request using
+// each of the specified web server ports in turn, until a handshake succeeds.
+// makePortBaseRequestUrl makes the base request URL for a port; the session
+// uses the base request URL of the port with the successful handshake.
+// Only a handshake request which fails, as when the port can't be reached,
+// falls back to the next port. A handshake response which is received and
+// rejected, as on an echoed ID or server identity mismatch, isn't retried,
+// as every port reaches the same server. When all ports fail, the last
+// handshake error is returned.
+func (session *Session) doHandshakeRequestWithFallback(
+	webServerPorts []string, makePortBaseRequestUrl func(webServerPort string) string) error {
+
+	var err error
+	for _, webServerPort := range webServerPorts {
+		session.baseRequestUrl = makePortBaseRequestUrl(webServerPort)
+		err = session.doHandshakeRequest()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*handshakeRequestError); !ok {
+			return ContextError(err)
+		}
+		NoticeAlert("handshake using web server port %s failed: %s", webServerPort, err)
+	}
+	return ContextError(err)
+}
+
+// handshakeRequestError is a handshake failure in which the handshake
+// request failed and no handshake response was received.
+type handshakeRequestError struct {
+	err error
+}
+
+func (err *handshakeRequestError) Error() string {
+	return err.err.Error()
+}
+
 // doHandshakeRequest performs the handshake API request. The handshake
 // returns upgrade info, newly discovered server entries -- which are
 // stored -- and sponsor info (home pages, stat regexes).
 func (session *Session) doHandshakeRequest() error {
-	extraParams := make([]*ExtraParam, 0)
-	serverEntryIpAddresses, err := GetServerEntryIpAddresses()
+	var serverEntryIpAddresses []string
+	var err error
+	if session.config.MaxHandshakeKnownServers > 0 {
+		serverEntryIpAddresses, err = GetServerEntryIpAddressesLimited(
+			session.config.MaxHandshakeKnownServers, IP_ADDRESS_ORDER_MOST_RECENT)
+	} else {
+		serverEntryIpAddresses, err = GetServerEntryIpAddresses()
+	}
 	if err != nil {
 		return ContextError(err)
 	}
 	// Submit a list of known servers -- this will be used for
 	// discovery statistics.
-	for _, ipAddress := range serverEntryIpAddresses {
-		extraParams = append(extraParams, &ExtraParam{"known_server", ipAddress})
-	}
-	url := session.buildRequestUrl("handshake", extraParams...)
-	responseBody, err := session.doGetRequest(url)
+	extraParams, err := makeKnownServerParams(
+		serverEntryIpAddresses, session.config.PadHandshakeKnownServers)
 	if err != nil {
 		return ContextError(err)
 	}
-	// Skip legacy format lines and just parse the JSON config line
-	configLinePrefix := []byte("Config: ")
-	var configLine []byte
-	for _, line := range bytes.Split(responseBody, []byte("\n")) {
-		if bytes.HasPrefix(line, configLinePrefix) {
-			configLine = line[len(configLinePrefix):]
-			break
+	var identityNonce string
+	if session.config.VerifyHandshakeServerIdentity {
+		nonce, err := MakeSecureRandomBytes(PSIPHON_API_HANDSHAKE_IDENTITY_NONCE_LENGTH)
+		if err != nil {
+			return ContextError(err)
 		}
+		identityNonce = hex.EncodeToString(nonce)
+		extraParams = append(extraParams, &ExtraParam{"identity_nonce", identityNonce})
 	}
-	if len(configLine) == 0 {
+	url := session.buildRequestUrl("handshake", extraParams...)
+	response, err := session.doRequest("GET", url, "", nil, 0)
+	if err != nil {
+		// Note: ContextError() would break the handshakeRequestError check
+		// in doHandshakeRequestWithFallback
+		return &handshakeRequestError{err: ContextError(err)}
+	}
+	defer response.Body.Close()
+
+	// The response is streamed, as a handshake response may carry a large
+	// encoded server list, and the server entries are written to a
+	// datastore staging area in bounded batches as they're decoded; see
+	// decodeHandshakeConfig.
+	//
+	// The staged server entries are only stored once the entire response
+	// has been parsed and the echoed IDs and server identity fields, which
+	// may follow the server list in the response, have been checked: a
+	// rejected or truncated handshake stores no server entries. The staged
+	// server entries are then stored as a single list, so that the list is
+	// ordered, and the available egress regions are reported, once, as
+	// when the response was read in its entirety.
+	// Asynchronous stores are also staged, so that the handshake is delayed
+	// only by the staging writes.
+	reader := bufio.NewReader(response.Body)
+	found, err := findConfigLine(reader)
+	if err != nil {
+		return ContextError(err)
+	}
+	if !found {
 		return ContextError(errors.New("no config line found"))
 	}
 
@@ -200,40 +720,83 @@ func (session *Session) doHandshakeRequest() error {
 		UpgradeClientVersion string              `json:"upgrade_client_version"`
 		PageViewRegexes      []map[string]string `json:"page_view_regexes"`
 		HttpsRequestRegexes  []map[string]string `json:"https_request_regexes"`
-		EncodedServerList    []string            `json:"encoded_server_list"`
 		ClientRegion         string              `json:"client_region"`
+		ClientAddress        string              `json:"client_address"`
+		PropagationChannelId string              `json:"propagation_channel_id"`
+		SponsorId            string              `json:"sponsor_id"`
+		IdentityNonce        string              `json:"identity_nonce"`
+		ServerAddress        string              `json:"server_address"`
 	}
-	err = json.Unmarshal(configLine, &handshakeConfig)
+	stagingId, err := makeServerEntryStagingId()
 	if err != nil {
 		return ContextError(err)
 	}
+	// Unless the staging area is handed off to an asynchronous store,
+	// it's discarded when the handshake returns.
+	defer func() {
+		if stagingId != "" {
+			discardStagedServerEntries(stagingId)
+		}
+	}()
 
-	session.clientRegion = handshakeConfig.ClientRegion
-	NoticeClientRegion(session.clientRegion)
-
-	var decodedServerEntries []*ServerEntry
+	maxServerEntries := session.config.MaxHandshakeServerEntries
+	serverEntryCount, err := decodeHandshakeConfig(
+		reader, &handshakeConfig, maxServerEntries,
+		func(serverEntries []*ServerEntry) error {
+			return StageServerEntries(stagingId, serverEntries)
+		})
+	if err != nil {
+		return ContextError(err)
+	}
 
-	// Store discovered server entries
-	for _, encodedServerEntry := range handshakeConfig.EncodedServerList {
-		serverEntry, err := DecodeServerEntry(encodedServerEntry)
+	if session.config.ValidateHandshakeEchoedIds {
+		err = validateHandshakeEchoedId(
+			"propagation channel ID",
+			handshakeConfig.PropagationChannelId,
+			session.config.PropagationChannelId)
 		if err != nil {
 			return ContextError(err)
 		}
-		err = ValidateServerEntry(serverEntry)
+		err = validateHandshakeEchoedId(
+			"sponsor ID", handshakeConfig.SponsorId, session.config.SponsorId)
 		if err != nil {
-			// Skip this entry and continue with the next one
-			continue
+			return ContextError(err)
 		}
+	}
 
-		decodedServerEntries = append(decodedServerEntries, serverEntry)
+	if session.config.VerifyHandshakeServerIdentity {
+		err = validateHandshakeServerIdentity(
+			identityNonce, session.serverIpAddress,
+			handshakeConfig.IdentityNonce, handshakeConfig.ServerAddress)
+		if err != nil {
+			return ContextError(err)
+		}
 	}
 
-	// The reason we are storing the entire array of server entries at once rather
-	// than one at a time is that some desirable side-effects get triggered by
-	// StoreServerEntries that don't get triggered by StoreServerEntry.
-	err = StoreServerEntries(decodedServerEntries, true)
-	if err != nil {
-		return ContextError(err)
+	session.clientRegion = handshakeConfig.ClientRegion
+	NoticeClientRegion(session.clientRegion)
+
+	// Older servers don't echo the client IP address.
+	session.clientPublicIP = nil
+	if handshakeConfig.ClientAddress != "" {
+		session.clientPublicIP = net.ParseIP(handshakeConfig.ClientAddress)
+		if session.clientPublicIP == nil {
+			NoticeAlert("invalid handshake client address: '%s'", handshakeConfig.ClientAddress)
+		}
+	}
+
+	if maxServerEntries > 0 && serverEntryCount > maxServerEntries {
+		NoticeAlert("truncated handshake server entries from %d to %d",
+			serverEntryCount, maxServerEntries)
+	}
+	if session.config.StoreHandshakeServerEntriesAsynchronously {
+		session.storeStagedServerEntriesAsync(stagingId)
+		stagingId = ""
+	} else {
+		_, err = session.storeStagedServerEntries(stagingId)
+		if err != nil {
+			return ContextError(err)
+		}
 	}
 
 	// TODO: formally communicate the sponsor and upgrade info to an
@@ -259,57 +822,663 @@ func (session *Session) doHandshakeRequest() error {
 	return nil
 }
 
+// validateHandshakeEchoedId checks that an ID echoed in the handshake
+// response matches the value sent by the client. An ID which isn't echoed
+// is not checked.
+func validateHandshakeEchoedId(name, echoedValue, expectedValue string) error {
+	if echoedValue == "" || echoedValue == expectedValue {
+		return nil
+	}
+	NoticeAlert("handshake %s mismatch: got '%s', expected '%s'",
+		name, echoedValue, expectedValue)
+	return fmt.Errorf("unexpected handshake %s: '%s'", name, echoedValue)
+}
+
+// validateHandshakeServerIdentity checks that the handshake response was
+// produced by the tunnel's server in response to this handshake request:
+// the server must echo the nonce sent by the client, and the IP address it
+// reports must match the tunnel's server entry.
+func validateHandshakeServerIdentity(
+	identityNonce, serverIpAddress, echoedNonce, echoedServerAddress string) error {
+
+	if echoedNonce != identityNonce {
+		NoticeAlert("handshake identity nonce mismatch for %s",
+			redactServerAddress(serverIpAddress))
+		return errors.New("unexpected handshake identity nonce")
+	}
+	if echoedServerAddress != serverIpAddress {
+		NoticeAlert("handshake server address mismatch: got '%s', expected '%s'",
+			redactServerAddress(echoedServerAddress), redactServerAddress(serverIpAddress))
+		return errors.New("unexpected handshake server address")
+	}
+	return nil
+}
+
+// getConfigLine returns the JSON config line from a handshake or status
+// response, skipping legacy format lines. A blank value is returned when
+// there is no config line.
+func getConfigLine(responseBody []byte) []byte {
+	configLinePrefix := []byte("Config: ")
+	for _, line := range bytes.Split(responseBody, []byte("\n")) {
+		if bytes.HasPrefix(line, configLinePrefix) {
+			return line[len(configLinePrefix):]
+		}
+	}
+	return nil
+}
+
+// findConfigLine advances the reader to the start of the JSON config in a
+// handshake or status response, skipping legacy format lines. Lines are not
+// buffered in their entirety. false is returned when there is no config
+// line.
+func findConfigLine(reader *bufio.Reader) (bool, error) {
+	configLinePrefix := []byte("Config: ")
+	for {
+		prefix, err := reader.Peek(len(configLinePrefix))
+		if err != nil && err != io.EOF {
+			return false, ContextError(err)
+		}
+		if bytes.Equal(prefix, configLinePrefix) {
+			_, err = reader.Discard(len(configLinePrefix))
+			if err != nil {
+				return false, ContextError(err)
+			}
+			return true, nil
+		}
+		for {
+			_, err = reader.ReadSlice('\n')
+			if err != bufio.ErrBufferFull {
+				break
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, ContextError(err)
+		}
+	}
+}
+
+// decodeHandshakeConfig decodes the JSON handshake config from the reader
+// into handshakeConfig. The encoded_server_list value is decoded
+// incrementally: each server entry is decoded and validated as it's read,
+// and invalid server entries are skipped. The valid server entries are
+// passed to storeServerEntries in batches of at most
+// PSIPHON_API_HANDSHAKE_SERVER_ENTRY_BATCH_SIZE, so decodeHandshakeConfig
+// holds at most one batch of the encoded server list and decoded server
+// entries at a time. When maxServerEntries is set, only the first maxServerEntries
+// valid server entries are stored. serverEntryCount is the total number of
+// valid server entries.
+func decodeHandshakeConfig(
+	reader io.Reader,
+	handshakeConfig interface{},
+	maxServerEntries int,
+	storeServerEntries func([]*ServerEntry) error) (serverEntryCount int, err error) {
+
+	decoder := json.NewDecoder(reader)
+	err = expectJSONDelim(decoder, '{')
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	fields := make(map[string]json.RawMessage)
+	var batch []*ServerEntry
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, ContextError(err)
+		}
+		key, ok := token.(string)
+		if !ok {
+			return 0, ContextError(fmt.Errorf("unexpected JSON token: %v", token))
+		}
+
+		if key != "encoded_server_list" {
+			var value json.RawMessage
+			err = decoder.Decode(&value)
+			if err != nil {
+				return 0, ContextError(err)
+			}
+			fields[key] = value
+			continue
+		}
+
+		token, err = decoder.Token()
+		if err != nil {
+			return 0, ContextError(err)
+		}
+		if token == nil {
+			continue
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return 0, ContextError(fmt.Errorf("unexpected JSON token: %v", token))
+		}
+		for decoder.More() {
+			var encodedServerEntry string
+			err = decoder.Decode(&encodedServerEntry)
+			if err != nil {
+				return 0, ContextError(err)
+			}
+			serverEntry, err := DecodeServerEntry(encodedServerEntry)
+			if err != nil {
+				return 0, ContextError(err)
+			}
+			err = ValidateServerEntry(serverEntry)
+			if err != nil {
+				// Skip this entry and continue with the next one
+				continue
+			}
+			serverEntryCount += 1
+			if maxServerEntries > 0 && serverEntryCount > maxServerEntries {
+				continue
+			}
+			batch = append(batch, serverEntry)
+			if len(batch) >= PSIPHON_API_HANDSHAKE_SERVER_ENTRY_BATCH_SIZE {
+				err = storeServerEntries(batch)
+				if err != nil {
+					return 0, ContextError(err)
+				}
+				batch = nil
+			}
+		}
+		if len(batch) > 0 {
+			err = storeServerEntries(batch)
+			if err != nil {
+				return 0, ContextError(err)
+			}
+			batch = nil
+		}
+		err = expectJSONDelim(decoder, ']')
+		if err != nil {
+			return 0, ContextError(err)
+		}
+	}
+
+	err = expectJSONDelim(decoder, '}')
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	// The remaining fields are small, so they're decoded as a whole.
+	encodedFields, err := json.Marshal(fields)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	err = json.Unmarshal(encodedFields, handshakeConfig)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	return serverEntryCount, nil
+}
+
+// expectJSONDelim reads the next JSON token and checks that it's the
+// specified delimiter.
+func expectJSONDelim(decoder *json.Decoder, expectedDelim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return ContextError(err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != expectedDelim {
+		return ContextError(fmt.Errorf("unexpected JSON token: %v", token))
+	}
+	return nil
+}
+
+// storeEncodedServerList decodes and stores server entries discovered via
+// the handshake or status response. Invalid server entries are skipped. The
+// number of stored server entries is returned.
+func (session *Session) storeEncodedServerList(encodedServerList []string) (int, error) {
+	serverEntries, err := decodeEncodedServerList(encodedServerList)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	err = session.storeServerEntries(serverEntries)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return len(serverEntries), nil
+}
+
+// decodeEncodedServerList decodes server entries discovered via the
+// handshake or status response. Invalid server entries are skipped.
+func decodeEncodedServerList(encodedServerList []string) ([]*ServerEntry, error) {
+	var decodedServerEntries []*ServerEntry
+	for _, encodedServerEntry := range encodedServerList {
+		serverEntry, err := DecodeServerEntry(encodedServerEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		err = ValidateServerEntry(serverEntry)
+		if err != nil {
+			// Skip this entry and continue with the next one
+			continue
+		}
+
+		decodedServerEntries = append(decodedServerEntries, serverEntry)
+	}
+	return decodedServerEntries, nil
+}
+
+// storeServerEntries stores server entries discovered via the handshake or
+// status response.
+func (session *Session) storeServerEntries(serverEntries []*ServerEntry) error {
+
+	// Stores for the session are serialized, including asynchronous stores.
+	session.serverEntryStoreMutex.Lock()
+	defer session.serverEntryStoreMutex.Unlock()
+
+	// The reason we are storing the entire array of server entries at once rather
+	// than one at a time is that some desirable side-effects get triggered by
+	// StoreServerEntries that don't get triggered by StoreServerEntry.
+	var err error
+	if session.config.ImportServerEntriesByPriority {
+		err = StoreServerEntriesByPriority(serverEntries, true)
+	} else {
+		err = StoreServerEntries(serverEntries, true)
+	}
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// makeServerEntryStagingId makes a random ID for a handshake's server entry
+// staging area, so that concurrent handshakes stage to distinct areas.
+func makeServerEntryStagingId() (string, error) {
+	randomId, err := MakeSecureRandomBytes(8)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return hex.EncodeToString(randomId), nil
+}
+
+// storeStagedServerEntries stores the server entries staged by a
+// handshake. The staged server entries are read back and stored in batches,
+// with the same ordering options, such as
+// config.ImportServerEntriesByPriority, as storeServerEntries applies to an
+// entire list, and the available egress regions are reported once. Only a
+// key for each staged server entry is held in memory. The number of stored
+// server entries is returned.
+func (session *Session) storeStagedServerEntries(stagingId string) (int, error) {
+
+	// Stores for the session are serialized, including asynchronous stores.
+	session.serverEntryStoreMutex.Lock()
+	defer session.serverEntryStoreMutex.Unlock()
+
+	count, err := StoreStagedServerEntries(
+		stagingId,
+		PSIPHON_API_HANDSHAKE_SERVER_ENTRY_BATCH_SIZE,
+		true,
+		session.config.ImportServerEntriesByPriority)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return count, nil
+}
+
+// storeStagedServerEntriesAsync stores the server entries staged by a
+// handshake in a goroutine, so that storing a large server list doesn't
+// delay tunnel readiness, and then discards the staging area. Completion
+// is reported with a notice. Each server entry is stored in its own
+// datastore transaction, so a concurrent ServerEntryIterator may see some
+// but not all of the server entries.
+func (session *Session) storeStagedServerEntriesAsync(stagingId string) {
+	session.serverEntryStoreWaitGroup.Add(1)
+	go func() {
+		defer session.serverEntryStoreWaitGroup.Done()
+		defer discardStagedServerEntries(stagingId)
+		count, err := session.storeStagedServerEntries(stagingId)
+		if err != nil {
+			NoticeAlert("failed to store handshake server entries: %s", ContextError(err))
+			return
+		}
+		NoticeHandshakeServerEntriesStored(count)
+	}()
+}
+
+// discardStagedServerEntries discards a handshake's server entry staging
+// area. A failure is logged and otherwise ignored, as any remaining staged
+// server entries are discarded when the datastore is next opened.
+func discardStagedServerEntries(stagingId string) {
+	err := DeleteStagedServerEntries(stagingId)
+	if err != nil {
+		NoticeAlert("failed to discard staged server entries: %s", ContextError(err))
+	}
+}
+
+// makeKnownServerParams makes the known_server handshake parameters for the
+// specified server IP addresses. When addPadding is set, a random number of
+// decoy addresses are also included. The decoy addresses are selected from the
+// reserved 240.0.0.0/4 range, so they never match a real server and are
+// ignored by the server when it compiles discovery statistics.
+func makeKnownServerParams(ipAddresses []string, addPadding bool) ([]*ExtraParam, error) {
+	extraParams := make([]*ExtraParam, 0)
+	for _, ipAddress := range ipAddresses {
+		extraParams = append(extraParams, &ExtraParam{"known_server", ipAddress})
+	}
+	if !addPadding {
+		return extraParams, nil
+	}
+	paddingCount, err := MakeSecureRandomInt(PSIPHON_API_KNOWN_SERVER_PADDING_MAX_COUNT)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	for i := 0; i <= paddingCount; i++ {
+		address, err := MakeSecureRandomBytes(4)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		address[0] |= 0xf0
+		extraParams = append(
+			extraParams, &ExtraParam{"known_server", net.IP(address).String()})
+	}
+	return extraParams, nil
+}
+
 // doGetRequest makes a tunneled HTTPS request and returns the response body.
 func (session *Session) doGetRequest(requestUrl string) (responseBody []byte, err error) {
-	response, err := session.psiphonHttpsClient.Get(requestUrl)
-	if err == nil && response.StatusCode != http.StatusOK {
-		response.Body.Close()
-		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
-	}
+	return session.doGetRequestWithTimeout(requestUrl, 0)
+}
+
+// doGetRequestWithTimeout is doGetRequest with a timeout which overrides the
+// default Psiphon API request timeout. When timeout is 0, the default is used.
+func (session *Session) doGetRequestWithTimeout(
+	requestUrl string, timeout time.Duration) (responseBody []byte, err error) {
+
+	response, err := session.doRequest("GET", requestUrl, "", nil, timeout)
 	if err != nil {
-		// Trim this error since it may include long URLs
-		return nil, ContextError(TrimError(err))
+		return nil, ContextError(err)
 	}
 	defer response.Body.Close()
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return nil, ContextError(err)
 	}
-	if response.StatusCode != http.StatusOK {
-		return nil, ContextError(fmt.Errorf("HTTP GET request failed with response code: %d", response.StatusCode))
-	}
 	return body, nil
 }
 
-// doPostRequest makes a tunneled HTTPS POST request.
-func (session *Session) doPostRequest(requestUrl string, bodyType string, body io.Reader) (err error) {
-	response, err := session.psiphonHttpsClient.Post(requestUrl, bodyType, body)
-	if err == nil && response.StatusCode != http.StatusOK {
-		response.Body.Close()
-		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+// doPostRequest makes a tunneled HTTPS POST request and returns the response body.
+func (session *Session) doPostRequest(
+	requestUrl string, bodyType string, body []byte) (responseBody []byte, err error) {
+	return session.doPostRequestWithTimeout(requestUrl, bodyType, body, 0)
+}
+
+// doPostRequestWithTimeout is doPostRequest with a timeout which overrides the
+// default Psiphon API request timeout. When timeout is 0, the default is used.
+func (session *Session) doPostRequestWithTimeout(
+	requestUrl string, bodyType string, body []byte, timeout time.Duration) (responseBody []byte, err error) {
+
+	response, err := session.doRequest("POST", requestUrl, bodyType, body, timeout)
+	if err != nil {
+		return nil, ContextError(err)
 	}
+	defer response.Body.Close()
+	responseBody, err = ioutil.ReadAll(response.Body)
 	if err != nil {
-		// Trim this error since it may include long URLs
-		return ContextError(TrimError(err))
+		return nil, ContextError(err)
+	}
+	return responseBody, nil
+}
+
+// PSIPHON_API_REQUEST_SIGNATURE_HEADER is the header which carries the
+// request signature; see signApiRequest.
+const PSIPHON_API_REQUEST_SIGNATURE_HEADER = "X-Psiphon-Signature"
+
+// doRequest makes a tunneled HTTPS request and returns the response, which
+// is only returned when the response status is 200 OK. When the server
+// responds with 429 Too Many Requests and config.RetryApiRequestsAfterTooManyRequests
+// is set, the request is retried after waiting for the Retry-After period.
+// When the server entry specifies a request signing key, the request is
+// signed.
+// Each request attempt has a deadline of timeout or, when timeout is 0, the
+// default Psiphon API request timeout; see getApiRequestTimeout. The deadline
+// applies until the response body is closed. When
+// config.PsiphonApiServerTimeoutJitterPercent is set, each attempt's timeout
+// is jittered; see jitterTimeout.
+func (session *Session) doRequest(
+	method, requestUrl, bodyType string, body []byte, timeout time.Duration) (response *http.Response, err error) {
+
+	psiphonHttpsClient, err := session.getPsiphonHttpsClient()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if timeout == 0 {
+		timeout = session.getApiRequestTimeout()
+	}
+
+	for retries := 0; ; retries++ {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		request, err := http.NewRequest(method, requestUrl, bodyReader)
+		if err != nil {
+			// Trim this error since it may include long URLs
+			return nil, ContextError(TrimError(err))
+		}
+		if bodyType != "" {
+			request.Header.Set("Content-Type", bodyType)
+		}
+		request.Header.Set("Accept-Encoding", "gzip")
+		if session.requestSigningKey != nil {
+			request.Header.Set(
+				PSIPHON_API_REQUEST_SIGNATURE_HEADER,
+				signApiRequest(session.requestSigningKey, method, request.URL.RequestURI(), body))
+		}
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			jitterTimeout(timeout, session.config.PsiphonApiServerTimeoutJitterPercent))
+		response, err = psiphonHttpsClient.Do(request.WithContext(ctx))
+		if err == nil {
+			response.Body = &cancelOnCloseBody{ReadCloser: response.Body, cancel: cancel}
+		} else {
+			cancel()
+		}
+
+		if err == nil &&
+			response.StatusCode == http.StatusTooManyRequests &&
+			session.config.RetryApiRequestsAfterTooManyRequests &&
+			retries < PSIPHON_API_TOO_MANY_REQUESTS_MAX_RETRIES {
+
+			retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After"))
+			if ok {
+				closeResponseBody(response.Body)
+				NoticeInfo("retrying %s request after %s", method, retryAfter)
+				time.Sleep(retryAfter)
+				continue
+			}
+		}
+
+		if err == nil && response.StatusCode != http.StatusOK {
+			closeResponseBody(response.Body)
+			err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+		}
+		if err == nil {
+			err = decompressResponse(response)
+		}
+		if err != nil {
+			// Trim this error since it may include long URLs
+			return nil, ContextError(TrimError(err))
+		}
+		response.Body = newLimitedResponseBody(
+			response.Body, session.getMaxApiResponseBodyBytes())
+		return response, nil
 	}
-	response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		return ContextError(fmt.Errorf("HTTP POST request failed with response code: %d", response.StatusCode))
+}
+
+// getApiRequestTimeout returns the default Psiphon API request timeout,
+// config.PsiphonApiServerTimeoutSeconds or, when not set,
+// PSIPHON_API_SERVER_TIMEOUT.
+func (session *Session) getApiRequestTimeout() time.Duration {
+	if session.config.PsiphonApiServerTimeoutSeconds > 0 {
+		return time.Duration(session.config.PsiphonApiServerTimeoutSeconds) * time.Second
 	}
-	return
+	return PSIPHON_API_SERVER_TIMEOUT
+}
+
+// jitterTimeout returns a timeout selected uniformly at random, using
+// math/rand, from the range timeout +/- jitterPercent percent, so that
+// concurrent requests don't all time out at the same moment. When
+// jitterPercent is 0, timeout is returned unchanged. jitterPercent is
+// capped at 100.
+func jitterTimeout(timeout time.Duration, jitterPercent int) time.Duration {
+	if jitterPercent <= 0 {
+		return timeout
+	}
+	if jitterPercent > 100 {
+		jitterPercent = 100
+	}
+	jitter := int64(timeout) * int64(jitterPercent) / 100
+	if jitter <= 0 {
+		return timeout
+	}
+	return timeout - time.Duration(jitter) + time.Duration(rand.Int63n(2*jitter+1))
+}
+
+// cancelOnCloseBody is a response body which cancels the request context
+// when closed, so that the request deadline covers reading the body.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// signApiRequest returns the hex encoded HMAC-SHA256, using the specified
+// key, of the request method, the request URI (path and query, which
+// includes the server secret), and the request body. The host is excluded
+// so that the signature is unaffected by domain fronting.
+func signApiRequest(key []byte, method, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(requestURI))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// gzipResponseBody is a response body which is decompressed as it's read.
+// Closing it closes the underlying response body.
+type gzipResponseBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (responseBody *gzipResponseBody) Close() error {
+	responseBody.Reader.Close()
+	return closeResponseBody(responseBody.body)
+}
+
+// closeResponseBody discards any unread remainder of the response body,
+// up to PSIPHON_API_MAX_DISCARDED_RESPONSE_BYTES, and closes it. The
+// transport only reuses a keep-alive connection when the response body
+// is read to the end before it's closed. For example, a gzip reader stops
+// at the end of the compressed stream, before the final chunk terminator.
+func closeResponseBody(body io.ReadCloser) error {
+	io.Copy(ioutil.Discard, io.LimitReader(body, PSIPHON_API_MAX_DISCARDED_RESPONSE_BYTES))
+	return body.Close()
+}
+
+// decompressResponse replaces a gzip-encoded response body with a reader
+// which decompresses it. The transport only decompresses responses
+// automatically when it adds the Accept-Encoding header itself; requests
+// which set Accept-Encoding explicitly must use decompressResponse. On
+// failure, the response body is closed.
+func decompressResponse(response *http.Response) error {
+	if response.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+	gzipReader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		response.Body.Close()
+		return ContextError(err)
+	}
+	response.Body = &gzipResponseBody{Reader: gzipReader, body: response.Body}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After header value, which may be either
+// a number of seconds or an HTTP date. The result is false when the value
+// is missing or invalid, or when the period exceeds PSIPHON_API_RETRY_AFTER_MAX_PERIOD.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		retryAfter = date.Sub(time.Now())
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+	} else {
+		return 0, false
+	}
+	if retryAfter < 0 || retryAfter > PSIPHON_API_RETRY_AFTER_MAX_PERIOD {
+		return 0, false
+	}
+	return retryAfter, true
+}
+
+// getMaxApiResponseBodyBytes returns the maximum Psiphon API response body
+// size, config.MaxApiResponseBodyBytes or, when not set,
+// PSIPHON_API_MAX_RESPONSE_BODY_BYTES.
+func (session *Session) getMaxApiResponseBodyBytes() int64 {
+	if session.config.MaxApiResponseBodyBytes > 0 {
+		return int64(session.config.MaxApiResponseBodyBytes)
+	}
+	return PSIPHON_API_MAX_RESPONSE_BODY_BYTES
+}
+
+// limitedResponseBody is a response body which fails with an error once
+// more than the maximum number of bytes is read, so that a malicious or
+// compromised server can't exhaust client memory with an enormous response.
+type limitedResponseBody struct {
+	io.ReadCloser
+	reader *io.LimitedReader
+}
+
+func newLimitedResponseBody(body io.ReadCloser, maxBytes int64) *limitedResponseBody {
+	return &limitedResponseBody{
+		ReadCloser: body,
+		reader:     &io.LimitedReader{R: body, N: maxBytes + 1},
+	}
+}
+
+func (body *limitedResponseBody) Read(p []byte) (int, error) {
+	n, err := body.reader.Read(p)
+	if body.reader.N <= 0 {
+		// Don't return the byte beyond the maximum.
+		if n > 0 {
+			n -= 1
+		}
+		return n, errors.New("response body exceeds maximum size")
+	}
+	return n, err
 }
 
 // makeBaseRequestUrl makes a URL containing all the common parameters
 // that are included with Psiphon API requests. These common parameters
-// are used for statistics.
-func makeBaseRequestUrl(config *Config, tunnel *Tunnel, sessionId string) string {
+// are used for statistics. The URL addresses the specified web server port.
+func makeBaseRequestUrl(config *Config, tunnel *Tunnel, sessionId, webServerPort string) string {
 	var requestUrl bytes.Buffer
 	// Note: don't prefix with HTTPS scheme, see comment in doGetRequest.
 	// e.g., don't do this: requestUrl.WriteString("https://")
 	requestUrl.WriteString("http://")
 	requestUrl.WriteString(tunnel.serverEntry.IpAddress)
 	requestUrl.WriteString(":")
-	requestUrl.WriteString(tunnel.serverEntry.WebServerPort)
+	requestUrl.WriteString(webServerPort)
 	requestUrl.WriteString("/")
 	// Placeholder for the path component of a request
 	requestUrl.WriteString("%s")
@@ -349,32 +1518,118 @@ func (session *Session) buildRequestUrl(path string, extraParams ...*ExtraParam)
 	return requestUrl.String()
 }
 
-// makeHttpsClient creates a Psiphon HTTPS client that tunnels requests and which validates
-// the web server using the Psiphon server entry web server certificate.
+// makeTunneledHttpClient creates a general purpose HTTP client which makes
+// requests through the tunnel. HTTPS URLs use the standard TLS certificate
+// verification.
+func makeTunneledHttpClient(tunnel *Tunnel) *http.Client {
+	tunneledDialer := func(_, addr string) (conn net.Conn, err error) {
+		return tunnel.sshClient.Dial("tcp", addr)
+	}
+	transport := &http.Transport{
+		Dial:                  tunneledDialer,
+		ResponseHeaderTimeout: FETCH_REMOTE_SERVER_LIST_TIMEOUT,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   FETCH_REMOTE_SERVER_LIST_TIMEOUT,
+	}
+}
+
+// InvalidWebServerCertificateError is returned by NewSession when the
+// server entry web server certificate can't be decoded. The Psiphon API
+// can't be used with the server, but the tunnel itself is not affected.
+type InvalidWebServerCertificateError struct {
+	err error
+}
+
+func (e *InvalidWebServerCertificateError) Error() string {
+	return fmt.Sprintf("invalid web server certificate: %s", e.err)
+}
+
+const DATA_STORE_INVALID_WEB_SERVER_CERTIFICATE_KEY_PREFIX = "invalidWebServerCertificate."
+
+// MarkWebServerCertificateInvalid records, in the datastore, that the
+// server entry web server certificate is invalid. The record applies only
+// to the current certificate, so it's superseded when the server entry is
+// updated with a different certificate. The record is an internal
+// key-value, so it's not mixed with app key-values or datastore stats.
+func MarkWebServerCertificateInvalid(serverEntry *ServerEntry) error {
+	err := setInternalKeyValue(
+		DATA_STORE_INVALID_WEB_SERVER_CERTIFICATE_KEY_PREFIX+serverEntry.IpAddress,
+		serverEntry.WebServerCertificate)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// IsWebServerCertificateMarkedInvalid returns true when the server entry
+// web server certificate was recorded as invalid by
+// MarkWebServerCertificateInvalid.
+func IsWebServerCertificateMarkedInvalid(serverEntry *ServerEntry) (bool, error) {
+	value, err := getInternalKeyValue(
+		DATA_STORE_INVALID_WEB_SERVER_CERTIFICATE_KEY_PREFIX + serverEntry.IpAddress)
+	if err != nil {
+		return false, ContextError(err)
+	}
+	return value != "" && value == serverEntry.WebServerCertificate, nil
+}
+
+// makePsiphonHttpsClient creates a Psiphon HTTPS client that tunnels
+// requests and which validates the web server using the Psiphon server
+// entry web server certificate or, when
+// config.AcceptableWebServerCertificateIssuers is set, using CA verification.
+// When the server entry certificate can't be decoded, an
+// InvalidWebServerCertificateError is returned.
 // This is not a general purpose HTTPS client.
 // As the custom dialer makes an explicit TLS connection, URLs submitted to the returned
 // http.Client should use the "http://" scheme. Otherwise http.Transport will try to do another TLS
 // handshake inside the explicit TLS session.
-func makePsiphonHttpsClient(tunnel *Tunnel) (httpsClient *http.Client, err error) {
-	certificate, err := DecodeCertificate(tunnel.serverEntry.WebServerCertificate)
-	if err != nil {
-		return nil, ContextError(err)
+func makePsiphonHttpsClient(config *Config, tunnel *Tunnel) (httpsClient *http.Client, err error) {
+	var certificate *x509.Certificate
+	if len(config.AcceptableWebServerCertificateIssuers) == 0 {
+		certificate, err = DecodeCertificate(tunnel.serverEntry.WebServerCertificate)
+		if err != nil {
+			// Note: ContextError() would break the error type check in EstablishTunnel()
+			return nil, &InvalidWebServerCertificateError{err: ContextError(err)}
+		}
 	}
 	tunneledDialer := func(_, addr string) (conn net.Conn, err error) {
 		return tunnel.sshClient.Dial("tcp", addr)
 	}
-	dialer := NewCustomTLSDialer(
-		&CustomTLSConfig{
-			Dial:                    tunneledDialer,
-			Timeout:                 PSIPHON_API_SERVER_TIMEOUT,
-			VerifyLegacyCertificate: certificate,
-		})
+	return makePsiphonHttpsClientWithDialer(config, certificate, tunneledDialer), nil
+}
+
+// makePsiphonHttpsClientWithDialer creates a Psiphon HTTPS client which
+// makes TLS connections, validated using the specified web server
+// certificate, over network connections made by dialer. When
+// config.AcceptableWebServerCertificateIssuers is set, connections are
+// instead validated using CA verification, and certificate may be nil.
+// Connections are kept alive and reused for subsequent requests, so that
+// each request doesn't open a new tunneled port forward; see
+// closeResponseBody.
+func makePsiphonHttpsClientWithDialer(
+	config *Config, certificate *x509.Certificate, dialer Dialer) *http.Client {
+
+	tlsConfig := &CustomTLSConfig{
+		Dial:    dialer,
+		Timeout: PSIPHON_API_SERVER_TIMEOUT,
+	}
+	if len(config.AcceptableWebServerCertificateIssuers) > 0 {
+		tlsConfig.VerifyIssuerFingerprints = config.AcceptableWebServerCertificateIssuers
+		tlsConfig.TrustedCACertificatesFilename = config.TrustedCACertificatesFilename
+	} else {
+		tlsConfig.VerifyLegacyCertificate = certificate
+	}
+	tlsDialer := NewCustomTLSDialer(tlsConfig)
+	// Note: there's no client-wide request timeout; doRequest sets a
+	// deadline for each request, which may be overridden per request.
 	transport := &http.Transport{
-		Dial: dialer,
-		ResponseHeaderTimeout: PSIPHON_API_SERVER_TIMEOUT,
+		Dial:            tlsDialer,
+		IdleConnTimeout: time.Duration(config.PsiphonApiIdleConnTimeoutSeconds) * time.Second,
+		MaxIdleConns:    config.PsiphonApiMaxIdleConns,
 	}
 	return &http.Client{
 		Transport: transport,
-		Timeout:   PSIPHON_API_SERVER_TIMEOUT,
-	}, nil
+	}
 }
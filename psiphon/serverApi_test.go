@@ -0,0 +1,1632 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestSession makes a Session which sends untunneled requests to
+// the specified test server. No handshake is performed.
+func newTestSession(config *Config, serverUrl string) *Session {
+	return &Session{
+		mutex:              new(sync.Mutex),
+		config:             config,
+		sessionId:          "test",
+		baseRequestUrl:     serverUrl + "/%s?client_session_id=test",
+		psiphonHttpsClient: &http.Client{Transport: &http.Transport{}},
+		tunneledHttpClient: &http.Client{Transport: &http.Transport{}},
+	}
+}
+
+func TestMakeKnownServerParams(t *testing.T) {
+
+	ipAddresses := []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}
+
+	extraParams, err := makeKnownServerParams(ipAddresses, false)
+	if err != nil {
+		t.Fatalf("makeKnownServerParams failed: %s", err)
+	}
+	if len(extraParams) != len(ipAddresses) {
+		t.Errorf("unexpected known server count without padding: %d", len(extraParams))
+	}
+
+	_, reservedNetwork, _ := net.ParseCIDR("240.0.0.0/4")
+
+	extraParams, err = makeKnownServerParams(ipAddresses, true)
+	if err != nil {
+		t.Fatalf("makeKnownServerParams failed: %s", err)
+	}
+	if len(extraParams) <= len(ipAddresses) ||
+		len(extraParams) > len(ipAddresses)+PSIPHON_API_KNOWN_SERVER_PADDING_MAX_COUNT {
+		t.Errorf("unexpected known server count with padding: %d", len(extraParams))
+	}
+	for index, extraParam := range extraParams {
+		if extraParam.name != "known_server" {
+			t.Errorf("unexpected param name: %s", extraParam.name)
+		}
+		if index < len(ipAddresses) {
+			if extraParam.value != ipAddresses[index] {
+				t.Errorf("unexpected known server: %s", extraParam.value)
+			}
+			continue
+		}
+		if !reservedNetwork.Contains(net.ParseIP(extraParam.value)) {
+			t.Errorf("unexpected padding known server: %s", extraParam.value)
+		}
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprint(responseWriter, "{}")
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	_, err := session.doGetRequest(session.buildRequestUrl("test"))
+	if err != nil {
+		t.Fatalf("request before Close failed: %s", err)
+	}
+
+	session.Close()
+	session.Close()
+
+	_, err = session.doGetRequest(session.buildRequestUrl("test"))
+	if err == nil {
+		t.Errorf("GET request after Close unexpectedly succeeded")
+	}
+	_, err = session.doPostRequest(session.buildRequestUrl("test"), "application/json", nil)
+	if err == nil {
+		t.Errorf("POST request after Close unexpectedly succeeded")
+	}
+}
+
+func TestTooManyRequestsRetry(t *testing.T) {
+
+	var mutex sync.Mutex
+	requestCount := 0
+	getRequestCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requestCount
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			mutex.Lock()
+			requestCount += 1
+			isFirstRequest := (requestCount == 1)
+			mutex.Unlock()
+			if isFirstRequest {
+				responseWriter.Header().Set("Retry-After", "1")
+				responseWriter.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprint(responseWriter, "{}")
+		}))
+	defer server.Close()
+
+	session := newTestSession(
+		&Config{RetryApiRequestsAfterTooManyRequests: true}, server.URL)
+
+	startTime := time.Now()
+	_, err := session.doGetRequest(session.buildRequestUrl("test"))
+	if err != nil {
+		t.Fatalf("request with retry failed: %s", err)
+	}
+	if time.Now().Sub(startTime) < 1*time.Second {
+		t.Errorf("request retried before Retry-After period")
+	}
+	if getRequestCount() != 2 {
+		t.Errorf("unexpected request count: %d", getRequestCount())
+	}
+
+	mutex.Lock()
+	requestCount = 0
+	mutex.Unlock()
+	session = newTestSession(&Config{}, server.URL)
+
+	_, err = session.doGetRequest(session.buildRequestUrl("test"))
+	if err == nil {
+		t.Errorf("request without retry unexpectedly succeeded")
+	}
+	if getRequestCount() != 1 {
+		t.Errorf("unexpected request count: %d", getRequestCount())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	testCases := []struct {
+		value         string
+		expectedOk    bool
+		expectedDelay time.Duration
+	}{
+		{"", false, 0},
+		{"invalid", false, 0},
+		{"-1", false, 0},
+		{"0", true, 0},
+		{"5", true, 5 * time.Second},
+		{"3600", false, 0},
+	}
+
+	for _, testCase := range testCases {
+		delay, ok := parseRetryAfter(testCase.value)
+		if ok != testCase.expectedOk || delay != testCase.expectedDelay {
+			t.Errorf("unexpected result for '%s': %s %t", testCase.value, delay, ok)
+		}
+	}
+
+	date := time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+	delay, ok := parseRetryAfter(date)
+	if !ok || delay > 2*time.Second {
+		t.Errorf("unexpected result for '%s': %s %t", date, delay, ok)
+	}
+}
+
+func TestRecordRegionTransferStats(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	sessions := []*Session{
+		&Session{clientRegion: "XP"},
+		&Session{clientRegion: "XQ"},
+		&Session{clientRegion: ""},
+	}
+
+	for i := 0; i < 3; i++ {
+		for j, session := range sessions {
+			err := session.RecordRegionTransferStats(int64(100 * (j + 1)))
+			if err != nil {
+				t.Fatalf("RecordRegionTransferStats failed: %s", err)
+			}
+		}
+	}
+
+	regionTransferStats, err := GetRegionTransferStats()
+	if err != nil {
+		t.Fatalf("GetRegionTransferStats failed: %s", err)
+	}
+	if regionTransferStats["XP"] != 300 {
+		t.Errorf("unexpected XP bytes transferred: %d", regionTransferStats["XP"])
+	}
+	if regionTransferStats["XQ"] != 600 {
+		t.Errorf("unexpected XQ bytes transferred: %d", regionTransferStats["XQ"])
+	}
+	if _, ok := regionTransferStats[""]; ok {
+		t.Errorf("unexpected bytes transferred for unknown region")
+	}
+}
+
+func TestConnectedTimestamp(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	var mutex sync.Mutex
+	connectedTimestamp := ""
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			fmt.Fprintf(responseWriter, "{\"connected_timestamp\": \"%s\"}", connectedTimestamp)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	validTimestamp := "2015-06-01T12:00:00.000Z"
+	for _, timestamp := range []string{validTimestamp, "not-a-timestamp", ""} {
+		mutex.Lock()
+		connectedTimestamp = timestamp
+		mutex.Unlock()
+		err := session.DoConnectedRequest()
+		if err != nil {
+			t.Fatalf("DoConnectedRequest failed: %s", err)
+		}
+		lastConnected, err := GetKeyValue("lastConnected")
+		if err != nil {
+			t.Fatalf("GetKeyValue failed: %s", err)
+		}
+		if lastConnected != validTimestamp {
+			t.Errorf("unexpected last connected value: %s", lastConnected)
+		}
+	}
+}
+
+func TestFetchAndStoreServerList(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	const etag = `"server-list-1"`
+	serverList := makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.18.1", "XU")) + "\n" +
+		makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.18.2", "XU")) + "\n" +
+		makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.18.", "XU")) + "\n"
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			if request.Header.Get("If-None-Match") == etag {
+				responseWriter.WriteHeader(http.StatusNotModified)
+				return
+			}
+			responseWriter.Header().Set("ETag", etag)
+			fmt.Fprint(responseWriter, serverList)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+	serverListUrl := server.URL + "/server_list"
+
+	stored, skipped, err := session.FetchAndStoreServerList(serverListUrl, false)
+	if err != nil {
+		t.Fatalf("FetchAndStoreServerList failed: %s", err)
+	}
+	if stored != 2 || skipped != 1 {
+		t.Errorf("unexpected counts for new list: stored %d, skipped %d", stored, skipped)
+	}
+	for _, ipAddress := range []string{"10.0.18.1", "10.0.18.2"} {
+		serverEntry, err := GetServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if serverEntry == nil {
+			t.Errorf("server entry not stored: %s", ipAddress)
+		}
+	}
+
+	// The ETag is cached, so the unchanged list is not stored again
+	stored, skipped, err = session.FetchAndStoreServerList(serverListUrl, false)
+	if err != nil {
+		t.Fatalf("FetchAndStoreServerList failed: %s", err)
+	}
+	if stored != 0 || skipped != 0 {
+		t.Errorf("unexpected counts for unchanged list: stored %d, skipped %d", stored, skipped)
+	}
+
+	// Without the cached ETag, the existing server entries are skipped
+	err = SetUrlETag(serverListUrl, "")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+	stored, skipped, err = session.FetchAndStoreServerList(serverListUrl, false)
+	if err != nil {
+		t.Fatalf("FetchAndStoreServerList failed: %s", err)
+	}
+	if stored != 0 || skipped != 3 {
+		t.Errorf("unexpected counts for existing list: stored %d, skipped %d", stored, skipped)
+	}
+
+	// Server entries which the datastore doesn't accept aren't counted as
+	// stored
+	singleton.config.AllowedRegions = []string{"XV"}
+	defer func() {
+		singleton.config.AllowedRegions = nil
+	}()
+	stored, skipped, err = session.FetchAndStoreServerList(serverListUrl+"?replace", true)
+	if err != nil {
+		t.Fatalf("FetchAndStoreServerList failed: %s", err)
+	}
+	if stored != 0 || skipped != 3 {
+		t.Errorf("unexpected counts for list outside allowed regions: stored %d, skipped %d", stored, skipped)
+	}
+}
+
+func TestFetchAndStoreServerListMaxResponseBodyBytes(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverList := makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.67.1", "YZ")) + "\n" +
+		makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.67.2", "YZ")) + "\n"
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprint(responseWriter, serverList)
+		}))
+	defer server.Close()
+
+	serverListUrl := server.URL + "/server_list"
+
+	// The list is one byte over the limit, so the fetch fails and nothing
+	// is stored
+
+	session := newTestSession(&Config{MaxApiResponseBodyBytes: len(serverList) - 1}, server.URL)
+	_, _, err := session.FetchAndStoreServerList(serverListUrl, true)
+	if err == nil {
+		t.Errorf("unexpected success with oversized server list")
+	}
+	serverEntry, err := GetServerEntry("10.0.67.1")
+	if err != nil {
+		t.Fatalf("GetServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Errorf("unexpected server entry stored from oversized server list")
+	}
+
+	// The list is exactly at the limit, so the fetch succeeds
+
+	session = newTestSession(&Config{MaxApiResponseBodyBytes: len(serverList)}, server.URL)
+	stored, _, err := session.FetchAndStoreServerList(serverListUrl, true)
+	if err != nil {
+		t.Fatalf("FetchAndStoreServerList failed: %s", err)
+	}
+	if stored != 2 {
+		t.Errorf("unexpected stored count: %d", stored)
+	}
+}
+
+func TestDoStatusRequest(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	statusConfig, err := json.Marshal(map[string]interface{}{
+		"upgrade_client_version": "999",
+		"encoded_server_list": []string{
+			makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.23.1", "XZ")),
+			makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.23.2", "XZ")),
+			makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.23.", "XZ")),
+		},
+	})
+	if err != nil {
+		t.Fatalf("error encoding status config: %s", err)
+	}
+
+	var mutex sync.Mutex
+	statusResponseBody := fmt.Sprintf("Legacy: value\nConfig: %s\n", statusConfig)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			fmt.Fprint(responseWriter, statusResponseBody)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	statusResponse, err := session.DoStatusRequest(json.RawMessage("{}"))
+	if err != nil {
+		t.Fatalf("DoStatusRequest failed: %s", err)
+	}
+	if statusResponse.StoredServerEntryCount != 2 {
+		t.Errorf("unexpected stored server entry count: %d", statusResponse.StoredServerEntryCount)
+	}
+	if statusResponse.UpgradeClientVersion != "999" {
+		t.Errorf("unexpected upgrade client version: %s", statusResponse.UpgradeClientVersion)
+	}
+	for _, ipAddress := range []string{"10.0.23.1", "10.0.23.2"} {
+		serverEntry, err := GetServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if serverEntry == nil {
+			t.Errorf("server entry not stored: %s", ipAddress)
+		}
+	}
+
+	// An empty status response is valid
+	mutex.Lock()
+	statusResponseBody = ""
+	mutex.Unlock()
+
+	statusResponse, err = session.DoStatusRequest(json.RawMessage("{}"))
+	if err != nil {
+		t.Fatalf("DoStatusRequest failed: %s", err)
+	}
+	if statusResponse.StoredServerEntryCount != 0 || statusResponse.UpgradeClientVersion != "" {
+		t.Errorf("unexpected status response for empty body: %+v", statusResponse)
+	}
+}
+
+func TestStoreHandshakeServerEntriesAsynchronously(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	handshakeConfig, err := json.Marshal(map[string]interface{}{
+		"encoded_server_list": []string{
+			makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.24.1", "YA")),
+			makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.24.2", "YA")),
+		},
+	})
+	if err != nil {
+		t.Fatalf("error encoding handshake config: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprintf(responseWriter, "Config: %s\n", handshakeConfig)
+		}))
+	defer server.Close()
+
+	session := newTestSession(
+		&Config{StoreHandshakeServerEntriesAsynchronously: true}, server.URL)
+
+	// Holding the store mutex blocks the asynchronous store, so the handshake
+	// must return without waiting for it.
+	session.serverEntryStoreMutex.Lock()
+	err = session.doHandshakeRequest()
+	if err != nil {
+		session.serverEntryStoreMutex.Unlock()
+		t.Fatalf("doHandshakeRequest failed: %s", err)
+	}
+	serverEntry, err := GetServerEntry("10.0.24.1")
+	if err != nil {
+		t.Fatalf("GetServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Errorf("server entry stored before handshake returned")
+	}
+	session.serverEntryStoreMutex.Unlock()
+
+	// Close waits for the asynchronous store to complete.
+	session.Close()
+
+	for _, ipAddress := range []string{"10.0.24.1", "10.0.24.2"} {
+		serverEntry, err := GetServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if serverEntry == nil {
+			t.Errorf("server entry not stored: %s", ipAddress)
+		}
+	}
+}
+
+func TestMaxHandshakeServerEntries(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	var encodedServerList []string
+	for i := 1; i <= 5; i++ {
+		encodedServerList = append(encodedServerList, makeTestEncodedServerEntry(
+			t, makeTestServerEntry(fmt.Sprintf("10.0.34.%d", i), "YM")))
+	}
+	handshakeConfig, err := json.Marshal(map[string]interface{}{
+		"encoded_server_list": encodedServerList,
+	})
+	if err != nil {
+		t.Fatalf("error encoding handshake config: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprintf(responseWriter, "Config: %s\n", handshakeConfig)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{MaxHandshakeServerEntries: 3}, server.URL)
+
+	err = session.doHandshakeRequest()
+	if err != nil {
+		t.Fatalf("doHandshakeRequest failed: %s", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		ipAddress := fmt.Sprintf("10.0.34.%d", i)
+		serverEntry, err := GetServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntry failed: %s", err)
+		}
+		if (serverEntry != nil) != (i <= 3) {
+			t.Errorf("unexpected stored state for server entry %s", ipAddress)
+		}
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			requestCount++
+			if request.URL.Path != "/dns_query" || request.URL.Query().Get("type") != "A" {
+				http.Error(responseWriter, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			ttl := 300
+			if request.URL.Query().Get("name") == "uncached.example.org" {
+				ttl = 0
+			}
+			fmt.Fprintf(responseWriter, `{"Status": 0, "Answer": [
+				{"name": "%[1]s", "type": 5, "TTL": %[2]d, "data": "cname.example.org."},
+				{"name": "%[1]s", "type": 1, "TTL": %[2]d, "data": "192.0.2.1"},
+				{"name": "%[1]s", "type": 1, "TTL": %[2]d, "data": "192.0.2.2"}]}`,
+				request.URL.Query().Get("name"), ttl)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+	expectedIPs := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+
+	for i := 0; i < 2; i++ {
+		ips, err := session.ResolveHost("cached.example.org")
+		if err != nil {
+			t.Fatalf("ResolveHost failed: %s", err)
+		}
+		if !reflect.DeepEqual(ips, expectedIPs) {
+			t.Errorf("unexpected resolved IPs: %+v", ips)
+		}
+	}
+	if requestCount != 1 {
+		t.Errorf("unexpected request count for cached host: %d", requestCount)
+	}
+
+	requestCount = 0
+	for i := 0; i < 2; i++ {
+		_, err := session.ResolveHost("uncached.example.org")
+		if err != nil {
+			t.Fatalf("ResolveHost failed: %s", err)
+		}
+	}
+	if requestCount != 2 {
+		t.Errorf("unexpected request count for uncached host: %d", requestCount)
+	}
+
+	ips, err := session.ResolveHost("192.0.2.3")
+	if err != nil {
+		t.Fatalf("ResolveHost failed: %s", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.3")) || requestCount != 2 {
+		t.Errorf("unexpected result for IP address host: %+v", ips)
+	}
+}
+
+func TestMinimumServerListEntries(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverList := makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.48.1", "ZG")) + "\n" +
+		makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.48.2", "ZG")) + "\n" +
+		makeTestEncodedServerEntry(t, makeTestServerEntry("10.0.48.", "ZG")) + "\n"
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprint(responseWriter, serverList)
+		}))
+	defer server.Close()
+
+	// The list has 2 valid server entries, fewer than the minimum
+	session := newTestSession(&Config{MinimumServerListEntries: 3}, server.URL)
+	_, _, err := session.FetchAndStoreServerList(server.URL+"/server_list", true)
+	if err == nil {
+		t.Errorf("FetchAndStoreServerList unexpectedly accepted list below minimum")
+	}
+	count := CountServerEntries("ZG", "")
+	if count != 0 {
+		t.Errorf("unexpected stored server entry count: %d", count)
+	}
+
+	session = newTestSession(&Config{MinimumServerListEntries: 2}, server.URL)
+	stored, _, err := session.FetchAndStoreServerList(server.URL+"/server_list", true)
+	if err != nil {
+		t.Fatalf("FetchAndStoreServerList failed: %s", err)
+	}
+	if stored != 2 {
+		t.Errorf("unexpected stored count: %d", stored)
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+
+	const responseBody = "{\"key\": \"value\"}"
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			if request.Header.Get("Accept-Encoding") != "gzip" {
+				fmt.Fprint(responseWriter, responseBody)
+				return
+			}
+			responseWriter.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(responseWriter)
+			fmt.Fprint(gzipWriter, responseBody)
+			gzipWriter.Close()
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	body, err := session.doGetRequest(session.buildRequestUrl("test"))
+	if err != nil {
+		t.Fatalf("doGetRequest failed: %s", err)
+	}
+	if string(body) != responseBody {
+		t.Errorf("unexpected response body: %s", body)
+	}
+
+	body, err = session.doPostRequest(session.buildRequestUrl("test"), "application/json", nil)
+	if err != nil {
+		t.Fatalf("doPostRequest failed: %s", err)
+	}
+	if string(body) != responseBody {
+		t.Errorf("unexpected response body: %s", body)
+	}
+}
+
+func TestMaxApiResponseBodyBytes(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	maxBytes := 1024
+
+	var responseBody string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			if request.Header.Get("Accept-Encoding") == "gzip" {
+				responseWriter.Header().Set("Content-Encoding", "gzip")
+				gzipWriter := gzip.NewWriter(responseWriter)
+				fmt.Fprint(gzipWriter, responseBody)
+				gzipWriter.Close()
+				return
+			}
+			fmt.Fprint(responseWriter, responseBody)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{MaxApiResponseBodyBytes: maxBytes}, server.URL)
+
+	testCases := []struct {
+		description string
+		size        int
+		expectError bool
+	}{
+		{"under the limit", maxBytes - 1, false},
+		{"at the limit", maxBytes, false},
+		{"over the limit", maxBytes + 1, true},
+	}
+
+	for _, testCase := range testCases {
+		responseBody = strings.Repeat("x", testCase.size)
+		body, err := session.doGetRequest(session.buildRequestUrl("test"))
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("%s: unexpected success", testCase.description)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: doGetRequest failed: %s", testCase.description, err)
+			continue
+		}
+		if string(body) != responseBody {
+			t.Errorf("%s: unexpected response body size: %d", testCase.description, len(body))
+		}
+	}
+
+	// The limit also applies to the handshake response
+
+	responseBody = fmt.Sprintf(
+		"Config: {\"client_region\": \"YY\", \"homepages\": [\"%s\"]}\n",
+		strings.Repeat("x", maxBytes))
+	err := session.doHandshakeRequest()
+	if err == nil {
+		t.Errorf("unexpected handshake success with oversized response")
+	}
+}
+
+func TestSignApiRequests(t *testing.T) {
+
+	key := []byte("test-request-signing-key")
+
+	signatures := make(chan string, 1)
+	verified := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			body, _ := ioutil.ReadAll(request.Body)
+			signature := request.Header.Get(PSIPHON_API_REQUEST_SIGNATURE_HEADER)
+			mac := hmac.New(sha256.New, key)
+			fmt.Fprintf(mac, "%s\n%s\n%s", request.Method, request.URL.RequestURI(), body)
+			expectedSignature := hex.EncodeToString(mac.Sum(nil))
+			signatures <- signature
+			verified <- hmac.Equal([]byte(signature), []byte(expectedSignature))
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	_, err := session.doGetRequest(session.buildRequestUrl("test"))
+	if err != nil {
+		t.Fatalf("doGetRequest failed: %s", err)
+	}
+	if signature := <-signatures; signature != "" {
+		t.Errorf("unexpected signature without signing key: %s", signature)
+	}
+	<-verified
+
+	session.requestSigningKey = key
+
+	_, err = session.doGetRequest(session.buildRequestUrl("test"))
+	if err != nil {
+		t.Fatalf("doGetRequest failed: %s", err)
+	}
+	if signature := <-signatures; signature == "" {
+		t.Errorf("missing signature")
+	}
+	if !<-verified {
+		t.Errorf("GET request signature did not verify")
+	}
+
+	_, err = session.doPostRequest(
+		session.buildRequestUrl("test"), "application/json", []byte("{\"key\": \"value\"}"))
+	if err != nil {
+		t.Fatalf("doPostRequest failed: %s", err)
+	}
+	if signature := <-signatures; signature == "" {
+		t.Errorf("missing signature")
+	}
+	if !<-verified {
+		t.Errorf("POST request signature did not verify")
+	}
+}
+
+func TestReportImpairedProtocols(t *testing.T) {
+
+	type impairedProtocolsReport struct {
+		path              string
+		sessionId         string
+		ImpairedProtocols []string `json:"impaired_protocols"`
+	}
+	reports := make(chan *impairedProtocolsReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			report := &impairedProtocolsReport{
+				path:      request.URL.Path,
+				sessionId: request.URL.Query().Get("session_id"),
+			}
+			err := json.NewDecoder(request.Body).Decode(report)
+			if err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reports <- report
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	protocols := []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH, TUNNEL_PROTOCOL_UNFRONTED_MEEK}
+	err := session.ReportImpairedProtocols(protocols)
+	if err != nil {
+		t.Fatalf("ReportImpairedProtocols failed: %s", err)
+	}
+	report := <-reports
+	if report.path != "/impaired_protocols" {
+		t.Errorf("unexpected request path: %s", report.path)
+	}
+	if report.sessionId != "test" {
+		t.Errorf("unexpected session ID: %s", report.sessionId)
+	}
+	if !reflect.DeepEqual(report.ImpairedProtocols, protocols) {
+		t.Errorf("unexpected impaired protocols: %+v", report.ImpairedProtocols)
+	}
+}
+
+func TestPsiphonHttpsClientKeepAlive(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {}))
+	defer server.Close()
+
+	serverEntry := makeTestServerEntry("10.0.44.1", "ZB")
+	serverEntry.WebServerCertificate =
+		base64.StdEncoding.EncodeToString(server.TLS.Certificates[0].Certificate[0])
+	tunnel := &Tunnel{serverEntry: serverEntry}
+
+	httpsClient, err := makePsiphonHttpsClient(&Config{}, tunnel)
+	if err != nil {
+		t.Fatalf("makePsiphonHttpsClient failed: %s", err)
+	}
+	transport := httpsClient.Transport.(*http.Transport)
+	if transport.IdleConnTimeout != 0 || transport.MaxIdleConns != 0 {
+		t.Errorf("unexpected default transport keep-alive settings: %s, %d",
+			transport.IdleConnTimeout, transport.MaxIdleConns)
+	}
+
+	httpsClient, err = makePsiphonHttpsClient(
+		&Config{
+			PsiphonApiIdleConnTimeoutSeconds: 30,
+			PsiphonApiMaxIdleConns:           4,
+		},
+		tunnel)
+	if err != nil {
+		t.Fatalf("makePsiphonHttpsClient failed: %s", err)
+	}
+	transport = httpsClient.Transport.(*http.Transport)
+	if transport.IdleConnTimeout != 30*time.Second {
+		t.Errorf("unexpected idle connection timeout: %s", transport.IdleConnTimeout)
+	}
+	if transport.MaxIdleConns != 4 {
+		t.Errorf("unexpected max idle connections: %d", transport.MaxIdleConns)
+	}
+}
+
+func TestInvalidWebServerCertificate(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverEntry := makeTestServerEntry("10.0.39.1", "YV")
+	serverEntry.WebServerCertificate = "<invalid certificate>"
+	tunnel := &Tunnel{serverEntry: serverEntry}
+
+	_, err := makePsiphonHttpsClient(&Config{}, tunnel)
+	if _, ok := err.(*InvalidWebServerCertificateError); !ok {
+		t.Errorf("unexpected makePsiphonHttpsClient error: %v", err)
+	}
+
+	_, err = NewSession(&Config{}, tunnel, "test")
+	if _, ok := err.(*InvalidWebServerCertificateError); !ok {
+		t.Errorf("unexpected NewSession error: %v", err)
+	}
+
+	marked, err := IsWebServerCertificateMarkedInvalid(serverEntry)
+	if err != nil {
+		t.Fatalf("IsWebServerCertificateMarkedInvalid failed: %s", err)
+	}
+	if marked {
+		t.Errorf("certificate unexpectedly marked invalid")
+	}
+
+	err = MarkWebServerCertificateInvalid(serverEntry)
+	if err != nil {
+		t.Fatalf("MarkWebServerCertificateInvalid failed: %s", err)
+	}
+	marked, err = IsWebServerCertificateMarkedInvalid(serverEntry)
+	if err != nil {
+		t.Fatalf("IsWebServerCertificateMarkedInvalid failed: %s", err)
+	}
+	if !marked {
+		t.Errorf("certificate not marked invalid")
+	}
+
+	// The mark doesn't apply to an updated certificate.
+	serverEntry.WebServerCertificate = "<updated certificate>"
+	marked, err = IsWebServerCertificateMarkedInvalid(serverEntry)
+	if err != nil {
+		t.Fatalf("IsWebServerCertificateMarkedInvalid failed: %s", err)
+	}
+	if marked {
+		t.Errorf("updated certificate unexpectedly marked invalid")
+	}
+}
+
+func TestMarkedInvalidWebServerCertificate(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {}))
+	defer server.Close()
+
+	serverEntry := makeTestServerEntry("10.0.39.2", "YV")
+	serverEntry.WebServerCertificate =
+		base64.StdEncoding.EncodeToString(server.TLS.Certificates[0].Certificate[0])
+	tunnel := &Tunnel{serverEntry: serverEntry}
+
+	err := MarkWebServerCertificateInvalid(serverEntry)
+	if err != nil {
+		t.Fatalf("MarkWebServerCertificateInvalid failed: %s", err)
+	}
+
+	// The mark is consulted before the certificate is used.
+	_, err = NewSession(&Config{}, tunnel, "test")
+	if _, ok := err.(*InvalidWebServerCertificateError); !ok {
+		t.Errorf("unexpected NewSession error: %v", err)
+	}
+
+	// The mark isn't a public key-value.
+	value, err := GetKeyValue(
+		DATA_STORE_INVALID_WEB_SERVER_CERTIFICATE_KEY_PREFIX + serverEntry.IpAddress)
+	if err != nil {
+		t.Fatalf("GetKeyValue failed: %s", err)
+	}
+	if value != "" {
+		t.Errorf("unexpected public key-value: %s", value)
+	}
+}
+
+func TestRequestTimeoutOverride(t *testing.T) {
+
+	const responseDelay = 1500 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			time.Sleep(responseDelay)
+			fmt.Fprint(responseWriter, "{}")
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{PsiphonApiServerTimeoutSeconds: 1}, server.URL)
+
+	_, err := session.doGetRequest(session.buildRequestUrl("test"))
+	if err == nil {
+		t.Errorf("doGetRequest unexpectedly succeeded with default timeout")
+	}
+
+	_, err = session.doGetRequestWithTimeout(session.buildRequestUrl("test"), 5*time.Second)
+	if err != nil {
+		t.Errorf("doGetRequestWithTimeout failed: %s", err)
+	}
+
+	_, err = session.doPostRequestWithTimeout(
+		session.buildRequestUrl("test"), "application/json", nil, 5*time.Second)
+	if err != nil {
+		t.Errorf("doPostRequestWithTimeout failed: %s", err)
+	}
+
+	_, err = session.doPostRequestWithTimeout(
+		session.buildRequestUrl("test"), "application/json", nil, 100*time.Millisecond)
+	if err == nil {
+		t.Errorf("doPostRequestWithTimeout unexpectedly succeeded with short timeout")
+	}
+}
+
+func TestHandshakeAlternateWebServerPorts(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprint(responseWriter, "Config: {}\n")
+		}))
+	defer server.Close()
+	_, alternatePort, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("SplitHostPort failed: %s", err)
+	}
+
+	// The primary port is unreachable: nothing listens on it.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	_, primaryPort, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("SplitHostPort failed: %s", err)
+	}
+	listener.Close()
+
+	makeBaseRequestUrl := func(webServerPort string) string {
+		return "http://127.0.0.1:" + webServerPort + "/%s?client_session_id=test"
+	}
+
+	session := newTestSession(&Config{}, server.URL)
+	err = session.doHandshakeRequestWithFallback(
+		[]string{primaryPort}, makeBaseRequestUrl)
+	if err == nil {
+		t.Errorf("handshake unexpectedly succeeded with unreachable port")
+	}
+
+	session = newTestSession(&Config{}, server.URL)
+	err = session.doHandshakeRequestWithFallback(
+		[]string{primaryPort, alternatePort}, makeBaseRequestUrl)
+	if err != nil {
+		t.Fatalf("doHandshakeRequestWithFallback failed: %s", err)
+	}
+	if session.baseRequestUrl != makeBaseRequestUrl(alternatePort) {
+		t.Errorf("unexpected base request URL: %s", session.baseRequestUrl)
+	}
+
+	// A handshake response which is rejected doesn't fall back to the next
+	// port
+
+	var rejectingRequestCount, alternateRequestCount int32
+	rejectingServer := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&rejectingRequestCount, 1)
+			fmt.Fprint(responseWriter, "Config: {\"sponsor_id\": \"other\"}\n")
+		}))
+	defer rejectingServer.Close()
+	_, rejectingPort, err := net.SplitHostPort(rejectingServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("SplitHostPort failed: %s", err)
+	}
+	alternateServer := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&alternateRequestCount, 1)
+			fmt.Fprint(responseWriter, "Config: {}\n")
+		}))
+	defer alternateServer.Close()
+	_, alternatePort, err = net.SplitHostPort(alternateServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("SplitHostPort failed: %s", err)
+	}
+
+	session = newTestSession(
+		&Config{SponsorId: "sponsor", ValidateHandshakeEchoedIds: true}, server.URL)
+	err = session.doHandshakeRequestWithFallback(
+		[]string{rejectingPort, alternatePort}, makeBaseRequestUrl)
+	if err == nil {
+		t.Errorf("handshake unexpectedly succeeded with rejected response")
+	}
+	rejectingCount := atomic.LoadInt32(&rejectingRequestCount)
+	alternateCount := atomic.LoadInt32(&alternateRequestCount)
+	if rejectingCount != 1 || alternateCount != 0 {
+		t.Errorf("unexpected request counts: %d, %d", rejectingCount, alternateCount)
+	}
+}
+
+func TestPsiphonHttpsClientConnectionReuse(t *testing.T) {
+
+	const responseBody = "{\"key\": \"value\"}"
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			switch request.URL.Path {
+			case "/gzip":
+				responseWriter.Header().Set("Content-Encoding", "gzip")
+				gzipWriter := gzip.NewWriter(responseWriter)
+				fmt.Fprint(gzipWriter, responseBody)
+				gzipWriter.Close()
+			case "/error":
+				http.Error(responseWriter, "error", http.StatusInternalServerError)
+			default:
+				fmt.Fprint(responseWriter, responseBody)
+			}
+		}))
+	defer server.Close()
+
+	var dialCount int32
+	dialer := func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialCount, 1)
+		return net.Dial(network, addr)
+	}
+
+	certificate, err := DecodeCertificate(
+		base64.StdEncoding.EncodeToString(server.TLS.Certificates[0].Certificate[0]))
+	if err != nil {
+		t.Fatalf("DecodeCertificate failed: %s", err)
+	}
+
+	// Note: the HTTPS client dialer performs TLS, so the request URL scheme
+	// is HTTP; see makeBaseRequestUrl.
+	session := newTestSession(&Config{}, "http://"+server.Listener.Addr().String())
+	session.psiphonHttpsClient = makePsiphonHttpsClientWithDialer(&Config{}, certificate, dialer)
+
+	for i := 0; i < 3; i++ {
+		_, err := session.doGetRequest(session.buildRequestUrl("test"))
+		if err != nil {
+			t.Fatalf("doGetRequest failed: %s", err)
+		}
+		_, err = session.doPostRequest(
+			session.buildRequestUrl("test"), "application/json", []byte(responseBody))
+		if err != nil {
+			t.Fatalf("doPostRequest failed: %s", err)
+		}
+		body, err := session.doGetRequest(session.buildRequestUrl("gzip"))
+		if err != nil {
+			t.Fatalf("doGetRequest failed: %s", err)
+		}
+		if string(body) != responseBody {
+			t.Errorf("unexpected response body: %s", body)
+		}
+		_, err = session.doGetRequest(session.buildRequestUrl("error"))
+		if err == nil {
+			t.Errorf("doGetRequest unexpectedly succeeded")
+		}
+	}
+
+	if count := atomic.LoadInt32(&dialCount); count != 1 {
+		t.Errorf("unexpected dial count: %d", count)
+	}
+}
+
+func TestValidateHandshakeEchoedIds(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	testCases := []struct {
+		description                string
+		validate                   bool
+		echoedPropagationChannelId string
+		echoedSponsorId            string
+		expectSuccess              bool
+	}{
+		{"matching", true, "propagation", "sponsor", true},
+		{"not echoed", true, "", "", true},
+		{"mismatched propagation channel", true, "other", "sponsor", false},
+		{"mismatched sponsor", true, "propagation", "other", false},
+		{"validation disabled", false, "other", "other", true},
+	}
+
+	var handshakeConfig []byte
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprintf(responseWriter, "Config: %s\n", handshakeConfig)
+		}))
+	defer server.Close()
+
+	for _, testCase := range testCases {
+		var err error
+		handshakeConfig, err = json.Marshal(map[string]interface{}{
+			"propagation_channel_id": testCase.echoedPropagationChannelId,
+			"sponsor_id":             testCase.echoedSponsorId,
+		})
+		if err != nil {
+			t.Fatalf("error encoding handshake config: %s", err)
+		}
+
+		config := &Config{
+			PropagationChannelId:       "propagation",
+			SponsorId:                  "sponsor",
+			ValidateHandshakeEchoedIds: testCase.validate,
+		}
+		session := newTestSession(config, server.URL)
+
+		err = session.doHandshakeRequest()
+		if (err == nil) != testCase.expectSuccess {
+			t.Errorf("unexpected handshake result for %s: %v", testCase.description, err)
+		}
+	}
+}
+
+func TestHandshakeLargeServerList(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverEntryCount := 1000
+	var encodedServerList []string
+	for i := 0; i < serverEntryCount; i++ {
+		encodedServerList = append(encodedServerList, makeTestEncodedServerEntry(
+			t, makeTestServerEntry(fmt.Sprintf("10.2.%d.%d", i/250, i%250+1), "ZV")))
+	}
+	handshakeConfig, err := json.Marshal(map[string]interface{}{
+		"encoded_server_list": encodedServerList,
+		"client_region":       "ZV",
+		"homepages":           []string{"https://example.org"},
+		"sponsor_id":          "sponsor",
+	})
+	if err != nil {
+		t.Fatalf("error encoding handshake config: %s", err)
+	}
+
+	truncate := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			// A long legacy format line precedes the config line
+			fmt.Fprintf(responseWriter, "Homepage: %s\n", strings.Repeat("x", 100000))
+			config := handshakeConfig
+			if truncate {
+				config = config[:len(config)-1]
+			}
+			fmt.Fprintf(responseWriter, "Config: %s\n", config)
+		}))
+	defer server.Close()
+
+	// A truncated handshake stores no server entries, even when there are
+	// no checks of the response fields
+	truncate = true
+	session := newTestSession(&Config{}, server.URL)
+	err = session.doHandshakeRequest()
+	if err == nil {
+		t.Fatalf("unexpected handshake success")
+	}
+	if count := CountServerEntries("ZV", ""); count != 0 {
+		t.Fatalf("unexpected server entry count after truncated handshake: %d", count)
+	}
+	truncate = false
+
+	// A rejected handshake stores no server entries
+	session = newTestSession(
+		&Config{SponsorId: "other", ValidateHandshakeEchoedIds: true}, server.URL)
+	err = session.doHandshakeRequest()
+	if err == nil {
+		t.Fatalf("unexpected handshake success")
+	}
+	if count := CountServerEntries("ZV", ""); count != 0 {
+		t.Fatalf("unexpected server entry count after rejected handshake: %d", count)
+	}
+
+	// An accepted handshake stores the staged server entries, which exceed
+	// a single batch
+	session = newTestSession(
+		&Config{SponsorId: "sponsor", ValidateHandshakeEchoedIds: true}, server.URL)
+	err = session.doHandshakeRequest()
+	if err != nil {
+		t.Fatalf("doHandshakeRequest failed: %s", err)
+	}
+	if session.clientRegion != "ZV" {
+		t.Errorf("unexpected client region: %s", session.clientRegion)
+	}
+	if count := CountServerEntries("ZV", ""); count != serverEntryCount {
+		t.Errorf("unexpected server entry count: %d", count)
+	}
+}
+
+func TestHandshakeClientPublicIP(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	testCases := []struct {
+		description      string
+		clientAddress    interface{}
+		expectedPublicIP net.IP
+	}{
+		{"IPv4", "192.0.2.1", net.ParseIP("192.0.2.1")},
+		{"IPv6", "2001:db8::1", net.ParseIP("2001:db8::1")},
+		{"not echoed", nil, nil},
+		{"invalid", "192.0.2", nil},
+	}
+
+	var handshakeConfig []byte
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprintf(responseWriter, "Config: %s\n", handshakeConfig)
+		}))
+	defer server.Close()
+
+	for _, testCase := range testCases {
+		fields := map[string]interface{}{"client_region": "YV"}
+		if testCase.clientAddress != nil {
+			fields["client_address"] = testCase.clientAddress
+		}
+		var err error
+		handshakeConfig, err = json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("error encoding handshake config: %s", err)
+		}
+
+		session := newTestSession(&Config{}, server.URL)
+		err = session.doHandshakeRequest()
+		if err != nil {
+			t.Fatalf("doHandshakeRequest failed: %s", err)
+		}
+		if session.ClientRegion() != "YV" {
+			t.Errorf("unexpected client region for %s: %s", testCase.description, session.ClientRegion())
+		}
+		if !session.ClientPublicIP().Equal(testCase.expectedPublicIP) {
+			t.Errorf("unexpected client public IP for %s: %s", testCase.description, session.ClientPublicIP())
+		}
+	}
+}
+
+func TestHandshakeServerIdentity(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	serverIpAddress := "192.0.2.10"
+
+	testCases := []struct {
+		description   string
+		echoNonce     bool
+		nonce         string
+		serverAddress string
+		expectSuccess bool
+	}{
+		{"matching identity", true, "", serverIpAddress, true},
+		{"nonce not echoed", false, "", serverIpAddress, false},
+		{"mismatching nonce", false, "00112233445566778899aabbccddeeff", serverIpAddress, false},
+		{"server address not echoed", true, "", "", false},
+		{"mismatching server address", true, "", "192.0.2.11", false},
+	}
+
+	for _, testCase := range testCases {
+		var requestNonce string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(responseWriter http.ResponseWriter, request *http.Request) {
+				requestNonce = request.URL.Query().Get("identity_nonce")
+				fields := map[string]interface{}{"client_region": "YX"}
+				if testCase.echoNonce {
+					fields["identity_nonce"] = requestNonce
+				} else if testCase.nonce != "" {
+					fields["identity_nonce"] = testCase.nonce
+				}
+				if testCase.serverAddress != "" {
+					fields["server_address"] = testCase.serverAddress
+				}
+				handshakeConfig, _ := json.Marshal(fields)
+				fmt.Fprintf(responseWriter, "Config: %s\n", handshakeConfig)
+			}))
+
+		session := newTestSession(&Config{VerifyHandshakeServerIdentity: true}, server.URL)
+		session.serverIpAddress = serverIpAddress
+		err := session.doHandshakeRequest()
+		server.Close()
+
+		if len(requestNonce) != 2*PSIPHON_API_HANDSHAKE_IDENTITY_NONCE_LENGTH {
+			t.Errorf("unexpected request nonce for %s: '%s'", testCase.description, requestNonce)
+		}
+		if testCase.expectSuccess && err != nil {
+			t.Errorf("unexpected handshake failure for %s: %s", testCase.description, err)
+		}
+		if !testCase.expectSuccess && err == nil {
+			t.Errorf("unexpected handshake success for %s", testCase.description)
+		}
+	}
+
+	// Without VerifyHandshakeServerIdentity, no nonce is sent and the
+	// identity isn't checked
+
+	var requestNonce string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			requestNonce = request.URL.Query().Get("identity_nonce")
+			fmt.Fprintf(responseWriter, "Config: {\"server_address\": \"192.0.2.11\"}\n")
+		}))
+	defer server.Close()
+	session := newTestSession(&Config{}, server.URL)
+	session.serverIpAddress = serverIpAddress
+	err := session.doHandshakeRequest()
+	if err != nil {
+		t.Errorf("doHandshakeRequest failed: %s", err)
+	}
+	if requestNonce != "" {
+		t.Errorf("unexpected request nonce: '%s'", requestNonce)
+	}
+}
+
+// makeTestCertificate creates a certificate, and its private key, from
+// template. The certificate is signed by parent, or is self-signed when
+// parent is nil.
+func makeTestCertificate(
+	t *testing.T,
+	template *x509.Certificate,
+	parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, privateKey
+	}
+	certificateDER, err := x509.CreateCertificate(
+		rand.Reader, template, parent, &privateKey.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(certificateDER)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+	return certificate, privateKey
+}
+
+func TestAcceptableWebServerCertificateIssuers(t *testing.T) {
+
+	makeCA := func(serialNumber int64) (*x509.Certificate, *ecdsa.PrivateKey) {
+		return makeTestCertificate(t, &x509.Certificate{
+			SerialNumber:          big.NewInt(serialNumber),
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("Test CA %d", serialNumber)},
+			NotBefore:             time.Now().Add(-1 * time.Hour),
+			NotAfter:              time.Now().Add(1 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, nil, nil)
+	}
+	allowedCA, allowedCAKey := makeCA(1)
+	disallowedCA, disallowedCAKey := makeCA(2)
+
+	caFile, err := ioutil.TempFile("", "psiphon_ca_test")
+	if err != nil {
+		t.Fatalf("error creating CA file: %s", err)
+	}
+	defer os.Remove(caFile.Name())
+	for _, ca := range []*x509.Certificate{allowedCA, disallowedCA} {
+		err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		if err != nil {
+			t.Fatalf("error writing CA file: %s", err)
+		}
+	}
+	caFile.Close()
+
+	allowedCAFingerprint := sha256.Sum256(allowedCA.Raw)
+	config := &Config{
+		AcceptableWebServerCertificateIssuers: []string{hex.EncodeToString(allowedCAFingerprint[:])},
+		TrustedCACertificatesFilename:         caFile.Name(),
+	}
+
+	testCases := []struct {
+		description   string
+		issuer        *x509.Certificate
+		issuerKey     *ecdsa.PrivateKey
+		expectSuccess bool
+	}{
+		{"allowed issuer", allowedCA, allowedCAKey, true},
+		{"disallowed issuer", disallowedCA, disallowedCAKey, false},
+	}
+
+	for i, testCase := range testCases {
+		certificate, privateKey := makeTestCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(100 + i)),
+			Subject:      pkix.Name{CommonName: "127.0.0.1"},
+			NotBefore:    time.Now().Add(-1 * time.Hour),
+			NotAfter:     time.Now().Add(1 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}, testCase.issuer, testCase.issuerKey)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(responseWriter http.ResponseWriter, request *http.Request) {}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{
+				{
+					Certificate: [][]byte{certificate.Raw, testCase.issuer.Raw},
+					PrivateKey:  privateKey,
+				},
+			},
+		}
+		server.StartTLS()
+
+		// Note: the HTTPS client dialer performs TLS, so the request URL
+		// scheme is HTTP; see makeBaseRequestUrl.
+		httpsClient := makePsiphonHttpsClientWithDialer(config, nil, net.Dial)
+		response, err := httpsClient.Get("http://" + server.Listener.Addr().String())
+		if err == nil {
+			response.Body.Close()
+		}
+		if (err == nil) != testCase.expectSuccess {
+			t.Errorf("unexpected result for %s: %v", testCase.description, err)
+		}
+
+		server.Close()
+	}
+}
+
+func TestSyncTime(t *testing.T) {
+	defer initTestDataStore(t)()
+
+	var mutex sync.Mutex
+	serverTimestamp := ""
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			fmt.Fprintf(responseWriter, "{\"server_timestamp\": \"%s\"}", serverTimestamp)
+		}))
+	defer server.Close()
+
+	session := newTestSession(&Config{}, server.URL)
+
+	const expectedSkew = 1 * time.Hour
+	const tolerance = 1 * time.Second
+
+	mutex.Lock()
+	serverTimestamp = time.Now().Add(expectedSkew).UTC().Format(time.RFC3339Nano)
+	mutex.Unlock()
+
+	skew, err := session.SyncTime()
+	if err != nil {
+		t.Fatalf("SyncTime failed: %s", err)
+	}
+	if skew < expectedSkew-tolerance || skew > expectedSkew+tolerance {
+		t.Errorf("unexpected skew: %s", skew)
+	}
+
+	storedSkew, err := GetServerTimeSkew()
+	if err != nil {
+		t.Fatalf("GetServerTimeSkew failed: %s", err)
+	}
+	if storedSkew != skew {
+		t.Errorf("unexpected stored skew: %s, expected %s", storedSkew, skew)
+	}
+
+	// An invalid server time doesn't replace the stored skew.
+
+	mutex.Lock()
+	serverTimestamp = "not-a-timestamp"
+	mutex.Unlock()
+
+	_, err = session.SyncTime()
+	if err == nil {
+		t.Errorf("SyncTime unexpectedly succeeded")
+	}
+
+	storedSkew, err = GetServerTimeSkew()
+	if err != nil {
+		t.Fatalf("GetServerTimeSkew failed: %s", err)
+	}
+	if storedSkew != skew {
+		t.Errorf("unexpected stored skew after invalid response: %s", storedSkew)
+	}
+}
+
+// deadlineRecordingTransport records the context deadline of each request.
+type deadlineRecordingTransport struct {
+	http.RoundTripper
+	mutex     sync.Mutex
+	deadlines []time.Duration
+}
+
+func (transport *deadlineRecordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	deadline, ok := request.Context().Deadline()
+	if ok {
+		transport.mutex.Lock()
+		transport.deadlines = append(transport.deadlines, time.Until(deadline))
+		transport.mutex.Unlock()
+	}
+	return transport.RoundTripper.RoundTrip(request)
+}
+
+func TestJitterApiRequestTimeout(t *testing.T) {
+
+	defer mathrand.Seed(time.Now().UnixNano())
+	mathrand.Seed(1)
+
+	const timeout = 10 * time.Second
+
+	if jitterTimeout(timeout, 0) != timeout {
+		t.Errorf("unexpected jitter with 0 percent")
+	}
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		jittered := jitterTimeout(timeout, 20)
+		if jittered < 8*time.Second || jittered > 12*time.Second {
+			t.Fatalf("jittered timeout out of range: %s", jittered)
+		}
+		distinct[jittered] = true
+	}
+	if len(distinct) < 50 {
+		t.Errorf("unexpectedly few distinct jittered timeouts: %d", len(distinct))
+	}
+
+	for i := 0; i < 100; i++ {
+		jittered := jitterTimeout(timeout, 200)
+		if jittered < 0 || jittered > 20*time.Second {
+			t.Fatalf("capped jittered timeout out of range: %s", jittered)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			fmt.Fprint(responseWriter, "{}")
+		}))
+	defer server.Close()
+
+	session := newTestSession(
+		&Config{
+			PsiphonApiServerTimeoutSeconds:       10,
+			PsiphonApiServerTimeoutJitterPercent: 20,
+		},
+		server.URL)
+	transport := &deadlineRecordingTransport{RoundTripper: &http.Transport{}}
+	session.psiphonHttpsClient = &http.Client{Transport: transport}
+
+	for i := 0; i < 10; i++ {
+		_, err := session.doGetRequest(session.buildRequestUrl("test"))
+		if err != nil {
+			t.Fatalf("doGetRequest failed: %s", err)
+		}
+	}
+
+	if len(transport.deadlines) != 10 {
+		t.Fatalf("unexpected recorded deadline count: %d", len(transport.deadlines))
+	}
+	// Allow some slack for the time elapsed before the deadline is recorded.
+	for _, deadline := range transport.deadlines {
+		if deadline < 8*time.Second-time.Second || deadline > 12*time.Second {
+			t.Errorf("applied timeout out of jittered range: %s", deadline)
+		}
+	}
+}
@@ -21,23 +21,68 @@ package psiphon
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	TUNNEL_PROTOCOL_SSH            = "SSH"
-	TUNNEL_PROTOCOL_OBFUSCATED_SSH = "OSSH"
-	TUNNEL_PROTOCOL_UNFRONTED_MEEK = "UNFRONTED-MEEK-OSSH"
-	TUNNEL_PROTOCOL_FRONTED_MEEK   = "FRONTED-MEEK-OSSH"
+	TUNNEL_PROTOCOL_SSH               = "SSH"
+	TUNNEL_PROTOCOL_OBFUSCATED_SSH    = "OSSH"
+	TUNNEL_PROTOCOL_UNFRONTED_MEEK    = "UNFRONTED-MEEK-OSSH"
+	TUNNEL_PROTOCOL_FRONTED_MEEK      = "FRONTED-MEEK-OSSH"
+	TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP = "FRONTED-MEEK-HTTP-OSSH"
+)
+
+// Skip reasons reported to config.OnCandidate by ServerEntryIterator.
+const (
+	SERVER_ENTRY_SKIP_REASON_REGION              = "region mismatch"
+	SERVER_ENTRY_SKIP_REASON_PROTOCOL            = "protocol mismatch"
+	SERVER_ENTRY_SKIP_REASON_PROPAGATION_CHANNEL = "propagation channel mismatch"
+	SERVER_ENTRY_SKIP_REASON_TARGET              = "duplicate of target server entry"
+	SERVER_ENTRY_SKIP_REASON_DISABLED            = "disabled"
+	SERVER_ENTRY_SKIP_REASON_CLIENT_VERSION      = "client version below minimum"
+)
+
+const (
+	SERVER_ENTRY_INSERT_POSITION_NEXT_TO_TOP = "next-to-top"
+	SERVER_ENTRY_INSERT_POSITION_TOP         = "top"
+	SERVER_ENTRY_INSERT_POSITION_TAIL        = "tail"
+)
+
+var SupportedServerEntryInsertPositions = []string{
+	SERVER_ENTRY_INSERT_POSITION_NEXT_TO_TOP,
+	SERVER_ENTRY_INSERT_POSITION_TOP,
+	SERVER_ENTRY_INSERT_POSITION_TAIL,
+}
+
+const (
+	SERVER_ENTRY_STORE_ORDER_SHUFFLE     = "shuffle"
+	SERVER_ENTRY_STORE_ORDER_INPUT_ORDER = "input-order"
+	SERVER_ENTRY_STORE_ORDER_INTERLEAVE  = "interleave"
+)
+
+var SupportedServerEntryStoreOrders = []string{
+	SERVER_ENTRY_STORE_ORDER_SHUFFLE,
+	SERVER_ENTRY_STORE_ORDER_INPUT_ORDER,
+	SERVER_ENTRY_STORE_ORDER_INTERLEAVE,
+}
+
+const (
+	OBFUSCATION_PADDING_PROFILE_DEFAULT = "default"
 )
 
 var SupportedTunnelProtocols = []string{
 	TUNNEL_PROTOCOL_FRONTED_MEEK,
+	TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP,
 	TUNNEL_PROTOCOL_UNFRONTED_MEEK,
 	TUNNEL_PROTOCOL_OBFUSCATED_SSH,
 	TUNNEL_PROTOCOL_SSH,
@@ -67,13 +112,103 @@ type ServerEntry struct {
 	MeekFrontingDomain            string   `json:"meekFrontingDomain"`
 	MeekFrontingAddresses         []string `json:"meekFrontingAddresses"`
 	MeekFrontingAddressesRegex    string   `json:"meekFrontingAddressesRegex"`
+	ServerPriority                int      `json:"serverPriority"`
+
+	// ObfuscationParams is optional. When not present, GetObfuscationParams
+	// returns the default transport obfuscation parameters.
+	ObfuscationParams *ServerEntryObfuscationParams `json:"obfuscationParams,omitempty"`
+
+	// ApiRequestSigningKey is optional. When present, it's the hex encoded
+	// key used to sign Psiphon API requests made to the server.
+	ApiRequestSigningKey string `json:"apiRequestSigningKey,omitempty"`
+
+	// SshHostKeys is optional. When present, it lists additional base64
+	// encoded SSH host keys which are accepted along with SshHostKey. This
+	// allows both the old and new host keys to be published while a server
+	// host key is rotated. See AcceptableHostKeys.
+	SshHostKeys []string `json:"sshHostKeys,omitempty"`
+
+	// AlternateWebServerPorts is optional. When present, it lists additional
+	// ports on which the server exposes the web API. When the handshake
+	// fails using WebServerPort, the alternate ports are tried in turn.
+	AlternateWebServerPorts []string `json:"alternateWebServerPorts,omitempty"`
+
+	// MinClientVersion is optional. When present, it's the minimum client
+	// version, compared numerically with config.ClientVersion, which the
+	// server accepts. Server entry iterators skip servers which require a
+	// higher client version. See supportsClientVersion.
+	MinClientVersion string `json:"minClientVersion,omitempty"`
+
+	// MeekFrontingHttpHost is optional. When present, it's the HTTP Host
+	// header value used for FRONTED-MEEK-HTTP, which fronts over plain HTTP
+	// through the MeekFrontingAddresses. It's required with the
+	// FRONTED-MEEK-HTTP capability.
+	MeekFrontingHttpHost string `json:"meekFrontingHttpHost,omitempty"`
+
+	// ConnectTimeoutMilliseconds is optional. When present, it's a hint for
+	// the time allowed to connect to the server, for servers, such as those
+	// behind meek, which need more time than most. See ConnectTimeout.
+	ConnectTimeoutMilliseconds int `json:"connectTimeoutMilliseconds,omitempty"`
+
+	// PreferredProtocol is not part of the server entry record. It's set
+	// by the ServerEntryIterator when config.UseServerEntryPreferredProtocol
+	// is set. See SetServerEntryPreferredProtocol.
+	PreferredProtocol string `json:"-"`
 }
 
 // SupportsProtocol returns true if and only if the ServerEntry has
 // the necessary capability to support the specified tunnel protocol.
 func (serverEntry *ServerEntry) SupportsProtocol(protocol string) bool {
-	requiredCapability := strings.TrimSuffix(protocol, "-OSSH")
-	return Contains(serverEntry.Capabilities, requiredCapability)
+	return Contains(serverEntry.Capabilities, getTunnelProtocolCapability(protocol))
+}
+
+// getTunnelProtocolCapability returns the server entry capability required
+// by the specified tunnel protocol.
+// Note: for meek, the capabilities are FRONTED-MEEK, FRONTED-MEEK-HTTP, and
+// UNFRONTED-MEEK and the additonal OSSH service is assumed to be available
+// internally.
+func getTunnelProtocolCapability(protocol string) string {
+	return strings.TrimSuffix(protocol, "-OSSH")
+}
+
+// DialAddress returns the network and the host:port address to dial to
+// connect to the server using the specified tunnel protocol: the SSH port
+// for SSH, the obfuscated SSH port for OSSH, and the meek server port for
+// UNFRONTED-MEEK-OSSH. IPv6 addresses are bracketed. An error is returned
+// when the server doesn't support the protocol, or when the protocol is
+// fronted, as the fronted dial address is a front address selected for
+// each connection attempt; see FrontingAddressSelector.
+func (serverEntry *ServerEntry) DialAddress(protocol string) (network, address string, err error) {
+	if !serverEntry.SupportsProtocol(protocol) {
+		return "", "", ContextError(
+			fmt.Errorf("server %s does not support protocol %s", serverEntry.IpAddress, protocol))
+	}
+	var port int
+	switch protocol {
+	case TUNNEL_PROTOCOL_SSH:
+		port = serverEntry.SshPort
+	case TUNNEL_PROTOCOL_OBFUSCATED_SSH:
+		port = serverEntry.SshObfuscatedPort
+	case TUNNEL_PROTOCOL_UNFRONTED_MEEK:
+		port = serverEntry.MeekServerPort
+	default:
+		return "", "", ContextError(
+			fmt.Errorf("no direct dial address for protocol %s", protocol))
+	}
+	return "tcp", net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(port)), nil
+}
+
+// AcceptableHostKeys returns the SSH host keys which are accepted for the
+// server: the legacy SshHostKey, when set, followed by the SshHostKeys.
+// Blank and duplicate keys are omitted.
+func (serverEntry *ServerEntry) AcceptableHostKeys() []string {
+	hostKeys := make([]string, 0)
+	for _, hostKey := range append([]string{serverEntry.SshHostKey}, serverEntry.SshHostKeys...) {
+		if hostKey != "" && !Contains(hostKeys, hostKey) {
+			hostKeys = append(hostKeys, hostKey)
+		}
+	}
+	return hostKeys
 }
 
 // GetSupportedProtocols returns a list of tunnel protocols supported
@@ -96,8 +231,7 @@ func (serverEntry *ServerEntry) DisableImpairedProtocols(impairedProtocols []str
 	for _, capability := range serverEntry.Capabilities {
 		omit := false
 		for _, protocol := range impairedProtocols {
-			requiredCapability := strings.TrimSuffix(protocol, "-OSSH")
-			if capability == requiredCapability {
+			if capability == getTunnelProtocolCapability(protocol) {
 				omit = true
 				break
 			}
@@ -109,8 +243,117 @@ func (serverEntry *ServerEntry) DisableImpairedProtocols(impairedProtocols []str
 	serverEntry.Capabilities = capabilities
 }
 
+// serverEntriesByPriority implements sort.Interface to sort server
+// entries in ascending ServerPriority order.
+type serverEntriesByPriority []*ServerEntry
+
+func (serverEntries serverEntriesByPriority) Len() int {
+	return len(serverEntries)
+}
+
+func (serverEntries serverEntriesByPriority) Less(i, j int) bool {
+	return serverEntries[i].ServerPriority < serverEntries[j].ServerPriority
+}
+
+func (serverEntries serverEntriesByPriority) Swap(i, j int) {
+	serverEntries[i], serverEntries[j] = serverEntries[j], serverEntries[i]
+}
+
+// getRegionGroupMembers returns the regions matched by the specified
+// region, which may be a group name in regionGroups. A nil list, which
+// matches any region, is returned for a blank region.
+func getRegionGroupMembers(regionGroups map[string][]string, region string) []string {
+	if region == "" {
+		return nil
+	}
+	if members := regionGroups[region]; len(members) > 0 {
+		return members
+	}
+	return []string{region}
+}
+
+// regionMatches returns true when region is in regions, or when regions
+// is empty.
+func regionMatches(regions []string, region string) bool {
+	return len(regions) == 0 || Contains(regions, region)
+}
+
+var serverEntryFieldAliasesMutex sync.Mutex
+var serverEntryFieldAliases = map[string]string{
+	"ip": "ipAddress",
+}
+
+// SetServerEntryFieldAliases sets the server entry JSON field aliases
+// applied by DecodeServerEntry. Each alias field name is mapped to its
+// canonical field name; for example, "ip" to "ipAddress". This enables
+// decoding server entries from feeds which use alternate field names.
+// By default, only the "ip" alias is set.
+func SetServerEntryFieldAliases(aliases map[string]string) {
+	fieldAliases := make(map[string]string)
+	for alias, fieldName := range aliases {
+		fieldAliases[alias] = fieldName
+	}
+	serverEntryFieldAliasesMutex.Lock()
+	defer serverEntryFieldAliasesMutex.Unlock()
+	serverEntryFieldAliases = fieldAliases
+}
+
+// applyServerEntryFieldAliases rewrites aliased field names in the server
+// entry JSON to the canonical field names. When both an alias and its
+// canonical field are present, the canonical field takes precedence.
+func applyServerEntryFieldAliases(serverEntryJson []byte) ([]byte, error) {
+
+	// SetServerEntryFieldAliases replaces, and never modifies, the alias
+	// map, so the map may be used after the lock is released.
+	serverEntryFieldAliasesMutex.Lock()
+	fieldAliases := serverEntryFieldAliases
+	serverEntryFieldAliasesMutex.Unlock()
+
+	// Most server entries use no aliases, so the JSON is only decoded into
+	// fields when it contains a quoted alias name.
+	containsAlias := false
+	for alias := range fieldAliases {
+		if bytes.Contains(serverEntryJson, []byte("\""+alias+"\"")) {
+			containsAlias = true
+			break
+		}
+	}
+	if !containsAlias {
+		return serverEntryJson, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(serverEntryJson, &fields)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	rewritten := false
+	for alias, fieldName := range fieldAliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		if _, ok := fields[fieldName]; !ok {
+			fields[fieldName] = value
+		}
+		delete(fields, alias)
+		rewritten = true
+	}
+	if !rewritten {
+		return serverEntryJson, nil
+	}
+
+	serverEntryJson, err = json.Marshal(fields)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return serverEntryJson, nil
+}
+
 // DecodeServerEntry extracts server entries from the encoding
 // used by remote server lists and Psiphon server handshake requests.
+// Field aliases set by SetServerEntryFieldAliases are applied.
 func DecodeServerEntry(encodedServerEntry string) (serverEntry *ServerEntry, err error) {
 	hexDecodedServerEntry, err := hex.DecodeString(encodedServerEntry)
 	if err != nil {
@@ -121,8 +364,12 @@ func DecodeServerEntry(encodedServerEntry string) (serverEntry *ServerEntry, err
 	if len(fields) != 5 {
 		return nil, ContextError(errors.New("invalid encoded server entry"))
 	}
+	serverEntryJson, err := applyServerEntryFieldAliases(fields[4])
+	if err != nil {
+		return nil, ContextError(err)
+	}
 	serverEntry = new(ServerEntry)
-	err = json.Unmarshal(fields[4], &serverEntry)
+	err = json.Unmarshal(serverEntryJson, &serverEntry)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -130,10 +377,45 @@ func DecodeServerEntry(encodedServerEntry string) (serverEntry *ServerEntry, err
 	return serverEntry, nil
 }
 
+// EncodeServerEntry returns the encoding used by remote server lists and
+// Psiphon server handshake requests, which is accepted by DecodeServerEntry.
+// The legacy space delimited fields are populated from the server entry.
+func EncodeServerEntry(serverEntry *ServerEntry) (string, error) {
+	serverEntryJson, err := json.Marshal(serverEntry)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return hex.EncodeToString([]byte(fmt.Sprintf(
+		"%s %s %s %s %s",
+		serverEntry.IpAddress,
+		serverEntry.WebServerPort,
+		serverEntry.WebServerSecret,
+		serverEntry.WebServerCertificate,
+		serverEntryJson))), nil
+}
+
+// encodeServerEntryList returns the newline delimited list encoding of the
+// server entries, which is accepted by DecodeAndValidateServerEntryList.
+func encodeServerEntryList(serverEntries []*ServerEntry) (string, error) {
+	encodedServerEntries := make([]string, 0, len(serverEntries))
+	for _, serverEntry := range serverEntries {
+		encodedServerEntry, err := EncodeServerEntry(serverEntry)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+	return strings.Join(encodedServerEntries, "\n"), nil
+}
+
 // ValidateServerEntry checks for malformed server entries.
 // Currently, it checks for a valid ipAddress. This is important since
 // handshake requests submit back to the server a list of known server
-// IP addresses and the handshake API expects well-formed inputs.
+// IP addresses and the handshake API expects well-formed inputs. When
+// enabled with SetRejectPrivateServerEntryIpAddresses, an ipAddress in a
+// private or reserved range is also invalid.
+// Optional obfuscation parameters are validated leniently; see
+// validateServerEntryObfuscationParams.
 // TODO: validate more fields
 func ValidateServerEntry(serverEntry *ServerEntry) error {
 	ipAddr := net.ParseIP(serverEntry.IpAddress)
@@ -141,12 +423,421 @@ func ValidateServerEntry(serverEntry *ServerEntry) error {
 		errMsg := fmt.Sprintf("server entry has invalid IpAddress: '%s'", serverEntry.IpAddress)
 		// Some callers skip invalid server entries without propagating
 		// the error mesage, so issue a notice.
-		NoticeAlert(errMsg)
+		NoticeAlert("%s", errMsg)
+		return ContextError(errors.New(errMsg))
+	}
+	if getRejectPrivateServerEntryIpAddresses() && isPrivateIPAddress(ipAddr) {
+		errMsg := fmt.Sprintf("server entry has private IpAddress: '%s'",
+			redactServerAddress(serverEntry.IpAddress))
+		NoticeAlert("%s", errMsg)
 		return ContextError(errors.New(errMsg))
 	}
+	err := validateServerEntryFrontingAddresses(serverEntry)
+	if err != nil {
+		NoticeAlert("%s", err)
+		return ContextError(err)
+	}
+	err = validateServerEntryFrontingHttpHost(serverEntry)
+	if err != nil {
+		NoticeAlert("%s", err)
+		return ContextError(err)
+	}
+	err = validateServerEntryAlternateWebServerPorts(serverEntry)
+	if err != nil {
+		NoticeAlert("%s", err)
+		return ContextError(err)
+	}
+	err = validateServerEntryConnectTimeout(serverEntry)
+	if err != nil {
+		NoticeAlert("%s", err)
+		return ContextError(err)
+	}
+	validateServerEntryObfuscationParams(serverEntry)
+	return nil
+}
+
+var rejectPrivateServerEntryIpAddressesMutex sync.Mutex
+var rejectPrivateServerEntryIpAddresses bool
+
+// SetRejectPrivateServerEntryIpAddresses sets whether ValidateServerEntry
+// rejects server entries with an ipAddress in a private or reserved range,
+// such as 10.0.0.0/8 or 127.0.0.0/8. Such addresses are almost certainly
+// bogus for production clients, but are used in tests. By default, private
+// addresses are accepted.
+func SetRejectPrivateServerEntryIpAddresses(reject bool) {
+	rejectPrivateServerEntryIpAddressesMutex.Lock()
+	defer rejectPrivateServerEntryIpAddressesMutex.Unlock()
+	rejectPrivateServerEntryIpAddresses = reject
+}
+
+func getRejectPrivateServerEntryIpAddresses() bool {
+	rejectPrivateServerEntryIpAddressesMutex.Lock()
+	defer rejectPrivateServerEntryIpAddressesMutex.Unlock()
+	return rejectPrivateServerEntryIpAddresses
+}
+
+// privateIPNetworks are the private and reserved IP ranges, in addition
+// to the loopback, link-local, multicast and unspecified addresses, which
+// are never Psiphon server addresses.
+var privateIPNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"fc00::/7",
+	"2001:db8::/32")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// isPrivateIPAddress checks if the IP address is in a private or
+// reserved range.
+func isPrivateIPAddress(ipAddr net.IP) bool {
+	if ipAddr.IsLoopback() || ipAddr.IsLinkLocalUnicast() ||
+		ipAddr.IsMulticast() || ipAddr.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateIPNetworks {
+		if network.Contains(ipAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsClientVersion returns true when the server accepts the specified
+// client version: when the server entry has no MinClientVersion, or when
+// clientVersion is not less than MinClientVersion. When either version can't
+// be parsed, the requirement is not satisfied.
+func (serverEntry *ServerEntry) supportsClientVersion(clientVersion string) bool {
+	if serverEntry.MinClientVersion == "" {
+		return true
+	}
+	comparison, err := compareClientVersions(clientVersion, serverEntry.MinClientVersion)
+	return err == nil && comparison >= 0
+}
+
+// compareClientVersions compares two client versions, which are numbers or
+// dot-separated sequences of numbers, such as "120" or "1.2.3". The result
+// is negative, zero, or positive when a is less than, equal to, or greater
+// than b. Missing trailing components are treated as 0.
+func compareClientVersions(a, b string) (int, error) {
+	aComponents := strings.Split(a, ".")
+	bComponents := strings.Split(b, ".")
+	for i := 0; i < len(aComponents) || i < len(bComponents); i++ {
+		aValue, err := parseClientVersionComponent(aComponents, i)
+		if err != nil {
+			return 0, ContextError(err)
+		}
+		bValue, err := parseClientVersionComponent(bComponents, i)
+		if err != nil {
+			return 0, ContextError(err)
+		}
+		if aValue != bValue {
+			if aValue < bValue {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parseClientVersionComponent(components []string, index int) (int, error) {
+	if index >= len(components) {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(components[index])
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid client version component: '%s'", components[index])
+	}
+	return value, nil
+}
+
+// GetWebServerPorts returns the ports on which the server exposes the web
+// API: WebServerPort followed by the AlternateWebServerPorts.
+func (serverEntry *ServerEntry) GetWebServerPorts() []string {
+	ports := make([]string, 0, 1+len(serverEntry.AlternateWebServerPorts))
+	ports = append(ports, serverEntry.WebServerPort)
+	return append(ports, serverEntry.AlternateWebServerPorts...)
+}
+
+// ConnectTimeout returns the time allowed to connect to the server: the
+// ConnectTimeoutMilliseconds hint, when present, or TUNNEL_CONNECT_TIMEOUT.
+func (serverEntry *ServerEntry) ConnectTimeout() time.Duration {
+	if serverEntry.ConnectTimeoutMilliseconds <= 0 {
+		return TUNNEL_CONNECT_TIMEOUT
+	}
+	return time.Duration(serverEntry.ConnectTimeoutMilliseconds) * time.Millisecond
+}
+
+// validateServerEntryConnectTimeout checks that the connect timeout hint
+// isn't negative.
+func validateServerEntryConnectTimeout(serverEntry *ServerEntry) error {
+	if serverEntry.ConnectTimeoutMilliseconds < 0 {
+		return fmt.Errorf(
+			"server entry %s has invalid connect timeout: %d",
+			redactServerAddress(serverEntry.IpAddress), serverEntry.ConnectTimeoutMilliseconds)
+	}
+	return nil
+}
+
+// validateServerEntryAlternateWebServerPorts checks that each alternate web
+// server port is a valid port number.
+func validateServerEntryAlternateWebServerPorts(serverEntry *ServerEntry) error {
+	for _, port := range serverEntry.AlternateWebServerPorts {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber <= 0 || portNumber > 65535 {
+			return fmt.Errorf(
+				"server entry %s has invalid alternate web server port: '%s'",
+				redactServerAddress(serverEntry.IpAddress), port)
+		}
+	}
+	return nil
+}
+
+// validateServerEntryFrontingAddresses checks that a server entry with the
+// FRONTED-MEEK or FRONTED-MEEK-HTTP capability has front addresses, in any
+// of the front address fields, and that each front address is a plausible
+// hostname.
+func validateServerEntryFrontingAddresses(serverEntry *ServerEntry) error {
+	if !Contains(serverEntry.Capabilities, "FRONTED-MEEK") &&
+		!Contains(serverEntry.Capabilities, "FRONTED-MEEK-HTTP") {
+		return nil
+	}
+	if !isServerEntryFieldSet(serverEntry, "meekFrontingAddresses") {
+		return fmt.Errorf(
+			"server entry %s has no meek fronting addresses", redactServerAddress(serverEntry.IpAddress))
+	}
+	frontingAddresses := serverEntry.MeekFrontingAddresses
+	if serverEntry.MeekFrontingDomain != "" {
+		frontingAddresses = append(
+			[]string{serverEntry.MeekFrontingDomain}, frontingAddresses...)
+	}
+	for _, frontingAddress := range frontingAddresses {
+		if !isPlausibleHostname(frontingAddress) {
+			return fmt.Errorf(
+				"server entry %s has invalid meek fronting address: '%s'",
+				redactServerAddress(serverEntry.IpAddress), frontingAddress)
+		}
+	}
 	return nil
 }
 
+// validateServerEntryFrontingHttpHost checks that a server entry with the
+// FRONTED-MEEK-HTTP capability has a plausible MeekFrontingHttpHost.
+func validateServerEntryFrontingHttpHost(serverEntry *ServerEntry) error {
+	if !Contains(serverEntry.Capabilities, "FRONTED-MEEK-HTTP") {
+		return nil
+	}
+	if !isPlausibleHostname(serverEntry.MeekFrontingHttpHost) {
+		return fmt.Errorf(
+			"server entry %s has invalid meek fronting HTTP host: '%s'",
+			redactServerAddress(serverEntry.IpAddress), serverEntry.MeekFrontingHttpHost)
+	}
+	return nil
+}
+
+// isPlausibleHostname checks that the hostname is an IP address or
+// a syntactically valid domain name.
+func isPlausibleHostname(hostname string) bool {
+	if net.ParseIP(hostname) != nil {
+		return true
+	}
+	if len(hostname) == 0 || len(hostname) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(hostname, "."), ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ServerEntryObfuscationParams are per-server transport obfuscation tuning
+// parameters. Unset values are replaced with defaults by GetObfuscationParams.
+type ServerEntryObfuscationParams struct {
+	PaddingProfile string `json:"paddingProfile"`
+	MaxPadding     int    `json:"maxPadding"`
+}
+
+// GetObfuscationParams returns the server's transport obfuscation
+// parameters, with defaults for any parameters not specified in the
+// server entry.
+func (serverEntry *ServerEntry) GetObfuscationParams() ServerEntryObfuscationParams {
+	obfuscationParams := ServerEntryObfuscationParams{
+		PaddingProfile: OBFUSCATION_PADDING_PROFILE_DEFAULT,
+		MaxPadding:     OBFUSCATE_MAX_PADDING,
+	}
+	if serverEntry.ObfuscationParams == nil {
+		return obfuscationParams
+	}
+	if serverEntry.ObfuscationParams.PaddingProfile != "" {
+		obfuscationParams.PaddingProfile = serverEntry.ObfuscationParams.PaddingProfile
+	}
+	if serverEntry.ObfuscationParams.MaxPadding > 0 {
+		obfuscationParams.MaxPadding = serverEntry.ObfuscationParams.MaxPadding
+	}
+	return obfuscationParams
+}
+
+// validateServerEntryObfuscationParams leniently validates the optional
+// obfuscation parameters: an out of range value is discarded, with a notice,
+// and the default is used instead. The server entry itself remains valid.
+func validateServerEntryObfuscationParams(serverEntry *ServerEntry) {
+	obfuscationParams := serverEntry.ObfuscationParams
+	if obfuscationParams == nil {
+		return
+	}
+	if obfuscationParams.MaxPadding < 0 || obfuscationParams.MaxPadding > OBFUSCATE_MAX_PADDING {
+		NoticeAlert(
+			"server entry %s has invalid maxPadding: %d",
+			redactServerAddress(serverEntry.IpAddress), obfuscationParams.MaxPadding)
+		obfuscationParams.MaxPadding = 0
+	}
+}
+
+// ServerEntryAuditIssue describes a server entry which advertises a
+// capability without the fields required to use that capability. An
+// invalid IP address is reported with a blank Capability.
+type ServerEntryAuditIssue struct {
+	IpAddress     string
+	Capability    string
+	MissingFields []string
+}
+
+var sshCredentialFields = []string{"sshUsername", "sshPassword", "sshHostKey"}
+
+var serverEntryCapabilityRequiredFields = map[string][]string{
+	"handshake":         {"webServerPort", "webServerSecret", "webServerCertificate"},
+	"SSH":               append([]string{"sshPort"}, sshCredentialFields...),
+	"OSSH":              append([]string{"sshObfuscatedPort", "sshObfuscatedKey"}, sshCredentialFields...),
+	"UNFRONTED-MEEK":    append([]string{"meekServerPort", "meekCookieEncryptionPublicKey", "meekObfuscatedKey", "sshObfuscatedKey"}, sshCredentialFields...),
+	"FRONTED-MEEK":      append([]string{"meekFrontingHost", "meekFrontingAddresses", "meekCookieEncryptionPublicKey", "meekObfuscatedKey", "sshObfuscatedKey"}, sshCredentialFields...),
+	"FRONTED-MEEK-HTTP": append([]string{"meekFrontingHttpHost", "meekFrontingAddresses", "meekCookieEncryptionPublicKey", "meekObfuscatedKey", "sshObfuscatedKey"}, sshCredentialFields...),
+}
+
+// isServerEntryFieldSet checks that the server entry field, specified by
+// its JSON name, has a value.
+func isServerEntryFieldSet(serverEntry *ServerEntry, field string) bool {
+	switch field {
+	case "webServerPort":
+		return serverEntry.WebServerPort != ""
+	case "webServerSecret":
+		return serverEntry.WebServerSecret != ""
+	case "webServerCertificate":
+		return serverEntry.WebServerCertificate != ""
+	case "sshPort":
+		return serverEntry.SshPort != 0
+	case "sshUsername":
+		return serverEntry.SshUsername != ""
+	case "sshPassword":
+		return serverEntry.SshPassword != ""
+	case "sshHostKey":
+		return len(serverEntry.AcceptableHostKeys()) > 0
+	case "sshObfuscatedPort":
+		return serverEntry.SshObfuscatedPort != 0
+	case "sshObfuscatedKey":
+		return serverEntry.SshObfuscatedKey != ""
+	case "meekServerPort":
+		return serverEntry.MeekServerPort != 0
+	case "meekCookieEncryptionPublicKey":
+		return serverEntry.MeekCookieEncryptionPublicKey != ""
+	case "meekObfuscatedKey":
+		return serverEntry.MeekObfuscatedKey != ""
+	case "meekFrontingHost":
+		return serverEntry.MeekFrontingHost != ""
+	case "meekFrontingHttpHost":
+		return serverEntry.MeekFrontingHttpHost != ""
+	case "meekFrontingAddresses":
+		// Any of the front address fields may be used; see
+		// MakeCompatibleServerEntry.
+		return len(serverEntry.MeekFrontingAddresses) > 0 ||
+			serverEntry.MeekFrontingAddressesRegex != "" ||
+			serverEntry.MeekFrontingDomain != ""
+	}
+	return false
+}
+
+// AuditServerEntry performs the ValidateServerEntry checks, along with
+// checks that each advertised capability has its required fields, and
+// reports any issues instead of failing. Unlike ValidateServerEntry, no
+// notices are issued.
+func AuditServerEntry(serverEntry *ServerEntry) []ServerEntryAuditIssue {
+	issues := make([]ServerEntryAuditIssue, 0)
+	if net.ParseIP(serverEntry.IpAddress) == nil {
+		issues = append(issues, ServerEntryAuditIssue{
+			IpAddress:     serverEntry.IpAddress,
+			MissingFields: []string{"ipAddress"},
+		})
+	}
+	for _, capability := range serverEntry.Capabilities {
+		missingFields := make([]string, 0)
+		for _, field := range serverEntryCapabilityRequiredFields[capability] {
+			if !isServerEntryFieldSet(serverEntry, field) {
+				missingFields = append(missingFields, field)
+			}
+		}
+		if len(missingFields) > 0 {
+			issues = append(issues, ServerEntryAuditIssue{
+				IpAddress:     serverEntry.IpAddress,
+				Capability:    capability,
+				MissingFields: missingFields,
+			})
+		}
+	}
+	return issues
+}
+
+// VerifyWebServerCertificateFingerprint checks that the SHA-256 fingerprint
+// of the server entry's web server certificate is one of the expected
+// fingerprints, which are hex encoded. When no fingerprints are expected,
+// any certificate is accepted.
+func VerifyWebServerCertificateFingerprint(
+	serverEntry *ServerEntry, expectedFingerprints []string) error {
+
+	if len(expectedFingerprints) == 0 {
+		return nil
+	}
+	derEncodedCertificate, err := base64.StdEncoding.DecodeString(serverEntry.WebServerCertificate)
+	if err != nil {
+		return ContextError(err)
+	}
+	digest := sha256.Sum256(derEncodedCertificate)
+	fingerprint := hex.EncodeToString(digest[:])
+	for _, expectedFingerprint := range expectedFingerprints {
+		if strings.ToLower(expectedFingerprint) == fingerprint {
+			return nil
+		}
+	}
+	return ContextError(fmt.Errorf(
+		"server entry %s has unexpected web server certificate fingerprint: %s",
+		serverEntry.IpAddress, fingerprint))
+}
+
 // DecodeAndValidateServerEntryList extracts server entries from the list encoding
 // used by remote server lists and Psiphon server handshake requests.
 // Each server entry is validated and invalid entries are skipped.
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	SERVER_ENTRY_CODEC_JSON = "json"
+	SERVER_ENTRY_CODEC_GOB  = "gob"
+)
+
+var SupportedServerEntryCodecs = []string{
+	SERVER_ENTRY_CODEC_JSON,
+	SERVER_ENTRY_CODEC_GOB,
+}
+
+const DATA_STORE_SERVER_ENTRY_CODEC_KEY = "serverEntryCodec"
+
+// serverEntryCodec encodes server entry records for storage in the
+// datastore. All datastore paths which store or read server entry records
+// use the codec selected by config.ServerEntryCodec.
+type serverEntryCodec interface {
+	Marshal(serverEntry *ServerEntry) ([]byte, error)
+	Unmarshal(data []byte, serverEntry *ServerEntry) error
+}
+
+// newServerEntryCodec returns the codec with the specified name. For the
+// default, "", the JSON codec is returned.
+func newServerEntryCodec(name string) (serverEntryCodec, error) {
+	switch name {
+	case "", SERVER_ENTRY_CODEC_JSON:
+		return jsonServerEntryCodec{}, nil
+	case SERVER_ENTRY_CODEC_GOB:
+		return gobServerEntryCodec{}, nil
+	}
+	return nil, ContextError(fmt.Errorf("unsupported server entry codec: %s", name))
+}
+
+// jsonServerEntryCodec stores server entries in the JSON format used by
+// remote server lists. This is the original datastore format.
+type jsonServerEntryCodec struct{}
+
+func (jsonServerEntryCodec) Marshal(serverEntry *ServerEntry) ([]byte, error) {
+	return json.Marshal(serverEntry)
+}
+
+func (jsonServerEntryCodec) Unmarshal(data []byte, serverEntry *ServerEntry) error {
+	return json.Unmarshal(data, serverEntry)
+}
+
+// gobServerEntryCodec stores server entries in the more compact gob format.
+type gobServerEntryCodec struct{}
+
+func (gobServerEntryCodec) Marshal(serverEntry *ServerEntry) ([]byte, error) {
+	// PreferredProtocol is not part of the server entry record.
+	record := *serverEntry
+	record.PreferredProtocol = ""
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(&record)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobServerEntryCodec) Unmarshal(data []byte, serverEntry *ServerEntry) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(serverEntry)
+}
+
+// initServerEntryCodec selects the codec configured by config.ServerEntryCodec.
+// The codec used by a datastore is recorded in the internal key-value store
+// when the datastore is first opened, and opening the datastore with a
+// different codec fails, as the stored server entries could not be read;
+// stored server entries aren't re-encoded, so switching codecs requires
+// deleting the datastore. Datastores which have server entries but no
+// recorded codec predate codec selection and use the JSON codec.
+func (dataStore *DataStore) initServerEntryCodec() error {
+	codecName := dataStore.config.ServerEntryCodec
+	if codecName == "" {
+		codecName = SERVER_ENTRY_CODEC_JSON
+	}
+	codec, err := newServerEntryCodec(codecName)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	storedCodecName, err := dataStore.getInternalKeyValue(DATA_STORE_SERVER_ENTRY_CODEC_KEY)
+	if err != nil {
+		return ContextError(err)
+	}
+	if storedCodecName == "" {
+		ipAddresses, err := dataStore.GetServerEntryIpAddresses()
+		if err != nil {
+			return ContextError(err)
+		}
+		storedCodecName = codecName
+		if len(ipAddresses) > 0 {
+			storedCodecName = SERVER_ENTRY_CODEC_JSON
+		}
+		err = dataStore.setInternalKeyValue(DATA_STORE_SERVER_ENTRY_CODEC_KEY, storedCodecName)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	if storedCodecName != codecName {
+		return ContextError(fmt.Errorf(
+			"datastore server entry codec %s does not match configured codec %s; the datastore must be deleted to change codecs",
+			storedCodecName, codecName))
+	}
+
+	dataStore.codec = codec
+	return nil
+}
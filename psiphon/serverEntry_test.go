@@ -21,7 +21,9 @@ package psiphon
 
 import (
 	"encoding/hex"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -29,6 +31,9 @@ const (
 	_VALID_BLANK_LEGACY_SERVER_ENTRY              = `    {"ipAddress":"192.168.0.1","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
 	_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
 	_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY    = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
+	_VALID_ALIASED_SERVER_ENTRY                   = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ip":"192.168.0.1","port":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA"}`
+	_VALID_OBFUSCATION_PARAMS_SERVER_ENTRY        = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","webServerPort":"80","sshPort":22,"capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","obfuscationParams":{"paddingProfile":"<paddingProfile>","maxPadding":1024}}`
+	_INVALID_OBFUSCATION_PARAMS_SERVER_ENTRY      = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","webServerPort":"80","sshPort":22,"capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","obfuscationParams":{"maxPadding":-1}}`
 	_EXPECTED_IP_ADDRESS                          = `192.168.0.1`
 )
 
@@ -72,3 +77,411 @@ func TestInvalidServerEntries(t *testing.T) {
 		}
 	}
 }
+
+// DecodeServerEntry should map aliased field names onto the canonical fields
+func TestDecodeAliasedServerEntry(t *testing.T) {
+
+	encodedServerEntry := hex.EncodeToString([]byte(_VALID_ALIASED_SERVER_ENTRY))
+
+	serverEntry, err := DecodeServerEntry(encodedServerEntry)
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+	if serverEntry.IpAddress != _EXPECTED_IP_ADDRESS {
+		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
+	}
+	if serverEntry.WebServerPort != "" {
+		t.Errorf("unexpected web server port in decoded server entry: %s", serverEntry.WebServerPort)
+	}
+
+	SetServerEntryFieldAliases(map[string]string{"ip": "ipAddress", "port": "webServerPort"})
+	defer SetServerEntryFieldAliases(map[string]string{"ip": "ipAddress"})
+
+	serverEntry, err = DecodeServerEntry(encodedServerEntry)
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+	if serverEntry.IpAddress != _EXPECTED_IP_ADDRESS {
+		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
+	}
+	if serverEntry.WebServerPort != "80" {
+		t.Errorf("unexpected web server port in decoded server entry: %s", serverEntry.WebServerPort)
+	}
+
+	// The canonical field takes precedence over an alias
+	serverEntry, err = DecodeServerEntry(hex.EncodeToString([]byte(
+		`192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ip":"192.168.0.2","ipAddress":"192.168.0.1"}`)))
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+	if serverEntry.IpAddress != _EXPECTED_IP_ADDRESS {
+		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
+	}
+
+	// JSON without any alias is returned unchanged
+	serverEntryJson := []byte(`{"ipAddress":"192.168.0.1", "webServerPort":"80"}`)
+	aliasedJson, err := applyServerEntryFieldAliases(serverEntryJson)
+	if err != nil {
+		t.Fatalf("applyServerEntryFieldAliases failed: %s", err)
+	}
+	if string(aliasedJson) != string(serverEntryJson) {
+		t.Errorf("unexpected JSON rewrite: %s", aliasedJson)
+	}
+}
+
+// AuditServerEntry should report an invalid IP address without failing
+func TestAuditInvalidServerEntry(t *testing.T) {
+
+	encodedServerEntry := hex.EncodeToString([]byte(_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY))
+	serverEntry, err := DecodeServerEntry(encodedServerEntry)
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+
+	issues := AuditServerEntry(serverEntry)
+	if len(issues) == 0 || issues[0].Capability != "" || issues[0].MissingFields[0] != "ipAddress" {
+		t.Errorf("unexpected audit issues: %+v", issues)
+	}
+}
+
+// Server entries with invalid obfuscation params are valid and use the defaults
+func TestServerEntryObfuscationParams(t *testing.T) {
+
+	testCases := []struct {
+		encodedServerEntry     string
+		expectedPaddingProfile string
+		expectedMaxPadding     int
+	}{
+		{_VALID_NORMAL_SERVER_ENTRY, OBFUSCATION_PADDING_PROFILE_DEFAULT, OBFUSCATE_MAX_PADDING},
+		{_VALID_OBFUSCATION_PARAMS_SERVER_ENTRY, "<paddingProfile>", 1024},
+		{_INVALID_OBFUSCATION_PARAMS_SERVER_ENTRY, OBFUSCATION_PADDING_PROFILE_DEFAULT, OBFUSCATE_MAX_PADDING},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry, err := DecodeServerEntry(
+			hex.EncodeToString([]byte(testCase.encodedServerEntry)))
+		if err != nil {
+			t.Fatalf("DecodeServerEntry failed: %s", err)
+		}
+		err = ValidateServerEntry(serverEntry)
+		if err != nil {
+			t.Fatalf("ValidateServerEntry failed: %s", err)
+		}
+		obfuscationParams := serverEntry.GetObfuscationParams()
+		if obfuscationParams.PaddingProfile != testCase.expectedPaddingProfile {
+			t.Errorf("unexpected padding profile: %s", obfuscationParams.PaddingProfile)
+		}
+		if obfuscationParams.MaxPadding != testCase.expectedMaxPadding {
+			t.Errorf("unexpected max padding: %d", obfuscationParams.MaxPadding)
+		}
+	}
+}
+
+// Server entries with the FRONTED-MEEK capability must have plausible front addresses
+func TestValidateServerEntryFrontingAddresses(t *testing.T) {
+
+	testCases := []struct {
+		meekFrontingDomain    string
+		meekFrontingAddresses []string
+		expectValid           bool
+	}{
+		{"", []string{"example.org", "www.example.com"}, true},
+		{"example.org", nil, true},
+		{"", []string{"192.168.0.2"}, true},
+		{"", nil, false},
+		{"", []string{"example.org", ""}, false},
+		{"", []string{"example..org"}, false},
+		{"", []string{"-example.org"}, false},
+		{"", []string{"example.org/path"}, false},
+		{"<meekFrontingDomain>", nil, false},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry := &ServerEntry{
+			IpAddress:             _EXPECTED_IP_ADDRESS,
+			Capabilities:          []string{"handshake", "FRONTED-MEEK"},
+			MeekFrontingDomain:    testCase.meekFrontingDomain,
+			MeekFrontingAddresses: testCase.meekFrontingAddresses,
+		}
+		err := ValidateServerEntry(serverEntry)
+		if (err == nil) != testCase.expectValid {
+			t.Errorf("unexpected validation result for %+v: %v", testCase, err)
+		}
+	}
+
+	// Front addresses aren't checked without the FRONTED-MEEK capability
+	serverEntry := &ServerEntry{
+		IpAddress:             _EXPECTED_IP_ADDRESS,
+		Capabilities:          []string{"handshake", "UNFRONTED-MEEK"},
+		MeekFrontingAddresses: []string{"example..org"},
+	}
+	err := ValidateServerEntry(serverEntry)
+	if err != nil {
+		t.Errorf("ValidateServerEntry failed: %s", err)
+	}
+}
+
+func TestValidateServerEntryFrontingHttpHost(t *testing.T) {
+
+	testCases := []struct {
+		capabilities         []string
+		meekFrontingHttpHost string
+		expectValid          bool
+	}{
+		{[]string{"handshake", "FRONTED-MEEK-HTTP"}, "www.example.org", true},
+		{[]string{"handshake", "FRONTED-MEEK-HTTP"}, "", false},
+		{[]string{"handshake", "FRONTED-MEEK-HTTP"}, "www.example.org/path", false},
+		{[]string{"handshake", "FRONTED-MEEK"}, "", true},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry := &ServerEntry{
+			IpAddress:             _EXPECTED_IP_ADDRESS,
+			Capabilities:          testCase.capabilities,
+			MeekFrontingHost:      "www.example.com",
+			MeekFrontingHttpHost:  testCase.meekFrontingHttpHost,
+			MeekFrontingAddresses: []string{"example.com"},
+		}
+		err := ValidateServerEntry(serverEntry)
+		if (err == nil) != testCase.expectValid {
+			t.Errorf("unexpected validation result for %+v: %v", testCase, err)
+		}
+	}
+
+	// Front addresses are required with the FRONTED-MEEK-HTTP capability
+	serverEntry := &ServerEntry{
+		IpAddress:            _EXPECTED_IP_ADDRESS,
+		Capabilities:         []string{"handshake", "FRONTED-MEEK-HTTP"},
+		MeekFrontingHttpHost: "www.example.org",
+	}
+	err := ValidateServerEntry(serverEntry)
+	if err == nil {
+		t.Errorf("unexpected success validating server entry without front addresses")
+	}
+
+	if !serverEntry.SupportsProtocol(TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP) ||
+		serverEntry.SupportsProtocol(TUNNEL_PROTOCOL_FRONTED_MEEK) {
+		t.Errorf("unexpected supported protocols: %v", serverEntry.GetSupportedProtocols())
+	}
+}
+
+// Private and reserved IP addresses are rejected only when configured
+func TestValidateServerEntryPrivateIpAddresses(t *testing.T) {
+
+	defer SetRejectPrivateServerEntryIpAddresses(false)
+
+	testCases := []struct {
+		ipAddress string
+		isPrivate bool
+	}{
+		{"8.8.8.8", false},
+		{"1.2.3.4", false},
+		{"2001:4860:4860::8888", false},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.0.1", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"fd00::1", true},
+	}
+
+	for _, rejectPrivate := range []bool{false, true} {
+		SetRejectPrivateServerEntryIpAddresses(rejectPrivate)
+		for _, testCase := range testCases {
+			serverEntry := &ServerEntry{
+				IpAddress:    testCase.ipAddress,
+				Capabilities: []string{"handshake", "SSH"},
+			}
+			err := ValidateServerEntry(serverEntry)
+			expectValid := !(rejectPrivate && testCase.isPrivate)
+			if (err == nil) != expectValid {
+				t.Errorf("unexpected validation result for %s (reject private: %v): %v",
+					testCase.ipAddress, rejectPrivate, err)
+			}
+		}
+	}
+}
+
+// AcceptableHostKeys should combine the legacy host key and the host key list
+func TestAcceptableHostKeys(t *testing.T) {
+
+	testCases := []struct {
+		sshHostKey  string
+		sshHostKeys []string
+		expected    []string
+	}{
+		{"<sshHostKey>", nil, []string{"<sshHostKey>"}},
+		{"", []string{"<sshHostKey1>", "<sshHostKey2>"}, []string{"<sshHostKey1>", "<sshHostKey2>"}},
+		{"<sshHostKey1>", []string{"<sshHostKey1>", "<sshHostKey2>"}, []string{"<sshHostKey1>", "<sshHostKey2>"}},
+		{"", nil, []string{}},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry := &ServerEntry{
+			SshHostKey:  testCase.sshHostKey,
+			SshHostKeys: testCase.sshHostKeys,
+		}
+		hostKeys := serverEntry.AcceptableHostKeys()
+		if !reflect.DeepEqual(hostKeys, testCase.expected) {
+			t.Errorf("unexpected acceptable host keys: %+v", hostKeys)
+		}
+	}
+
+	// The host key list is optional in encoded server entries
+	serverEntry, err := DecodeServerEntry(hex.EncodeToString([]byte(
+		`192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","sshHostKey":"<sshHostKey1>","sshHostKeys":["<sshHostKey2>"]}`)))
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+	hostKeys := serverEntry.AcceptableHostKeys()
+	if !reflect.DeepEqual(hostKeys, []string{"<sshHostKey1>", "<sshHostKey2>"}) {
+		t.Errorf("unexpected acceptable host keys: %+v", hostKeys)
+	}
+}
+
+func TestValidateServerEntryAlternateWebServerPorts(t *testing.T) {
+
+	testCases := []struct {
+		alternateWebServerPorts []string
+		expectValid             bool
+	}{
+		{nil, true},
+		{[]string{"443", "8080"}, true},
+		{[]string{""}, false},
+		{[]string{"0"}, false},
+		{[]string{"65536"}, false},
+		{[]string{"443", "http"}, false},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry := &ServerEntry{
+			IpAddress:               _EXPECTED_IP_ADDRESS,
+			WebServerPort:           "80",
+			Capabilities:            []string{"handshake"},
+			AlternateWebServerPorts: testCase.alternateWebServerPorts,
+		}
+		err := ValidateServerEntry(serverEntry)
+		if (err == nil) != testCase.expectValid {
+			t.Errorf("unexpected validation result for %+v: %v", testCase, err)
+		}
+	}
+
+	serverEntry := &ServerEntry{
+		WebServerPort:           "80",
+		AlternateWebServerPorts: []string{"443", "8080"},
+	}
+	ports := serverEntry.GetWebServerPorts()
+	if !reflect.DeepEqual(ports, []string{"80", "443", "8080"}) {
+		t.Errorf("unexpected web server ports: %+v", ports)
+	}
+}
+
+func TestServerEntrySupportsClientVersion(t *testing.T) {
+
+	testCases := []struct {
+		minClientVersion string
+		clientVersion    string
+		expectSupported  bool
+	}{
+		{"", "1", true},
+		{"", "", true},
+		{"100", "99", false},
+		{"100", "100", true},
+		{"100", "101", true},
+		{"100", "1000", true},
+		{"1.2", "1.10", true},
+		{"1.2.1", "1.2", false},
+		{"1.2.0", "1.2", true},
+		{"100", "invalid", false},
+		{"invalid", "100", false},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry := &ServerEntry{MinClientVersion: testCase.minClientVersion}
+		supported := serverEntry.supportsClientVersion(testCase.clientVersion)
+		if supported != testCase.expectSupported {
+			t.Errorf("unexpected result for %+v: %v", testCase, supported)
+		}
+	}
+}
+
+func TestServerEntryDialAddress(t *testing.T) {
+
+	serverEntry := &ServerEntry{
+		IpAddress:         "192.168.0.1",
+		SshPort:           22,
+		SshObfuscatedPort: 1022,
+		MeekServerPort:    8080,
+		Capabilities:      []string{"handshake", "SSH", "OSSH", "UNFRONTED-MEEK", "FRONTED-MEEK"},
+	}
+
+	testCases := []struct {
+		ipAddress       string
+		protocol        string
+		expectedAddress string
+	}{
+		{"192.168.0.1", TUNNEL_PROTOCOL_SSH, "192.168.0.1:22"},
+		{"192.168.0.1", TUNNEL_PROTOCOL_OBFUSCATED_SSH, "192.168.0.1:1022"},
+		{"192.168.0.1", TUNNEL_PROTOCOL_UNFRONTED_MEEK, "192.168.0.1:8080"},
+		{"2001:db8::1", TUNNEL_PROTOCOL_SSH, "[2001:db8::1]:22"},
+		{"2001:db8::1", TUNNEL_PROTOCOL_UNFRONTED_MEEK, "[2001:db8::1]:8080"},
+	}
+
+	for _, testCase := range testCases {
+		serverEntry.IpAddress = testCase.ipAddress
+		network, address, err := serverEntry.DialAddress(testCase.protocol)
+		if err != nil {
+			t.Errorf("DialAddress failed for %s %s: %s", testCase.ipAddress, testCase.protocol, err)
+			continue
+		}
+		if network != "tcp" || address != testCase.expectedAddress {
+			t.Errorf("unexpected dial address for %s %s: %s %s",
+				testCase.ipAddress, testCase.protocol, network, address)
+		}
+	}
+
+	// Unsupported, fronted, and unknown protocols have no dial address
+	for _, protocol := range []string{
+		TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP, TUNNEL_PROTOCOL_FRONTED_MEEK, "VPN"} {
+
+		_, _, err := serverEntry.DialAddress(protocol)
+		if err == nil {
+			t.Errorf("unexpected DialAddress success for %s", protocol)
+		}
+	}
+}
+
+func TestServerEntryConnectTimeout(t *testing.T) {
+
+	testCases := []struct {
+		description     string
+		jsonFields      string
+		expectValid     bool
+		expectedTimeout time.Duration
+	}{
+		{"present", `,"connectTimeoutMilliseconds":45000`, true, 45 * time.Second},
+		{"not a number", `,"connectTimeoutMilliseconds":"45000"`, false, 0},
+		{"absent", ``, true, TUNNEL_CONNECT_TIMEOUT},
+		{"zero", `,"connectTimeoutMilliseconds":0`, true, TUNNEL_CONNECT_TIMEOUT},
+		{"negative", `,"connectTimeoutMilliseconds":-1`, false, 0},
+	}
+
+	for _, testCase := range testCases {
+		encodedServerEntry := hex.EncodeToString([]byte(
+			`192.168.0.1 80 <webServerSecret> <webServerCertificate> ` +
+				`{"ipAddress":"192.168.0.1","webServerPort":"80","sshPort":22,` +
+				`"capabilities":["handshake","SSH"],"region":"CA"` +
+				testCase.jsonFields + `}`))
+		serverEntry, err := DecodeServerEntry(encodedServerEntry)
+		if err == nil {
+			err = ValidateServerEntry(serverEntry)
+		}
+		if (err == nil) != testCase.expectValid {
+			t.Errorf("%s: unexpected validation result: %v", testCase.description, err)
+			continue
+		}
+		if testCase.expectValid && serverEntry.ConnectTimeout() != testCase.expectedTimeout {
+			t.Errorf("%s: unexpected connect timeout: %s", testCase.description, serverEntry.ConnectTimeout())
+		}
+	}
+}
@@ -72,10 +72,14 @@ package psiphon
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -107,6 +111,14 @@ type CustomTLSConfig struct {
 	// specified certificate. SNI is disbled when this is set.
 	VerifyLegacyCertificate *x509.Certificate
 
+	// VerifyIssuerFingerprints specifies that the server certificate is
+	// verified with standard CA verification, and that the verified chain
+	// must include an issuer certificate with a hex-encoded SHA-256
+	// fingerprint in the list. The roots are loaded from
+	// TrustedCACertificatesFilename, when specified, or else are the system
+	// roots. SNI is disabled when this is set.
+	VerifyIssuerFingerprints []string
+
 	// UseIndistinguishableTLS specifies whether to try to use an
 	// alternative stack for TLS. From a circumvention perspective,
 	// Go's TLS has a distinct fingerprint that may be used for blocking.
@@ -172,7 +184,8 @@ func CustomTLSDial(network, addr string, config *CustomTLSConfig) (net.Conn, err
 		tlsConfig.InsecureSkipVerify = true
 	}
 
-	if config.SendServerName && config.VerifyLegacyCertificate == nil {
+	if config.SendServerName && config.VerifyLegacyCertificate == nil &&
+		len(config.VerifyIssuerFingerprints) == 0 {
 		// Set the ServerName and rely on the usual logic in
 		// tls.Conn.Handshake() to do its verification
 		tlsConfig.ServerName = hostname
@@ -220,6 +233,8 @@ func CustomTLSDial(network, addr string, config *CustomTLSConfig) (net.Conn, err
 
 		if config.VerifyLegacyCertificate != nil {
 			err = verifyLegacyCertificate(tlsConn, config.VerifyLegacyCertificate)
+		} else if len(config.VerifyIssuerFingerprints) > 0 {
+			err = verifyServerCertIssuer(tlsConn, hostname, config)
 		} else {
 			// Manually verify certificates
 			err = verifyServerCerts(tlsConn, hostname, tlsConfig)
@@ -268,3 +283,58 @@ func verifyServerCerts(conn *tls.Conn, hostname string, config *tls.Config) erro
 	}
 	return nil
 }
+
+// verifyServerCertIssuer verifies the server certificate chain and checks
+// that the chain was issued by an acceptable issuer. See
+// CustomTLSConfig.VerifyIssuerFingerprints.
+func verifyServerCertIssuer(conn *tls.Conn, hostname string, config *CustomTLSConfig) error {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) < 1 {
+		return ContextError(errors.New("no certificate to verify"))
+	}
+
+	var roots *x509.CertPool
+	if config.TrustedCACertificatesFilename != "" {
+		pemCerts, err := ioutil.ReadFile(config.TrustedCACertificatesFilename)
+		if err != nil {
+			return ContextError(err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCerts) {
+			return ContextError(errors.New("no trusted CA certificates loaded"))
+		}
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		CurrentTime:   time.Now(),
+		DNSName:       hostname,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for i, cert := range certs {
+		if i == 0 {
+			continue
+		}
+		opts.Intermediates.AddCert(cert)
+	}
+
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	for _, chain := range chains {
+		for _, issuer := range chain[1:] {
+			fingerprint := sha256.Sum256(issuer.Raw)
+			encodedFingerprint := hex.EncodeToString(fingerprint[:])
+			for _, acceptableFingerprint := range config.VerifyIssuerFingerprints {
+				if strings.EqualFold(encodedFingerprint, acceptableFingerprint) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return ContextError(errors.New("unacceptable certificate issuer"))
+}
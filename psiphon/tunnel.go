@@ -30,7 +30,6 @@ import (
 	"sync"
 	"time"
 
-	regen "github.com/Psiphon-Inc/goregen"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 	"golang.org/x/crypto/ssh"
 )
@@ -85,11 +84,13 @@ type Tunnel struct {
 // HTTP (meek protocol).
 // When requiredProtocol is not blank, that protocol is used. Otherwise,
 // the a random supported protocol is used.
+// For fronted meek, the front address is selected by frontingAddressSelector.
 func EstablishTunnel(
 	config *Config,
 	sessionId string,
 	pendingConns *Conns,
 	serverEntry *ServerEntry,
+	frontingAddressSelector *FrontingAddressSelector,
 	tunnelOwner TunnelOwner) (tunnel *Tunnel, err error) {
 
 	selectedProtocol, err := selectProtocol(config, serverEntry)
@@ -99,7 +100,7 @@ func EstablishTunnel(
 
 	// Build transport layers and establish SSH connection
 	conn, sshClient, err := dialSsh(
-		config, pendingConns, serverEntry, selectedProtocol, sessionId)
+		config, pendingConns, serverEntry, selectedProtocol, sessionId, frontingAddressSelector)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -134,10 +135,20 @@ func EstablishTunnel(
 	// proceed with this tunnel as long as at least one previous handhake succeeded?
 	//
 	if !config.DisableApi {
-		NoticeInfo("starting session for %s", tunnel.serverEntry.IpAddress)
+		NoticeInfo("starting session for %s", redactServerAddress(tunnel.serverEntry.IpAddress))
 		tunnel.session, err = NewSession(config, tunnel, sessionId)
+		if _, ok := err.(*InvalidWebServerCertificateError); ok {
+			// The tunnel is usable; only the Psiphon API is unavailable with
+			// this server. Proceed without a session, as with DisableApi, and
+			// record the invalid certificate.
+			NoticeAlert("skipping session for %s: %s", redactServerAddress(tunnel.serverEntry.IpAddress), err)
+			if err := MarkWebServerCertificateInvalid(tunnel.serverEntry); err != nil {
+				NoticeAlert("failed to mark web server certificate invalid: %s", err)
+			}
+			err = nil
+		}
 		if err != nil {
-			return nil, ContextError(fmt.Errorf("error starting session for %s: %s", tunnel.serverEntry.IpAddress, err))
+			return nil, ContextError(fmt.Errorf("error starting session for %s: %s", redactServerAddress(tunnel.serverEntry.IpAddress), err))
 		}
 	}
 
@@ -150,6 +161,19 @@ func EstablishTunnel(
 	// of the first candidates next time establish runs.
 	PromoteServerEntry(tunnel.serverEntry.IpAddress)
 
+	// Record the protocol which established this tunnel, for use with
+	// config.UseServerEntryPreferredProtocol.
+	if err := SetServerEntryPreferredProtocol(
+		tunnel.serverEntry.IpAddress, tunnel.protocol); err != nil {
+		NoticeAlert("failed to set preferred protocol: %s", err)
+	}
+
+	// Record the protocol in the protocol success distribution, for
+	// telemetry and protocol prioritization.
+	if err := RecordSuccessfulProtocol(tunnel.protocol); err != nil {
+		NoticeAlert("failed to record successful protocol: %s", err)
+	}
+
 	// Spawn the operateTunnel goroutine, which monitors the tunnel and handles periodic stats updates.
 	tunnel.operateWaitGroup.Add(1)
 	go tunnel.operateTunnel(config, tunnelOwner)
@@ -173,12 +197,15 @@ func (tunnel *Tunnel) Close() {
 		// A timer is set, so if operateTunnel takes too long to stop, the
 		// tunnel is closed, which will interrupt any slow final status request.
 		// In effect, the TUNNEL_OPERATE_SHUTDOWN_TIMEOUT value will take
-		// precedence over the PSIPHON_API_SERVER_TIMEOUT http.Client.Timeout
-		// value set in makePsiphonHttpsClient.
+		// precedence over the Psiphon API request timeout set in doRequest.
 		timer := time.AfterFunc(TUNNEL_OPERATE_SHUTDOWN_TIMEOUT, func() { tunnel.conn.Close() })
 		close(tunnel.shutdownOperateBroadcast)
 		tunnel.operateWaitGroup.Wait()
 		timer.Stop()
+		// Tunnel does not have a session when DisableApi is set.
+		if tunnel.session != nil {
+			tunnel.session.Close()
+		}
 		tunnel.sshClient.Close()
 		// tunnel.conn.Close() may get called twice, which is allowed.
 		tunnel.conn.Close()
@@ -298,6 +325,11 @@ func selectProtocol(config *Config, serverEntry *ServerEntry) (selectedProtocol
 			return "", ContextError(fmt.Errorf("server does not have required capability"))
 		}
 		selectedProtocol = config.TunnelProtocol
+	} else if serverEntry.PreferredProtocol != "" &&
+		serverEntry.SupportsProtocol(serverEntry.PreferredProtocol) {
+		// The preferred protocol is set by ServerEntryIterator when
+		// config.UseServerEntryPreferredProtocol is set.
+		selectedProtocol = serverEntry.PreferredProtocol
 	} else {
 		// Pick at random from the supported protocols. This ensures that we'll eventually
 		// try all possible protocols. Depending on network configuration, it may be the
@@ -325,53 +357,41 @@ func dialSsh(
 	pendingConns *Conns,
 	serverEntry *ServerEntry,
 	selectedProtocol,
-	sessionId string) (conn net.Conn, sshClient *ssh.Client, err error) {
+	sessionId string,
+	frontingAddressSelector *FrontingAddressSelector) (conn net.Conn, sshClient *ssh.Client, err error) {
 
 	// The meek protocols tunnel obfuscated SSH. Obfuscated SSH is layered on top of SSH.
 	// So depending on which protocol is used, multiple layers are initialized.
-	port := 0
 	useMeek := false
 	useFronting := false
+	useHttpFronting := false
 	useObfuscatedSsh := false
 	switch selectedProtocol {
 	case TUNNEL_PROTOCOL_FRONTED_MEEK:
 		useMeek = true
 		useFronting = true
 		useObfuscatedSsh = true
+	case TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
+		useMeek = true
+		useFronting = true
+		useHttpFronting = true
+		useObfuscatedSsh = true
 	case TUNNEL_PROTOCOL_UNFRONTED_MEEK:
 		useMeek = true
 		useObfuscatedSsh = true
-		port = serverEntry.SshObfuscatedPort
 	case TUNNEL_PROTOCOL_OBFUSCATED_SSH:
 		useObfuscatedSsh = true
-		port = serverEntry.SshObfuscatedPort
-	case TUNNEL_PROTOCOL_SSH:
-		port = serverEntry.SshPort
 	}
 
 	frontingAddress := ""
 	if useFronting {
-		if len(serverEntry.MeekFrontingAddressesRegex) > 0 {
-
-			// Generate a front address based on the regex.
-
-			frontingAddress, err = regen.Generate(serverEntry.MeekFrontingAddressesRegex)
-			if err != nil {
-				return nil, nil, ContextError(err)
-			}
-		} else {
 
-			// Randomly select, for this connection attempt, one front address for
-			// fronting-capable servers.
+		// Select, for this connection attempt, one front address for
+		// fronting-capable servers.
 
-			if len(serverEntry.MeekFrontingAddresses) == 0 {
-				return nil, nil, ContextError(errors.New("MeekFrontingAddresses is empty"))
-			}
-			index, err := MakeSecureRandomInt(len(serverEntry.MeekFrontingAddresses))
-			if err != nil {
-				return nil, nil, ContextError(err)
-			}
-			frontingAddress = serverEntry.MeekFrontingAddresses[index]
+		frontingAddress, err = frontingAddressSelector.SelectMeekFrontingAddress(serverEntry)
+		if err != nil {
+			return nil, nil, ContextError(err)
 		}
 	}
 	NoticeConnectingServer(
@@ -383,7 +403,7 @@ func dialSsh(
 	// Create the base transport: meek or direct connection
 	dialConfig := &DialConfig{
 		UpstreamProxyUrl:              config.UpstreamProxyUrl,
-		ConnectTimeout:                TUNNEL_CONNECT_TIMEOUT,
+		ConnectTimeout:                serverEntry.ConnectTimeout(),
 		PendingConns:                  pendingConns,
 		DeviceBinder:                  config.DeviceBinder,
 		DnsServerGetter:               config.DnsServerGetter,
@@ -391,12 +411,17 @@ func dialSsh(
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
 	}
 	if useMeek {
-		conn, err = DialMeek(serverEntry, sessionId, frontingAddress, dialConfig)
+		conn, err = DialMeek(serverEntry, sessionId, frontingAddress, useHttpFronting, dialConfig)
 		if err != nil {
 			return nil, nil, ContextError(err)
 		}
 	} else {
-		conn, err = DialTCP(fmt.Sprintf("%s:%d", serverEntry.IpAddress, port), dialConfig)
+		var address string
+		_, address, err = serverEntry.DialAddress(selectedProtocol)
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		conn, err = DialTCP(address, dialConfig)
 		if err != nil {
 			return nil, nil, ContextError(err)
 		}
@@ -421,16 +446,23 @@ func dialSsh(
 	}
 
 	// Now establish the SSH session over the sshConn transport
-	expectedPublicKey, err := base64.StdEncoding.DecodeString(serverEntry.SshHostKey)
-	if err != nil {
-		return nil, nil, ContextError(err)
+	// Any of the acceptable host keys is accepted, to support host key rotation
+	var expectedPublicKeys [][]byte
+	for _, hostKey := range serverEntry.AcceptableHostKeys() {
+		expectedPublicKey, err := base64.StdEncoding.DecodeString(hostKey)
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		expectedPublicKeys = append(expectedPublicKeys, expectedPublicKey)
 	}
 	sshCertChecker := &ssh.CertChecker{
 		HostKeyFallback: func(addr string, remote net.Addr, publicKey ssh.PublicKey) error {
-			if !bytes.Equal(expectedPublicKey, publicKey.Marshal()) {
-				return ContextError(errors.New("unexpected host public key"))
+			for _, expectedPublicKey := range expectedPublicKeys {
+				if bytes.Equal(expectedPublicKey, publicKey.Marshal()) {
+					return nil
+				}
 			}
-			return nil
+			return ContextError(errors.New("unexpected host public key"))
 		},
 	}
 	sshPasswordPayload, err := json.Marshal(
@@ -465,7 +497,7 @@ func dialSsh(
 		err       error
 	}
 	resultChannel := make(chan *sshNewClientResult, 2)
-	time.AfterFunc(TUNNEL_CONNECT_TIMEOUT, func() {
+	time.AfterFunc(serverEntry.ConnectTimeout(), func() {
 		resultChannel <- &sshNewClientResult{nil, errors.New("ssh dial timeout")}
 	})
 
@@ -543,10 +575,12 @@ func (tunnel *Tunnel) operateTunnel(config *Config, tunnelOwner TunnelOwner) {
 	lastTotalBytesTransferedTime := time.Now()
 	totalSent := int64(0)
 	totalReceived := int64(0)
+	unrecordedRegionBytes := int64(0)
 
 	// Always emit a final NoticeTotalBytesTransferred
 	defer func() {
 		NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+		recordRegionTransferStats(tunnel, unrecordedRegionBytes)
 	}()
 
 	noticeBytesTransferredTicker := time.NewTicker(1 * time.Second)
@@ -624,9 +658,12 @@ func (tunnel *Tunnel) operateTunnel(config *Config, tunnelOwner TunnelOwner) {
 
 			totalSent += sent
 			totalReceived += received
+			unrecordedRegionBytes += sent + received
 
 			if lastTotalBytesTransferedTime.Add(TOTAL_BYTES_TRANSFERRED_NOTICE_PERIOD).Before(time.Now()) {
 				NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+				recordRegionTransferStats(tunnel, unrecordedRegionBytes)
+				unrecordedRegionBytes = 0
 				lastTotalBytesTransferedTime = time.Now()
 			}
 
@@ -678,7 +715,7 @@ func (tunnel *Tunnel) operateTunnel(config *Config, tunnelOwner TunnelOwner) {
 	}
 
 	if err != nil {
-		NoticeAlert("operate tunnel error for %s: %s", tunnel.serverEntry.IpAddress, err)
+		NoticeAlert("operate tunnel error for %s: %s", redactServerAddress(tunnel.serverEntry.IpAddress), err)
 		tunnelOwner.SignalTunnelFailure(tunnel)
 	}
 }
@@ -720,9 +757,25 @@ func sendStats(tunnel *Tunnel) {
 	}
 
 	payload := transferstats.GetForServer(tunnel.serverEntry.IpAddress)
-	err := tunnel.session.DoStatusRequest(payload)
+	_, err := tunnel.session.DoStatusRequest(payload)
 	if err != nil {
-		NoticeAlert("DoStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
+		NoticeAlert("DoStatusRequest failed for %s: %s", redactServerAddress(tunnel.serverEntry.IpAddress), err)
 		transferstats.PutBack(tunnel.serverEntry.IpAddress, payload)
 	}
 }
+
+// recordRegionTransferStats is a helper for persisting bytes transferred
+// through the tunnel to the per-region totals.
+func recordRegionTransferStats(tunnel *Tunnel, bytesTransferred int64) {
+
+	// Tunnel does not have a session when DisableApi is set
+	if tunnel.session == nil {
+		return
+	}
+
+	err := tunnel.session.RecordRegionTransferStats(bytesTransferred)
+	if err != nil {
+		NoticeAlert("RecordRegionTransferStats failed for %s: %s",
+			redactServerAddress(tunnel.serverEntry.IpAddress), err)
+	}
+}